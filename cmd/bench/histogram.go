@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+// subBucketBits sets the precision of the histogram: every power of two is
+// split into 128 buckets, so values are recorded with less than 1% error
+const subBucketBits = 7
+
+const subBuckets = 1 << subBucketBits
+
+// histogram records latencies in log-linear buckets, like HDR histograms,
+// so percentiles are exact to the precision of a bucket whatever the range
+type histogram struct {
+	counts []uint64
+	total  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, bucketIndex(1<<63-1)+1)}
+}
+
+// bucketIndex returns the bucket of a value, values below subBuckets have
+// a bucket each and larger ones share it with their closest values
+func bucketIndex(v uint64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits - 1
+	return shift*subBuckets + int(v>>shift)
+}
+
+// bucketValue returns the largest value recorded in the bucket
+func bucketValue(index int) uint64 {
+	if index < subBuckets {
+		return uint64(index)
+	}
+	shift := index/subBuckets - 1
+	m := uint64(index - shift*subBuckets)
+	return (m+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[bucketIndex(uint64(d))]++
+	if h.total == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.total++
+	h.sum += d
+}
+
+// merge adds the values recorded by another histogram
+func (h *histogram) merge(other *histogram) {
+	if other.total == 0 {
+		return
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	h.max = max(h.max, other.max)
+	h.total += other.total
+	h.sum += other.sum
+}
+
+// percentile returns the value below which the percentage of the values
+// fall, capped to the maximum recorded
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.total))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			return min(time.Duration(bucketValue(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.total)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	// Every value is in a bucket whose largest value is within 1%
+	for _, v := range []uint64{0, 1, 127, 128, 255, 256, 1000, 123456789, 1<<63 - 1} {
+		index := bucketIndex(v)
+		largest := bucketValue(index)
+		if largest < v || float64(largest-v) > float64(v)/100 {
+			t.Errorf("value %d in bucket %d up to %d", v, index, largest)
+		}
+		if index > 0 && bucketValue(index-1) >= v {
+			t.Errorf("value %d fits in the previous bucket", v)
+		}
+	}
+}
+
+func TestHistogram_percentile(t *testing.T) {
+	h := newHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	other := newHistogram()
+	other.record(time.Second)
+	h.merge(other)
+
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 50, want: 500 * time.Microsecond},
+		{p: 99, want: 990 * time.Microsecond},
+		{p: 100, want: time.Second},
+	}
+	for _, tt := range tests {
+		got := h.percentile(tt.p)
+		if got < tt.want || float64(got-tt.want) > float64(tt.want)/100 {
+			t.Errorf("p%v = %s, want %s", tt.p, got, tt.want)
+		}
+	}
+	if h.min != time.Microsecond || h.max != time.Second || h.total != 1001 {
+		t.Errorf("unexpected min %s, max %s, total %d", h.min, h.max, h.total)
+	}
+}
@@ -0,0 +1,295 @@
+// Command bench is a load generator for the server, like redis-benchmark.
+// It runs each test with concurrent clients and reports the throughput and
+// the latency percentiles, as text or JSON.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/client"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var host = flag.String("h", "127.0.0.1", "server hostname")
+var port = flag.Int("p", 3000, "server port")
+var socket = flag.String("s", "", "unix socket of the server, overrides the hostname and port")
+var password = flag.String("a", "", "password to authenticate with")
+var user = flag.String("user", "", "ACL user to authenticate as, the default user when empty")
+var clients = flag.Int("c", 50, "number of concurrent clients")
+var requests = flag.Int("n", 100000, "number of requests of each test")
+var pipeline = flag.Int("P", 1, "commands sent together by each client")
+var keyspace = flag.Int("r", 0, "number of random keys, 0 uses a single key")
+var dataSize = flag.Int("d", 3, "bytes of the values of SET, LPUSH and RPUSH")
+var tests = flag.String("t", "PING,SET,GET,INCR,LPUSH,RPUSH", "comma separated tests to run")
+var mix = flag.String("mix", "", "weighted command mix run as a single test, e.g. GET:80,SET:20")
+var quiet = flag.Bool("q", false, "print one line per test")
+var jsonOutput = flag.Bool("json", false, "print the results as JSON")
+
+var UnknownTest = errors.New("unknown test")
+
+// commands build the command of each test for a key
+var commands = map[string]func(key, value string) []interface{}{
+	"PING":  func(string, string) []interface{} { return []interface{}{"PING"} },
+	"SET":   func(key, value string) []interface{} { return []interface{}{"SET", "key:" + key, value} },
+	"GET":   func(key, _ string) []interface{} { return []interface{}{"GET", "key:" + key} },
+	"INCR":  func(key, _ string) []interface{} { return []interface{}{"INCR", "counter:" + key} },
+	"LPUSH": func(key, value string) []interface{} { return []interface{}{"LPUSH", "list:" + key, value} },
+	"RPUSH": func(key, value string) []interface{} { return []interface{}{"RPUSH", "list:" + key, value} },
+}
+
+// weighted is a command of a mix and its weight
+type weighted struct {
+	name   string
+	weight int
+}
+
+// test is a workload, a single command or a mix of them
+type test struct {
+	name  string
+	mix   []weighted
+	total int
+}
+
+// pick returns a command of the test, with the probability of its weight
+func (t test) pick(r *rand.Rand) string {
+	n := r.IntN(t.total)
+	for _, w := range t.mix {
+		if n < w.weight {
+			return w.name
+		}
+		n -= w.weight
+	}
+	return t.mix[len(t.mix)-1].name
+}
+
+// Result is the report of a test, it is the JSON output
+type Result struct {
+	Test              string  `json:"test"`
+	Requests          int     `json:"requests"`
+	Errors            int64   `json:"errors"`
+	Clients           int     `json:"clients"`
+	Pipeline          int     `json:"pipeline"`
+	DataSize          int     `json:"data_size"`
+	Keyspace          int     `json:"keyspace"`
+	DurationSeconds   float64 `json:"duration_seconds"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Latency           Latency `json:"latency_ms"`
+}
+
+// Latency holds the latency statistics in milliseconds
+type Latency struct {
+	Min  float64 `json:"min"`
+	Avg  float64 `json:"avg"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+func main() {
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, out io.Writer) error {
+	workloads, err := parseTests(*tests, *mix)
+	if err != nil {
+		return err
+	}
+	if *clients < 1 || *requests < 1 || *pipeline < 1 || *keyspace < 0 || *dataSize < 0 {
+		return errors.New("clients, requests and pipeline must be positive, keyspace and data size can't be negative")
+	}
+
+	opts := client.Options{
+		Addr:     net.JoinHostPort(*host, strconv.Itoa(*port)),
+		Username: *user,
+		Password: *password,
+	}
+	if *socket != "" {
+		opts.Network, opts.Addr = "unix", *socket
+	}
+
+	results := make([]Result, 0, len(workloads))
+	for _, t := range workloads {
+		result, err := runTest(ctx, opts, t)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.name, err)
+		}
+		results = append(results, result)
+		if !*jsonOutput {
+			printResult(out, result)
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+	return nil
+}
+
+// parseTests returns the tests of the -t flag, or the test of the mix
+func parseTests(names, mix string) ([]test, error) {
+	if mix != "" {
+		t := test{name: "MIX"}
+		for _, part := range strings.Split(mix, ",") {
+			name, weight, _ := strings.Cut(strings.TrimSpace(part), ":")
+			name = strings.ToUpper(name)
+			n, err := strconv.Atoi(weight)
+			if _, ok := commands[name]; !ok || err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: %s", UnknownTest, part)
+			}
+			t.mix = append(t.mix, weighted{name: name, weight: n})
+			t.total += n
+		}
+		return []test{t}, nil
+	}
+
+	var workloads []test
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if _, ok := commands[name]; !ok {
+			return nil, fmt.Errorf("%w: %s", UnknownTest, name)
+		}
+		workloads = append(workloads, test{name: name, mix: []weighted{{name: name, weight: 1}}, total: 1})
+	}
+	return workloads, nil
+}
+
+// runTest sends the requests of the test from concurrent clients, each
+// one takes as many requests as the pipeline depth at a time
+func runTest(ctx context.Context, opts client.Options, t test) (Result, error) {
+	conns := make([]*client.Conn, *clients)
+	for i := range conns {
+		conn, err := client.Dial(ctx, opts)
+		if err != nil {
+			return Result{}, err
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	var remaining atomic.Int64
+	remaining.Store(int64(*requests))
+	var errs atomic.Int64
+	value := strings.Repeat("x", *dataSize)
+	histograms := make([]*histogram, len(conns))
+	failures := make([]error, len(conns))
+
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+	start := time.Now()
+	for i, conn := range conns {
+		histograms[i] = newHistogram()
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(start.UnixNano()), uint64(i)))
+			failures[i] = runClient(ctx, conn, t, r, value, &remaining, &errs, histograms[i])
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if err := errors.Join(failures...); err != nil {
+		return Result{}, err
+	}
+
+	h := newHistogram()
+	for _, other := range histograms {
+		h.merge(other)
+	}
+	return Result{
+		Test:              t.name,
+		Requests:          *requests,
+		Errors:            errs.Load(),
+		Clients:           *clients,
+		Pipeline:          *pipeline,
+		DataSize:          *dataSize,
+		Keyspace:          *keyspace,
+		DurationSeconds:   elapsed.Seconds(),
+		RequestsPerSecond: float64(*requests) / elapsed.Seconds(),
+		Latency: Latency{
+			Min:  milliseconds(h.min),
+			Avg:  milliseconds(h.mean()),
+			P50:  milliseconds(h.percentile(50)),
+			P95:  milliseconds(h.percentile(95)),
+			P99:  milliseconds(h.percentile(99)),
+			P999: milliseconds(h.percentile(99.9)),
+			Max:  milliseconds(h.max),
+		},
+	}, nil
+}
+
+// runClient sends pipelines until the requests of the test run out, the
+// latency of each request is the time until its reply is read
+func runClient(ctx context.Context, conn *client.Conn, t test, r *rand.Rand, value string, remaining, errs *atomic.Int64, h *histogram) error {
+	for {
+		n := min(int64(*pipeline), remaining.Add(-int64(*pipeline))+int64(*pipeline))
+		if n <= 0 {
+			return nil
+		}
+
+		for range n {
+			key := "__rand_int__"
+			if *keyspace > 0 {
+				key = strconv.Itoa(r.IntN(*keyspace))
+			}
+			if err := conn.Send(commands[t.pick(r)](key, value)...); err != nil {
+				return err
+			}
+		}
+
+		sent := time.Now()
+		for range n {
+			_, err := conn.Receive(ctx)
+			var reply client.Error
+			if errors.As(err, &reply) {
+				errs.Add(1)
+			} else if err != nil {
+				return err
+			}
+			h.record(time.Since(sent))
+		}
+	}
+}
+
+func printResult(out io.Writer, r Result) {
+	if *quiet {
+		fmt.Fprintf(out, "%s: %.2f requests per second, p50=%.3f msec, p99=%.3f msec, p999=%.3f msec\n",
+			r.Test, r.RequestsPerSecond, r.Latency.P50, r.Latency.P99, r.Latency.P999)
+		return
+	}
+
+	fmt.Fprintf(out, "====== %s ======\n", r.Test)
+	fmt.Fprintf(out, "  %d requests completed in %.2f seconds, %d errors\n", r.Requests, r.DurationSeconds, r.Errors)
+	fmt.Fprintf(out, "  %d parallel clients, pipeline %d, %d bytes payload, keyspace %d\n", r.Clients, r.Pipeline, r.DataSize, r.Keyspace)
+	fmt.Fprintf(out, "  %.2f requests per second\n", r.RequestsPerSecond)
+	fmt.Fprintf(out, "  latency (msec): min=%.3f avg=%.3f p50=%.3f p95=%.3f p99=%.3f p999=%.3f max=%.3f\n\n",
+		r.Latency.Min, r.Latency.Avg, r.Latency.P50, r.Latency.P95, r.Latency.P99, r.Latency.P999, r.Latency.Max)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
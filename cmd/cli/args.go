@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var InvalidArguments = errors.New("Invalid argument(s)")
+
+// splitArgs splits a line into arguments like redis-cli. Double quoted
+// arguments support the escapes \n, \r, \t, \b, \a, \" and \xHH, single
+// quoted ones only \'. Quotes must be followed by a space or the end.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for i := 0; ; {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		var quote byte
+		if line[i] == '"' || line[i] == '\'' {
+			quote = line[i]
+			i++
+		}
+
+		for {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, InvalidArguments
+				}
+				break
+			}
+			c := line[i]
+
+			if quote == 0 {
+				if isSpace(c) {
+					break
+				}
+				arg.WriteByte(c)
+				i++
+				continue
+			}
+
+			if c == quote {
+				// The closing quote must end the argument
+				if i+1 < len(line) && !isSpace(line[i+1]) {
+					return nil, InvalidArguments
+				}
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(line) {
+				escaped, n := unescape(line[i:], quote)
+				arg.WriteString(escaped)
+				i += n
+				continue
+			}
+			arg.WriteByte(c)
+			i++
+		}
+		args = append(args, arg.String())
+	}
+}
+
+// unescape decodes the escape sequence at the start of s and returns the
+// number of bytes it takes
+func unescape(s string, quote byte) (string, int) {
+	if quote == '\'' {
+		if s[1] == '\'' {
+			return "'", 2
+		}
+		return `\`, 1
+	}
+
+	switch s[1] {
+	case 'n':
+		return "\n", 2
+	case 'r':
+		return "\r", 2
+	case 't':
+		return "\t", 2
+	case 'b':
+		return "\b", 2
+	case 'a':
+		return "\a", 2
+	case 'x':
+		if len(s) >= 4 {
+			if b, err := strconv.ParseUint(s[2:4], 16, 8); err == nil {
+				return string([]byte{byte(b)}), 4
+			}
+		}
+	}
+	return s[1:2], 2
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  error
+	}{
+		{line: "  SET key   value ", want: []string{"SET", "key", "value"}},
+		{line: `SET key "hello world\n\x41"`, want: []string{"SET", "key", "hello world\nA"}},
+		{line: `SET key 'it\'s "quoted"'`, want: []string{"SET", "key", `it's "quoted"`}},
+		{line: `SET key ""`, want: []string{"SET", "key", ""}},
+		{line: `SET key "unclosed`, err: InvalidArguments},
+		{line: `SET key "a"b`, err: InvalidArguments},
+		{line: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := splitArgs(tt.line)
+			if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitArgs() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestPrettyLines(t *testing.T) {
+	reply := []interface{}{"a\tb", int64(3), nil, []interface{}{"x", []interface{}{}}, errors.New("ERR failed")}
+	want := strings.Join([]string{
+		`1) "a\tb"`,
+		`2) (integer) 3`,
+		`3) (nil)`,
+		`4) 1) "x"`,
+		`   2) (empty array)`,
+		`5) (error) ERR failed`,
+	}, "\n")
+	if got := strings.Join(prettyLines(reply), "\n"); got != want {
+		t.Errorf("prettyLines() =\n%s\nwant\n%s", got, want)
+	}
+}
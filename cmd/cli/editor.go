@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by readLine on Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// Keys of the line editor
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyBackspace = 8
+	keyTab       = 9
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// lineEditor reads lines with readline style editing on terminals: moving
+// with the arrows, Ctrl-A and Ctrl-E, deleting with Ctrl-K and Ctrl-U, and
+// going through the history with the up and down arrows. Other inputs are
+// read line by line without a prompt.
+type lineEditor struct {
+	in       *os.File
+	out      io.Writer
+	reader   *bufio.Reader
+	terminal bool
+	history  []string
+}
+
+func newLineEditor(in *os.File, out io.Writer) *lineEditor {
+	return &lineEditor{
+		in:       in,
+		out:      out,
+		reader:   bufio.NewReader(in),
+		terminal: isTerminal(in),
+	}
+}
+
+// load reads the history saved by a previous session
+func (l *lineEditor) load(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			l.history = append(l.history, line)
+		}
+	}
+}
+
+// save writes the last lines of the history
+func (l *lineEditor) save(path string) {
+	history := l.history
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	_ = os.WriteFile(path, []byte(strings.Join(history, "\n")+"\n"), 0600)
+}
+
+// add appends a line to the history, skipping repeated lines
+func (l *lineEditor) add(line string) {
+	if !l.terminal || len(l.history) > 0 && l.history[len(l.history)-1] == line {
+		return
+	}
+	l.history = append(l.history, line)
+}
+
+func (l *lineEditor) readLine(prompt string) (string, error) {
+	if !l.terminal {
+		line, err := l.reader.ReadString('\n')
+		if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	restore, err := makeRaw(l.in)
+	if err != nil {
+		// Terminals that can't be put in raw mode are read by line
+		fmt.Fprint(l.out, prompt)
+		l.terminal = false
+		defer func() { l.terminal = true }()
+		return l.readLine(prompt)
+	}
+	defer restore()
+	return l.edit(prompt)
+}
+
+// edit reads the keys of a line until enter is pressed
+func (l *lineEditor) edit(prompt string) (string, error) {
+	var line []rune
+	cursor := 0
+	// position in the history, the line being edited is kept in saved
+	position := len(l.history)
+	saved := ""
+
+	refresh := func() {
+		fmt.Fprintf(l.out, "\r%s%s\x1b[K\r\x1b[%dC", prompt, string(line), utf8.RuneCountInString(prompt)+cursor)
+	}
+	browse := func(to int) {
+		if to < 0 || to > len(l.history) {
+			return
+		}
+		if position == len(l.history) {
+			saved = string(line)
+		}
+		position = to
+		if position == len(l.history) {
+			line = []rune(saved)
+		} else {
+			line = []rune(l.history[position])
+		}
+		cursor = len(line)
+		refresh()
+	}
+	refresh()
+
+	for {
+		r, _, err := l.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case keyEnter, '\n':
+			fmt.Fprint(l.out, "\r\n")
+			return string(line), nil
+		case keyCtrlC:
+			fmt.Fprint(l.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(l.out, "\r\n")
+				return "", io.EOF
+			}
+			if cursor < len(line) {
+				line = append(line[:cursor], line[cursor+1:]...)
+			}
+		case keyBackspace, keyDelete:
+			if cursor > 0 {
+				line = append(line[:cursor-1], line[cursor:]...)
+				cursor--
+			}
+		case keyCtrlA:
+			cursor = 0
+		case keyCtrlE:
+			cursor = len(line)
+		case keyCtrlB:
+			cursor = max(cursor-1, 0)
+		case keyCtrlF:
+			cursor = min(cursor+1, len(line))
+		case keyCtrlK:
+			line = line[:cursor]
+		case keyCtrlU:
+			line = line[cursor:]
+			cursor = 0
+		case keyCtrlL:
+			fmt.Fprint(l.out, "\x1b[H\x1b[2J")
+		case keyCtrlP:
+			browse(position - 1)
+			continue
+		case keyCtrlN:
+			browse(position + 1)
+			continue
+		case keyTab:
+		case keyEscape:
+			switch l.escape() {
+			case 'A':
+				browse(position - 1)
+				continue
+			case 'B':
+				browse(position + 1)
+				continue
+			case 'C':
+				cursor = min(cursor+1, len(line))
+			case 'D':
+				cursor = max(cursor-1, 0)
+			case 'H':
+				cursor = 0
+			case 'F':
+				cursor = len(line)
+			case '3':
+				if cursor < len(line) {
+					line = append(line[:cursor], line[cursor+1:]...)
+				}
+			}
+		default:
+			if r < 32 {
+				continue
+			}
+			line = append(line[:cursor], append([]rune{r}, line[cursor:]...)...)
+			cursor++
+		}
+		refresh()
+	}
+}
+
+// escape reads an escape sequence, like ESC [ A of the up arrow, and
+// returns its final byte. Delete, ESC [ 3 ~, is returned as '3'.
+func (l *lineEditor) escape() byte {
+	next, err := l.reader.ReadByte()
+	if err != nil || next != '[' && next != 'O' {
+		return 0
+	}
+	key, err := l.reader.ReadByte()
+	if err != nil {
+		return 0
+	}
+	if key >= '0' && key <= '9' {
+		// Extended keys end with ~
+		for {
+			b, err := l.reader.ReadByte()
+			if err != nil || b == '~' {
+				break
+			}
+		}
+		switch key {
+		case '1', '7':
+			return 'H'
+		case '4', '8':
+			return 'F'
+		}
+	}
+	return key
+}
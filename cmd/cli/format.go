@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type format int
+
+const (
+	// formatPretty prints the types of the replies, like redis-cli
+	formatPretty format = iota
+	// formatRaw prints the values, one per line
+	formatRaw
+	formatCSV
+	formatJSON
+)
+
+// writeReply prints the reply, or the error reply
+func writeReply(w io.Writer, res interface{}, err error, f format) error {
+	if err != nil {
+		res = err
+	}
+
+	var out string
+	switch f {
+	case formatRaw:
+		out = formatRawReply(res)
+	case formatCSV:
+		out = strings.Join(csvFields(res, nil), ",")
+	case formatJSON:
+		data, err := json.Marshal(jsonValue(res))
+		if err != nil {
+			return err
+		}
+		out = string(data)
+	default:
+		out = strings.Join(prettyLines(res), "\n")
+	}
+
+	_, err = fmt.Fprintln(w, out)
+	return err
+}
+
+// prettyLines renders the reply with its type, the elements of arrays are
+// numbered and nested arrays are indented under their number
+func prettyLines(res interface{}) []string {
+	switch v := res.(type) {
+	case nil:
+		return []string{"(nil)"}
+	case int64:
+		return []string{fmt.Sprintf("(integer) %d", v)}
+	case string:
+		return []string{quote(v)}
+	case error:
+		return []string{"(error) " + v.Error()}
+	case []interface{}:
+		if len(v) == 0 {
+			return []string{"(empty array)"}
+		}
+		width := len(strconv.Itoa(len(v)))
+		lines := make([]string, 0, len(v))
+		for i, element := range v {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			indent := strings.Repeat(" ", len(prefix))
+			for j, line := range prettyLines(element) {
+				if j == 0 {
+					lines = append(lines, prefix+line)
+				} else {
+					lines = append(lines, indent+line)
+				}
+			}
+		}
+		return lines
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// quote writes the string between double quotes, escaping the characters
+// that are not printable
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// formatRawReply prints the values without types, the elements of arrays
+// on separate lines
+func formatRawReply(res interface{}) string {
+	switch v := res.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		lines := make([]string, len(v))
+		for i, element := range v {
+			lines[i] = formatRawReply(element)
+		}
+		return strings.Join(lines, "\n")
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// csvFields flattens the reply into CSV fields, strings are always quoted
+func csvFields(res interface{}, fields []string) []string {
+	switch v := res.(type) {
+	case nil:
+		return append(fields, "NULL")
+	case int64:
+		return append(fields, strconv.FormatInt(v, 10))
+	case string:
+		return append(fields, `"`+strings.ReplaceAll(v, `"`, `""`)+`"`)
+	case error:
+		return append(fields, "ERROR", `"`+strings.ReplaceAll(v.Error(), `"`, `""`)+`"`)
+	case []interface{}:
+		for _, element := range v {
+			fields = csvFields(element, fields)
+		}
+		return fields
+	default:
+		return append(fields, fmt.Sprint(v))
+	}
+}
+
+// jsonValue converts the reply to values encoded by encoding/json, error
+// replies are objects with an error field
+func jsonValue(res interface{}) interface{} {
+	switch v := res.(type) {
+	case error:
+		return map[string]string{"error": v.Error()}
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, element := range v {
+			values[i] = jsonValue(element)
+		}
+		return values
+	default:
+		return v
+	}
+}
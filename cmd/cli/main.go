@@ -0,0 +1,151 @@
+// Command cli is an interactive client of the server, in the spirit of
+// redis-cli. Without arguments it starts a REPL, otherwise it runs the
+// command given in the arguments.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/client"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var host = flag.String("h", "127.0.0.1", "server hostname")
+var port = flag.Int("p", 3000, "server port")
+var socket = flag.String("s", "", "unix socket of the server, overrides the hostname and port")
+var password = flag.String("a", "", "password to authenticate with")
+var user = flag.String("user", "", "ACL user to authenticate as, the default user when empty")
+var useTLS = flag.Bool("tls", false, "connect with TLS")
+var caCert = flag.String("cacert", "", "CA certificate that verifies the server")
+var certFile = flag.String("cert", "", "client certificate for TLS")
+var keyFile = flag.String("key", "", "private key of the client certificate")
+var raw = flag.Bool("raw", false, "print the replies without formatting, the default when stdout is not a terminal")
+var csvOutput = flag.Bool("csv", false, "print the replies as CSV")
+var jsonOutput = flag.Bool("json", false, "print the replies as JSON")
+var pipe = flag.Bool("pipe", false, "send the commands read from stdin, in RESP or one per line, and report the replies")
+var scan = flag.Bool("scan", false, "list the keys with SCAN")
+var pattern = flag.String("pattern", "*", "keys listed by --scan")
+var count = flag.Int("count", 10, "keys scanned at a time by --scan")
+var stat = flag.Bool("stat", false, "print statistics of the server every interval")
+var interval = flag.Float64("i", 1, "seconds between the lines of --stat")
+
+func main() {
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts, err := options()
+	if err == nil {
+		switch {
+		case *pipe:
+			err = runPipe(ctx, opts, os.Stdin, os.Stdout)
+		case *scan:
+			err = runScan(ctx, opts, os.Stdout)
+		case *stat:
+			err = runStat(ctx, opts, os.Stdout, time.Duration(*interval*float64(time.Second)))
+		case flag.NArg() > 0:
+			err = runCommand(ctx, opts, flag.Args(), outputFormat())
+		default:
+			err = runREPL(ctx, opts, outputFormat())
+		}
+	}
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// options returns the client options of the flags
+func options() (client.Options, error) {
+	opts := client.Options{
+		Addr:     net.JoinHostPort(*host, strconv.Itoa(*port)),
+		Username: *user,
+		Password: *password,
+	}
+	if *socket != "" {
+		opts.Network, opts.Addr = "unix", *socket
+	}
+	if !*useTLS {
+		return opts, nil
+	}
+
+	opts.TLSConfig = &tls.Config{ServerName: *host}
+	if *caCert != "" {
+		pem, err := os.ReadFile(*caCert)
+		if err != nil {
+			return opts, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return opts, fmt.Errorf("no certificates in %s", *caCert)
+		}
+		opts.TLSConfig.RootCAs = roots
+	}
+	if *certFile != "" {
+		pair, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.TLSConfig.Certificates = []tls.Certificate{pair}
+	}
+	return opts, nil
+}
+
+// outputFormat returns the format of the flags, replies are formatted for
+// humans when stdout is a terminal
+func outputFormat() format {
+	switch {
+	case *jsonOutput:
+		return formatJSON
+	case *csvOutput:
+		return formatCSV
+	case *raw || !isTerminal(os.Stdout):
+		return formatRaw
+	default:
+		return formatPretty
+	}
+}
+
+// runCommand runs the command of the arguments and prints its reply
+func runCommand(ctx context.Context, opts client.Options, args []string, f format) error {
+	conn, err := client.Dial(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	res, err := conn.Do(ctx, command(args)...)
+	var reply client.Error
+	if err != nil && !errors.As(err, &reply) {
+		return err
+	}
+	return writeReply(os.Stdout, res, err, f)
+}
+
+// command returns the arguments of a command, the server expects the names
+// of the commands in uppercase
+func command(args []string) []interface{} {
+	cmd := make([]interface{}, len(args))
+	for i, arg := range args {
+		cmd[i] = arg
+	}
+	cmd[0] = strings.ToUpper(args[0])
+	return cmd
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/client"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var InvalidCommand = errors.New("commands must be arrays")
+
+// runPipe sends the commands of the input without waiting for the replies,
+// for mass insertion. The input is either RESP, like the dump files, or one
+// command per line. An ECHO of a random marker follows the commands, its
+// reply tells when every reply was read.
+func runPipe(ctx context.Context, opts client.Options, in io.Reader, out io.Writer) error {
+	conn, err := client.Dial(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	marker := hex.EncodeToString(id)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendCommands(conn, in, marker)
+	}()
+
+	var replies, errs int
+	for {
+		res, err := conn.Receive(ctx)
+		var reply client.Error
+		if errors.As(err, &reply) {
+			errs++
+			replies++
+			fmt.Fprintln(out, reply)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if res == marker {
+			break
+		}
+		replies++
+	}
+
+	fmt.Fprintf(out, "errors: %d, replies: %d\n", errs, replies)
+	return <-sent
+}
+
+// sendCommands writes the commands of the input followed by the marker,
+// straight to the connection while its replies are received
+func sendCommands(conn *client.Conn, in io.Reader, marker string) error {
+	w := bufio.NewWriter(conn.NetConn())
+	reader := bufio.NewReader(in)
+
+	var err error
+	if first, _ := reader.Peek(1); len(first) == 1 && first[0] == '*' {
+		parser := resp.RespParser{}
+		scanner := parser.CreateScanner(reader)
+		for {
+			var payload interface{}
+			if payload, err = parser.ParseScanner(scanner); err != nil {
+				break
+			}
+			if _, ok := payload.([]interface{}); !ok {
+				err = InvalidCommand
+				break
+			}
+			if err = writeCommand(w, payload); err != nil {
+				break
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, resp.MaxBulkLength)
+		for scanner.Scan() {
+			var args []string
+			if args, err = splitArgs(scanner.Text()); err != nil {
+				break
+			}
+			if len(args) == 0 {
+				continue
+			}
+			if err = writeCommand(w, command(args)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	// The marker is sent after an error too, so the replies of the
+	// commands already sent are read
+	if markerErr := writeCommand(w, []interface{}{"ECHO", marker}); markerErr != nil {
+		return markerErr
+	}
+	if flushErr := w.Flush(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+func writeCommand(w *bufio.Writer, payload interface{}) error {
+	serializer := resp.RespSerializer{}
+	buf, err := serializer.Serialize(payload)
+	if err != nil {
+		return err
+	}
+	defer serializer.Release(buf)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// runScan prints the keys matching the pattern, one per line
+func runScan(ctx context.Context, opts client.Options, out io.Writer) error {
+	conn, err := client.Dial(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		res, err := conn.Do(ctx, "SCAN", cursor, "MATCH", *pattern, "COUNT", *count)
+		if err != nil {
+			return err
+		}
+		reply, ok := res.([]interface{})
+		if !ok || len(reply) != 2 {
+			return fmt.Errorf("unexpected SCAN reply %v", res)
+		}
+		cursor, _ = reply[0].(string)
+		keys, _ := reply[1].([]interface{})
+		for _, key := range keys {
+			fmt.Fprintln(out, key)
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// statHeader is printed every statHeaderEvery lines of --stat
+const statHeader = "keys       mem      clients requests            connections"
+
+const statHeaderEvery = 20
+
+// runStat prints the keys, memory, clients, commands and connections of
+// the server every interval, until it is interrupted
+func runStat(ctx context.Context, opts client.Options, out io.Writer, interval time.Duration) error {
+	conn, err := client.Dial(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var previous int64 = -1
+	for line := 0; ; line++ {
+		res, err := conn.Do(ctx, "INFO")
+		if err != nil {
+			return err
+		}
+		info := parseInfo(fmt.Sprint(res))
+
+		if line%statHeaderEvery == 0 {
+			fmt.Fprintln(out, statHeader)
+		}
+		requests, _ := strconv.ParseInt(info["total_commands_processed"], 10, 64)
+		delta := ""
+		if previous >= 0 {
+			delta = fmt.Sprintf("(+%d)", requests-previous)
+		}
+		previous = requests
+		fmt.Fprintf(out, "%-10s %-8s %-7s %-19s %s\n",
+			keyCount(info["db0"]), info["used_memory_human"], info["connected_clients"],
+			strings.TrimSpace(fmt.Sprintf("%d %s", requests, delta)), info["total_connections_received"])
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// parseInfo returns the fields of an INFO reply
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// keyCount returns the keys of a keyspace field, like keys=1,expires=0
+func keyCount(field string) string {
+	keys, _, _ := strings.Cut(strings.TrimPrefix(field, "keys="), ",")
+	if keys == "" {
+		return "0"
+	}
+	return keys
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/client"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// historyFile is kept in the home directory, like .rediscli_history
+const historyFile = ".redis-compatible-cli_history"
+
+// maxHistory is the number of lines kept in the history
+const maxHistory = 1000
+
+// runREPL reads commands from stdin and prints their replies. On a
+// terminal, lines are edited like readline and the history is saved.
+func runREPL(ctx context.Context, opts client.Options, f format) error {
+	history := filepath.Join(os.Getenv("HOME"), historyFile)
+	editor := newLineEditor(os.Stdin, os.Stdout)
+	if editor.terminal {
+		editor.load(history)
+		defer editor.save(history)
+	}
+
+	var conn *client.Conn
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	prompt := opts.Addr + "> "
+	for {
+		line, err := editor.readLine(prompt)
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		editor.add(line)
+
+		switch strings.ToLower(args[0]) {
+		case "quit", "exit":
+			return nil
+		case "clear":
+			fmt.Print("\x1b[H\x1b[2J")
+			continue
+		}
+
+		// Broken connections are opened again for the next command
+		if conn == nil || conn.Err() != nil {
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if conn, err = client.Dial(ctx, opts); err != nil {
+				conn = nil
+				fmt.Printf("Could not connect to %s: %s\n", opts.Addr, err)
+				continue
+			}
+		}
+
+		res, err := conn.Do(ctx, command(args)...)
+		var reply client.Error
+		if err != nil && !errors.As(err, &reply) {
+			fmt.Printf("Error: %s\n", err)
+			continue
+		}
+		if err := writeReply(os.Stdout, res, err, f); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "syscall"
+
+const ioctlGetTermios = syscall.TIOCGETA
+
+const ioctlSetTermios = syscall.TIOCSETA
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// makeRaw is not supported, the lines are read without editing
+func makeRaw(*os.File) (func(), error) {
+	return nil, errors.New("raw mode is not supported")
+}
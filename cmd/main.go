@@ -3,90 +3,317 @@ package main
 import (
 	"context"
 	"flag"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/acl"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/admin"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/server"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
-	"runtime/pprof"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
-var port = flag.String("port", "3000", "port")
-var threads = flag.Int("threads", 1, "number of threads")
-var cpuProfile = flag.Bool("cpuprofile", false, "profile cpu")
-var memProfile = flag.Bool("memprofile", false, "profile memory")
-var mutexProfile = flag.Bool("mutexprofile", false, "profile mutexes")
-var reload = flag.Bool("reload", true, "reload memory")
-var memfile = flag.String("memfile", "memory.resp", "path to memory file")
-var global = flag.Bool("global", false, "use global path")
+var configFile = flag.String("config", "", "path to a redis.conf style configuration file")
+
+// defaults is the configuration the defaults of the flags come from
+var defaults = config.New()
+
+// Flags assigned to _ override the parameters in flagParameters, their values are read from the configuration
+var _ = flag.String("port", defaults.GetString(config.Port), "port")
+var _ = flag.Int("threads", int(defaults.GetInt(config.Threads)), "number of threads")
+var mutexProfile = flag.Bool("mutexprofile", false, "profile mutexes, the profile is served by the admin HTTP listener with -admin-pprof")
+var _ = flag.Bool("reload", defaults.GetBool(config.Reload), "reload memory")
+var _ = flag.String("memfile", defaults.GetString(config.DBFilename), "path to memory file")
+var _ = flag.Bool("global", defaults.GetBool(config.Global), "use global path")
+var _ = flag.String("maxmemory", defaults.GetString(config.MaxMemory), "memory limit of the dataset, e.g. 100mb, 0 means no limit")
+var _ = flag.String("maxmemory-policy", defaults.GetString(config.MaxMemoryPolicy), "eviction policy when maxmemory is reached")
+var _ = flag.Int("maxmemory-samples", int(defaults.GetInt(config.MaxMemorySamples)), "keys sampled for each eviction")
+var _ = flag.String("save", defaults.GetString(config.Save), "save rules as pairs of seconds and changes, empty disables automatic saves and the save on shutdown")
+var _ = flag.String("requirepass", defaults.GetString(config.RequirePass), "password of the default user, empty disables authentication")
+var _ = flag.String("aclfile", defaults.GetString(config.ACLFile), "path to the ACL file with the users")
+var _ = flag.String("bind", defaults.GetString(config.Bind), "addresses to listen on, e.g. \"127.0.0.1 ::1\", empty listens on every interface")
+var _ = flag.String("unixsocket", defaults.GetString(config.UnixSocket), "path of the unix socket, empty disables it")
+var _ = flag.String("unixsocketperm", defaults.GetString(config.UnixSocketPerm), "permissions of the unix socket in octal, e.g. 700")
+var _ = flag.Bool("protected-mode", defaults.GetBool(config.ProtectedMode), "only accept loopback clients when there is no password or bind address")
+var _ = flag.Int("maxclients", int(defaults.GetInt(config.MaxClients)), "maximum number of connected clients")
+var _ = flag.Int("timeout", int(defaults.GetInt(config.Timeout)), "seconds before closing idle clients, 0 disables it")
+var _ = flag.Int("tcp-keepalive", int(defaults.GetInt(config.TCPKeepAlive)), "seconds between TCP keepalive probes, 0 disables them")
+var _ = flag.String("client-output-buffer-limit", defaults.GetString(config.ClientOutputBufferLimits), "output buffer limits of each class, e.g. \"pubsub 32mb 8mb 60\"")
+var _ = flag.String("replicaof", defaults.GetString(config.ReplicaOf), "primary to replicate, e.g. \"127.0.0.1 6379\", empty starts as a primary")
+var _ = flag.String("masterauth", defaults.GetString(config.MasterAuth), "password to authenticate with the primary")
+var _ = flag.String("masteruser", defaults.GetString(config.MasterUser), "ACL user to authenticate with the primary")
+var _ = flag.Bool("replica-read-only", defaults.GetBool(config.ReplicaReadOnly), "reject write commands from clients of replicas")
+var _ = flag.String("repl-backlog-size", defaults.GetString(config.ReplBacklogSize), "bytes of the replication stream kept for partial resynchronizations")
+var _ = flag.Int("repl-timeout", int(defaults.GetInt(config.ReplTimeout)), "seconds before dropping a silent replication link")
+var _ = flag.Int("repl-ping-replica-period", int(defaults.GetInt(config.ReplPingReplicaPeriod)), "seconds between the pings of the primary to its replicas")
+var _ = flag.Bool("cluster-enabled", defaults.GetBool(config.ClusterEnabled), "run as a node of a cluster with hash slots")
+var _ = flag.String("cluster-config-file", defaults.GetString(config.ClusterConfigFile), "file where the node saves the state of the cluster")
+var _ = flag.Int("cluster-node-timeout", int(defaults.GetInt(config.ClusterNodeTimeout)), "milliseconds before a silent node is considered failing")
+var _ = flag.String("cluster-announce-ip", defaults.GetString(config.ClusterAnnounceIP), "address announced to the other nodes, empty uses the one they observe")
+var _ = flag.Int("busy-reply-threshold", int(defaults.GetInt(config.BusyReplyThreshold)), "milliseconds a script runs before other clients get BUSY errors")
+var _ = flag.Int("slowlog-log-slower-than", int(defaults.GetInt(config.SlowlogLogSlowerThan)), "microseconds a command runs before it is logged in the slow log, negative disables it")
+var _ = flag.Int("slowlog-max-len", int(defaults.GetInt(config.SlowlogMaxLen)), "number of entries kept in the slow log")
+var _ = flag.Int("latency-monitor-threshold", int(defaults.GetInt(config.LatencyMonitorThreshold)), "milliseconds an event takes before it is recorded by the latency monitor, 0 disables it")
+var _ = flag.String("admin-addr", defaults.GetString(config.AdminAddr), "address of the admin HTTP listener with /metrics, /healthz and /readyz, e.g. :9121, empty disables it")
+var _ = flag.Bool("admin-pprof", defaults.GetBool(config.AdminPprof), "serve the Go profiler in /debug/pprof of the admin HTTP listener")
+var _ = flag.Int("tls-port", int(defaults.GetInt(config.TLSPort)), "port of the TLS listener, 0 disables TLS")
+var _ = flag.String("tls-cert-file", defaults.GetString(config.TLSCertFile), "path to the server certificate")
+var _ = flag.String("tls-key-file", defaults.GetString(config.TLSKeyFile), "path to the private key of the server certificate")
+var _ = flag.String("tls-ca-cert-file", defaults.GetString(config.TLSCACertFile), "path to the CA certificates that verify the clients")
+var _ = flag.String("tls-auth-clients", defaults.GetString(config.TLSAuthClients), "verify client certificates: yes, no or optional")
+var _ = flag.String("tls-auth-clients-user", defaults.GetString(config.TLSClientsUser), "CN to authenticate clients as the ACL user named like their certificate")
+
+// flagParameters maps the flags that override configuration parameters
+var flagParameters = map[string]string{
+	"port":                       config.Port,
+	"threads":                    config.Threads,
+	"reload":                     config.Reload,
+	"memfile":                    config.DBFilename,
+	"global":                     config.Global,
+	"maxmemory":                  config.MaxMemory,
+	"maxmemory-policy":           config.MaxMemoryPolicy,
+	"maxmemory-samples":          config.MaxMemorySamples,
+	"save":                       config.Save,
+	"requirepass":                config.RequirePass,
+	"aclfile":                    config.ACLFile,
+	"bind":                       config.Bind,
+	"unixsocket":                 config.UnixSocket,
+	"unixsocketperm":             config.UnixSocketPerm,
+	"protected-mode":             config.ProtectedMode,
+	"maxclients":                 config.MaxClients,
+	"timeout":                    config.Timeout,
+	"tcp-keepalive":              config.TCPKeepAlive,
+	"client-output-buffer-limit": config.ClientOutputBufferLimits,
+	"replicaof":                  config.ReplicaOf,
+	"masterauth":                 config.MasterAuth,
+	"masteruser":                 config.MasterUser,
+	"replica-read-only":          config.ReplicaReadOnly,
+	"repl-backlog-size":          config.ReplBacklogSize,
+	"repl-timeout":               config.ReplTimeout,
+	"repl-ping-replica-period":   config.ReplPingReplicaPeriod,
+	"cluster-enabled":            config.ClusterEnabled,
+	"cluster-config-file":        config.ClusterConfigFile,
+	"cluster-node-timeout":       config.ClusterNodeTimeout,
+	"cluster-announce-ip":        config.ClusterAnnounceIP,
+	"busy-reply-threshold":       config.BusyReplyThreshold,
+	"slowlog-log-slower-than":    config.SlowlogLogSlowerThan,
+	"slowlog-max-len":            config.SlowlogMaxLen,
+	"latency-monitor-threshold":  config.LatencyMonitorThreshold,
+	"admin-addr":                 config.AdminAddr,
+	"admin-pprof":                config.AdminPprof,
+	"tls-port":                   config.TLSPort,
+	"tls-cert-file":              config.TLSCertFile,
+	"tls-key-file":               config.TLSKeyFile,
+	"tls-ca-cert-file":           config.TLSCACertFile,
+	"tls-auth-clients":           config.TLSAuthClients,
+	"tls-auth-clients-user":      config.TLSClientsUser,
+}
+
+// loadConfig reads the configuration file, then applies the flags set in the command line
+func loadConfig() (*config.Config, error) {
+	cfg := config.New()
+	if *configFile != "" {
+		if err := cfg.LoadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		name, ok := flagParameters[f.Name]
+		if ok && err == nil {
+			err = cfg.Override(name, f.Value.String())
+		}
+	})
+
+	return cfg, err
+}
 
 func main() {
 	flag.Parse()
 
 	var logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
 
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Fatalf("Error loading configuration: %v", err)
+	}
+
 	// Configure concurrency
-	if *threads > runtime.NumCPU() {
+	threads := int(cfg.GetInt(config.Threads))
+	if threads > runtime.NumCPU() {
 		logger.Println("Warning max threads is beyond number of cores")
 	}
-	logger.Printf("Using %d CPU", *threads)
-	runtime.GOMAXPROCS(*threads)
+	logger.Printf("Using %d CPU", threads)
+	runtime.GOMAXPROCS(threads)
 
-	// Configure profiler
-	if *cpuProfile {
-		logger.Println("Starting CPU profiler")
-		f, err := os.Create("cpu.prof")
-		if err != nil {
-			log.Fatal(err)
-		}
-		if pprof.StartCPUProfile(f) != nil {
-			logger.Fatal(err)
-			return
-		}
-		defer pprof.StopCPUProfile()
-	}
 	// Enable mutex profiling
 	if *mutexProfile {
 		runtime.SetMutexProfileFraction(1)
 		defer runtime.SetMutexProfileFraction(0)
 	}
 
+	// The admin listener starts first, so the probes answer while the dump file loads
+	var adm *admin.Server
+	if addr := cfg.GetString(config.AdminAddr); addr != "" {
+		adm = admin.New(logger, cfg.GetBool(config.AdminPprof))
+		if err = adm.Start(addr); err != nil {
+			logger.Fatalf("Error starting the admin HTTP listener: %v", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	ready := make(chan struct{})
 
-	opts := engine.EngineOptions{
-		Load:       reload,
-		GlobalPath: global,
-	}
-	if *memfile != "" {
-		opts.File = memfile
+	opts, err := engineOptions(cfg)
+	if err != nil {
+		logger.Fatalf("Error parsing save: %v", err)
 	}
 	eng, err := engine.NewEngine(opts)
 	if err != nil {
 		logger.Fatalf("Error creating engine: %v", err)
 	}
-	serv := server.NewServer(eng, logger)
-	go serv.StartServer(ctx, *port, ready)
-	<-ready
+	go eng.Cron(ctx)
+	if adm != nil {
+		adm.SetEngine(eng)
+	}
 
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	users := acl.New(engine.CommandCategories)
+	if aclFile := cfg.GetString(config.ACLFile); aclFile != "" {
+		if err = users.LoadFile(aclFile); err != nil {
+			logger.Fatalf("Error loading ACL file: %v", err)
+		}
+	}
+
+	// A zero port disables the listener, like in Redis
+	port := cfg.GetString(config.Port)
+	tlsPort := cfg.GetString(config.TLSPort)
 
-	// Wait for termination signal
-	<-signalCh
+	unixSocketPerm, err := strconv.ParseUint(cfg.GetString(config.UnixSocketPerm), 8, 32)
+	if err != nil {
+		logger.Fatalf("Error parsing unixsocketperm: %v", err)
+	}
+
+	serverOpts := server.ServerOptions{
+		ACL:            users,
+		Bind:           strings.Fields(cfg.GetString(config.Bind)),
+		UnixSocket:     cfg.GetString(config.UnixSocket),
+		UnixSocketPerm: os.FileMode(unixSocketPerm),
+	}
+	if tlsPort != "0" {
+		serverOpts.TLS = &server.TLSOptions{
+			CertFile:    cfg.GetString(config.TLSCertFile),
+			KeyFile:     cfg.GetString(config.TLSKeyFile),
+			CACertFile:  cfg.GetString(config.TLSCACertFile),
+			AuthClients: cfg.GetString(config.TLSAuthClients),
+			ClientsUser: cfg.GetString(config.TLSClientsUser),
+		}
+	}
+
+	serv, err := server.NewServerWithOptions(eng, logger, serverOpts)
+	if err != nil {
+		logger.Fatalf("Error creating server: %v", err)
+	}
+	if port != "0" {
+		ready := make(chan struct{})
+		go serv.StartServer(ctx, port, ready)
+		<-ready
+	}
+	if tlsPort != "0" {
+		ready := make(chan struct{})
+		go serv.StartTLSServer(ctx, tlsPort, ready)
+		<-ready
+	}
+	if serverOpts.UnixSocket != "" {
+		ready := make(chan struct{})
+		go serv.StartUnixServer(ctx, ready)
+		<-ready
+	}
+	if adm != nil {
+		adm.SetReady(true)
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	waitForShutdown(logger, serv, adm, tlsPort != "0", signalCh)
 	cancel()
 
-	if *memProfile {
-		f, err := os.Create("mem.prof")
-		if err != nil {
-			log.Fatal("could not create memory profile: ", err)
+	if adm != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), server.DefaultShutdownTimeout)
+		if err = adm.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("Error stopping the admin HTTP listener: %v", err)
 		}
-		defer f.Close() // error handling omitted for example
-		runtime.GC()    // get up-to-date statistics
-		if err = pprof.WriteHeapProfile(f); err != nil {
-			log.Fatal("could not write memory profile: ", err)
+		cancelShutdown()
+	}
+}
+
+// engineOptions returns the options of the engine from the configuration
+func engineOptions(cfg *config.Config) (engine.EngineOptions, error) {
+	saveParams, err := engine.ParseSaveParams(cfg.GetString(config.Save))
+	if err != nil {
+		return engine.EngineOptions{}, err
+	}
+
+	reload := cfg.GetBool(config.Reload)
+	global := cfg.GetBool(config.Global)
+	maxMemory := cfg.GetMemory(config.MaxMemory)
+	maxMemoryPolicy := cfg.GetString(config.MaxMemoryPolicy)
+	maxMemorySamples := int(cfg.GetInt(config.MaxMemorySamples))
+	opts := engine.EngineOptions{
+		Load:             &reload,
+		GlobalPath:       &global,
+		MaxMemory:        &maxMemory,
+		MaxMemoryPolicy:  &maxMemoryPolicy,
+		MaxMemorySamples: &maxMemorySamples,
+		SaveParams:       saveParams,
+		Config:           cfg,
+	}
+	if memfile := cfg.GetString(config.DBFilename); memfile != "" {
+		opts.File = &memfile
+	}
+	return opts, nil
+}
+
+// waitForShutdown waits for a termination signal or SHUTDOWN, SIGHUP
+// reloads the TLS certificates. Signals shut down the server like SHUTDOWN
+// without arguments, so the dataset is saved when there are save rules.
+func waitForShutdown(logger *log.Logger, serv *server.Server, adm *admin.Server, tls bool, signalCh chan os.Signal) {
+	for {
+		select {
+		case sig := <-signalCh:
+			if sig == syscall.SIGHUP {
+				if !tls {
+					continue
+				}
+				if err := serv.ReloadTLS(); err != nil {
+					logger.Printf("Error reloading TLS certificates: %v", err)
+					continue
+				}
+				logger.Println("TLS certificates reloaded")
+				continue
+			}
+
+			logger.Printf("Received %s, shutting down", sig)
+			if adm != nil {
+				adm.SetReady(false)
+			}
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), server.DefaultShutdownTimeout)
+			err := serv.Shutdown(shutdownCtx, server.ShutdownDefault, false)
+			cancelShutdown()
+			// Like Redis, the server keeps running when the final save fails
+			if err != nil {
+				logger.Printf("Error shutting down: %v", err)
+				if adm != nil {
+					adm.SetReady(true)
+				}
+				continue
+			}
+			return
+		case <-serv.Done():
+			return
 		}
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/server"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWaitForShutdown_SIGTERM(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memory.resp")
+	cfg := config.New()
+	_ = cfg.Override(config.DBFilename, file)
+	_ = cfg.Override(config.Global, "yes")
+
+	opts, err := engineOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng, err := engine.NewEngine(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng.Process([]interface{}{engine.SET, "key", "value"})
+
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+	if err = syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitForShutdown(logger, server.NewServer(eng, logger), nil, false, signalCh)
+
+	// The default save rules save the dataset on SIGTERM
+	loaded, err := engine.NewEngine(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, _ := loaded.Get(context.Background(), "key"); !ok || val != "value" {
+		t.Errorf("expected the dataset saved on SIGTERM, got %q", val)
+	}
+}
+
+func TestFlagDefaults(t *testing.T) {
+	for name, parameter := range flagParameters {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Errorf("flag %s of %s is not defined", name, parameter)
+			continue
+		}
+		cfg := config.New()
+		expected := cfg.GetString(parameter)
+		if err := cfg.Override(parameter, f.DefValue); err != nil {
+			t.Errorf("default of flag %s: %v", name, err)
+		} else if got := cfg.GetString(parameter); got != expected {
+			t.Errorf("flag %s defaults to %q, the default of %s is %q", name, got, parameter, expected)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package acl implements Redis 6 style access control lists. Users have
+// hashed passwords, command rules by category, command and subcommand,
+// and key and channel patterns. Rules use the ACL SETUSER syntax, and
+// users can be loaded from and saved to an ACL file.
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultUser is used by connections that don't authenticate
+const DefaultUser = "default"
+
+var SyntaxError = errors.New("syntax error")
+
+var UnknownCommand = errors.New("unknown command")
+
+var UnknownCategory = errors.New("unknown command category")
+
+var InvalidHash = errors.New("the password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+
+var NoSuchPassword = errors.New("the password you are trying to remove from the user does not exist")
+
+var NoSuchUser = errors.New("no such user")
+
+var DefaultUserDeletion = errors.New("the 'default' user cannot be removed")
+
+var InvalidUsername = errors.New("usernames can't contain spaces or null characters")
+
+var WrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+
+// Categories lists the command categories, like ACL CAT
+var Categories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// CategoriesFunc returns the categories of a lowercase command, or of a
+// subcommand written as command|subcommand. It returns false for unknown commands.
+type CategoriesFunc func(command string) ([]string, bool)
+
+type ACL struct {
+	lock       sync.RWMutex
+	users      map[string]*User
+	categories CategoriesFunc
+	file       string
+	log        *Log
+}
+
+// New returns an ACL with the default user, which has no password and can
+// run every command on every key and channel
+func New(categories CategoriesFunc) *ACL {
+	a := &ACL{
+		users:      make(map[string]*User),
+		categories: categories,
+		log:        NewLog(DefaultLogMaxLen),
+	}
+	a.users[DefaultUser] = a.defaultUser()
+	return a
+}
+
+func (a *ACL) defaultUser() *User {
+	u := newUser(DefaultUser, a.categories)
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "allcommands"} {
+		_ = u.apply(rule)
+	}
+	return u
+}
+
+func (a *ACL) Log() *Log {
+	return a.log
+}
+
+// User returns the current snapshot of a user
+func (a *ACL) User(name string) (*User, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u, ok := a.users[name]
+	return u, ok
+}
+
+// Users returns the users sorted by name
+func (a *ACL) Users() []*User {
+	a.lock.RLock()
+	users := make([]*User, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	a.lock.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].name < users[j].name
+	})
+	return users
+}
+
+// SetUser creates or modifies a user applying the rules in order. New
+// users start disabled, without passwords, keys, channels or commands.
+// When a rule is invalid the user is left unchanged.
+func (a *ACL) SetUser(name string, rules ...string) error {
+	if name == "" || strings.ContainsAny(name, " \x00") {
+		return InvalidUsername
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var u *User
+	if existing, ok := a.users[name]; ok {
+		u = existing.clone()
+	} else {
+		u = newUser(name, a.categories)
+	}
+
+	if err := applyRules(u, rules); err != nil {
+		return err
+	}
+	a.users[name] = u
+	return nil
+}
+
+func applyRules(u *User, rules []string) error {
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return fmt.Errorf("error in ACL SETUSER modifier '%s': %w", rule, err)
+		}
+	}
+	return nil
+}
+
+// DeleteUsers removes the users and returns how many existed
+func (a *ACL) DeleteUsers(names ...string) (int, error) {
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, DefaultUserDeletion
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	deleted := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Authenticate checks the password of an enabled user
+func (a *ACL) Authenticate(name, password string) (*User, error) {
+	u, ok := a.User(name)
+	if !ok || !u.enabled || !u.CheckPassword(password) {
+		return nil, WrongPass
+	}
+	return u, nil
+}
+
+// SetDefaultPassword sets the only password of the default user, an empty
+// password makes it nopass, like requirepass
+func (a *ACL) SetDefaultPassword(password string) error {
+	if password == "" {
+		return a.SetUser(DefaultUser, "nopass")
+	}
+	return a.SetUser(DefaultUser, "resetpass", ">"+password)
+}
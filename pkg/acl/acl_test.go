@@ -0,0 +1,334 @@
+package acl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testCategories mimics the engine command table
+func testCategories(command string) ([]string, bool) {
+	categories := map[string][]string{
+		"get":            {"read", "string", "fast"},
+		"set":            {"write", "string", "slow"},
+		"del":            {"keyspace", "write", "slow"},
+		"config":         {"admin", "slow", "dangerous"},
+		"client":         {"admin", "slow", "dangerous", "connection"},
+		"client|setname": {"slow", "connection"},
+	}
+	if c, ok := categories[command]; ok {
+		return c, true
+	}
+	// Only container commands have subcommands
+	container, _, found := strings.Cut(command, "|")
+	if found && (container == "config" || container == "client") {
+		return categories[container], true
+	}
+	return nil, false
+}
+
+func TestACL_DefaultUser(t *testing.T) {
+	a := New(testCategories)
+	u, ok := a.User(DefaultUser)
+	if !ok {
+		t.Fatal("expected the default user")
+	}
+	if !u.Enabled() || !u.NoPass() || !u.CanRun("CONFIG", "SET") || !u.CanAccessKey("any", true) {
+		t.Error("expected the default user to be allowed everything")
+	}
+	if got := u.Rules(); got != "on nopass ~* &* +@all" {
+		t.Errorf("unexpected rules %q", got)
+	}
+}
+
+func TestACL_SetUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string
+		assert func(t *testing.T, u *User)
+	}{
+		{
+			name:  "new users are denied everything",
+			rules: nil,
+			assert: func(t *testing.T, u *User) {
+				if u.Enabled() || u.CanRun("GET", "") || u.CanAccessKey("key", false) {
+					t.Error("expected a disabled user without permissions")
+				}
+				if got := u.Rules(); got != "off resetchannels -@all" {
+					t.Errorf("unexpected rules %q", got)
+				}
+			},
+		},
+		{
+			name:  "passwords",
+			rules: []string{"on", ">secret", ">other", "<other"},
+			assert: func(t *testing.T, u *User) {
+				if !u.CheckPassword("secret") || u.CheckPassword("other") || u.CheckPassword("") {
+					t.Error("unexpected password check")
+				}
+				if !reflect.DeepEqual(u.Passwords(), []string{HashPassword("secret")}) {
+					t.Errorf("expected only the hash of the password, got %v", u.Passwords())
+				}
+			},
+		},
+		{
+			name:  "categories and commands",
+			rules: []string{"+@all", "-@dangerous", "+client|setname", "-del"},
+			assert: func(t *testing.T, u *User) {
+				cases := []struct {
+					command, subcommand string
+					want                bool
+				}{
+					{"GET", "", true},
+					{"SET", "", true},
+					{"DEL", "", false},
+					{"CONFIG", "GET", false},
+					{"CLIENT", "KILL", false},
+					{"CLIENT", "SETNAME", true},
+				}
+				for _, c := range cases {
+					if got := u.CanRun(c.command, c.subcommand); got != c.want {
+						t.Errorf("CanRun(%s, %s) = %v, want %v", c.command, c.subcommand, got, c.want)
+					}
+				}
+				if got := u.CommandRules(); got != "+@all -@dangerous +client|setname -del" {
+					t.Errorf("unexpected command rules %q", got)
+				}
+			},
+		},
+		{
+			name:  "nocommands resets the command rules",
+			rules: []string{"+get", "+set", "nocommands", "+@read"},
+			assert: func(t *testing.T, u *User) {
+				if u.CanRun("SET", "") || !u.CanRun("GET", "") {
+					t.Error("expected only read commands")
+				}
+				if got := u.CommandRules(); got != "-@all +@read" {
+					t.Errorf("unexpected command rules %q", got)
+				}
+			},
+		},
+		{
+			name:  "key patterns",
+			rules: []string{"~cache:*", "%R~config:*", "%W~log:*"},
+			assert: func(t *testing.T, u *User) {
+				cases := []struct {
+					key   string
+					write bool
+					want  bool
+				}{
+					{"cache:1", false, true},
+					{"cache:1", true, true},
+					{"config:1", false, true},
+					{"config:1", true, false},
+					{"log:1", false, false},
+					{"log:1", true, true},
+					{"other", false, false},
+				}
+				for _, c := range cases {
+					if got := u.CanAccessKey(c.key, c.write); got != c.want {
+						t.Errorf("CanAccessKey(%s, %v) = %v, want %v", c.key, c.write, got, c.want)
+					}
+				}
+				if got := u.KeyRules(); got != "~cache:* %R~config:* %W~log:*" {
+					t.Errorf("unexpected key rules %q", got)
+				}
+			},
+		},
+		{
+			name:  "channel patterns",
+			rules: []string{"&news.*", "allchannels", "resetchannels", "&alerts"},
+			assert: func(t *testing.T, u *User) {
+				if u.CanAccessChannel("news.1") || !u.CanAccessChannel("alerts") {
+					t.Error("unexpected channel permissions")
+				}
+			},
+		},
+		{
+			name:  "reset",
+			rules: []string{"on", ">secret", "allkeys", "+@all", "reset"},
+			assert: func(t *testing.T, u *User) {
+				if got := u.Rules(); got != "off resetchannels -@all" {
+					t.Errorf("unexpected rules %q", got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(testCategories)
+			if err := a.SetUser("alice", tt.rules...); err != nil {
+				t.Fatal(err)
+			}
+			u, _ := a.User("alice")
+			tt.assert(t, u)
+		})
+	}
+}
+
+func TestACL_SetUserErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		want error
+	}{
+		{rule: "+unknown", want: UnknownCommand},
+		{rule: "+get|key", want: UnknownCommand},
+		{rule: "+@unknown", want: UnknownCategory},
+		{rule: "#abc", want: InvalidHash},
+		{rule: "<missing", want: NoSuchPassword},
+		{rule: "%X~key", want: SyntaxError},
+		{rule: "invalid", want: SyntaxError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			a := New(testCategories)
+			_ = a.SetUser("alice", "on", "+get")
+			err := a.SetUser("alice", "off", tt.rule)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+
+			// Invalid rules leave the user unchanged
+			u, _ := a.User("alice")
+			if !u.Enabled() {
+				t.Error("expected the user to be unchanged")
+			}
+		})
+	}
+}
+
+func TestACL_Authenticate(t *testing.T) {
+	a := New(testCategories)
+	_ = a.SetUser("alice", "on", ">secret")
+	_ = a.SetUser("bob", "off", ">secret")
+
+	if _, err := a.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("expected alice to authenticate, got %v", err)
+	}
+	if _, err := a.Authenticate("alice", "wrong"); !errors.Is(err, WrongPass) {
+		t.Errorf("expected a wrong password, got %v", err)
+	}
+	if _, err := a.Authenticate("bob", "secret"); !errors.Is(err, WrongPass) {
+		t.Errorf("expected disabled users to fail, got %v", err)
+	}
+	if _, err := a.Authenticate("carol", "secret"); !errors.Is(err, WrongPass) {
+		t.Errorf("expected unknown users to fail, got %v", err)
+	}
+
+	_ = a.SetDefaultPassword("pass")
+	if _, err := a.Authenticate(DefaultUser, "pass"); err != nil {
+		t.Errorf("expected the requirepass password, got %v", err)
+	}
+	_ = a.SetDefaultPassword("")
+	if u, _ := a.User(DefaultUser); !u.NoPass() {
+		t.Error("expected an empty requirepass to disable the password")
+	}
+}
+
+func TestACL_DeleteUsers(t *testing.T) {
+	a := New(testCategories)
+	_ = a.SetUser("alice")
+
+	if _, err := a.DeleteUsers("alice", DefaultUser); !errors.Is(err, DefaultUserDeletion) {
+		t.Fatalf("expected the default user to be protected, got %v", err)
+	}
+	deleted, err := a.DeleteUsers("alice", "bob")
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected 1 deleted user, got %d %v", deleted, err)
+	}
+	if _, ok := a.User("alice"); ok {
+		t.Error("expected alice to be deleted")
+	}
+}
+
+func TestACL_File(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.acl")
+	content := "# users\n" +
+		"user alice on >secret ~cache:* +get\n" +
+		"user default on nopass ~* &* +@all -config\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(testCategories)
+	if err := a.Save(); !errors.Is(err, NoACLFile) {
+		t.Fatalf("expected no ACL file, got %v", err)
+	}
+	if err := a.LoadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, ok := a.User("alice")
+	if !ok || !alice.CheckPassword("secret") || !alice.CanRun("GET", "") {
+		t.Fatal("expected alice to be loaded")
+	}
+	if def, _ := a.User(DefaultUser); def.CanRun("CONFIG", "GET") {
+		t.Error("expected the default user rules from the file")
+	}
+
+	_ = a.SetUser("bob", "on", "nopass", "+@read")
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(file)
+	want := "user alice on #" + HashPassword("secret") + " ~cache:* resetchannels -@all +get\n" +
+		"user bob on nopass resetchannels -@all +@read\n" +
+		"user default on nopass ~* &* +@all -config\n"
+	if string(saved) != want {
+		t.Errorf("unexpected saved file\n%s\nwant\n%s", saved, want)
+	}
+
+	// Saved files load into the same users
+	_, _ = a.DeleteUsers("bob")
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.User("bob"); !ok {
+		t.Error("expected bob to be reloaded")
+	}
+
+	// Invalid files don't change the users
+	if err := os.WriteFile(file, []byte("user carol +unknown\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Load(); !errors.Is(err, UnknownCommand) {
+		t.Fatalf("expected an unknown command, got %v", err)
+	}
+	if _, ok := a.User("alice"); !ok {
+		t.Error("expected the users to be kept")
+	}
+}
+
+func TestLog(t *testing.T) {
+	l := NewLog(2)
+	l.Add(ReasonCommand, "toplevel", "config", "alice", "id=1")
+	l.Add(ReasonKey, "toplevel", "secret", "alice", "id=1")
+	l.Add(ReasonCommand, "toplevel", "config", "alice", "id=2")
+
+	entries := l.Entries(-1)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Object != "config" || entries[0].Count != 2 || entries[0].ClientInfo != "id=2" {
+		t.Errorf("expected the grouped entry first, got %+v", entries[0])
+	}
+
+	l.Add(ReasonAuth, "toplevel", "AUTH", "bob", "id=3")
+	entries = l.Entries(10)
+	if len(entries) != 2 || entries[0].Reason != ReasonAuth || entries[0].EntryID != 2 {
+		t.Errorf("expected the oldest entry to be dropped, got %+v", entries)
+	}
+	if len(l.Entries(1)) != 1 {
+		t.Error("expected count to limit the entries")
+	}
+
+	l.Reset()
+	if len(l.Entries(-1)) != 0 {
+		t.Error("expected no entries after a reset")
+	}
+}
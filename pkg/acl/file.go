@@ -0,0 +1,100 @@
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"os"
+	"path/filepath"
+)
+
+var NoACLFile = errors.New("this server is not configured to use an ACL file")
+
+// LoadFile replaces the users with the ones in the file, the file is
+// remembered for ACL LOAD and ACL SAVE. Each line of the file is
+// "user <name> <rules...>", when the file doesn't define the default user
+// it gets its defaults. Nothing changes when a line is invalid.
+func (a *ACL) LoadFile(file string) error {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	directives, err := config.Parse(f)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*User)
+	for _, directive := range directives {
+		if directive.Name != "user" || len(directive.Args) == 0 {
+			return fmt.Errorf("line %d: %w, lines must start with 'user <name>'", directive.Line, SyntaxError)
+		}
+		name := directive.Args[0]
+		if _, ok := users[name]; ok {
+			return fmt.Errorf("line %d: duplicated user '%s'", directive.Line, name)
+		}
+
+		u := newUser(name, a.categories)
+		if err = applyRules(u, directive.Args[1:]); err != nil {
+			return fmt.Errorf("line %d: %w", directive.Line, err)
+		}
+		users[name] = u
+	}
+
+	if _, ok := users[DefaultUser]; !ok {
+		users[DefaultUser] = a.defaultUser()
+	}
+
+	a.lock.Lock()
+	a.users = users
+	a.file = file
+	a.lock.Unlock()
+	return nil
+}
+
+// Load reloads the ACL file, like ACL LOAD
+func (a *ACL) Load() error {
+	a.lock.RLock()
+	file := a.file
+	a.lock.RUnlock()
+
+	if file == "" {
+		return NoACLFile
+	}
+	return a.LoadFile(file)
+}
+
+// Save writes the users to the ACL file, like ACL SAVE. The file is
+// replaced atomically by renaming a temporary file.
+func (a *ACL) Save() error {
+	a.lock.RLock()
+	file := a.file
+	a.lock.RUnlock()
+
+	if file == "" {
+		return NoACLFile
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	for _, u := range a.Users() {
+		_, _ = fmt.Fprintf(writer, "user %s %s\n", u.name, u.Rules())
+	}
+
+	if err = writer.Flush(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
@@ -0,0 +1,106 @@
+package acl
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLogMaxLen is the number of entries kept by ACL LOG, like acllog-max-len
+const DefaultLogMaxLen = 128
+
+// logGroupingTime is how long similar denials are grouped in a single entry
+const logGroupingTime = 60 * time.Second
+
+// Reasons of the log entries
+const (
+	ReasonCommand = "command"
+	ReasonKey     = "key"
+	ReasonChannel = "channel"
+	ReasonAuth    = "auth"
+)
+
+// LogEntry is a denied command or failed authentication, similar denials
+// within a minute increase the count of the same entry
+type LogEntry struct {
+	Count    int64
+	Reason   string
+	Context  string
+	Object   string
+	Username string
+	// ClientInfo is the CLIENT INFO of the last client denied
+	ClientInfo string
+	EntryID    int64
+	Created    time.Time
+	Updated    time.Time
+}
+
+// Log keeps the most recent entries first
+type Log struct {
+	lock    sync.Mutex
+	entries []*LogEntry
+	maxLen  int
+	lastID  int64
+}
+
+func NewLog(maxLen int) *Log {
+	return &Log{maxLen: maxLen}
+}
+
+// Add records a denial, context is "toplevel" for commands sent by clients
+func (l *Log) Add(reason, context, object, username, clientInfo string) {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for i, entry := range l.entries {
+		if entry.Reason == reason && entry.Context == context && entry.Object == object &&
+			entry.Username == username && now.Sub(entry.Updated) < logGroupingTime {
+			entry.Count++
+			entry.ClientInfo = clientInfo
+			entry.Updated = now
+			// The updated entry moves to the top
+			copy(l.entries[1:i+1], l.entries[:i])
+			l.entries[0] = entry
+			return
+		}
+	}
+
+	entry := &LogEntry{
+		Count:      1,
+		Reason:     reason,
+		Context:    context,
+		Object:     object,
+		Username:   username,
+		ClientInfo: clientInfo,
+		EntryID:    l.lastID,
+		Created:    now,
+		Updated:    now,
+	}
+	l.lastID++
+
+	l.entries = append([]*LogEntry{entry}, l.entries...)
+	if len(l.entries) > l.maxLen {
+		l.entries = l.entries[:l.maxLen]
+	}
+}
+
+// Entries returns copies of the most recent entries, count < 0 returns all of them
+func (l *Log) Entries(count int) []LogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	entries := make([]LogEntry, count)
+	for i := range entries {
+		entries[i] = *l.entries[i]
+	}
+	return entries
+}
+
+func (l *Log) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = nil
+}
@@ -0,0 +1,400 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/glob"
+	"strings"
+)
+
+// keyPattern is a key pattern of a user, ~pattern allows reads and writes,
+// %R~pattern only reads and %W~pattern only writes
+type keyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+func (k keyPattern) String() string {
+	switch {
+	case k.read && k.write:
+		return "~" + k.pattern
+	case k.read:
+		return "%R~" + k.pattern
+	default:
+		return "%W~" + k.pattern
+	}
+}
+
+// commandRule allows or denies a category, a command or a subcommand
+type commandRule struct {
+	allow bool
+	// category is set for @category rules, otherwise command is the
+	// lowercase name of the command, or command|subcommand
+	category string
+	command  string
+}
+
+func (r commandRule) String() string {
+	sign := "-"
+	if r.allow {
+		sign = "+"
+	}
+	if r.category != "" {
+		return sign + "@" + r.category
+	}
+	return sign + r.command
+}
+
+// User is a snapshot of an ACL user. Users are never modified once they
+// are stored in the ACL, SetUser replaces them with a modified copy.
+type User struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // SHA-256 hashes in hex
+	keys      []keyPattern
+	channels  []string
+	// commands are evaluated in order, the last matching rule wins
+	commands   []commandRule
+	categories CategoriesFunc
+}
+
+func newUser(name string, categories CategoriesFunc) *User {
+	return &User{name: name, categories: categories}
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.keys = append([]keyPattern(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	c.commands = append([]commandRule(nil), u.commands...)
+	return &c
+}
+
+func (u *User) Name() string {
+	return u.name
+}
+
+func (u *User) Enabled() bool {
+	return u.enabled
+}
+
+// NoPass reports whether any password authenticates the user
+func (u *User) NoPass() bool {
+	return u.nopass
+}
+
+// HashPassword returns the hash stored for a password
+func HashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+func (u *User) CheckPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	// Every password is compared in constant time, so the time of the
+	// check doesn't tell which one matched or how much of it
+	hash := []byte(HashPassword(password))
+	match := 0
+	for _, p := range u.passwords {
+		match |= subtle.ConstantTimeCompare([]byte(p), hash)
+	}
+	return match == 1
+}
+
+// CanRun reports whether the user can run the command, subcommand is
+// empty for commands without subcommands
+func (u *User) CanRun(command, subcommand string) bool {
+	command = strings.ToLower(command)
+	full := command
+	if subcommand != "" {
+		full = command + "|" + strings.ToLower(subcommand)
+	}
+
+	var categories []string
+	allowed := false
+	for _, rule := range u.commands {
+		if rule.category == "" {
+			if rule.command == command || rule.command == full {
+				allowed = rule.allow
+			}
+			continue
+		}
+
+		if rule.category == "all" {
+			allowed = rule.allow
+			continue
+		}
+		if categories == nil {
+			categories, _ = u.categories(full)
+		}
+		for _, category := range categories {
+			if category == rule.category {
+				allowed = rule.allow
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+// CanAccessKey reports whether the user can read or write the key
+func (u *User) CanAccessKey(key string, write bool) bool {
+	for _, k := range u.keys {
+		if (write && !k.write) || (!write && !k.read) {
+			continue
+		}
+		if glob.Match(k.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) CanAccessChannel(channel string) bool {
+	for _, pattern := range u.channels {
+		if glob.Match(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flags returns the flags reported by ACL GETUSER
+func (u *User) Flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *User) Passwords() []string {
+	return append([]string(nil), u.passwords...)
+}
+
+// CommandRules describes the command rules, like ACL GETUSER
+func (u *User) CommandRules() string {
+	rules := make([]string, 0, len(u.commands)+1)
+	if len(u.commands) == 0 || u.commands[0] != (commandRule{allow: true, category: "all"}) {
+		rules = append(rules, "-@all")
+	}
+	for _, rule := range u.commands {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *User) KeyRules() string {
+	rules := make([]string, 0, len(u.keys))
+	for _, k := range u.keys {
+		rules = append(rules, k.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *User) ChannelRules() string {
+	rules := make([]string, 0, len(u.channels))
+	for _, channel := range u.channels {
+		rules = append(rules, "&"+channel)
+	}
+	return strings.Join(rules, " ")
+}
+
+// Rules describes the user with rules that recreate it, like ACL LIST
+func (u *User) Rules() string {
+	rules := u.Flags()
+	for _, hash := range u.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	if keys := u.KeyRules(); keys != "" {
+		rules = append(rules, keys)
+	}
+	if channels := u.ChannelRules(); channels != "" {
+		rules = append(rules, channels)
+	} else {
+		rules = append(rules, "resetchannels")
+	}
+	rules = append(rules, u.CommandRules())
+	return strings.Join(rules, " ")
+}
+
+// apply modifies the user with a rule, see SetUser
+func (u *User) apply(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		u.keys = []keyPattern{{pattern: "*", read: true, write: true}}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		u.channels = []string{"*"}
+		return nil
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		return u.apply("+@all")
+	case "nocommands":
+		return u.apply("-@all")
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			_ = u.apply(r)
+		}
+		return nil
+	}
+
+	if rule == "" {
+		return SyntaxError
+	}
+
+	switch rule[0] {
+	case '>':
+		u.addPassword(HashPassword(rule[1:]))
+	case '<':
+		return u.removePassword(HashPassword(rule[1:]))
+	case '#':
+		hash := strings.ToLower(rule[1:])
+		if !validHash(hash) {
+			return InvalidHash
+		}
+		u.addPassword(hash)
+	case '!':
+		return u.removePassword(strings.ToLower(rule[1:]))
+	case '~':
+		u.addKeyPattern(keyPattern{pattern: rule[1:], read: true, write: true})
+	case '%':
+		permissions, pattern, found := strings.Cut(rule[1:], "~")
+		if !found || permissions == "" {
+			return SyntaxError
+		}
+		k := keyPattern{pattern: pattern}
+		for _, p := range strings.ToUpper(permissions) {
+			switch p {
+			case 'R':
+				k.read = true
+			case 'W':
+				k.write = true
+			default:
+				return SyntaxError
+			}
+		}
+		u.addKeyPattern(k)
+	case '&':
+		u.addChannel(rule[1:])
+	case '+', '-':
+		return u.addCommandRule(rule[0] == '+', strings.ToLower(rule[1:]))
+	default:
+		return SyntaxError
+	}
+	return nil
+}
+
+func (u *User) addPassword(hash string) {
+	u.nopass = false
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *User) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return NoSuchPassword
+}
+
+func (u *User) addKeyPattern(k keyPattern) {
+	for i, existing := range u.keys {
+		if existing.pattern == k.pattern {
+			u.keys[i].read = existing.read || k.read
+			u.keys[i].write = existing.write || k.write
+			return
+		}
+	}
+	u.keys = append(u.keys, k)
+}
+
+func (u *User) addChannel(pattern string) {
+	for _, existing := range u.channels {
+		if existing == pattern {
+			return
+		}
+	}
+	u.channels = append(u.channels, pattern)
+}
+
+func (u *User) addCommandRule(allow bool, name string) error {
+	rule := commandRule{allow: allow}
+	if strings.HasPrefix(name, "@") {
+		rule.category = name[1:]
+		if !validCategory(rule.category) {
+			return fmt.Errorf("%w '%s'", UnknownCategory, rule.category)
+		}
+	} else {
+		rule.command = name
+		if _, ok := u.categories(name); !ok {
+			return fmt.Errorf("%w '%s'", UnknownCommand, name)
+		}
+	}
+
+	// +@all and -@all override every previous rule
+	if rule.category == "all" {
+		u.commands = nil
+		if !allow {
+			return nil
+		}
+	}
+	u.commands = append(u.commands, rule)
+	return nil
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func validCategory(category string) bool {
+	if category == "all" {
+		return true
+	}
+	for _, c := range Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+// Package admin serves the HTTP endpoints used to operate the server:
+// Prometheus metrics, health and readiness probes, and optionally the Go
+// profiler.
+package admin
+
+import (
+	"context"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// readHeaderTimeout bounds the time to read the headers of a request
+const readHeaderTimeout = 10 * time.Second
+
+// Server is the admin HTTP listener. It starts before the engine, so the
+// probes answer while the dump file is loaded: /healthz is ok as soon as
+// the process serves, /readyz once the engine is set, it is not loading
+// and the server is marked ready.
+type Server struct {
+	logger *log.Logger
+	// pprof serves the profiler, it has no authentication so it is opt-in
+	pprof bool
+	eng   atomic.Pointer[engine.Engine]
+	ready atomic.Bool
+	http  *http.Server
+}
+
+func New(logger *log.Logger, pprof bool) *Server {
+	s := &Server{logger: logger, pprof: pprof}
+	s.http = &http.Server{Handler: s.Handler(), ReadHeaderTimeout: readHeaderTimeout}
+	return s
+}
+
+// Handler returns the routes of the admin endpoints. The profiler has no
+// cmdline endpoint, the arguments of the process hold the passwords.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metrics)
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	if !s.pprof {
+		return mux
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// SetEngine sets the engine of the metrics once it is created
+func (s *Server) SetEngine(eng *engine.Engine) {
+	s.eng.Store(eng)
+}
+
+// SetReady marks the server ready, once it accepts clients, or not
+// ready, when it shuts down
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Start listens on the address and serves the endpoints in the background
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.logger.Printf("Admin HTTP listening on %s", listener.Addr())
+	go func() {
+		if err := s.http.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Printf("Admin HTTP stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the listener and waits for the requests in progress
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) readyz(w http.ResponseWriter, _ *http.Request) {
+	eng := s.eng.Load()
+	switch {
+	case eng == nil || eng.Loading():
+		http.Error(w, "loading", http.StatusServiceUnavailable)
+	case !s.ready.Load():
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	default:
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
+
+func (s *Server) metrics(w http.ResponseWriter, _ *http.Request) {
+	eng := s.eng.Load()
+	if eng == nil {
+		http.Error(w, "loading", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, eng.Info())
+}
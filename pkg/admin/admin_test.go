@@ -0,0 +1,112 @@
+package admin
+
+import (
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestServer_probes(t *testing.T) {
+	s := New(log.New(io.Discard, "", log.LstdFlags), false)
+	handler := s.Handler()
+
+	if code, _ := get(t, handler, "/healthz"); code != http.StatusOK {
+		t.Errorf("expected healthz to be ok before the engine, got %d", code)
+	}
+	if code, body := get(t, handler, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "loading") {
+		t.Errorf("expected readyz to be loading before the engine, got %d %q", code, body)
+	}
+	if code, _ := get(t, handler, "/metrics"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected no metrics before the engine, got %d", code)
+	}
+
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	s.SetEngine(eng)
+	if code, _ := get(t, handler, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to wait for the listeners, got %d", code)
+	}
+	s.SetReady(true)
+	if code, _ := get(t, handler, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected readyz to be ok, got %d", code)
+	}
+}
+
+func TestServer_pprof(t *testing.T) {
+	if code, _ := get(t, New(log.New(io.Discard, "", log.LstdFlags), false).Handler(), "/debug/pprof/"); code != http.StatusNotFound {
+		t.Errorf("expected no profiler by default, got %d", code)
+	}
+
+	handler := New(log.New(io.Discard, "", log.LstdFlags), true).Handler()
+	if code, body := get(t, handler, "/debug/pprof/"); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("expected the pprof index, got %d", code)
+	}
+	// The command line has the passwords given with -requirepass and -masterauth
+	if code, body := get(t, handler, "/debug/pprof/cmdline"); code == http.StatusOK || strings.Contains(body, os.Args[0]) {
+		t.Errorf("expected no cmdline, got %d %q", code, body)
+	}
+}
+
+func TestServer_metrics(t *testing.T) {
+	s := New(log.New(io.Discard, "", log.LstdFlags), false)
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	s.SetEngine(eng)
+	eng.Process([]interface{}{engine.SET, "key", "value"})
+	eng.Process([]interface{}{engine.GET, "key"})
+
+	code, body := get(t, s.Handler(), "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("expected the metrics, got %d", code)
+	}
+	for _, line := range []string{
+		"# TYPE redis_commands_processed_total counter",
+		"redis_commands_processed_total 2",
+		"redis_connected_clients 0",
+		`redis_commands_total{cmd="get"} 1`,
+		`redis_db_keys{db="db0"} 1`,
+		"redis_keyspace_hits_total 1",
+		"redis_rdb_last_save_ok 1",
+		"redis_loading_dump_file 0",
+		`role="master"`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in the metrics:\n%s", line, body)
+		}
+	}
+}
+
+func TestWriteMetrics_replica(t *testing.T) {
+	info := strings.Join([]string{
+		"# Replication",
+		"role:slave",
+		"master_link_status:down",
+		"master_last_io_seconds_ago:12",
+		"# Commandstats",
+		`cmdstat_set:calls=2,usec=1500000,usec_per_call=750000.00,rejected_calls=0,failed_calls=1`,
+	}, "\r\n")
+
+	b := strings.Builder{}
+	writeMetrics(&b, info)
+	for _, line := range []string{
+		"redis_master_link_up 0",
+		"redis_master_last_io_seconds_ago 12",
+		`redis_commands_duration_seconds_total{cmd="set"} 1.5`,
+		`redis_commands_failed_calls_total{cmd="set"} 1`,
+		`role="slave"`,
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("expected %q in the metrics:\n%s", line, b.String())
+		}
+	}
+}
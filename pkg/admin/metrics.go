@@ -0,0 +1,175 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metricPrefix matches redis_exporter, so its dashboards and alerts work
+const metricPrefix = "redis_"
+
+// infoMetric exports a numeric field of INFO
+type infoMetric struct {
+	field string
+	name  string
+	kind  string
+	help  string
+}
+
+var infoMetrics = []infoMetric{
+	{"uptime_in_seconds", "uptime_in_seconds", "gauge", "Seconds since the server started."},
+	{"connected_clients", "connected_clients", "gauge", "Number of client connections."},
+	{"maxclients", "max_clients", "gauge", "Maximum number of connected clients."},
+	{"total_connections_received", "connections_received_total", "counter", "Connections accepted by the server."},
+	{"rejected_connections", "rejected_connections_total", "counter", "Connections rejected because of maxclients."},
+	{"client_output_buffer_limit_disconnections", "client_output_buffer_limit_disconnections_total", "counter", "Clients closed for exceeding their output buffer limits."},
+	{"client_timeout_disconnections", "client_timeout_disconnections_total", "counter", "Clients closed for being idle."},
+	{"used_memory", "memory_used_bytes", "gauge", "Bytes used by the dataset."},
+	{"used_memory_rss", "memory_used_rss_bytes", "gauge", "Bytes of memory obtained from the system."},
+	{"used_memory_heap", "memory_used_heap_bytes", "gauge", "Bytes of allocated heap objects."},
+	{"maxmemory", "memory_max_bytes", "gauge", "Memory limit of the dataset, zero means no limit."},
+	{"number_of_cached_scripts", "number_of_cached_scripts", "gauge", "Scripts in the script cache."},
+	{"evicted_keys", "evicted_keys_total", "counter", "Keys evicted because of maxmemory."},
+	{"total_commands_processed", "commands_processed_total", "counter", "Commands processed by the server."},
+	{"total_error_replies", "errors_total", "counter", "Error replies sent to the clients."},
+	{"instantaneous_ops_per_sec", "instantaneous_ops_per_sec", "gauge", "Commands processed per second, recently."},
+	{"keyspace_hits", "keyspace_hits_total", "counter", "Lookups of keys that existed."},
+	{"keyspace_misses", "keyspace_misses_total", "counter", "Lookups of keys that didn't exist."},
+	{"loading", "loading_dump_file", "gauge", "Whether the dataset is being loaded."},
+	{"rdb_changes_since_last_save", "rdb_changes_since_last_save", "gauge", "Writes since the last save."},
+	{"rdb_last_save_time", "rdb_last_save_timestamp_seconds", "gauge", "Unix time of the last successful save."},
+	{"connected_slaves", "connected_slaves", "gauge", "Number of connected replicas."},
+	{"master_repl_offset", "master_repl_offset", "gauge", "Offset of the replication stream."},
+	{"repl_backlog_histlen", "repl_backlog_history_bytes", "gauge", "Bytes of the replication stream in the backlog."},
+	{"master_last_io_seconds_ago", "master_last_io_seconds_ago", "gauge", "Seconds since the last interaction with the primary."},
+	{"sync_full", "sync_full_total", "counter", "Full synchronizations of replicas."},
+	{"sync_partial_ok", "sync_partial_ok_total", "counter", "Partial synchronizations of replicas accepted."},
+	{"sync_partial_err", "sync_partial_err_total", "counter", "Partial synchronizations of replicas denied."},
+}
+
+// statusMetric exports a field of INFO as 1 when it has the value
+type statusMetric struct {
+	field string
+	value string
+	name  string
+	help  string
+}
+
+var statusMetrics = []statusMetric{
+	{"rdb_last_bgsave_status", "ok", "rdb_last_save_ok", "Whether the last save succeeded."},
+	{"master_link_status", "up", "master_link_up", "Whether the link with the primary is up."},
+	{"cluster_enabled", "1", "cluster_enabled", "Whether the server runs in cluster mode."},
+}
+
+// commandMetrics export the fields of each cmdstat_ line, with the command
+// as label
+var commandMetrics = []infoMetric{
+	{"calls", "commands_total", "counter", "Calls of each command."},
+	{"usec", "commands_duration_seconds_total", "counter", "Seconds spent running each command."},
+	{"rejected_calls", "commands_rejected_calls_total", "counter", "Calls of each command rejected before running."},
+	{"failed_calls", "commands_failed_calls_total", "counter", "Calls of each command that failed."},
+}
+
+var dbField = regexp.MustCompile(`^db\d+$`)
+
+// writeMetrics converts the output of INFO to the Prometheus text format
+func writeMetrics(w io.Writer, info string) {
+	fields := make(map[string]string)
+	var commands, dbs []string
+	for _, line := range strings.Split(info, "\r\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields[name] = value
+		if command, ok := strings.CutPrefix(name, "cmdstat_"); ok {
+			commands = append(commands, command)
+		} else if dbField.MatchString(name) {
+			dbs = append(dbs, name)
+		}
+	}
+	sort.Strings(commands)
+	sort.Strings(dbs)
+
+	writeHeader(w, "instance_info", "gauge", "Information about the server, the value is always 1.")
+	fmt.Fprintf(w, "%sinstance_info{redis_version=%s,redis_mode=%s,role=%s,run_id=%s} 1\n", metricPrefix,
+		quote(fields["redis_version"]), quote(fields["redis_mode"]), quote(fields["role"]), quote(fields["run_id"]))
+
+	for _, m := range infoMetrics {
+		value, ok := fields[m.field]
+		if !ok {
+			continue
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			continue
+		}
+		writeHeader(w, m.name, m.kind, m.help)
+		fmt.Fprintf(w, "%s%s %s\n", metricPrefix, m.name, value)
+	}
+
+	for _, m := range statusMetrics {
+		value, ok := fields[m.field]
+		if !ok {
+			continue
+		}
+		writeHeader(w, m.name, "gauge", m.help)
+		fmt.Fprintf(w, "%s%s %d\n", metricPrefix, m.name, boolToInt(value == m.value))
+	}
+
+	if len(commands) > 0 {
+		stats := make(map[string]map[string]string, len(commands))
+		for _, command := range commands {
+			stats[command] = parseValues(fields["cmdstat_"+command])
+		}
+		for _, m := range commandMetrics {
+			writeHeader(w, m.name, m.kind, m.help)
+			for _, command := range commands {
+				value := stats[command][m.field]
+				if m.field == "usec" {
+					usec, _ := strconv.ParseFloat(value, 64)
+					value = strconv.FormatFloat(usec/1e6, 'g', -1, 64)
+				}
+				fmt.Fprintf(w, "%s%s{cmd=%s} %s\n", metricPrefix, m.name, quote(command), value)
+			}
+		}
+	}
+
+	if len(dbs) > 0 {
+		writeHeader(w, "db_keys", "gauge", "Number of keys of each database.")
+		for _, db := range dbs {
+			fmt.Fprintf(w, "%sdb_keys{db=%s} %s\n", metricPrefix, quote(db), parseValues(fields[db])["keys"])
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricPrefix, name, help, metricPrefix, name, kind)
+}
+
+// parseValues parses the key=value pairs of fields like cmdstat_get
+func parseValues(field string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(field, ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// quote escapes a label value, backslashes, quotes and newlines are escaped
+func quote(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ClientClosed = errors.New("client is closed")
+
+// Options configure the connections of a client
+type Options struct {
+	// Network is tcp by default, unix for unix sockets
+	Network string
+	Addr    string
+	// Username and Password authenticate the connections with AUTH, the
+	// default user is used without a username
+	Username string
+	Password string
+	// TLSConfig enables TLS when set
+	TLSConfig   *tls.Config
+	DialTimeout time.Duration
+	// PoolSize is the maximum number of open connections, 10 by default
+	PoolSize int
+	// AutoPipeline sends the commands of concurrent calls to Do together,
+	// saving round trips to the server
+	AutoPipeline bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.Network == "" {
+		o.Network = "tcp"
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	if o.PoolSize <= 0 {
+		o.PoolSize = 10
+	}
+	return o
+}
+
+// Client runs commands on a pool of connections, it is safe for
+// concurrent use
+type Client struct {
+	opts Options
+	// slots holds a token for each open connection
+	slots chan struct{}
+	idle  chan *Conn
+	// lock guards closed, so connections are not returned to the pool
+	// while it is closing
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+	auto   chan *request
+}
+
+func New(opts Options) *Client {
+	opts = opts.withDefaults()
+	c := &Client{
+		opts:  opts,
+		slots: make(chan struct{}, opts.PoolSize),
+		idle:  make(chan *Conn, opts.PoolSize),
+		done:  make(chan struct{}),
+	}
+	if opts.AutoPipeline {
+		c.auto = make(chan *request)
+		for range opts.PoolSize {
+			go c.autoPipeline()
+		}
+	}
+	return c
+}
+
+// Do runs a command and returns its reply, error replies are returned as
+// an Error
+func (c *Client) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if c.auto != nil {
+		return c.autoDo(ctx, args)
+	}
+
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.put(conn)
+	return conn.Do(ctx, args...)
+}
+
+// Close closes the idle connections, the ones in use are closed when they
+// are returned to the pool
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for {
+		select {
+		case conn := <-c.idle:
+			c.release(conn)
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns an idle connection, or opens one when the pool is not full
+func (c *Client) get(ctx context.Context) (*Conn, error) {
+	select {
+	case <-c.done:
+		return nil, ClientClosed
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	case c.slots <- struct{}{}:
+		conn, err := Dial(ctx, c.opts)
+		if err != nil {
+			<-c.slots
+			return nil, err
+		}
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ClientClosed
+	}
+}
+
+// put returns a connection to the pool, broken connections are closed
+func (c *Client) put(conn *Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed || conn.Err() != nil {
+		c.release(conn)
+		return
+	}
+	c.idle <- conn
+}
+
+func (c *Client) release(conn *Conn) {
+	_ = conn.Close()
+	<-c.slots
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/server"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/server/servertest"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) string {
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	return servertest.Start(t, server.NewServer(eng, log.New(io.Discard, "", log.LstdFlags)))
+}
+
+func TestClient_Do(t *testing.T) {
+	c := New(Options{Addr: startServer(t)})
+	defer c.Close()
+	ctx := context.Background()
+
+	if res, err := c.Do(ctx, "SET", "key", "line\r\nbreak"); err != nil || res != "OK" {
+		t.Fatalf("expected OK, got %v, error %v", res, err)
+	}
+	if res, _ := c.Do(ctx, "GET", "key"); res != "line\r\nbreak" {
+		t.Errorf("unexpected value %q", res)
+	}
+	if res, _ := c.Do(ctx, "RPUSH", "list", 1, int64(2), 1.5, []byte("x")); res != int64(4) {
+		t.Errorf("expected 4, got %v", res)
+	}
+
+	var reply Error
+	if _, err := c.Do(ctx, "UNKNOWN"); !errors.As(err, &reply) {
+		t.Errorf("expected an error reply, got %v", err)
+	}
+	if _, err := c.Do(ctx, "SET", "key", struct{}{}); !errors.Is(err, UnsupportedArgument) {
+		t.Errorf("expected unsupported argument, got %v", err)
+	}
+	// Error replies leave the connection usable
+	if res, err := c.Do(ctx, "PING"); err != nil || res != "PONG" {
+		t.Errorf("expected PONG, got %v, error %v", res, err)
+	}
+
+	c.Close()
+	if _, err := c.Do(ctx, "PING"); !errors.Is(err, ClientClosed) {
+		t.Errorf("expected closed client, got %v", err)
+	}
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	c := New(Options{Addr: startServer(t)})
+	defer c.Close()
+
+	p := c.Pipeline()
+	p.Queue("SET", "key", "value")
+	p.Queue("UNKNOWN")
+	p.Queue("GET", "key")
+	replies, err := p.Exec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 || replies[0] != "OK" || replies[2] != "value" {
+		t.Errorf("unexpected replies %v", replies)
+	}
+	if _, ok := replies[1].(Error); !ok {
+		t.Errorf("expected an error reply, got %v", replies[1])
+	}
+	if p.Len() != 0 {
+		t.Error("expected the pipeline to be empty")
+	}
+}
+
+func TestClient_AutoPipeline(t *testing.T) {
+	c := New(Options{Addr: startServer(t), PoolSize: 2, AutoPipeline: true})
+	defer c.Close()
+
+	const calls = 100
+	lengths := make([]int, calls)
+	var wg sync.WaitGroup
+	wg.Add(calls)
+	for i := range calls {
+		go func() {
+			defer wg.Done()
+			res, err := c.Do(context.Background(), "RPUSH", "list", i)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lengths[i] = int(res.(int64))
+		}()
+	}
+	wg.Wait()
+
+	// Every push is applied once
+	sort.Ints(lengths)
+	for i, n := range lengths {
+		if n != i+1 {
+			t.Fatalf("expected the length %d, got %d", i+1, n)
+		}
+	}
+	if _, err := c.Do(context.Background(), "UNKNOWN"); !errors.As(err, new(Error)) {
+		t.Errorf("expected an error reply, got %v", err)
+	}
+}
+
+func TestClient_timeout(t *testing.T) {
+	// The listener accepts connections and never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := New(Options{Addr: listener.Addr().String(), PoolSize: 1})
+	defer c.Close()
+	for range 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := c.Do(ctx, "PING")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := c.Do(ctx, "PING"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+}
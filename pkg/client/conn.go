@@ -0,0 +1,204 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"net"
+	"strconv"
+	"time"
+)
+
+var UnsupportedArgument = errors.New("unsupported argument type")
+
+var ConnectionBroken = errors.New("connection is broken")
+
+// Error is an error reply of the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Conn is a connection to the server. Commands can be pipelined by sending
+// several of them before receiving their replies. It is not safe for
+// concurrent use.
+type Conn struct {
+	conn       net.Conn
+	scanner    *bufio.Scanner
+	parser     resp.RespParser
+	serializer resp.RespSerializer
+	pending    bytes.Buffer
+	// err is the error that broke the connection, the replies of the
+	// commands sent before it cannot be matched anymore
+	err error
+}
+
+// NewConn returns a connection using conn, which is usually a TCP, TLS or
+// unix socket connection
+func NewConn(conn net.Conn) *Conn {
+	c := &Conn{conn: conn}
+	c.scanner = c.parser.CreateScanner(conn)
+	return c
+}
+
+// Dial opens a connection with the options, it authenticates when a
+// password is set
+func Dial(ctx context.Context, opts Options) (*Conn, error) {
+	opts = opts.withDefaults()
+	ctx, cancel := context.WithTimeout(ctx, opts.DialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, opts.Network, opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TLSConfig != nil {
+		tlsConn := tls.Client(conn, opts.TLSConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c := NewConn(conn)
+	if opts.Password == "" {
+		return c, nil
+	}
+	auth := []interface{}{"AUTH", opts.Password}
+	if opts.Username != "" {
+		auth = []interface{}{"AUTH", opts.Username, opts.Password}
+	}
+	if _, err = c.Do(ctx, auth...); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Send buffers a command, it is written with the next Flush or Receive
+func (c *Conn) Send(args ...interface{}) error {
+	command, err := toCommand(args)
+	if err != nil {
+		return err
+	}
+	return c.serializer.SerializeWithBuffer(&c.pending, command)
+}
+
+// Flush writes the buffered commands
+func (c *Conn) Flush(ctx context.Context) error {
+	if c.err != nil {
+		return c.err
+	}
+	stop := c.watch(ctx)
+	defer stop()
+	if err := c.flush(); err != nil {
+		return c.fail(ctx, err)
+	}
+	return nil
+}
+
+// Receive flushes the buffered commands and reads the next reply, error
+// replies are returned as an Error
+func (c *Conn) Receive(ctx context.Context) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	stop := c.watch(ctx)
+	defer stop()
+	if err := c.flush(); err != nil {
+		return nil, c.fail(ctx, err)
+	}
+
+	res, err := c.parser.ParseScanner(c.scanner)
+	if err != nil {
+		return nil, c.fail(ctx, err)
+	}
+	if err, ok := res.(error); ok {
+		return nil, Error(err.Error())
+	}
+	return res, nil
+}
+
+// Do sends a command and returns its reply
+func (c *Conn) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	return c.Receive(ctx)
+}
+
+// Err returns the error that broke the connection, broken connections
+// must be closed
+func (c *Conn) Err() error {
+	return c.err
+}
+
+// NetConn returns the underlying connection
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) flush() error {
+	if c.pending.Len() == 0 {
+		return nil
+	}
+	_, err := c.pending.WriteTo(c.conn)
+	return err
+}
+
+// watch sets the deadline of the connection to the one of the context, a
+// canceled context interrupts the blocked reads and writes
+func (c *Conn) watch(ctx context.Context) func() bool {
+	deadline, _ := ctx.Deadline()
+	_ = c.conn.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() {
+		_ = c.conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// fail breaks the connection, errors caused by the context are reported
+// as the error of the context. The deadline of the connection may expire
+// before the one of the context is noticed.
+func (c *Conn) fail(ctx context.Context, err error) error {
+	var netErr net.Error
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	} else if _, ok := ctx.Deadline(); ok && errors.As(err, &netErr) && netErr.Timeout() {
+		err = context.DeadlineExceeded
+	}
+	c.err = fmt.Errorf("%w: %w", ConnectionBroken, err)
+	return err
+}
+
+// toCommand converts the arguments to the bulk strings of a command
+func toCommand(args []interface{}) ([]interface{}, error) {
+	command := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			command[i] = v
+		case []byte:
+			command[i] = string(v)
+		case int:
+			command[i] = strconv.Itoa(v)
+		case int64:
+			command[i] = strconv.FormatInt(v, 10)
+		case float64:
+			command[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("%w: %T", UnsupportedArgument, arg)
+		}
+	}
+	return command, nil
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// maxBatch limits the commands sent together by the automatic pipelining
+const maxBatch = 128
+
+// Pipeline queues commands to send them together on one connection
+type Pipeline struct {
+	c        *Client
+	commands [][]interface{}
+	err      error
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Queue adds a command to the pipeline, invalid arguments are reported by
+// Exec
+func (p *Pipeline) Queue(args ...interface{}) {
+	command, err := toCommand(args)
+	if err != nil {
+		p.err = errors.Join(p.err, err)
+		return
+	}
+	p.commands = append(p.commands, command)
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return len(p.commands)
+}
+
+// Exec sends the queued commands and returns their replies in order, error
+// replies are returned as an Error in the replies. The pipeline is empty
+// afterward.
+func (p *Pipeline) Exec(ctx context.Context) ([]interface{}, error) {
+	commands, err := p.commands, p.err
+	p.commands, p.err = nil, nil
+	if err != nil {
+		return nil, err
+	}
+	if len(commands) == 0 {
+		return nil, nil
+	}
+
+	conn, err := p.c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.c.put(conn)
+	return exec(ctx, conn, commands)
+}
+
+func exec(ctx context.Context, conn *Conn, commands [][]interface{}) ([]interface{}, error) {
+	for _, command := range commands {
+		if err := conn.serializer.SerializeWithBuffer(&conn.pending, command); err != nil {
+			conn.pending.Reset()
+			return nil, err
+		}
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		res, err := conn.Receive(ctx)
+		var reply Error
+		if errors.As(err, &reply) {
+			res, err = reply, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = res
+	}
+	return replies, nil
+}
+
+// request is a command waiting to be pipelined with the ones of other calls
+type request struct {
+	ctx     context.Context
+	command []interface{}
+	reply   chan result
+}
+
+type result struct {
+	res interface{}
+	err error
+}
+
+func (c *Client) autoDo(ctx context.Context, args []interface{}) (interface{}, error) {
+	command, err := toCommand(args)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &request{ctx: ctx, command: command, reply: make(chan result, 1)}
+	select {
+	case c.auto <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ClientClosed
+	}
+
+	select {
+	case r := <-req.reply:
+		return r.res, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// autoPipeline sends the requests waiting when a connection is available
+// in a single batch, each worker uses a connection at a time
+func (c *Client) autoPipeline() {
+	for {
+		var batch []*request
+		select {
+		case req := <-c.auto:
+			batch = append(batch, req)
+		case <-c.done:
+			return
+		}
+	collect:
+		for len(batch) < maxBatch {
+			select {
+			case req := <-c.auto:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		c.runBatch(batch)
+	}
+}
+
+func (c *Client) runBatch(batch []*request) {
+	pending := batch[:0]
+	for _, req := range batch {
+		if err := req.ctx.Err(); err != nil {
+			req.reply <- result{err: err}
+			continue
+		}
+		pending = append(pending, req)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := batchContext(pending)
+	defer cancel()
+	conn, err := c.get(ctx)
+	if err != nil {
+		reply(pending, nil, err)
+		return
+	}
+	defer c.put(conn)
+
+	commands := make([][]interface{}, len(pending))
+	for i, req := range pending {
+		commands[i] = req.command
+	}
+	replies, err := exec(ctx, conn, commands)
+	reply(pending, replies, err)
+}
+
+// batchContext waits for the latest deadline of the batch, the requests
+// without a deadline wait for their replies as long as needed
+func batchContext(batch []*request) (context.Context, context.CancelFunc) {
+	var latest time.Time
+	for _, req := range batch {
+		deadline, ok := req.ctx.Deadline()
+		if !ok {
+			return context.WithCancel(context.Background())
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return context.WithDeadline(context.Background(), latest)
+}
+
+func reply(batch []*request, replies []interface{}, err error) {
+	for i, req := range batch {
+		if err != nil {
+			req.reply <- result{err: err}
+			continue
+		}
+		if reply, ok := replies[i].(Error); ok {
+			req.reply <- result{err: reply}
+			continue
+		}
+		req.reply <- result{res: replies[i]}
+	}
+}
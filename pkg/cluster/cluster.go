@@ -0,0 +1,427 @@
+// Package cluster implements the state of a Redis Cluster node: the nodes
+// of the cluster, the hash slots each one owns and the slots being migrated.
+// Nodes exchange their state with a simplified gossip, the slots claimed
+// with the greatest config epoch win, like in Redis Cluster. There is no
+// failover, failing nodes are only reported.
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultNodeTimeout is the time a node can't be reached before it is reported as failing
+const DefaultNodeTimeout = 15 * time.Second
+
+var SlotBusy = errors.New("slot is already busy")
+
+var SlotUnassigned = errors.New("slot is already unassigned")
+
+var DuplicatedSlot = errors.New("slot specified multiple times")
+
+var UnknownNode = errors.New("unknown node")
+
+var NotOwner = errors.New("I'm not the owner of hash slot")
+
+var AlreadyOwner = errors.New("I'm already the owner of hash slot")
+
+var ForgetMyself = errors.New("I tried hard but I can't forget myself...")
+
+// Node is a node of the cluster
+type Node struct {
+	ID   string
+	Host string
+	Port int
+	// Epoch is the config epoch of the node, the claim of a slot with the
+	// greatest epoch wins
+	Epoch  uint64
+	Myself bool
+	// Failing nodes weren't reached for the node timeout
+	Failing bool
+	// lastSeen is the last time the node exchanged its state with this one
+	lastSeen time.Time
+}
+
+// Address is the host:port of the node
+func (n Node) Address() string {
+	return net.JoinHostPort(n.Host, fmt.Sprint(n.Port))
+}
+
+// Slot is the state of a slot
+type Slot struct {
+	// Owner is nil when the slot is not assigned
+	Owner *Node
+	// MigratingTo is the node importing a slot of this node, ImportingFrom
+	// the node this node imports the slot from
+	MigratingTo   *Node
+	ImportingFrom *Node
+}
+
+// Info are the fields of CLUSTER INFO
+type Info struct {
+	// State is ok when every slot is assigned to a node that is not failing
+	State         string
+	SlotsAssigned int
+	SlotsOK       int
+	SlotsFailing  int
+	KnownNodes    int
+	// Size is the number of nodes serving slots
+	Size         int
+	CurrentEpoch uint64
+	MyEpoch      uint64
+}
+
+type Cluster struct {
+	lock   sync.RWMutex
+	myself *Node
+	nodes  map[string]*Node
+	owners [Slots]*Node
+	// migrating and importing are the slots being moved, by their other node
+	migrating    map[int]*Node
+	importing    map[int]*Node
+	currentEpoch uint64
+	// announced is set when the host of this node is configured, otherwise
+	// it is learned from the other nodes
+	announced bool
+	// meets are the addresses of CLUSTER MEET that didn't reply yet
+	meets map[string]struct{}
+	file  string
+	// timeout is the node timeout in nanoseconds
+	timeout atomic.Int64
+}
+
+// New returns a cluster with only this node, which listens on port
+func New(port int) *Cluster {
+	myself := &Node{ID: newNodeID(), Port: port, Myself: true}
+	c := &Cluster{
+		myself:    myself,
+		nodes:     map[string]*Node{myself.ID: myself},
+		migrating: make(map[int]*Node),
+		importing: make(map[int]*Node),
+		meets:     make(map[string]struct{}),
+	}
+	c.timeout.Store(int64(DefaultNodeTimeout))
+	return c
+}
+
+// newNodeID returns a random node id of 40 characters
+func newNodeID() string {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// SetTimeout sets the node timeout
+func (c *Cluster) SetTimeout(timeout time.Duration) {
+	c.timeout.Store(int64(timeout))
+}
+
+// SetHost announces the host of this node, other nodes and clients use it
+// instead of the address they see
+func (c *Cluster) SetHost(host string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.announced = host != ""
+	c.myself.Host = host
+}
+
+// LearnHost sets the host of this node as seen by another node, unless it is announced
+func (c *Cluster) LearnHost(host string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.announced || host == "" || host == c.myself.Host {
+		return nil
+	}
+	c.myself.Host = host
+	return c.save()
+}
+
+// Myself returns this node
+func (c *Cluster) Myself() Node {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.export(c.myself)
+}
+
+// export copies a node, the lock must be held
+func (c *Cluster) export(n *Node) Node {
+	node := *n
+	node.Failing = !n.Myself && time.Since(n.lastSeen) > time.Duration(c.timeout.Load())
+	return node
+}
+
+// exportRef is export for optional nodes, the lock must be held
+func (c *Cluster) exportRef(n *Node) *Node {
+	if n == nil {
+		return nil
+	}
+	node := c.export(n)
+	return &node
+}
+
+// Node returns the node with the id
+func (c *Cluster) Node(id string) (Node, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	n, ok := c.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return c.export(n), true
+}
+
+// Nodes returns the known nodes sorted by id
+func (c *Cluster) Nodes() []Node {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	nodes := make([]Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, c.export(n))
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// Slot returns the owner of the slot and its migration
+func (c *Cluster) Slot(slot int) Slot {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return Slot{
+		Owner:         c.exportRef(c.owners[slot]),
+		MigratingTo:   c.exportRef(c.migrating[slot]),
+		ImportingFrom: c.exportRef(c.importing[slot]),
+	}
+}
+
+// SlotRanges returns the ranges of slots owned by the node
+func (c *Cluster) SlotRanges(id string) []SlotRange {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.slotRanges(id)
+}
+
+// slotRanges is SlotRanges with the lock held
+func (c *Cluster) slotRanges(id string) []SlotRange {
+	return toRanges(func(slot int) bool {
+		return c.owners[slot] != nil && c.owners[slot].ID == id
+	})
+}
+
+// AddSlots assigns the slots to this node, like CLUSTER ADDSLOTS. Nothing
+// changes when a slot is already assigned.
+func (c *Cluster) AddSlots(ranges []SlotRange) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	slots, err := expand(ranges)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if c.owners[slot] != nil {
+			return fmt.Errorf("%w: %d", SlotBusy, slot)
+		}
+	}
+	for _, slot := range slots {
+		c.owners[slot] = c.myself
+		delete(c.importing, slot)
+	}
+	return c.save()
+}
+
+// DelSlots unassigns the slots, like CLUSTER DELSLOTS. The other nodes
+// keep their owner until another node claims them.
+func (c *Cluster) DelSlots(ranges []SlotRange) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	slots, err := expand(ranges)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		if c.owners[slot] == nil {
+			return fmt.Errorf("%w: %d", SlotUnassigned, slot)
+		}
+	}
+	for _, slot := range slots {
+		c.owners[slot] = nil
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+	}
+	return c.save()
+}
+
+// expand returns the slots of the ranges, which must not overlap
+func expand(ranges []SlotRange) ([]int, error) {
+	var slots []int
+	seen := make(map[int]bool)
+	for _, r := range ranges {
+		for slot := r.Start; slot <= r.End; slot++ {
+			if seen[slot] {
+				return nil, fmt.Errorf("%w: %d", DuplicatedSlot, slot)
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// Migrating marks a slot of this node as being moved to another node,
+// like CLUSTER SETSLOT MIGRATING
+func (c *Cluster) Migrating(slot int, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.owners[slot] != c.myself {
+		return fmt.Errorf("%w %d", NotOwner, slot)
+	}
+	target, ok := c.nodes[id]
+	if !ok || target == c.myself {
+		return fmt.Errorf("%w: %s", UnknownNode, id)
+	}
+	c.migrating[slot] = target
+	return c.save()
+}
+
+// Importing marks a slot as being moved to this node from its owner, like
+// CLUSTER SETSLOT IMPORTING
+func (c *Cluster) Importing(slot int, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.owners[slot] == c.myself {
+		return fmt.Errorf("%w %d", AlreadyOwner, slot)
+	}
+	source, ok := c.nodes[id]
+	if !ok || source == c.myself {
+		return fmt.Errorf("%w: %s", UnknownNode, id)
+	}
+	c.importing[slot] = source
+	return c.save()
+}
+
+// Stable clears the migration of a slot, like CLUSTER SETSLOT STABLE
+func (c *Cluster) Stable(slot int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+	return c.save()
+}
+
+// Assign sets the owner of a slot, like CLUSTER SETSLOT NODE. A node
+// taking a slot bumps its epoch, so its claim wins over the previous owner.
+func (c *Cluster) Assign(slot int, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	owner, ok := c.nodes[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", UnknownNode, id)
+	}
+	if owner == c.myself && c.owners[slot] != c.myself {
+		c.currentEpoch++
+		c.myself.Epoch = c.currentEpoch
+	}
+	c.owners[slot] = owner
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+	return c.save()
+}
+
+// Meet adds a node to greet, like CLUSTER MEET. It joins the cluster once it replies.
+func (c *Cluster) Meet(host string, port int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.meets[net.JoinHostPort(host, fmt.Sprint(port))] = struct{}{}
+}
+
+// Meets returns the addresses of CLUSTER MEET that didn't reply yet
+func (c *Cluster) Meets() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	addresses := make([]string, 0, len(c.meets))
+	for address := range c.meets {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Met removes an address of CLUSTER MEET that replied
+func (c *Cluster) Met(address string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.meets, address)
+}
+
+// Forget removes a node, like CLUSTER FORGET. Nodes that still know it add
+// it again through the gossip.
+func (c *Cluster) Forget(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n, ok := c.nodes[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", UnknownNode, id)
+	}
+	if n == c.myself {
+		return ForgetMyself
+	}
+	delete(c.nodes, id)
+	for slot := range c.owners {
+		if c.owners[slot] == n {
+			c.owners[slot] = nil
+		}
+	}
+	for slot, other := range c.migrating {
+		if other == n {
+			delete(c.migrating, slot)
+		}
+	}
+	for slot, other := range c.importing {
+		if other == n {
+			delete(c.importing, slot)
+		}
+	}
+	return c.save()
+}
+
+// Info returns the fields of CLUSTER INFO
+func (c *Cluster) Info() Info {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	info := Info{KnownNodes: len(c.nodes), CurrentEpoch: c.currentEpoch, MyEpoch: c.myself.Epoch}
+	serving := make(map[*Node]bool)
+	for _, owner := range c.owners {
+		if owner == nil {
+			continue
+		}
+		info.SlotsAssigned++
+		serving[owner] = true
+		if c.export(owner).Failing {
+			info.SlotsFailing++
+		} else {
+			info.SlotsOK++
+		}
+	}
+	info.Size = len(serving)
+	info.State = "fail"
+	if info.SlotsOK == Slots {
+		info.State = "ok"
+	}
+	return info
+}
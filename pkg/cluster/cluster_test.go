@@ -0,0 +1,190 @@
+package cluster
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", KeySlot("user1000")},
+		{"{user1000}.followers", KeySlot("user1000")},
+		// Empty tags hash the whole key
+		{"foo{}{bar}", int(crc16("foo{}{bar}") & (Slots - 1))},
+		{"foo{{bar}}zap", KeySlot("{bar")},
+		{"foo{bar}{zap}", KeySlot("bar")},
+	}
+	for _, test := range tests {
+		if slot := KeySlot(test.key); slot != test.slot {
+			t.Errorf("KeySlot(%q) = %d, expected %d", test.key, slot, test.slot)
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	ranges, err := parseRanges("0-10,12,100-200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatted := formatRanges(ranges); formatted != "0-10,12,100-200" {
+		t.Errorf("unexpected ranges %s", formatted)
+	}
+	if _, err = parseRanges("10-5"); !errors.Is(err, InvalidSlot) {
+		t.Errorf("expected InvalidSlot, got %v", err)
+	}
+	if _, err = parseRanges("16384"); !errors.Is(err, InvalidSlot) {
+		t.Errorf("expected InvalidSlot, got %v", err)
+	}
+}
+
+func TestCluster_AddSlots(t *testing.T) {
+	c := New(7000)
+	if err := c.AddSlots([]SlotRange{{0, 100}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddSlots([]SlotRange{{100, 200}}); !errors.Is(err, SlotBusy) {
+		t.Errorf("expected SlotBusy, got %v", err)
+	}
+	if err := c.AddSlots([]SlotRange{{300, 300}, {300, 300}}); !errors.Is(err, DuplicatedSlot) {
+		t.Errorf("expected DuplicatedSlot, got %v", err)
+	}
+	if ranges := c.SlotRanges(c.Myself().ID); !reflect.DeepEqual(ranges, []SlotRange{{0, 100}}) {
+		t.Errorf("unexpected slots %v", ranges)
+	}
+
+	if err := c.DelSlots([]SlotRange{{50, 100}}); err != nil {
+		t.Fatal(err)
+	}
+	if owner := c.Slot(50).Owner; owner != nil {
+		t.Errorf("expected slot 50 unassigned, got %v", owner)
+	}
+	if info := c.Info(); info.SlotsAssigned != 50 || info.State != "fail" || info.Size != 1 {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+// exchange sends the state of each node to the other
+func exchange(t *testing.T, a, b *Cluster) {
+	if err := b.Receive(a.Message(), "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Receive(b.Message(), "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCluster_Receive(t *testing.T) {
+	a, b, c := New(7000), New(7001), New(7002)
+	_ = a.AddSlots([]SlotRange{{0, 8191}})
+	_ = b.AddSlots([]SlotRange{{8192, 16383}})
+
+	// c learns b through a
+	exchange(t, a, b)
+	exchange(t, a, c)
+	if _, ok := c.Node(b.Myself().ID); !ok {
+		t.Fatal("expected c to know b")
+	}
+	exchange(t, b, c)
+
+	for _, n := range []*Cluster{a, b, c} {
+		if info := n.Info(); info.State != "ok" || info.KnownNodes != 3 || info.Size != 2 {
+			t.Errorf("unexpected info %+v", info)
+		}
+		if owner := n.Slot(100).Owner; owner == nil || owner.ID != a.Myself().ID || owner.Port != 7000 {
+			t.Errorf("expected a to own slot 100, got %v", owner)
+		}
+	}
+
+	// Migrate slot 100 from a to b
+	if err := b.Importing(100, a.Myself().ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Migrating(100, b.Myself().ID); err != nil {
+		t.Fatal(err)
+	}
+	if slot := a.Slot(100); slot.MigratingTo == nil || slot.MigratingTo.ID != b.Myself().ID {
+		t.Errorf("expected slot 100 migrating to b, got %+v", slot)
+	}
+	if err := b.Assign(100, b.Myself().ID); err != nil {
+		t.Fatal(err)
+	}
+	if b.Myself().Epoch != 1 {
+		t.Errorf("expected b to bump its epoch, got %d", b.Myself().Epoch)
+	}
+
+	// The claim of b wins over the one of a, which still owns the slot
+	exchange(t, a, c)
+	exchange(t, b, c)
+	exchange(t, a, b)
+	for _, n := range []*Cluster{a, b, c} {
+		slot := n.Slot(100)
+		if slot.Owner == nil || slot.Owner.ID != b.Myself().ID || slot.MigratingTo != nil || slot.ImportingFrom != nil {
+			t.Errorf("expected b to own slot 100, got %+v", slot)
+		}
+	}
+}
+
+func TestMessage_Args(t *testing.T) {
+	c := New(7000)
+	_ = c.AddSlots([]SlotRange{{0, 10}, {20, 20}})
+	_ = c.Receive(Message{Sender: Node{ID: "other", Port: 7001}}, "10.0.0.1")
+
+	msg := c.Message()
+	msg.Observed = "10.0.0.2"
+	parsed, err := ParseMessage(msg.Args())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Sender.ID != msg.Sender.ID || parsed.Sender.Port != 7000 || parsed.Observed != "10.0.0.2" {
+		t.Errorf("unexpected sender %+v", parsed)
+	}
+	if !reflect.DeepEqual(parsed.Slots, []SlotRange{{0, 10}, {20, 20}}) {
+		t.Errorf("unexpected slots %v", parsed.Slots)
+	}
+	if len(parsed.Nodes) != 1 || parsed.Nodes[0].ID != "other" || parsed.Nodes[0].Host != "10.0.0.1" {
+		t.Errorf("unexpected nodes %+v", parsed.Nodes)
+	}
+
+	if _, err = ParseMessage([]string{"id"}); !errors.Is(err, InvalidMessage) {
+		t.Errorf("expected InvalidMessage, got %v", err)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nodes.conf")
+	c, err := LoadFile(file, 7000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := New(7001)
+	exchange(t, c, other)
+	_ = c.AddSlots([]SlotRange{{0, 100}})
+	_ = c.Migrating(50, other.Myself().ID)
+	_ = c.Importing(200, other.Myself().ID)
+
+	loaded, err := LoadFile(file, 7002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Myself().ID != c.Myself().ID || loaded.Myself().Port != 7002 {
+		t.Errorf("unexpected myself %+v", loaded.Myself())
+	}
+	if len(loaded.Nodes()) != 2 {
+		t.Errorf("expected 2 nodes, got %v", loaded.Nodes())
+	}
+	slot := loaded.Slot(50)
+	if slot.Owner == nil || !slot.Owner.Myself || slot.MigratingTo == nil || slot.MigratingTo.ID != other.Myself().ID {
+		t.Errorf("unexpected slot 50 %+v", slot)
+	}
+	if slot = loaded.Slot(200); slot.ImportingFrom == nil || slot.ImportingFrom.ID != other.Myself().ID {
+		t.Errorf("unexpected slot 200 %+v", slot)
+	}
+}
@@ -0,0 +1,215 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var InvalidNodesFile = errors.New("invalid cluster config file")
+
+// LoadFile loads the cluster saved in the file, like the cluster-config-file
+// of Redis. A new cluster with only this node is created and saved when the
+// file doesn't exist. The cluster is saved to the file on every change.
+func LoadFile(file string, port int) (*Cluster, error) {
+	c := New(port)
+	c.file = file
+
+	f, err := os.Open(filepath.Clean(file))
+	if os.IsNotExist(err) {
+		return c, c.Save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = c.parse(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	c.myself.Port = port
+	return c, nil
+}
+
+// parse reads the nodes in the format of CLUSTER NODES, followed by the vars line
+func (c *Cluster) parse(r io.Reader) error {
+	nodes := make(map[string]*Node)
+	var myself *Node
+	// migrations are the [slot->-id] and [slot-<-id] fields of this node
+	var migrations []string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					c.currentEpoch, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("line %d: %w", line, InvalidNodesFile)
+		}
+
+		address, _, _ := strings.Cut(fields[1], "@")
+		host, portValue, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, InvalidNodesFile)
+		}
+		n := &Node{ID: fields[0], Host: host, lastSeen: time.Now()}
+		if n.Port, err = strconv.Atoi(portValue); err != nil {
+			return fmt.Errorf("line %d: %w", line, InvalidNodesFile)
+		}
+		if n.Epoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return fmt.Errorf("line %d: %w", line, InvalidNodesFile)
+		}
+		if strings.Contains(fields[2], "myself") {
+			n.Myself = true
+			myself = n
+		}
+		nodes[n.ID] = n
+
+		for _, field := range fields[8:] {
+			if strings.HasPrefix(field, "[") {
+				if n.Myself {
+					migrations = append(migrations, field)
+				}
+				continue
+			}
+			r, err := parseSlotRange(field)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			for slot := r.Start; slot <= r.End; slot++ {
+				c.owners[slot] = n
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if myself == nil {
+		return fmt.Errorf("%w: missing myself", InvalidNodesFile)
+	}
+
+	for _, field := range migrations {
+		field = strings.Trim(field, "[]")
+		slotValue, id, migrating := strings.Cut(field, "->-")
+		if !migrating {
+			slotValue, id, _ = strings.Cut(field, "-<-")
+		}
+		slot, err := ParseSlot(slotValue)
+		other, ok := nodes[id]
+		if err != nil || !ok {
+			return fmt.Errorf("%w: invalid migration [%s]", InvalidNodesFile, field)
+		}
+		if migrating {
+			c.migrating[slot] = other
+		} else {
+			c.importing[slot] = other
+		}
+	}
+
+	c.myself, c.nodes = myself, nodes
+	return nil
+}
+
+// Save writes the cluster to its file, like CLUSTER SAVECONFIG
+func (c *Cluster) Save() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.save()
+}
+
+// save writes the file, replacing it atomically, the lock must be held
+func (c *Cluster) save() error {
+	if c.file == "" {
+		return nil
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	_, _ = writer.WriteString(c.formatNodes())
+	_, _ = fmt.Fprintf(writer, "vars currentEpoch %d lastVoteEpoch 0\n", c.currentEpoch)
+
+	if err = writer.Flush(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), c.file)
+}
+
+// FormatNodes returns the nodes in the format of CLUSTER NODES
+func (c *Cluster) FormatNodes() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.formatNodes()
+}
+
+// formatNodes is FormatNodes with the lock held. The cluster bus uses the
+// port of the clients, so it is also the port after the @.
+func (c *Cluster) formatNodes() string {
+	ids := make([]string, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b := strings.Builder{}
+	for _, id := range ids {
+		n := c.export(c.nodes[id])
+		flags, link, pong := "master", "connected", n.lastSeen.UnixMilli()
+		switch {
+		case n.Myself:
+			flags, pong = "myself,master", 0
+		case n.Failing:
+			flags, link = "master,fail?", "disconnected"
+		}
+		_, _ = fmt.Fprintf(&b, "%s %s@%d %s - 0 %d %d %s", n.ID, n.Address(), n.Port, flags, pong, n.Epoch, link)
+
+		for _, r := range c.slotRanges(n.ID) {
+			b.WriteString(" " + r.String())
+		}
+		if n.Myself {
+			b.WriteString(formatMigrations(c.migrating, "->-"))
+			b.WriteString(formatMigrations(c.importing, "-<-"))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func formatMigrations(migrations map[int]*Node, arrow string) string {
+	slots := make([]int, 0, len(migrations))
+	for slot := range migrations {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+
+	b := strings.Builder{}
+	for _, slot := range slots {
+		_, _ = fmt.Fprintf(&b, " [%d%s%s]", slot, arrow, migrations[slot].ID)
+	}
+	return b.String()
+}
@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var InvalidMessage = errors.New("invalid gossip message")
+
+// Message is the state a node sends to the others. The slots are only
+// taken from the sender, the other nodes are only used to discover them.
+type Message struct {
+	Sender       Node
+	CurrentEpoch uint64
+	Slots        []SlotRange
+	// Nodes are the other nodes known by the sender
+	Nodes []Node
+	// Observed is the host the receiver sees for the sender, replies carry
+	// it so nodes learn their own host
+	Observed string
+}
+
+// Message returns the state of this node for the others
+func (c *Cluster) Message() Message {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	msg := Message{
+		Sender:       *c.myself,
+		CurrentEpoch: c.currentEpoch,
+		Slots:        c.slotRanges(c.myself.ID),
+	}
+	if !c.announced {
+		// The receiver uses the address it sees
+		msg.Sender.Host = ""
+	}
+	for _, n := range c.nodes {
+		if n != c.myself && n.Host != "" {
+			msg.Nodes = append(msg.Nodes, *n)
+		}
+	}
+	return msg
+}
+
+// Args returns the message as the arguments of CLUSTER GOSSIP: the id, host,
+// port and epoch of the sender, the current epoch, the slots of the sender,
+// the observed host, then the id, host and port of each known node
+func (m Message) Args() []string {
+	args := []string{
+		m.Sender.ID, m.Sender.Host, strconv.Itoa(m.Sender.Port),
+		strconv.FormatUint(m.Sender.Epoch, 10), strconv.FormatUint(m.CurrentEpoch, 10),
+		formatRanges(m.Slots), m.Observed,
+	}
+	for _, n := range m.Nodes {
+		args = append(args, n.ID, n.Host, strconv.Itoa(n.Port))
+	}
+	return args
+}
+
+// ParseMessage parses the arguments of CLUSTER GOSSIP
+func ParseMessage(args []string) (Message, error) {
+	if len(args) < 7 || (len(args)-7)%3 != 0 {
+		return Message{}, InvalidMessage
+	}
+
+	var msg Message
+	var err error
+	msg.Sender.ID, msg.Sender.Host, msg.Observed = args[0], args[1], args[6]
+	if msg.Sender.Port, err = strconv.Atoi(args[2]); err != nil {
+		return Message{}, InvalidMessage
+	}
+	if msg.Sender.Epoch, err = strconv.ParseUint(args[3], 10, 64); err != nil {
+		return Message{}, InvalidMessage
+	}
+	if msg.CurrentEpoch, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+		return Message{}, InvalidMessage
+	}
+	if msg.Slots, err = parseRanges(args[5]); err != nil {
+		return Message{}, InvalidMessage
+	}
+
+	for i := 7; i < len(args); i += 3 {
+		port, err := strconv.Atoi(args[i+2])
+		if err != nil {
+			return Message{}, InvalidMessage
+		}
+		msg.Nodes = append(msg.Nodes, Node{ID: args[i], Host: args[i+1], Port: port})
+	}
+	return msg, nil
+}
+
+// Receive merges the state of another node, host is the address it was
+// seen at. The sender takes the slots it claims with a greater epoch than
+// their owner, and the unknown nodes are added.
+func (c *Cluster) Receive(msg Message, host string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if msg.Sender.ID == c.myself.ID {
+		return nil
+	}
+
+	changed := false
+	sender, ok := c.nodes[msg.Sender.ID]
+	if !ok {
+		sender = &Node{ID: msg.Sender.ID}
+		c.nodes[sender.ID] = sender
+		changed = true
+	}
+	if msg.Sender.Host != "" {
+		host = msg.Sender.Host
+	}
+	if sender.Host != host || sender.Port != msg.Sender.Port {
+		sender.Host, sender.Port = host, msg.Sender.Port
+		changed = true
+	}
+	sender.lastSeen = time.Now()
+
+	if msg.Sender.Epoch > sender.Epoch {
+		sender.Epoch = msg.Sender.Epoch
+		changed = true
+	}
+	if msg.CurrentEpoch > c.currentEpoch {
+		c.currentEpoch = msg.CurrentEpoch
+		changed = true
+	}
+	if sender.Epoch > c.currentEpoch {
+		c.currentEpoch = sender.Epoch
+		changed = true
+	}
+
+	for _, r := range msg.Slots {
+		for slot := r.Start; slot <= r.End; slot++ {
+			owner := c.owners[slot]
+			if owner == sender || (owner != nil && owner.Epoch >= sender.Epoch) {
+				continue
+			}
+			c.owners[slot] = sender
+			delete(c.migrating, slot)
+			delete(c.importing, slot)
+			changed = true
+		}
+	}
+
+	for _, n := range msg.Nodes {
+		if _, ok := c.nodes[n.ID]; ok || n.Host == "" {
+			continue
+		}
+		c.nodes[n.ID] = &Node{ID: n.ID, Host: n.Host, Port: n.Port, lastSeen: time.Now()}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return c.save()
+}
@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Slots is the number of hash slots the keys are distributed in
+const Slots = 16384
+
+var InvalidSlot = errors.New("Invalid or out of range slot")
+
+// crc16Table is the table of the CRC16 XMODEM polynomial 0x1021 used by Redis Cluster
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of a key. When the key has a hash tag, a
+// non empty substring between the first { and the next }, only the tag is
+// hashed, so keys with the same tag are in the same slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (Slots - 1))
+}
+
+// ParseSlot parses a slot number
+func ParseSlot(value string) (int, error) {
+	slot, err := strconv.Atoi(value)
+	if err != nil || slot < 0 || slot >= Slots {
+		return 0, InvalidSlot
+	}
+	return slot, nil
+}
+
+// SlotRange is a range of slots, both ends included
+type SlotRange struct {
+	Start int
+	End   int
+}
+
+func (r SlotRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return strconv.Itoa(r.Start) + "-" + strconv.Itoa(r.End)
+}
+
+// parseSlotRange parses a slot or a range of slots like 0-5460
+func parseSlotRange(value string) (SlotRange, error) {
+	start, end, found := strings.Cut(value, "-")
+	if !found {
+		end = start
+	}
+	first, err := ParseSlot(start)
+	if err != nil {
+		return SlotRange{}, err
+	}
+	last, err := ParseSlot(end)
+	if err != nil || last < first {
+		return SlotRange{}, InvalidSlot
+	}
+	return SlotRange{Start: first, End: last}, nil
+}
+
+// toRanges groups the slots of the set in ranges
+func toRanges(set func(slot int) bool) []SlotRange {
+	var ranges []SlotRange
+	for slot := 0; slot < Slots; slot++ {
+		if !set(slot) {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{Start: slot, End: slot})
+		}
+	}
+	return ranges
+}
+
+func formatRanges(ranges []SlotRange) string {
+	if len(ranges) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseRanges(value string) ([]SlotRange, error) {
+	if value == "-" {
+		return nil, nil
+	}
+	var ranges []SlotRange
+	for _, part := range strings.Split(value, ",") {
+		r, err := parseSlotRange(part)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
@@ -0,0 +1,70 @@
+package concurrency
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// LFU parameters, they match the Redis defaults for lfu-log-factor and lfu-decay-time
+const (
+	LFUInitVal   = 5
+	lfuLogFactor = 10
+	// lfuDecayTime is the number of minutes after which the counter is decremented
+	lfuDecayTime = 1
+	// lfuMinutesMask keeps the last decrement time in 24 bits, the low 8 bits hold the counter
+	lfuMinutesMask = 1<<24 - 1
+)
+
+// access keeps the metadata used by approximated LRU and LFU eviction. It is
+// updated with atomics so reads don't need to take the entry write lock.
+type access struct {
+	// lastAccess is the time of the last access in unix milliseconds
+	lastAccess atomic.Int64
+	// lfu packs the last decrement time in minutes and a logarithmic counter like Redis does
+	lfu atomic.Uint32
+}
+
+func lfuMinutes(now time.Time) uint32 {
+	return uint32(now.Unix()/60) & lfuMinutesMask
+}
+
+func (a *access) init(now time.Time) {
+	a.lastAccess.Store(now.UnixMilli())
+	a.lfu.Store(lfuMinutes(now)<<8 | LFUInitVal)
+}
+
+func (a *access) touch(now time.Time) {
+	a.lastAccess.Store(now.UnixMilli())
+	minutes := lfuMinutes(now)
+	counter := lfuLogIncr(a.frequency(minutes))
+	a.lfu.Store(minutes<<8 | uint32(counter))
+}
+
+// frequency returns the LFU counter decremented by the minutes elapsed since the last decrement
+func (a *access) frequency(minutes uint32) uint8 {
+	packed := a.lfu.Load()
+	counter := uint8(packed & 0xff)
+	elapsed := (minutes - packed>>8) & lfuMinutesMask
+	periods := elapsed / lfuDecayTime
+	if periods >= uint32(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+// lfuLogIncr increments the counter with a probability that decreases as it grows
+func lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return 255
+	}
+	baseval := float64(counter) - LFUInitVal
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*lfuLogFactor + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
@@ -2,7 +2,6 @@ package concurrency
 
 import (
 	"iter"
-	"reflect"
 	"sync"
 )
 
@@ -22,8 +21,6 @@ type ConcurrentList struct {
 	keyLock sync.RWMutex
 }
 
-var ConcurrentListType = reflect.TypeOf(&ConcurrentList{})
-
 func NewConcurrentList() *ConcurrentList {
 	return &ConcurrentList{}
 }
@@ -37,6 +34,8 @@ func NewConcurrentListFromSlice(slice []interface{}) *ConcurrentList {
 }
 
 func (cl *ConcurrentList) Len() int {
+	cl.keyLock.RLock()
+	defer cl.keyLock.RUnlock()
 	return cl.size
 }
 
@@ -172,3 +172,26 @@ func TestConcurrentIterationAndModification(t *testing.T) {
 		}
 	}
 }
+
+func TestConcurrentLenAndPushes(t *testing.T) {
+	list := NewConcurrentList()
+	var wg sync.WaitGroup
+	const numGoroutines = 10
+
+	wg.Add(numGoroutines * 2)
+	for i := 0; i < numGoroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			list.PushLeft(i)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_ = list.Len()
+		}()
+	}
+	wg.Wait()
+
+	if list.Len() != numGoroutines {
+		t.Errorf("Expected list length %d, got %d", numGoroutines, list.Len())
+	}
+}
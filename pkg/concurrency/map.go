@@ -1,24 +1,55 @@
+// Package concurrency provides the thread safe containers used by the engine.
+//
+// Locking model:
+//   - A ConcurrentMap shard lock only guards the shard's key to *Entry map. It
+//     is never held while an entry lock is acquired. Iterable takes every shard
+//     read lock in index order and no entry lock.
+//   - An Entry lock guards its value and memory accounting. Read takes the read
+//     lock, Write, Map and Mutate take the write lock, so mappers and mutators
+//     run exclusively. Access metadata is kept with atomics and no lock.
+//   - A ConcurrentList has its own lock and may be acquired while holding an
+//     entry lock, never the other way around.
+//   - A group lock guards the keys of a group. It is acquired while holding a
+//     shard lock, so keys enter and leave their group with the shard map.
+//
+// Since locks are always acquired in the order shard, group, entry, list and
+// no lock is acquired twice by the same goroutine, operations cannot deadlock.
 package concurrency
 
 import (
 	"iter"
+	"math/rand/v2"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type MapperFunc = func(v interface{}) (interface{}, error)
 
 type Constructor func() interface{}
 
+// SizerFunc estimates the memory used by a key and its value in bytes
+type SizerFunc func(key string, value interface{}) int64
+
+// GroupFunc returns the group of a key, from zero to MapOptions.Groups
+type GroupFunc func(key string) int
+
 type Entry struct {
 	value interface{}
 	lock  sync.RWMutex
+	// size and removed are guarded by lock, they are used for memory accounting
+	size    int64
+	removed bool
+	access  access
 }
 
 func NewEntry(value interface{}) *Entry {
-	return &Entry{
+	e := &Entry{
 		value: value,
 		lock:  sync.RWMutex{},
 	}
+	e.access.init(time.Now())
+	return e
 }
 
 func (e *Entry) Read() interface{} {
@@ -28,13 +59,24 @@ func (e *Entry) Read() interface{} {
 }
 
 func (e *Entry) Write(value interface{}) {
+	e.write(value, nil)
+}
+
+func (e *Entry) write(value interface{}, onChange func(*Entry)) {
 	e.lock.Lock()
 	defer e.lock.Unlock()
 	e.value = value
+	if onChange != nil {
+		onChange(e)
+	}
 }
 
 // Map assumes "mapper" returns the new value to set
 func (e *Entry) Map(mapper MapperFunc) error {
+	return e.mapValue(mapper, nil)
+}
+
+func (e *Entry) mapValue(mapper MapperFunc, onChange func(*Entry)) error {
 	e.lock.Lock()
 	defer e.lock.Unlock()
 	val, err := mapper(e.value)
@@ -42,20 +84,31 @@ func (e *Entry) Map(mapper MapperFunc) error {
 		return err
 	}
 	e.value = val
+	if onChange != nil {
+		onChange(e)
+	}
 	return nil
 }
 
-// Mutate assumes "mutator" takes care of race conditions for writing
+// Mutate runs "mutator" under the entry write lock, creating the value with
+// "constructor" first when it is missing. Unlike Map the value is not replaced,
+// the result of "mutator" is returned to the caller instead.
 func (e *Entry) Mutate(mutator MapperFunc, constructor Constructor) (interface{}, error) {
-	e.lock.RLock()
-	defer e.lock.RLock()
+	return e.mutate(mutator, constructor, nil)
+}
+
+func (e *Entry) mutate(mutator MapperFunc, constructor Constructor, onChange func(*Entry)) (interface{}, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
 
 	if e.value == nil {
 		e.value = constructor()
-		return mutator(e.value)
 	}
 
 	val, err := mutator(e.value)
+	if onChange != nil {
+		onChange(e)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -63,80 +116,422 @@ func (e *Entry) Mutate(mutator MapperFunc, constructor Constructor) (interface{}
 	return val, nil
 }
 
+// DefaultShardCount is the number of shards used by NewConcurrentMap. It is a
+// power of two so the shard index can be computed with a mask.
+const DefaultShardCount = 64
+
+type shard struct {
+	memory map[string]*Entry
+	lock   sync.RWMutex
+}
+
+// group holds the keys of a group, the map is allocated with the first key
+type group struct {
+	keys map[string]struct{}
+	lock sync.Mutex
+}
+
+// ConcurrentMap splits its keys into independently locked shards so that
+// operations on different keys rarely contend on the same mutex.
 type ConcurrentMap struct {
-	memory  map[string]*Entry
-	keyLock sync.Mutex
+	shards []*shard
+	mask   uint32
+	sizer  SizerFunc
+	used   atomic.Int64
+	group  GroupFunc
+	groups []group
+}
+
+type MapOptions struct {
+	// Shards is rounded up to the next power of two, DefaultShardCount is used when zero
+	Shards int
+	// Sizer enables memory accounting, see ConcurrentMap.Used
+	Sizer SizerFunc
+	// Group indexes the keys in Groups groups, like the hash slots of a
+	// cluster, see ConcurrentMap.GroupLen and ConcurrentMap.GroupKeys
+	Group  GroupFunc
+	Groups int
 }
 
 func NewConcurrentMap() *ConcurrentMap {
-	return &ConcurrentMap{
-		memory:  make(map[string]*Entry),
-		keyLock: sync.Mutex{},
+	return NewConcurrentMapWithOptions(MapOptions{})
+}
+
+// NewConcurrentMapWithShards creates a map with at least n shards, rounded up
+// to the next power of two.
+func NewConcurrentMapWithShards(n int) *ConcurrentMap {
+	if n < 1 {
+		n = 1
+	}
+	return NewConcurrentMapWithOptions(MapOptions{Shards: n})
+}
+
+func NewConcurrentMapWithOptions(opts MapOptions) *ConcurrentMap {
+	n := opts.Shards
+	if n == 0 {
+		n = DefaultShardCount
+	}
+
+	count := uint32(1)
+	for int(count) < n {
+		count <<= 1
+	}
+
+	shards := make([]*shard, count)
+	for i := range shards {
+		shards[i] = &shard{memory: make(map[string]*Entry)}
+	}
+
+	c := &ConcurrentMap{
+		shards: shards,
+		mask:   count - 1,
+		sizer:  opts.Sizer,
+	}
+	if opts.Group != nil {
+		c.group = opts.Group
+		c.groups = make([]group, opts.Groups)
+	}
+	return c
+}
+
+// fnv32 is an inlined FNV-1a hash, it avoids the allocation of hash/fnv
+func fnv32(key string) uint32 {
+	const offset32 = 2166136261
+	const prime32 = 16777619
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+	return hash
+}
+
+func (c *ConcurrentMap) getShard(key string) *shard {
+	return c.shards[fnv32(key)&c.mask]
+}
+
+// index adds the key to its group, the shard lock must be held
+func (c *ConcurrentMap) index(key string) {
+	if c.group == nil {
+		return
+	}
+	g := &c.groups[c.group(key)]
+	g.lock.Lock()
+	if g.keys == nil {
+		g.keys = make(map[string]struct{})
+	}
+	g.keys[key] = struct{}{}
+	g.lock.Unlock()
+}
+
+// unindex removes the key from its group, the shard lock must be held
+func (c *ConcurrentMap) unindex(key string) {
+	if c.group == nil {
+		return
+	}
+	g := &c.groups[c.group(key)]
+	g.lock.Lock()
+	delete(g.keys, key)
+	g.lock.Unlock()
+}
+
+// accountFor returns the callback that updates the memory used by "key", it
+// must run while the entry is locked or not yet published
+func (c *ConcurrentMap) accountFor(key string) func(*Entry) {
+	if c.sizer == nil {
+		return nil
+	}
+
+	return func(e *Entry) {
+		if e.removed {
+			return
+		}
+		size := c.sizer(key, e.value)
+		c.used.Add(size - e.size)
+		e.size = size
 	}
 }
 
 func (c *ConcurrentMap) Set(key string, value interface{}) {
-	c.keyLock.Lock()
-	entry, ok := c.memory[key]
+	s := c.getShard(key)
+	account := c.accountFor(key)
+	s.lock.Lock()
+	entry, ok := s.memory[key]
 
 	if !ok {
-		c.memory[key] = NewEntry(value)
-		c.keyLock.Unlock()
+		entry = NewEntry(value)
+		if account != nil {
+			account(entry)
+		}
+		s.memory[key] = entry
+		c.index(key)
+		s.lock.Unlock()
 		return
 	}
 
-	c.keyLock.Unlock()
-	entry.Write(value)
+	s.lock.Unlock()
+	entry.access.touch(time.Now())
+	entry.write(value, account)
+}
+
+// SetIf stores the value when "condition" accepts whether the key exists,
+// like SET NX and XX, and reports whether it was stored. A missing key is
+// checked and stored under the shard lock, an existing one under the entry
+// lock, so no other write can change its existence in between.
+func (c *ConcurrentMap) SetIf(key string, value interface{}, condition func(exists bool) bool) bool {
+	s := c.getShard(key)
+	account := c.accountFor(key)
+	for {
+		s.lock.Lock()
+		entry, ok := s.memory[key]
+
+		if !ok {
+			if !condition(false) {
+				s.lock.Unlock()
+				return false
+			}
+			entry = NewEntry(value)
+			if account != nil {
+				account(entry)
+			}
+			s.memory[key] = entry
+			c.index(key)
+			s.lock.Unlock()
+			return true
+		}
+
+		s.lock.Unlock()
+		entry.lock.Lock()
+		if entry.removed {
+			// The key was deleted after the lookup, look it up again
+			entry.lock.Unlock()
+			continue
+		}
+		if !condition(entry.value != nil) {
+			entry.lock.Unlock()
+			return false
+		}
+		entry.access.touch(time.Now())
+		entry.value = value
+		if account != nil {
+			account(entry)
+		}
+		entry.lock.Unlock()
+		return true
+	}
 }
 
 func (c *ConcurrentMap) Map(key string, mapper MapperFunc) error {
-	c.keyLock.Lock()
-	entry, ok := c.memory[key]
+	s := c.getShard(key)
+	account := c.accountFor(key)
+	s.lock.Lock()
+	entry, ok := s.memory[key]
 
 	if !ok {
 		defaultValue, _ := mapper(nil)
-		c.memory[key] = NewEntry(defaultValue)
-		c.keyLock.Unlock()
+		entry = NewEntry(defaultValue)
+		if account != nil {
+			account(entry)
+		}
+		s.memory[key] = entry
+		c.index(key)
+		s.lock.Unlock()
 		return nil
 	}
 
-	c.keyLock.Unlock()
-	return entry.Map(mapper)
+	s.lock.Unlock()
+	entry.access.touch(time.Now())
+	return entry.mapValue(mapper, account)
 }
 
+// Mutate creates the entry with "constructor" when the key is missing, the
+// shard lock is released before "mutator" runs
 func (c *ConcurrentMap) Mutate(key string, mutator MapperFunc, constructor Constructor) (interface{}, error) {
-	c.keyLock.Lock()
-	defer c.keyLock.Unlock()
-	entry, ok := c.memory[key]
+	s := c.getShard(key)
+	s.lock.Lock()
+	entry, ok := s.memory[key]
 
 	if !ok {
-		entry = NewEntry(nil)
-		c.memory[key] = entry
+		entry = NewEntry(constructor())
+		s.memory[key] = entry
+		c.index(key)
 	}
+	s.lock.Unlock()
 
-	return entry.Mutate(mutator, constructor)
+	if ok {
+		entry.access.touch(time.Now())
+	}
+	return entry.mutate(mutator, constructor, c.accountFor(key))
 }
 
 func (c *ConcurrentMap) Get(key string) (interface{}, bool) {
-	c.keyLock.Lock()
-	entry, ok := c.memory[key]
-	c.keyLock.Unlock()
+	s := c.getShard(key)
+	s.lock.RLock()
+	entry, ok := s.memory[key]
+	s.lock.RUnlock()
 	if !ok {
 		return nil, false
 	}
 
+	entry.access.touch(time.Now())
 	return entry.Read(), true
 }
 
 func (c *ConcurrentMap) Has(key string) bool {
-	entry, ok := c.memory[key]
+	s := c.getShard(key)
+	s.lock.RLock()
+	entry, ok := s.memory[key]
+	s.lock.RUnlock()
 	return ok && entry.Read() != nil
 }
 
-func (c *ConcurrentMap) Delete(key string) {
-	c.keyLock.Lock()
-	defer c.keyLock.Unlock()
-	delete(c.memory, key)
+// Delete removes the key and reports whether it was present
+func (c *ConcurrentMap) Delete(key string) bool {
+	s := c.getShard(key)
+	s.lock.Lock()
+	entry, ok := s.memory[key]
+	if ok {
+		delete(s.memory, key)
+		c.unindex(key)
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	// Writers that still hold a reference to the entry must not account for it anymore
+	entry.lock.Lock()
+	entry.removed = true
+	c.used.Add(-entry.size)
+	entry.lock.Unlock()
+
+	return true
+}
+
+// Clear removes every key, like FLUSHALL
+func (c *ConcurrentMap) Clear() {
+	for _, s := range c.shards {
+		s.lock.Lock()
+		entries := s.memory
+		s.memory = make(map[string]*Entry)
+		for key := range entries {
+			c.unindex(key)
+		}
+		s.lock.Unlock()
+
+		for _, entry := range entries {
+			entry.lock.Lock()
+			entry.removed = true
+			c.used.Add(-entry.size)
+			entry.lock.Unlock()
+		}
+	}
+}
+
+// Len returns the number of keys across all shards
+func (c *ConcurrentMap) Len() int {
+	total := 0
+	for _, s := range c.shards {
+		s.lock.RLock()
+		total += len(s.memory)
+		s.lock.RUnlock()
+	}
+	return total
+}
+
+// GroupLen returns the number of keys in a group, zero when the keys are
+// not grouped
+func (c *ConcurrentMap) GroupLen(index int) int {
+	if c.group == nil {
+		return 0
+	}
+	g := &c.groups[index]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.keys)
+}
+
+// GroupKeys returns up to count keys of a group
+func (c *ConcurrentMap) GroupKeys(index int, count int) []string {
+	keys := make([]string, 0)
+	if c.group == nil {
+		return keys
+	}
+	g := &c.groups[index]
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for key := range g.keys {
+		if len(keys) >= count {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Used returns the memory in bytes reported by the sizer for all keys
+func (c *ConcurrentMap) Used() int64 {
+	return c.used.Load()
+}
+
+// Sample holds the access metadata of a key, used to pick eviction candidates
+type Sample struct {
+	Key string
+	// LastAccess is the time of the last access in unix milliseconds
+	LastAccess int64
+	// Frequency is the logarithmic LFU counter, decayed to the current time
+	Frequency uint8
+}
+
+// Sample returns up to n keys from a random shard, moving to the following
+// shards when it has fewer keys. Like Redis, eviction only approximates LRU
+// and LFU by choosing the best candidate among a few random keys.
+func (c *ConcurrentMap) Sample(n int) []Sample {
+	samples := make([]Sample, 0, n)
+	minutes := lfuMinutes(time.Now())
+	first := rand.IntN(len(c.shards))
+
+	for i := 0; i < len(c.shards) && len(samples) < n; i++ {
+		s := c.shards[(first+i)%len(c.shards)]
+		s.lock.RLock()
+		// Go randomizes the iteration start of maps
+		for k, v := range s.memory {
+			if len(samples) == n {
+				break
+			}
+			samples = append(samples, Sample{
+				Key:        k,
+				LastAccess: v.access.lastAccess.Load(),
+				Frequency:  v.access.frequency(minutes),
+			})
+		}
+		s.lock.RUnlock()
+	}
+
+	return samples
+}
+
+// Scan returns the keys of the shards from the cursor on, until count keys
+// are collected, and the cursor of the following shard. The cursor is zero
+// once the last shard is scanned. A key always belongs to the same shard,
+// so keys stored during the whole scan are returned once.
+func (c *ConcurrentMap) Scan(cursor int, count int) ([]string, int) {
+	keys := make([]string, 0, count)
+	for cursor < len(c.shards) && len(keys) < count {
+		s := c.shards[cursor]
+		s.lock.RLock()
+		for k := range s.memory {
+			keys = append(keys, k)
+		}
+		s.lock.RUnlock()
+		cursor++
+	}
+
+	if cursor >= len(c.shards) {
+		cursor = 0
+	}
+	return keys, cursor
 }
 
 type Pair struct {
@@ -151,12 +546,30 @@ func NewPair(key string, value interface{}) Pair {
 	}
 }
 
+// Iterable yields a point-in-time snapshot of the keys. Every shard is read
+// locked, always in the same order, while the entries are collected, so the
+// key set is consistent across shards and the consumer is free to write to
+// the map while iterating. Values are read from each entry when yielded.
 func (c *ConcurrentMap) Iterable() iter.Seq[Pair] {
 	return func(yield func(Pair) bool) {
-		c.keyLock.Lock()
-		defer c.keyLock.Unlock()
-		for k, v := range c.memory {
-			if !yield(NewPair(k, v.Read())) {
+		keys := make([]string, 0)
+		entries := make([]*Entry, 0)
+
+		for _, s := range c.shards {
+			s.lock.RLock()
+		}
+		for _, s := range c.shards {
+			for k, v := range s.memory {
+				keys = append(keys, k)
+				entries = append(entries, v)
+			}
+		}
+		for _, s := range c.shards {
+			s.lock.RUnlock()
+		}
+
+		for i, k := range keys {
+			if !yield(NewPair(k, entries[i].Read())) {
 				return
 			}
 		}
@@ -3,7 +3,9 @@ package concurrency
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestConcurrentDelete(t *testing.T) {
@@ -172,3 +174,470 @@ func TestConcurrentMapWithIncrementDecrement(t *testing.T) {
 		t.Errorf("expected final value to be 0, but got %d", finalValue)
 	}
 }
+
+func TestConcurrentMap_ShardCount(t *testing.T) {
+	tests := []struct {
+		requested int
+		expected  int
+	}{
+		{requested: 0, expected: 1},
+		{requested: 1, expected: 1},
+		{requested: 3, expected: 4},
+		{requested: 64, expected: 64},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d shards", tt.requested), func(t *testing.T) {
+			cm := NewConcurrentMapWithShards(tt.requested)
+			if len(cm.shards) != tt.expected {
+				t.Errorf("got %d shards, want %d", len(cm.shards), tt.expected)
+			}
+		})
+	}
+}
+
+func TestConcurrentMap_IterableAcrossShards(t *testing.T) {
+	cm := NewConcurrentMap()
+	numKeys := 1000
+
+	for i := 0; i < numKeys; i++ {
+		cm.Set(fmt.Sprintf("key%d", i), i)
+	}
+
+	if cm.Len() != numKeys {
+		t.Fatalf("expected %d keys, got %d", numKeys, cm.Len())
+	}
+
+	seen := make(map[string]bool)
+	for pair := range cm.Iterable() {
+		if seen[pair.Key] {
+			t.Fatalf("key %s yielded twice", pair.Key)
+		}
+		seen[pair.Key] = true
+
+		// Writing while iterating must not deadlock
+		cm.Set(pair.Key, pair.Value)
+	}
+
+	if len(seen) != numKeys {
+		t.Errorf("expected %d keys to be iterated, got %d", numKeys, len(seen))
+	}
+}
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	return keys
+}
+
+// Run with -cpu=1,2,4,8 to observe how throughput scales with GOMAXPROCS
+func BenchmarkConcurrentMap_Set(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	for _, shards := range []int{1, DefaultShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cm := NewConcurrentMapWithShards(shards)
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					cm.Set(keys[i%len(keys)], i)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkConcurrentMap_Get(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	for _, shards := range []int{1, DefaultShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cm := NewConcurrentMapWithShards(shards)
+			for i, key := range keys {
+				cm.Set(key, i)
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					_, _ = cm.Get(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkConcurrentMap_Mixed(b *testing.B) {
+	keys := benchmarkKeys(1024)
+	for _, shards := range []int{1, DefaultShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cm := NewConcurrentMapWithShards(shards)
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					switch i % 4 {
+					case 0:
+						cm.Set(key, i)
+					case 1:
+						_ = cm.Map(key, incrementMapper)
+					default:
+						_, _ = cm.Get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func appendMutator(v interface{}) (interface{}, error) {
+	cl := v.(*ConcurrentList)
+	cl.PushRight(1)
+	return cl.Len(), nil
+}
+
+func listConstructor() interface{} {
+	return NewConcurrentList()
+}
+
+// TestConcurrentMap_MixedWorkload is meant to be run with -race
+func TestConcurrentMap_MixedWorkload(t *testing.T) {
+	cm := NewConcurrentMapWithShards(4)
+	keys := benchmarkKeys(16)
+	numGoroutines := 16
+	numOperations := 500
+
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < numOperations; j++ {
+				key := keys[(i+j)%len(keys)]
+				switch (i + j) % 6 {
+				case 0:
+					cm.Set(key, NewConcurrentList())
+				case 1:
+					// A concurrent Set may have stored a non list value
+					_, _ = cm.Mutate(key, func(v interface{}) (interface{}, error) {
+						if _, ok := v.(*ConcurrentList); !ok {
+							return nil, fmt.Errorf("not a list")
+						}
+						return appendMutator(v)
+					}, listConstructor)
+				case 2:
+					cm.Delete(key)
+				case 3:
+					for pair := range cm.Iterable() {
+						if cl, ok := pair.Value.(*ConcurrentList); ok {
+							_ = cl.Len()
+						}
+					}
+				case 4:
+					_ = cm.Has(key)
+					_, _ = cm.Get(key)
+				case 5:
+					cm.Set(key, j)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestConcurrentMap_MutateThenWrite(t *testing.T) {
+	cm := NewConcurrentMap()
+
+	for i := 0; i < 10; i++ {
+		_, err := cm.Mutate("list", appendMutator, listConstructor)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Writing after Mutate must not deadlock on leaked read locks
+		cm.Set("list", "value")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Set after Mutate deadlocked")
+	}
+
+	value, _ := cm.Get("list")
+	if value != "value" {
+		t.Errorf("expected value to be overwritten, got %v", value)
+	}
+}
+
+func TestConcurrentMap_ConcurrentMutate(t *testing.T) {
+	cm := NewConcurrentMap()
+	numGoroutines := 50
+	numPushes := 100
+
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numPushes; j++ {
+				_, _ = cm.Mutate("list", appendMutator, listConstructor)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _ := cm.Get("list")
+	if value.(*ConcurrentList).Len() != numGoroutines*numPushes {
+		t.Errorf("expected %d elements, got %d", numGoroutines*numPushes, value.(*ConcurrentList).Len())
+	}
+}
+
+func lengthSizer(key string, value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return int64(len(key) + len(v))
+	case *ConcurrentList:
+		return int64(len(key) + v.Len())
+	default:
+		return int64(len(key))
+	}
+}
+
+func TestConcurrentMap_Used(t *testing.T) {
+	cm := NewConcurrentMapWithOptions(MapOptions{Sizer: lengthSizer})
+
+	cm.Set("key", "value")
+	if cm.Used() != 8 {
+		t.Fatalf("expected 8 bytes after Set, got %d", cm.Used())
+	}
+
+	cm.Set("key", "longer value")
+	if cm.Used() != 15 {
+		t.Fatalf("expected 15 bytes after overwrite, got %d", cm.Used())
+	}
+
+	_ = cm.Map("key", func(v interface{}) (interface{}, error) {
+		return "v", nil
+	})
+	if cm.Used() != 4 {
+		t.Fatalf("expected 4 bytes after Map, got %d", cm.Used())
+	}
+
+	for i := 0; i < 3; i++ {
+		_, _ = cm.Mutate("list", appendMutator, listConstructor)
+	}
+	if cm.Used() != 11 {
+		t.Fatalf("expected 11 bytes after Mutate, got %d", cm.Used())
+	}
+
+	cm.Delete("key")
+	cm.Delete("list")
+	if cm.Used() != 0 {
+		t.Fatalf("expected 0 bytes after Delete, got %d", cm.Used())
+	}
+}
+
+func TestConcurrentMap_Clear(t *testing.T) {
+	cm := NewConcurrentMapWithOptions(MapOptions{Sizer: lengthSizer})
+	for _, key := range benchmarkKeys(100) {
+		cm.Set(key, "value")
+	}
+
+	cm.Clear()
+	if cm.Len() != 0 {
+		t.Fatalf("expected no keys after Clear, got %d", cm.Len())
+	}
+	if cm.Used() != 0 {
+		t.Fatalf("expected 0 bytes after Clear, got %d", cm.Used())
+	}
+
+	cm.Set("key", "value")
+	if v, ok := cm.Get("key"); !ok || v != "value" {
+		t.Fatalf("expected the map to be usable after Clear, got %v", v)
+	}
+}
+
+func TestConcurrentMap_Groups(t *testing.T) {
+	cm := NewConcurrentMapWithOptions(MapOptions{
+		Group:  func(key string) int { return len(key) % 2 },
+		Groups: 2,
+	})
+	cm.Set("a", "value")
+	_ = cm.Map("bb", func(v interface{}) (interface{}, error) { return "value", nil })
+	_, _ = cm.Mutate("cc", func(v interface{}) (interface{}, error) { return v, nil }, func() interface{} { return "value" })
+	cm.Set("a", "updated")
+
+	if n := cm.GroupLen(0); n != 2 {
+		t.Fatalf("expected 2 keys in group 0, got %d", n)
+	}
+	if keys := cm.GroupKeys(1, 10); len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("expected [a] in group 1, got %v", keys)
+	}
+	if keys := cm.GroupKeys(0, 1); len(keys) != 1 {
+		t.Fatalf("expected 1 key with count 1, got %v", keys)
+	}
+
+	cm.Delete("bb")
+	cm.Delete("missing")
+	if n := cm.GroupLen(0); n != 1 {
+		t.Fatalf("expected 1 key in group 0 after Delete, got %d", n)
+	}
+	cm.Clear()
+	if n := cm.GroupLen(0) + cm.GroupLen(1); n != 0 {
+		t.Fatalf("expected no keys after Clear, got %d", n)
+	}
+
+	ungrouped := NewConcurrentMap()
+	ungrouped.Set("a", "value")
+	if n := ungrouped.GroupLen(0); n != 0 {
+		t.Fatalf("expected no groups, got %d keys", n)
+	}
+}
+
+func TestConcurrentMap_UsedWithConcurrentDeletes(t *testing.T) {
+	cm := NewConcurrentMapWithOptions(MapOptions{Sizer: lengthSizer})
+	keys := benchmarkKeys(8)
+
+	var wg sync.WaitGroup
+	wg.Add(8)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := keys[(i+j)%len(keys)]
+				if j%3 == 0 {
+					cm.Delete(key)
+				} else {
+					cm.Set(key, "value")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var expected int64
+	for pair := range cm.Iterable() {
+		expected += lengthSizer(pair.Key, pair.Value)
+	}
+	if cm.Used() != expected {
+		t.Errorf("expected %d bytes to be accounted, got %d", expected, cm.Used())
+	}
+}
+
+func TestConcurrentMap_Sample(t *testing.T) {
+	cm := NewConcurrentMap()
+	if len(cm.Sample(5)) != 0 {
+		t.Fatal("expected no samples from an empty map")
+	}
+
+	for _, key := range benchmarkKeys(3) {
+		cm.Set(key, "value")
+	}
+
+	samples := cm.Sample(5)
+	if len(samples) != 3 {
+		t.Fatalf("expected every key to be sampled, got %d samples", len(samples))
+	}
+
+	for _, sample := range samples {
+		if sample.Frequency != LFUInitVal {
+			t.Errorf("expected new keys to have frequency %d, got %d", LFUInitVal, sample.Frequency)
+		}
+		if sample.LastAccess == 0 {
+			t.Errorf("expected key %s to have an access time", sample.Key)
+		}
+	}
+}
+
+func TestAccess_Frequency(t *testing.T) {
+	var a access
+	now := time.Now()
+	a.init(now)
+
+	for i := 0; i < 1000; i++ {
+		a.touch(now)
+	}
+
+	counter := a.frequency(lfuMinutes(now))
+	if counter <= LFUInitVal {
+		t.Fatalf("expected counter to grow past %d, got %d", LFUInitVal, counter)
+	}
+
+	decayed := a.frequency(lfuMinutes(now.Add(2 * time.Minute)))
+	if decayed != counter-2 {
+		t.Errorf("expected counter to decay to %d after two minutes, got %d", counter-2, decayed)
+	}
+}
+
+func TestConcurrentMap_Scan(t *testing.T) {
+	cm := NewConcurrentMap()
+	numKeys := 1000
+	for i := 0; i < numKeys; i++ {
+		cm.Set(fmt.Sprintf("key%d", i), i)
+	}
+
+	seen := make(map[string]int)
+	cursor, calls := 0, 0
+	for {
+		var keys []string
+		keys, cursor = cm.Scan(cursor, 10)
+		calls++
+		for _, k := range keys {
+			seen[k]++
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if len(seen) != numKeys {
+		t.Errorf("got %d keys, want %d", len(seen), numKeys)
+	}
+	for k, n := range seen {
+		if n != 1 {
+			t.Errorf("key %s returned %d times", k, n)
+		}
+	}
+	if calls < 2 {
+		t.Errorf("expected the scan to take several calls, took %d", calls)
+	}
+}
+
+func TestConcurrentMap_SetIf(t *testing.T) {
+	cm := NewConcurrentMap()
+	missing := func(exists bool) bool { return !exists }
+
+	var wg sync.WaitGroup
+	var stored atomic.Int64
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if cm.SetIf("key", i, missing) {
+				stored.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stored.Load() != 1 {
+		t.Errorf("expected a single store of a missing key, got %d", stored.Load())
+	}
+	if cm.SetIf("other", 1, func(exists bool) bool { return exists }) {
+		t.Error("expected a missing key not to be stored")
+	}
+	if !cm.SetIf("key", -1, func(exists bool) bool { return exists }) {
+		t.Error("expected an existing key to be stored")
+	}
+	if v, _ := cm.Get("key"); v != -1 {
+		t.Errorf("expected -1, got %v", v)
+	}
+}
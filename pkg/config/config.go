@@ -0,0 +1,412 @@
+// Package config holds the server configuration. Values are read from a
+// redis.conf style file, overridden by command line flags, and some of them
+// can be changed at runtime with CONFIG SET.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/glob"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var UnknownParameter = errors.New("unknown parameter")
+
+var ImmutableParameter = errors.New("can't set immutable config")
+
+var InvalidArgument = errors.New("argument couldn't be parsed into an integer")
+
+var InvalidBool = errors.New("argument must be 'yes' or 'no'")
+
+var NoConfigFile = errors.New("the server is running without a config file")
+
+// Kind is the type of the value of a parameter, used for validation
+type Kind uint8
+
+const (
+	KindString Kind = iota
+	KindInt
+	KindBool
+	KindMemory
+	// KindClientOutputBufferLimit values only change the classes they include
+	KindClientOutputBufferLimit
+)
+
+// Parameter names, they match the redis.conf directives when there is an equivalent
+const (
+	Port                     = "port"
+	Threads                  = "threads"
+	DBFilename               = "dbfilename"
+	Reload                   = "reload"
+	Global                   = "global"
+	MaxMemory                = "maxmemory"
+	MaxMemoryPolicy          = "maxmemory-policy"
+	MaxMemorySamples         = "maxmemory-samples"
+	Save                     = "save"
+	RequirePass              = "requirepass"
+	ACLFile                  = "aclfile"
+	Bind                     = "bind"
+	UnixSocket               = "unixsocket"
+	UnixSocketPerm           = "unixsocketperm"
+	ProtectedMode            = "protected-mode"
+	MaxClients               = "maxclients"
+	Timeout                  = "timeout"
+	TCPKeepAlive             = "tcp-keepalive"
+	ClientOutputBufferLimits = "client-output-buffer-limit"
+	ReplicaOf                = "replicaof"
+	MasterAuth               = "masterauth"
+	MasterUser               = "masteruser"
+	ReplicaReadOnly          = "replica-read-only"
+	ReplBacklogSize          = "repl-backlog-size"
+	ReplTimeout              = "repl-timeout"
+	ReplPingReplicaPeriod    = "repl-ping-replica-period"
+	ClusterEnabled           = "cluster-enabled"
+	ClusterConfigFile        = "cluster-config-file"
+	ClusterNodeTimeout       = "cluster-node-timeout"
+	ClusterAnnounceIP        = "cluster-announce-ip"
+	BusyReplyThreshold       = "busy-reply-threshold"
+	SlowlogLogSlowerThan     = "slowlog-log-slower-than"
+	SlowlogMaxLen            = "slowlog-max-len"
+	LatencyMonitorThreshold  = "latency-monitor-threshold"
+	AdminAddr                = "admin-addr"
+	AdminPprof               = "admin-pprof"
+	TLSPort                  = "tls-port"
+	TLSCertFile              = "tls-cert-file"
+	TLSKeyFile               = "tls-key-file"
+	TLSCACertFile            = "tls-ca-cert-file"
+	TLSAuthClients           = "tls-auth-clients"
+	TLSClientsUser           = "tls-auth-clients-user"
+)
+
+// sensitiveParameters hold secrets, their values are redacted from the
+// slow log and the monitors, like the SENSITIVE_CONFIG parameters of Redis
+var sensitiveParameters = map[string]bool{
+	RequirePass: true,
+	MasterAuth:  true,
+}
+
+// Sensitive reports whether the value of the parameter is a secret
+func Sensitive(name string) bool {
+	return sensitiveParameters[strings.ToLower(name)]
+}
+
+// DefaultSave are the save rules of Redis: after an hour with a change,
+// 5 minutes with 100 changes or a minute with 10000 changes. They also
+// make shutdowns and SIGTERM save the dataset.
+const DefaultSave = "3600 1 300 100 60 10000"
+
+type parameter struct {
+	name         string
+	kind         Kind
+	value        string
+	defaultValue string
+	// mutable parameters can be changed with CONFIG SET
+	mutable bool
+	// multiArg parameters take several arguments on a single line, like save
+	multiArg bool
+	onChange []func(value string) error
+}
+
+type Config struct {
+	lock       sync.RWMutex
+	parameters map[string]*parameter
+	file       string
+	// setLock serializes runtime changes, so OnChange functions run one at a time
+	setLock sync.Mutex
+}
+
+// New returns a configuration with the defaults of every parameter
+func New() *Config {
+	c := &Config{parameters: make(map[string]*parameter)}
+	c.Define(Port, "3000", KindInt, false)
+	c.Define(Threads, "1", KindInt, false)
+	c.Define(DBFilename, "memory.resp", KindString, false)
+	c.Define(Reload, "yes", KindBool, false)
+	c.Define(Global, "no", KindBool, false)
+	c.Define(MaxMemory, "0", KindMemory, true)
+	c.Define(MaxMemoryPolicy, "noeviction", KindString, true)
+	c.Define(MaxMemorySamples, "5", KindInt, true)
+	c.Define(Save, DefaultSave, KindString, true)
+	c.parameters[Save].multiArg = true
+	c.Define(RequirePass, "", KindString, true)
+	c.Define(ACLFile, "", KindString, false)
+	c.Define(Bind, "", KindString, false)
+	c.parameters[Bind].multiArg = true
+	c.Define(UnixSocket, "", KindString, false)
+	c.Define(UnixSocketPerm, "0", KindString, false)
+	c.Define(ProtectedMode, "yes", KindBool, true)
+	c.Define(MaxClients, "10000", KindInt, true)
+	c.Define(Timeout, "0", KindInt, true)
+	c.Define(TCPKeepAlive, "300", KindInt, true)
+	c.Define(ClientOutputBufferLimits, DefaultClientOutputBufferLimits, KindClientOutputBufferLimit, true)
+	c.parameters[ClientOutputBufferLimits].multiArg = true
+	c.Define(ReplicaOf, "", KindString, false)
+	c.parameters[ReplicaOf].multiArg = true
+	c.Define(MasterAuth, "", KindString, true)
+	c.Define(MasterUser, "", KindString, true)
+	c.Define(ReplicaReadOnly, "yes", KindBool, true)
+	c.Define(ReplBacklogSize, "1mb", KindMemory, true)
+	c.Define(ReplTimeout, "60", KindInt, true)
+	c.Define(ReplPingReplicaPeriod, "10", KindInt, true)
+	c.Define(ClusterEnabled, "no", KindBool, false)
+	c.Define(ClusterConfigFile, "nodes.conf", KindString, false)
+	c.Define(ClusterNodeTimeout, "15000", KindInt, true)
+	c.Define(ClusterAnnounceIP, "", KindString, true)
+	c.Define(BusyReplyThreshold, "5000", KindInt, true)
+	c.Define(SlowlogLogSlowerThan, "10000", KindInt, true)
+	c.Define(SlowlogMaxLen, "128", KindInt, true)
+	c.Define(LatencyMonitorThreshold, "0", KindInt, true)
+	c.Define(AdminAddr, "", KindString, false)
+	c.Define(AdminPprof, "no", KindBool, false)
+	c.Define(TLSPort, "0", KindInt, false)
+	c.Define(TLSCertFile, "", KindString, false)
+	c.Define(TLSKeyFile, "", KindString, false)
+	c.Define(TLSCACertFile, "", KindString, false)
+	c.Define(TLSAuthClients, "yes", KindString, false)
+	c.Define(TLSClientsUser, "off", KindString, false)
+	return c
+}
+
+// Define adds a parameter, redefining a parameter resets it to its default
+func (c *Config) Define(name, defaultValue string, kind Kind, mutable bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.parameters[name] = &parameter{
+		name:         name,
+		kind:         kind,
+		value:        defaultValue,
+		defaultValue: defaultValue,
+		mutable:      mutable,
+	}
+}
+
+// OnChange registers a function called when CONFIG SET changes the
+// parameter. When it returns an error the change is rejected.
+func (c *Config) OnChange(name string, fn func(value string) error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if p, ok := c.parameters[name]; ok {
+		p.onChange = append(p.onChange, fn)
+	}
+}
+
+// LoadFile reads the parameters from a redis.conf style file, the file is
+// remembered for CONFIG REWRITE
+func (c *Config) LoadFile(file string) error {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	directives, err := Parse(f)
+	if err != nil {
+		return err
+	}
+
+	// Multi argument parameters accumulate their lines, like "save" in Redis
+	accumulated := make(map[string][]string)
+	for _, directive := range directives {
+		p, ok := c.parameter(directive.Name)
+		if !ok {
+			return fmt.Errorf("line %d: %w '%s'", directive.Line, UnknownParameter, directive.Name)
+		}
+
+		if p.multiArg {
+			accumulated[p.name] = append(accumulated[p.name], directive.Args...)
+			continue
+		}
+
+		if len(directive.Args) != 1 {
+			return fmt.Errorf("line %d: wrong number of arguments for '%s'", directive.Line, directive.Name)
+		}
+
+		if err = c.Override(p.name, directive.Args[0]); err != nil {
+			return fmt.Errorf("line %d: %w", directive.Line, err)
+		}
+	}
+
+	for name, args := range accumulated {
+		if err = c.Override(name, strings.Join(args, " ")); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	c.file = file
+	c.lock.Unlock()
+
+	return nil
+}
+
+func (c *Config) parameter(name string) (*parameter, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	p, ok := c.parameters[strings.ToLower(name)]
+	return p, ok
+}
+
+// Override sets a parameter at startup, it doesn't check if it is mutable
+// and doesn't call the OnChange functions
+func (c *Config) Override(name, value string) error {
+	p, ok := c.parameter(name)
+	if !ok {
+		return fmt.Errorf("%w '%s'", UnknownParameter, name)
+	}
+
+	value, err := normalize(p, value)
+	if err != nil {
+		return fmt.Errorf("%w '%s'", err, name)
+	}
+
+	c.lock.Lock()
+	p.value = value
+	c.lock.Unlock()
+	return nil
+}
+
+func normalize(p *parameter, value string) (string, error) {
+	switch p.kind {
+	case KindInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", InvalidArgument
+		}
+	case KindMemory:
+		if _, err := ParseMemory(value); err != nil {
+			return "", InvalidArgument
+		}
+	case KindBool:
+		switch strings.ToLower(value) {
+		case "yes", "true":
+			return "yes", nil
+		case "no", "false":
+			return "no", nil
+		default:
+			return "", InvalidBool
+		}
+	case KindClientOutputBufferLimit:
+		return mergeClientOutputBufferLimits(p.value, value)
+	}
+	return value, nil
+}
+
+// Set changes a mutable parameter at runtime, like CONFIG SET
+func (c *Config) Set(name, value string) error {
+	c.setLock.Lock()
+	defer c.setLock.Unlock()
+	return c.set(name, value)
+}
+
+func (c *Config) set(name, value string) error {
+	p, ok := c.parameter(name)
+	if !ok {
+		return fmt.Errorf("%w '%s'", UnknownParameter, name)
+	}
+
+	if !p.mutable {
+		return fmt.Errorf("%w '%s'", ImmutableParameter, name)
+	}
+
+	value, err := normalize(p, value)
+	if err != nil {
+		return fmt.Errorf("%w '%s'", err, name)
+	}
+
+	c.lock.RLock()
+	onChange := p.onChange
+	c.lock.RUnlock()
+
+	for _, fn := range onChange {
+		if err = fn(value); err != nil {
+			return fmt.Errorf("%w '%s'", err, name)
+		}
+	}
+
+	c.lock.Lock()
+	p.value = value
+	c.lock.Unlock()
+	return nil
+}
+
+// SetMany sets every pair or none of them, previous values are restored when one fails
+func (c *Config) SetMany(pairs [][2]string) error {
+	c.setLock.Lock()
+	defer c.setLock.Unlock()
+
+	previous := make([][2]string, 0, len(pairs))
+	for _, pair := range pairs {
+		old, _ := c.Get(pair[0])
+		if err := c.set(pair[0], pair[1]); err != nil {
+			for i := len(previous) - 1; i >= 0; i-- {
+				_ = c.set(previous[i][0], previous[i][1])
+			}
+			return err
+		}
+		previous = append(previous, [2]string{pair[0], old})
+	}
+	return nil
+}
+
+func (c *Config) Get(name string) (string, bool) {
+	p, ok := c.parameter(name)
+	if !ok {
+		return "", false
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return p.value, true
+}
+
+func (c *Config) GetString(name string) string {
+	value, _ := c.Get(name)
+	return value
+}
+
+func (c *Config) GetInt(name string) int64 {
+	value, _ := c.Get(name)
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
+func (c *Config) GetBool(name string) bool {
+	value, _ := c.Get(name)
+	return value == "yes"
+}
+
+func (c *Config) GetMemory(name string) int64 {
+	value, _ := c.Get(name)
+	n, _ := ParseMemory(value)
+	return n
+}
+
+// Match returns the name and value of the parameters matching the glob
+// pattern, sorted by name
+func (c *Config) Match(pattern string) [][2]string {
+	pattern = strings.ToLower(pattern)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	matches := make([][2]string, 0)
+	for name, p := range c.parameters {
+		if glob.Match(pattern, name) {
+			matches = append(matches, [2]string{name, p.value})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i][0] < matches[j][0]
+	})
+	return matches
+}
+
+// File returns the path of the loaded configuration file, empty if there is none
+func (c *Config) File() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.file
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfig_LoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		assert  func(t *testing.T, cfg *Config)
+		wantErr error
+	}{
+		{
+			name:    "Values and defaults",
+			content: "port 7000\nmaxmemory 1mb\nreload no\n",
+			assert: func(t *testing.T, cfg *Config) {
+				if cfg.GetInt(Port) != 7000 {
+					t.Errorf("expected port 7000, got %d", cfg.GetInt(Port))
+				}
+				if cfg.GetMemory(MaxMemory) != 1024*1024 {
+					t.Errorf("expected maxmemory 1mb, got %d", cfg.GetMemory(MaxMemory))
+				}
+				if cfg.GetBool(Reload) {
+					t.Error("expected reload to be disabled")
+				}
+				if cfg.GetString(MaxMemoryPolicy) != "noeviction" {
+					t.Errorf("expected default policy, got %s", cfg.GetString(MaxMemoryPolicy))
+				}
+			},
+		},
+		{
+			name:    "Save lines accumulate",
+			content: "save 900 1\nsave 300 10\n",
+			assert: func(t *testing.T, cfg *Config) {
+				if cfg.GetString(Save) != "900 1 300 10" {
+					t.Errorf("unexpected save %q", cfg.GetString(Save))
+				}
+			},
+		},
+		{
+			name:    "Unknown directive",
+			content: "port 7000\nunknown yes\n",
+			wantErr: UnknownParameter,
+		},
+		{
+			name:    "Invalid integer",
+			content: "port abc\n",
+			wantErr: InvalidArgument,
+		},
+		{
+			name:    "Invalid bool",
+			content: "global maybe\n",
+			wantErr: InvalidBool,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := New()
+			err := cfg.LoadFile(writeConfigFile(t, tt.content))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("LoadFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.assert != nil {
+				tt.assert(t, cfg)
+			}
+		})
+	}
+}
+
+func TestConfig_Set(t *testing.T) {
+	cfg := New()
+	var applied []string
+	cfg.OnChange(MaxMemoryPolicy, func(value string) error {
+		if value == "invalid" {
+			return errors.New("invalid policy")
+		}
+		applied = append(applied, value)
+		return nil
+	})
+
+	if err := cfg.Set(Port, "7000"); !errors.Is(err, ImmutableParameter) {
+		t.Errorf("expected port to be immutable, got %v", err)
+	}
+	if err := cfg.Set("unknown", "1"); !errors.Is(err, UnknownParameter) {
+		t.Errorf("expected unknown parameter, got %v", err)
+	}
+	if err := cfg.Set(MaxMemoryPolicy, "allkeys-lru"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Set(MaxMemoryPolicy, "invalid"); err == nil {
+		t.Error("expected OnChange error to reject the value")
+	}
+
+	if cfg.GetString(MaxMemoryPolicy) != "allkeys-lru" {
+		t.Errorf("expected rejected values to be discarded, got %s", cfg.GetString(MaxMemoryPolicy))
+	}
+	if !reflect.DeepEqual(applied, []string{"allkeys-lru"}) {
+		t.Errorf("unexpected applied values %v", applied)
+	}
+}
+
+func TestConfig_SetMany(t *testing.T) {
+	cfg := New()
+	err := cfg.SetMany([][2]string{
+		{MaxMemory, "100"},
+		{MaxMemorySamples, "not a number"},
+	})
+	if !errors.Is(err, InvalidArgument) {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+	if cfg.GetString(MaxMemory) != "0" {
+		t.Errorf("expected maxmemory to be restored, got %s", cfg.GetString(MaxMemory))
+	}
+}
+
+func TestConfig_Match(t *testing.T) {
+	cfg := New()
+	got := cfg.Match("MAXMEMORY*")
+	want := [][2]string{
+		{MaxMemory, "0"},
+		{MaxMemoryPolicy, "noeviction"},
+		{MaxMemorySamples, "5"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Match() got = %v, want %v", got, want)
+	}
+
+	if len(cfg.Match("*")) != len(cfg.parameters) {
+		t.Error("expected * to match every parameter")
+	}
+
+	// Unclosed brackets match like Redis, instead of failing like path.Match
+	if got := cfg.Match("maxclient[s"); len(got) != 1 || got[0][0] != MaxClients {
+		t.Errorf("expected maxclients, got %v", got)
+	}
+}
+
+func TestConfig_Rewrite(t *testing.T) {
+	content := strings.Join([]string{
+		"# Server port",
+		"port 7000",
+		"",
+		"maxmemory 1mb",
+		"# Save rules",
+		"save 900 1",
+		"save 300 10",
+		"",
+	}, "\n")
+	file := writeConfigFile(t, content)
+
+	cfg := New()
+	if err := cfg.LoadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SetMany([][2]string{
+		{MaxMemory, "2mb"},
+		{Save, "60 1000"},
+		{MaxMemoryPolicy, "allkeys-lru"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"# Server port",
+		"port 7000",
+		"",
+		"maxmemory 2mb",
+		"# Save rules",
+		"save 60 1000",
+		rewriteSignature,
+		"maxmemory-policy allkeys-lru",
+		"",
+	}, "\n")
+	if string(data) != want {
+		t.Errorf("Rewrite() got:\n%s\nwant:\n%s", data, want)
+	}
+
+	// Rewriting again is stable and the file loads back
+	if err = cfg.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := New()
+	if err = reloaded.LoadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.GetString(MaxMemoryPolicy) != "allkeys-lru" || reloaded.GetString(Save) != "60 1000" {
+		t.Errorf("unexpected reloaded values %s, %s", reloaded.GetString(MaxMemoryPolicy), reloaded.GetString(Save))
+	}
+}
+
+func TestConfig_RewriteWithoutFile(t *testing.T) {
+	if err := New().Rewrite(); !errors.Is(err, NoConfigFile) {
+		t.Errorf("expected no config file error, got %v", err)
+	}
+}
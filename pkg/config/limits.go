@@ -0,0 +1,97 @@
+package config
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var InvalidClientOutputBufferLimit = errors.New("invalid client output buffer limit")
+
+// Client classes of client-output-buffer-limit
+const (
+	ClassNormal  = "normal"
+	ClassReplica = "replica"
+	ClassPubSub  = "pubsub"
+)
+
+// DefaultClientOutputBufferLimits are the defaults of Redis, "normal 0 0 0
+// replica 256mb 64mb 60 pubsub 32mb 8mb 60" in bytes
+const DefaultClientOutputBufferLimits = "normal 0 0 0 replica 268435456 67108864 60 pubsub 33554432 8388608 60"
+
+// ClientOutputBufferLimit disconnects the clients of a class when their
+// pending output exceeds Hard, or exceeds Soft for SoftSeconds. Zero
+// disables a limit.
+type ClientOutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int64
+}
+
+// ParseClientOutputBufferLimits parses groups of "<class> <hard> <soft> <soft seconds>",
+// like "pubsub 32mb 8mb 60". The slave class is an alias of replica.
+func ParseClientOutputBufferLimits(value string) (map[string]ClientOutputBufferLimit, error) {
+	fields := strings.Fields(value)
+	if len(fields)%4 != 0 {
+		return nil, InvalidClientOutputBufferLimit
+	}
+
+	limits := make(map[string]ClientOutputBufferLimit, len(fields)/4)
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "slave" {
+			class = ClassReplica
+		}
+		if class != ClassNormal && class != ClassReplica && class != ClassPubSub {
+			return nil, InvalidClientOutputBufferLimit
+		}
+
+		hard, err := ParseMemory(fields[i+1])
+		if err != nil {
+			return nil, InvalidClientOutputBufferLimit
+		}
+		soft, err := ParseMemory(fields[i+2])
+		if err != nil {
+			return nil, InvalidClientOutputBufferLimit
+		}
+		seconds, err := strconv.ParseInt(fields[i+3], 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, InvalidClientOutputBufferLimit
+		}
+
+		limits[class] = ClientOutputBufferLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+	}
+	return limits, nil
+}
+
+// FormatClientOutputBufferLimits formats the limits of every class in bytes
+func FormatClientOutputBufferLimits(limits map[string]ClientOutputBufferLimit) string {
+	fields := make([]string, 0, 12)
+	for _, class := range []string{ClassNormal, ClassReplica, ClassPubSub} {
+		limit := limits[class]
+		fields = append(fields,
+			class,
+			strconv.FormatInt(limit.Hard, 10),
+			strconv.FormatInt(limit.Soft, 10),
+			strconv.FormatInt(limit.SoftSeconds, 10),
+		)
+	}
+	return strings.Join(fields, " ")
+}
+
+// mergeClientOutputBufferLimits applies the classes in value to the current
+// limits, like CONFIG SET client-output-buffer-limit does
+func mergeClientOutputBufferLimits(current, value string) (string, error) {
+	limits, err := ParseClientOutputBufferLimits(current)
+	if err != nil {
+		return "", err
+	}
+	changes, err := ParseClientOutputBufferLimits(value)
+	if err != nil {
+		return "", err
+	}
+	for class, limit := range changes {
+		limits[class] = limit
+	}
+	return FormatClientOutputBufferLimits(limits), nil
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseClientOutputBufferLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]ClientOutputBufferLimit
+		wantErr error
+	}{
+		{
+			name:  "Memory units",
+			value: "pubsub 32mb 8mb 60",
+			want:  map[string]ClientOutputBufferLimit{ClassPubSub: {Hard: 32 << 20, Soft: 8 << 20, SoftSeconds: 60}},
+		},
+		{
+			name:  "Slave is replica",
+			value: "slave 1024 0 0",
+			want:  map[string]ClientOutputBufferLimit{ClassReplica: {Hard: 1024}},
+		},
+		{
+			name:    "Unknown class",
+			value:   "master 0 0 0",
+			wantErr: InvalidClientOutputBufferLimit,
+		},
+		{
+			name:    "Missing arguments",
+			value:   "normal 0 0",
+			wantErr: InvalidClientOutputBufferLimit,
+		},
+		{
+			name:    "Negative seconds",
+			value:   "normal 0 0 -1",
+			wantErr: InvalidClientOutputBufferLimit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClientOutputBufferLimits(tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseClientOutputBufferLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseClientOutputBufferLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_SetClientOutputBufferLimits(t *testing.T) {
+	cfg := New()
+	if err := cfg.Set(ClientOutputBufferLimits, "normal 1mb 512kb 10"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "normal 1048576 524288 10 replica 268435456 67108864 60 pubsub 33554432 8388608 60"
+	if got := cfg.GetString(ClientOutputBufferLimits); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	if err := cfg.Set(ClientOutputBufferLimits, "normal 0"); !errors.Is(err, InvalidClientOutputBufferLimit) {
+		t.Errorf("expected invalid limit error, got %v", err)
+	}
+	if got := cfg.GetString(ClientOutputBufferLimits); got != want {
+		t.Errorf("expected the limits to be kept, got %q", got)
+	}
+}
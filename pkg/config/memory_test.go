@@ -0,0 +1,35 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected int64
+		wantErr  bool
+	}{
+		{size: "0", expected: 0},
+		{size: "100", expected: 100},
+		{size: "1k", expected: 1000},
+		{size: "1kb", expected: 1024},
+		{size: "2mb", expected: 2 * 1024 * 1024},
+		{size: "1GB", expected: 1024 * 1024 * 1024},
+		{size: "1g", expected: 1000 * 1000 * 1000},
+		{size: "-1", wantErr: true},
+		{size: "ten", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := ParseMemory(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMemory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseMemory() got = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+}
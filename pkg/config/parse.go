@@ -0,0 +1,153 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var UnbalancedQuotes = errors.New("unbalanced quotes in configuration line")
+
+// Directive is a configuration line, like "save 900 1" with name "save" and args ["900", "1"]
+type Directive struct {
+	Name string
+	Args []string
+	// Line is the line number in the file, starting at 1
+	Line int
+}
+
+// Parse reads directives in the redis.conf format. Empty lines and lines
+// starting with # are skipped, names are case insensitive.
+func Parse(reader io.Reader) ([]Directive, error) {
+	directives := make([]Directive, 0)
+	scanner := bufio.NewScanner(reader)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		args, err := SplitArgs(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		directives = append(directives, Directive{
+			Name: strings.ToLower(args[0]),
+			Args: args[1:],
+			Line: line,
+		})
+	}
+
+	return directives, scanner.Err()
+}
+
+// SplitArgs splits a line in arguments like sdssplitargs in Redis. Arguments
+// may be double quoted, supporting escapes like \n and \xHH, or single quoted.
+func SplitArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	i := 0
+
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		current := strings.Builder{}
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i == len(line) {
+					return nil, UnbalancedQuotes
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' {
+					if b, err := strconv.ParseUint(line[i+2:i+4], 16, 8); err == nil {
+						current.WriteByte(byte(b))
+						i += 4
+						continue
+					}
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					current.WriteByte(unescape(line[i]))
+				} else {
+					current.WriteByte(c)
+				}
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, UnbalancedQuotes
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				current.WriteByte(c)
+				i++
+			}
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				current.WriteByte(line[i])
+				i++
+			}
+			args = append(args, current.String())
+			continue
+		}
+
+		// A closing quote must be followed by a space or the end of the line
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, UnbalancedQuotes
+		}
+		args = append(args, current.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return c
+	}
+}
+
+// quote returns the argument as it must be written in a configuration file
+func quote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n\"'\\") {
+		return arg
+	}
+	return strconv.Quote(arg)
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr error
+	}{
+		{name: "Plain arguments", line: "save 900 1", want: []string{"save", "900", "1"}},
+		{name: "Extra spaces", line: "  port \t 3000  ", want: []string{"port", "3000"}},
+		{name: "Double quotes", line: `dbfilename "my file.resp"`, want: []string{"dbfilename", "my file.resp"}},
+		{name: "Empty double quotes", line: `save ""`, want: []string{"save", ""}},
+		{name: "Escapes", line: `name "a\tb\x41\"c"`, want: []string{"name", "a\tbA\"c"}},
+		{name: "Single quotes", line: `name 'it\'s'`, want: []string{"name", "it's"}},
+		{name: "Unbalanced quotes", line: `name "value`, wantErr: UnbalancedQuotes},
+		{name: "Text after quotes", line: `name "value"x`, wantErr: UnbalancedQuotes},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitArgs(tt.line)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SplitArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitArgs() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := "# comment\n\nPORT 7000\n  save 900 1\n"
+	directives, err := Parse(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Directive{
+		{Name: "port", Args: []string{"7000"}, Line: 3},
+		{Name: "save", Args: []string{"900", "1"}, Line: 4},
+	}
+	if !reflect.DeepEqual(directives, want) {
+		t.Errorf("Parse() got = %v, want %v", directives, want)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, arg := range []string{"value", "", "with space", `with "quotes"`, "new\nline"} {
+		args, err := SplitArgs("name " + quote(arg))
+		if err != nil || len(args) != 2 || args[1] != arg {
+			t.Errorf("quote(%q) does not round trip, got %q, error %v", arg, args, err)
+		}
+	}
+}
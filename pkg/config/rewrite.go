@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const rewriteSignature = "# Generated by CONFIG REWRITE"
+
+// Rewrite persists the current values to the configuration file like CONFIG
+// REWRITE. Comments and the order of the lines are kept, each parameter is
+// written once, and parameters that differ from their defaults but were not
+// in the file are appended at the end.
+func (c *Config) Rewrite() error {
+	file := c.File()
+	if file == "" {
+		return NoConfigFile
+	}
+
+	lines, err := readLines(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c.lock.RLock()
+	written := make(map[string]bool)
+	output := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == rewriteSignature {
+			continue
+		}
+		if trimmed == "" || trimmed[0] == '#' {
+			output = append(output, line)
+			continue
+		}
+
+		args, err := SplitArgs(trimmed)
+		name := ""
+		if err == nil && len(args) > 0 {
+			name = strings.ToLower(args[0])
+		}
+
+		p, ok := c.parameters[name]
+		if !ok {
+			output = append(output, line)
+			continue
+		}
+
+		if !written[name] {
+			output = append(output, p.line())
+			written[name] = true
+		}
+	}
+
+	appended := false
+	for _, name := range sortedNames(c.parameters) {
+		p := c.parameters[name]
+		if written[name] || p.value == p.defaultValue {
+			continue
+		}
+		if !appended {
+			output = append(output, rewriteSignature)
+			appended = true
+		}
+		output = append(output, p.line())
+	}
+	c.lock.RUnlock()
+
+	return writeLines(file, output)
+}
+
+// line formats the parameter as a configuration line
+func (p *parameter) line() string {
+	if p.multiArg && p.value != "" {
+		return p.name + " " + p.value
+	}
+	return p.name + " " + quote(p.value)
+}
+
+func sortedNames(parameters map[string]*parameter) []string {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// writeLines replaces the file atomically by renaming a temporary file
+func writeLines(file string, lines []string) error {
+	temp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	for _, line := range lines {
+		_, _ = writer.WriteString(line)
+		_ = writer.WriteByte('\n')
+	}
+
+	if err = writer.Flush(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), file)
+}
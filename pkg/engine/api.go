@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"context"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+)
+
+// The methods below are a typed API for embedding the engine in Go
+// programs. They build the commands and run them with Process, so they are
+// counted, replicated and persisted like the commands of the clients. They
+// must not be called from the handlers of the extensions, which already
+// hold the write lock.
+
+// SetOptions are the conditions of Set
+type SetOptions struct {
+	// NX only sets the key when it does not exist
+	NX bool
+	// XX only sets the key when it exists
+	XX bool
+}
+
+// Do runs a command given as its name and arguments, it is the typed API
+// for the commands without a method of their own
+func (e *Engine) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return e.Process(args)
+}
+
+// Ping checks that the engine runs commands
+func (e *Engine) Ping(ctx context.Context) error {
+	_, err := e.Do(ctx, PING)
+	return err
+}
+
+// Get returns the string stored under the key and whether it exists, keys
+// holding other types fail with WrongType
+func (e *Engine) Get(ctx context.Context, key string) (string, bool, error) {
+	res, err := e.Do(ctx, GET, key)
+	if err != nil || res == nil {
+		return "", false, err
+	}
+	str, ok := res.(*values.String)
+	if !ok {
+		return "", false, WrongType
+	}
+	return str.String(), true, nil
+}
+
+// Set stores the string under the key and reports whether it was set,
+// which is always the case without NX and XX
+func (e *Engine) Set(ctx context.Context, key, val string, opts SetOptions) (bool, error) {
+	args := []interface{}{SET, key, val}
+	if opts.NX {
+		args = append(args, "NX")
+	}
+	if opts.XX {
+		args = append(args, "XX")
+	}
+	res, err := e.Do(ctx, args...)
+	return res != nil, err
+}
+
+// Del removes the keys
+func (e *Engine) Del(ctx context.Context, keys ...string) error {
+	_, err := e.Do(ctx, withKeys(DEL, keys)...)
+	return err
+}
+
+// Incr adds one to the integer stored under the key, missing keys count
+// as zero
+func (e *Engine) Incr(ctx context.Context, key string) error {
+	_, err := e.Do(ctx, INCR, key)
+	return err
+}
+
+// Decr subtracts one from the integer stored under the key
+func (e *Engine) Decr(ctx context.Context, key string) error {
+	_, err := e.Do(ctx, DECR, key)
+	return err
+}
+
+// LPush inserts the values at the head of the list and returns its length
+func (e *Engine) LPush(ctx context.Context, key string, vals ...string) (int64, error) {
+	return e.push(ctx, LPUSH, key, vals)
+}
+
+// RPush appends the values to the list and returns its length
+func (e *Engine) RPush(ctx context.Context, key string, vals ...string) (int64, error) {
+	return e.push(ctx, RPUSH, key, vals)
+}
+
+func (e *Engine) push(ctx context.Context, name, key string, vals []string) (int64, error) {
+	if len(vals) == 0 {
+		return 0, WrongNumberOfArguments
+	}
+	res, err := e.Do(ctx, withKeys(name, append([]string{key}, vals...))...)
+	if err != nil {
+		return 0, err
+	}
+	return toInt64(res)
+}
+
+// withKeys returns the command with the name and the string arguments
+func withKeys(name string, args []string) []interface{} {
+	command := make([]interface{}, 0, len(args)+1)
+	command = append(command, name)
+	for _, arg := range args {
+		command = append(command, arg)
+	}
+	return command
+}
+
+// toInt64 converts an integer reply
+func toInt64(res interface{}) (int64, error) {
+	switch n := res.(type) {
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	default:
+		return 0, UnsupportedTypeForCommand
+	}
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEngine_typedAPI(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	ctx := context.Background()
+
+	if err := eng.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if set, err := eng.Set(ctx, "key", "value", SetOptions{}); err != nil || !set {
+		t.Fatalf("expected the key to be set, got %v, error %v", set, err)
+	}
+	if set, _ := eng.Set(ctx, "key", "other", SetOptions{NX: true}); set {
+		t.Error("expected NX not to set an existing key")
+	}
+	if set, _ := eng.Set(ctx, "missing", "other", SetOptions{XX: true}); set {
+		t.Error("expected XX not to set a missing key")
+	}
+	if val, ok, err := eng.Get(ctx, "key"); err != nil || !ok || val != "value" {
+		t.Errorf("expected value, got %q %v, error %v", val, ok, err)
+	}
+	if _, ok, err := eng.Get(ctx, "missing"); err != nil || ok {
+		t.Errorf("expected a missing key, got %v, error %v", ok, err)
+	}
+
+	if n, err := eng.RPush(ctx, "list", "b", "c"); err != nil || n != 2 {
+		t.Errorf("expected 2, got %d, error %v", n, err)
+	}
+	if n, _ := eng.LPush(ctx, "list", "a"); n != 3 {
+		t.Errorf("expected 3, got %d", n)
+	}
+	if res, _ := eng.Do(ctx, "TYPE", "list"); res != "list" {
+		t.Errorf("expected list, got %v", res)
+	}
+	if _, _, err := eng.Get(ctx, "list"); !errors.Is(err, WrongType) {
+		t.Errorf("expected WRONGTYPE, got %v", err)
+	}
+
+	eng.Incr(ctx, "counter")
+	eng.Incr(ctx, "counter")
+	eng.Decr(ctx, "counter")
+	if val, _, _ := eng.Get(ctx, "counter"); val != "1" {
+		t.Errorf("expected 1, got %q", val)
+	}
+	if err := eng.Incr(ctx, "key"); !errors.Is(err, NotAnInteger) {
+		t.Errorf("expected not an integer, got %v", err)
+	}
+
+	if err := eng.Del(ctx, "key", "list"); err != nil {
+		t.Fatal(err)
+	}
+	if eng.Exists("key") || eng.Exists("list") {
+		t.Error("expected the keys to be deleted")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := eng.Set(canceled, "key", "value", SetOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+	if eng.Exists("key") {
+		t.Error("expected canceled commands not to run")
+	}
+}
+
+func TestEngine_SET_options(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	if _, err := eng.Process(toCommand("SET key value NX XX")); !errors.Is(err, SyntaxError) {
+		t.Errorf("expected syntax error, got %v", err)
+	}
+	if _, err := eng.Process(toCommand("SET key value EX")); !errors.Is(err, SyntaxError) {
+		t.Errorf("expected syntax error, got %v", err)
+	}
+	if res, _ := eng.Process(toCommand("SET key value nx")); res != OK {
+		t.Errorf("expected OK, got %v", res)
+	}
+	if res, _ := eng.Process(toCommand("SET key other NX")); res != nil {
+		t.Errorf("expected nil, got %v", res)
+	}
+	if res, _ := eng.Process(toCommand("SET key other XX")); res != OK {
+		t.Errorf("expected OK, got %v", res)
+	}
+}
+
+func TestEngine_SET_NX_concurrent(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	ctx := context.Background()
+
+	for round := 0; round < 2000; round++ {
+		key := fmt.Sprintf("lock:%d", round)
+		var wg sync.WaitGroup
+		var winners atomic.Int64
+		start := make(chan struct{})
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				set, err := eng.Set(ctx, key, strconv.Itoa(i), SetOptions{NX: true})
+				if err != nil {
+					t.Error(err)
+				}
+				if set {
+					winners.Add(1)
+				}
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		if winners.Load() != 1 {
+			t.Fatalf("expected exactly one NX winner for %s, got %d", key, winners.Load())
+		}
+	}
+}
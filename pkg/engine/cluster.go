@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	"strings"
+)
+
+// CountKeysInSlot returns the number of keys in a hash slot, like CLUSTER
+// COUNTKEYSINSLOT. Keys are indexed by slot in cluster mode only, like in
+// Redis, otherwise there are no keys in the slots.
+func (e *Engine) CountKeysInSlot(slot int) int64 {
+	return int64(e.memory.GroupLen(slot))
+}
+
+// KeysInSlot returns up to count keys of a hash slot, like CLUSTER GETKEYSINSLOT
+func (e *Engine) KeysInSlot(slot int, count int) []string {
+	return e.memory.GroupKeys(slot, count)
+}
+
+// MigrateFunc sends the keys that exist and their values to another node
+type MigrateFunc func(keys []string, vals []values.Value) error
+
+// Migrate moves the keys to another node with send, like MIGRATE, and
+// reports whether any of them exists. Writes are held from the lookup of
+// the values until the keys are deleted, so the values sent are the ones
+// deleted. The keys are kept when keep is set, like MIGRATE COPY, or send fails.
+func (e *Engine) Migrate(keys []string, keep bool, send MigrateFunc) (bool, error) {
+	if err := e.acquireScripting(false); err != nil {
+		return false, err
+	}
+	defer e.scripting.lock.RUnlock()
+
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	var found []string
+	var vals []values.Value
+	for _, key := range keys {
+		if val, ok := e.get(key); ok {
+			found = append(found, key)
+			vals = append(vals, val)
+		}
+	}
+	if len(found) == 0 {
+		return false, nil
+	}
+	if err := send(found, vals); err != nil {
+		return true, err
+	}
+	if keep {
+		return true, nil
+	}
+
+	del := []interface{}{DEL}
+	for _, key := range found {
+		del = append(del, key)
+	}
+	if _, err := e.execute(DEL, del); err != nil {
+		return true, err
+	}
+	e.stats.dirty.Add(1)
+	e.propagate(del)
+	return true, nil
+}
+
+// Exists reports whether the key is stored
+func (e *Engine) Exists(key string) bool {
+	return e.memory.Has(key)
+}
+
+func (e *Engine) infoCluster(b *strings.Builder) {
+	writeField(b, "cluster_enabled", boolToInt(e.config.GetBool(config.ClusterEnabled)))
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/cluster"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newClusterEngine(t *testing.T) *Engine {
+	cfg := config.New()
+	if err := cfg.Override(config.ClusterEnabled, "yes"); err != nil {
+		t.Fatal(err)
+	}
+	eng, err := NewEngine(EngineOptions{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eng
+}
+
+func TestEngine_KeysInSlot(t *testing.T) {
+	eng := newClusterEngine(t)
+	for _, command := range []string{"SET {user}a 1", "SET {user}b 2", "SET other 3", "DEL {user}b"} {
+		if _, err := eng.Process(toCommand(command)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slot := cluster.KeySlot("user")
+	if n := eng.CountKeysInSlot(slot); n != 1 {
+		t.Errorf("expected 1 key, got %d", n)
+	}
+	if keys := eng.KeysInSlot(slot, 10); !reflect.DeepEqual(keys, []string{"{user}a"}) {
+		t.Errorf("expected [{user}a], got %v", keys)
+	}
+	if keys := eng.KeysInSlot(cluster.KeySlot("other"), 0); len(keys) != 0 {
+		t.Errorf("expected no keys with count 0, got %v", keys)
+	}
+
+	if err := eng.Replace(strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if n := eng.CountKeysInSlot(slot); n != 0 {
+		t.Errorf("expected no keys after Replace, got %d", n)
+	}
+}
+
+func TestEngine_Migrate(t *testing.T) {
+	eng := newClusterEngine(t)
+	var propagated [][]interface{}
+	eng.OnWrite(func(command []interface{}) {
+		propagated = append(propagated, command)
+	})
+	for _, command := range []string{"SET a 1", "SET b 2"} {
+		if _, err := eng.Process(toCommand(command)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	propagated = nil
+
+	// Writes wait until the migrated keys are deleted
+	written := make(chan struct{})
+	found, err := eng.Migrate([]string{"a", "missing", "b"}, false, func(keys []string, vals []values.Value) error {
+		if !reflect.DeepEqual(keys, []string{"a", "b"}) || len(vals) != 2 {
+			t.Errorf("expected the values of a and b, got %v %v", keys, vals)
+		}
+		go func() {
+			_, _ = eng.Process(toCommand("SET a 3"))
+			close(written)
+		}()
+		select {
+		case <-written:
+			t.Error("expected the write to wait for the migration")
+		case <-time.After(50 * time.Millisecond):
+		}
+		return nil
+	})
+	if !found || err != nil {
+		t.Fatalf("expected the keys to be migrated, got %v %v", found, err)
+	}
+	<-written
+	if res, _ := eng.Process(toCommand("GET a")); toString(res) != "3" {
+		t.Errorf("expected the write after the migration, got %v", res)
+	}
+	if res, _ := eng.Process(toCommand("EXISTS b")); res != int64(0) {
+		t.Errorf("expected b to be deleted, got %v", res)
+	}
+	if len(propagated) == 0 || !reflect.DeepEqual(propagated[0], []interface{}{DEL, "a", "b"}) {
+		t.Errorf("expected DEL to be propagated first, got %v", propagated)
+	}
+
+	failed := errors.New("failed")
+	found, err = eng.Migrate([]string{"a"}, false, func([]string, []values.Value) error { return failed })
+	if !found || !errors.Is(err, failed) {
+		t.Errorf("expected the error of send, got %v %v", found, err)
+	}
+	if _, err = eng.Migrate([]string{"a"}, true, func([]string, []values.Value) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := eng.Process(toCommand("EXISTS a")); res != int64(1) {
+		t.Errorf("expected a to be kept, got %v", res)
+	}
+
+	found, err = eng.Migrate([]string{"missing"}, false, func([]string, []values.Value) error {
+		t.Error("expected no keys to send")
+		return nil
+	})
+	if found || err != nil {
+		t.Errorf("expected no keys, got %v %v", found, err)
+	}
+}
+
+func TestInfo_clusterMode(t *testing.T) {
+	standalone, _ := NewEngine(EngineOptions{})
+	if mode := infoFields(t, standalone, "server")["redis_mode"]; mode != "standalone" {
+		t.Errorf("expected standalone, got %q", mode)
+	}
+	if mode := infoFields(t, newClusterEngine(t), "server")["redis_mode"]; mode != "cluster" {
+		t.Errorf("expected cluster, got %q", mode)
+	}
+}
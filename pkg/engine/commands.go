@@ -0,0 +1,323 @@
+package engine
+
+import (
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// commandInfo holds the flags Redis attaches to each command
+type commandInfo struct {
+	// write commands modify the dataset
+	write bool
+	// denyOOM commands may increase memory usage, they are rejected when
+	// memory cannot be freed below maxmemory
+	denyOOM bool
+	// container commands, like CONFIG, take a subcommand as first argument
+	container bool
+	// categories are the ACL categories of the command, without the @
+	categories []string
+	// firstKey, lastKey and step locate the keys in the arguments, like
+	// the key specs of Redis. A negative lastKey counts from the end and a
+	// zero firstKey means the command has no keys.
+	firstKey int
+	lastKey  int
+	step     int
+	// numKeys is the index of the argument with the number of keys, which
+	// follow it, like in EVAL. It replaces firstKey, lastKey and step.
+	numKeys int
+	// noScript commands can't be called by scripts
+	noScript bool
+	// arity is the number of arguments including the name, a negative arity
+	// is a minimum, like in Redis. It is checked before the commands of the
+	// engine run, the ones handled by the server check their arguments.
+	arity int
+	// handler is set for the commands of the extensions, see RegisterCommand
+	handler CommandFunc
+}
+
+// Commands handled by the server, they are part of the table for the ACLs
+const CLIENT = "CLIENT"
+const AUTH = "AUTH"
+const ACL = "ACL"
+const SHUTDOWN = "SHUTDOWN"
+const REPLICAOF = "REPLICAOF"
+const SLAVEOF = "SLAVEOF"
+const PSYNC = "PSYNC"
+const REPLCONF = "REPLCONF"
+const ROLE = "ROLE"
+const WAIT = "WAIT"
+const CLUSTER = "CLUSTER"
+const ASKING = "ASKING"
+const MIGRATE = "MIGRATE"
+const MONITOR = "MONITOR"
+
+// commandTable holds the commands and the subcommands, written as
+// NAME|SUBCOMMAND, that differ from their container command
+var commandTable = map[string]commandInfo{
+	COMMAND:            {arity: -1, container: true, categories: []string{"slow", "connection"}},
+	PING:               {arity: -1, categories: []string{"fast", "connection"}},
+	ECHO:               {arity: 2, categories: []string{"fast", "connection"}},
+	GET:                {arity: 2, categories: []string{"read", "string", "fast"}, firstKey: 1, lastKey: 1, step: 1},
+	SET:                {arity: -3, write: true, denyOOM: true, categories: []string{"write", "string", "slow"}, firstKey: 1, lastKey: 1, step: 1},
+	DEL:                {arity: -2, write: true, categories: []string{"keyspace", "write", "slow"}, firstKey: 1, lastKey: -1, step: 1},
+	EXISTS:             {arity: -2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: -1, step: 1},
+	SCAN:               {arity: -2, categories: []string{"keyspace", "read", "slow"}},
+	INCR:               {arity: 2, write: true, denyOOM: true, categories: []string{"write", "string", "fast"}, firstKey: 1, lastKey: 1, step: 1},
+	DECR:               {arity: 2, write: true, denyOOM: true, categories: []string{"write", "string", "fast"}, firstKey: 1, lastKey: 1, step: 1},
+	RPUSH:              {arity: -3, write: true, denyOOM: true, categories: []string{"write", "list", "fast"}, firstKey: 1, lastKey: 1, step: 1},
+	LPUSH:              {arity: -3, write: true, denyOOM: true, categories: []string{"write", "list", "fast"}, firstKey: 1, lastKey: 1, step: 1},
+	SAVE:               {arity: 1, noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	TYPE:               {arity: 2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: 1, step: 1},
+	OBJECT:             {arity: -2, container: true, categories: []string{"keyspace", "read", "slow"}, firstKey: 2, lastKey: 2, step: 1},
+	MEMORY:             {arity: -2, container: true, categories: []string{"read", "slow"}},
+	"MEMORY|USAGE":     {arity: -3, categories: []string{"read", "slow"}, firstKey: 2, lastKey: 2, step: 1},
+	INFO:               {arity: -1, categories: []string{"slow", "dangerous"}},
+	CONFIG:             {arity: -2, container: true, noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	SLOWLOG:            {arity: -2, container: true, noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	LATENCY:            {arity: -2, container: true, noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	EVAL:               {arity: -3, noScript: true, categories: []string{"slow", "scripting"}, numKeys: 2},
+	EVALSHA:            {arity: -3, noScript: true, categories: []string{"slow", "scripting"}, numKeys: 2},
+	SCRIPT:             {arity: -2, container: true, noScript: true, categories: []string{"slow", "scripting"}},
+	FCALL:              {arity: -3, noScript: true, categories: []string{"slow", "scripting"}, numKeys: 2},
+	FCALL_RO:           {arity: -3, noScript: true, categories: []string{"slow", "scripting"}, numKeys: 2},
+	FUNCTION:           {arity: -2, container: true, noScript: true, categories: []string{"slow", "scripting"}},
+	"FUNCTION|LOAD":    {arity: -3, write: true, denyOOM: true, noScript: true, categories: []string{"write", "slow", "scripting"}},
+	"FUNCTION|DELETE":  {arity: 3, write: true, noScript: true, categories: []string{"write", "slow", "scripting"}},
+	"FUNCTION|FLUSH":   {arity: -2, write: true, noScript: true, categories: []string{"write", "slow", "scripting"}},
+	"FUNCTION|RESTORE": {arity: -3, write: true, denyOOM: true, noScript: true, categories: []string{"write", "slow", "scripting"}},
+	// LOADVALUE is written by the snapshots, like RESTORE it replaces a key
+	// with a serialized value, so it is a dangerous write
+	LOADVALUE: {arity: 4, write: true, denyOOM: true, categories: []string{"admin", "write", "slow", "dangerous"}, firstKey: 1, lastKey: 1, step: 1},
+
+	CLIENT:                    {container: true, noScript: true, categories: []string{"admin", "slow", "dangerous", "connection"}},
+	"CLIENT|ID":               {noScript: true, categories: []string{"slow", "connection"}},
+	"CLIENT|INFO":             {noScript: true, categories: []string{"slow", "connection"}},
+	"CLIENT|GETNAME":          {noScript: true, categories: []string{"slow", "connection"}},
+	"CLIENT|SETNAME":          {noScript: true, categories: []string{"slow", "connection"}},
+	AUTH:                      {noScript: true, categories: []string{"fast", "connection"}},
+	ACL:                       {container: true, noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	"ACL|WHOAMI":              {noScript: true, categories: []string{"slow"}},
+	"ACL|CAT":                 {noScript: true, categories: []string{"slow"}},
+	SHUTDOWN:                  {noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	REPLICAOF:                 {noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	SLAVEOF:                   {noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	PSYNC:                     {noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	REPLCONF:                  {noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	ROLE:                      {noScript: true, categories: []string{"admin", "fast", "dangerous"}},
+	WAIT:                      {noScript: true, categories: []string{"slow", "connection"}},
+	CLUSTER:                   {container: true, noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+	"CLUSTER|INFO":            {noScript: true, categories: []string{"slow"}},
+	"CLUSTER|MYID":            {noScript: true, categories: []string{"slow"}},
+	"CLUSTER|NODES":           {noScript: true, categories: []string{"slow"}},
+	"CLUSTER|SLOTS":           {noScript: true, categories: []string{"slow"}},
+	"CLUSTER|SHARDS":          {noScript: true, categories: []string{"slow"}},
+	"CLUSTER|KEYSLOT":         {noScript: true, categories: []string{"slow"}},
+	"CLUSTER|COUNTKEYSINSLOT": {noScript: true, categories: []string{"slow"}},
+	"CLUSTER|GETKEYSINSLOT":   {noScript: true, categories: []string{"slow"}},
+	ASKING:                    {noScript: true, categories: []string{"fast", "connection"}},
+	MIGRATE:                   {write: true, noScript: true, categories: []string{"keyspace", "write", "slow", "dangerous"}, firstKey: 3, lastKey: 3, step: 1},
+	MONITOR:                   {noScript: true, categories: []string{"admin", "slow", "dangerous"}},
+}
+
+// checkArity reports whether n arguments, including the name, match the arity
+func (info commandInfo) checkArity(n int) bool {
+	return info.arity >= 0 && (info.arity == 0 || n == info.arity) || info.arity < 0 && n >= -info.arity
+}
+
+// lookupCommand returns the entry of the subcommand when it has one,
+// otherwise the entry of the command
+func lookupCommand(payloadArray []interface{}) (commandInfo, bool) {
+	name, _ := payloadArray[0].(string)
+	if subcommand := Subcommand(payloadArray); subcommand != "" {
+		if info, ok := commandTable[name+"|"+subcommand]; ok {
+			return info, true
+		}
+	}
+	info, ok := commandTable[name]
+	return info, ok
+}
+
+// IsWriteCommand reports whether the command, or its subcommand, modifies the dataset
+func IsWriteCommand(payloadArray []interface{}) bool {
+	if len(payloadArray) == 0 {
+		return false
+	}
+	info, _ := lookupCommand(payloadArray)
+	return info.write
+}
+
+// IsAdminCommand reports whether the command, or its subcommand, is in
+// the admin category
+func IsAdminCommand(payloadArray []interface{}) bool {
+	if len(payloadArray) == 0 {
+		return false
+	}
+	info, _ := lookupCommand(payloadArray)
+	return hasCategory(info, "admin")
+}
+
+// Redacted replaces the secret arguments of the commands
+const Redacted = "(redacted)"
+
+// RedactArgs returns the arguments with the secrets replaced by Redacted,
+// like Redis does before logging a command: the values of sensitive
+// parameters in CONFIG SET, the passwords of MIGRATE and the password
+// rules of ACL SETUSER. The arguments are returned as they are when there
+// is nothing to redact.
+func RedactArgs(payloadArray []interface{}) []interface{} {
+	if len(payloadArray) == 0 {
+		return payloadArray
+	}
+	var redacted []interface{}
+	redact := func(i int) {
+		if redacted == nil {
+			redacted = append([]interface{}(nil), payloadArray...)
+		}
+		redacted[i] = Redacted
+	}
+
+	name, _ := payloadArray[0].(string)
+	switch {
+	case name == CONFIG && Subcommand(payloadArray) == "SET":
+		for i := 2; i+1 < len(payloadArray); i += 2 {
+			if parameter, _ := payloadArray[i].(string); config.Sensitive(parameter) {
+				redact(i + 1)
+			}
+		}
+	case name == ACL && Subcommand(payloadArray) == "SETUSER":
+		for i := 3; i < len(payloadArray); i++ {
+			// >password, <password, #hash and !hash
+			if rule, _ := payloadArray[i].(string); rule != "" && strings.ContainsRune("><#!", rune(rule[0])) {
+				redact(i)
+			}
+		}
+	case name == MIGRATE:
+		for i := 6; i < len(payloadArray); i++ {
+			option, _ := payloadArray[i].(string)
+			switch strings.ToUpper(option) {
+			case "AUTH":
+				if i+1 < len(payloadArray) {
+					redact(i + 1)
+				}
+				i++
+			case "AUTH2":
+				for j := i + 1; j <= i+2 && j < len(payloadArray); j++ {
+					redact(j)
+				}
+				i += 2
+			case "KEYS":
+				i = len(payloadArray)
+			}
+		}
+	}
+	if redacted == nil {
+		return payloadArray
+	}
+	return redacted
+}
+
+// CommandCategories returns the ACL categories of a command, or of a
+// subcommand written as NAME|SUBCOMMAND. Subcommands without their own
+// entry have the categories of their command.
+func CommandCategories(name string) ([]string, bool) {
+	name = strings.ToUpper(name)
+	if info, ok := commandTable[name]; ok {
+		return info.categories, true
+	}
+	container, _, found := strings.Cut(name, "|")
+	if !found {
+		return nil, false
+	}
+	info, ok := commandTable[container]
+	return info.categories, ok && info.container
+}
+
+// Subcommand returns the uppercase subcommand of container commands, or
+// an empty string for other commands
+func Subcommand(payloadArray []interface{}) string {
+	if len(payloadArray) < 2 {
+		return ""
+	}
+	name, _ := payloadArray[0].(string)
+	subcommand, _ := payloadArray[1].(string)
+	if !commandTable[name].container {
+		return ""
+	}
+	return strings.ToUpper(subcommand)
+}
+
+// CommandKeys returns the keys in the arguments of a command
+func CommandKeys(payloadArray []interface{}) []string {
+	if len(payloadArray) == 0 {
+		return nil
+	}
+	info, ok := lookupCommand(payloadArray)
+	if !ok {
+		return nil
+	}
+	if info.numKeys > 0 {
+		return numKeysArguments(payloadArray, info.numKeys)
+	}
+	if info.firstKey == 0 {
+		return nil
+	}
+
+	last := info.lastKey
+	if last < 0 {
+		last += len(payloadArray)
+	}
+	var keys []string
+	for i := info.firstKey; i <= last && i < len(payloadArray); i += info.step {
+		if key, ok := payloadArray[i].(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// numKeysArguments returns the keys that follow the number of keys at
+// index i, or nothing when the number is invalid
+func numKeysArguments(payloadArray []interface{}, i int) []string {
+	if i >= len(payloadArray) {
+		return nil
+	}
+	var n int
+	switch arg := payloadArray[i].(type) {
+	case string:
+		parsed, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil
+		}
+		n = parsed
+	case int64:
+		n = int(arg)
+	}
+	if n <= 0 || i+n >= len(payloadArray) {
+		return nil
+	}
+	var keys []string
+	for _, arg := range payloadArray[i+1 : i+1+n] {
+		if key, ok := arg.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// CommandsInCategory returns the lowercase names of the commands and
+// subcommands in an ACL category, like ACL CAT
+func CommandsInCategory(category string) []string {
+	names := make([]string, 0)
+	for name, info := range commandTable {
+		for _, c := range info.categories {
+			if c == category {
+				names = append(names, strings.ToLower(name))
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"strconv"
+	"strings"
+)
+
+var WrongNumberOfArguments = errors.New("wrong number of arguments")
+
+// bindConfig writes the engine settings to the configuration, and applies
+// the changes made by CONFIG SET to the engine
+func (e *Engine) bindConfig() error {
+	settings := [][2]string{
+		{config.MaxMemory, strconv.FormatInt(e.maxMemory.Load(), 10)},
+		{config.MaxMemoryPolicy, *e.maxMemoryPolicy.Load()},
+		{config.MaxMemorySamples, strconv.FormatInt(e.maxMemorySamples.Load(), 10)},
+		{config.Save, FormatSaveParams(*e.saveParams.Load())},
+	}
+	for _, setting := range settings {
+		if err := e.config.Override(setting[0], setting[1]); err != nil {
+			return err
+		}
+	}
+
+	e.config.OnChange(config.MaxMemory, func(value string) error {
+		maxMemory, err := config.ParseMemory(value)
+		if err != nil {
+			return err
+		}
+		e.maxMemory.Store(maxMemory)
+		// Like Redis, keys are evicted right away when the limit is lowered
+		e.writeLock.Lock()
+		_ = e.freeMemoryIfNeeded()
+		e.writeLock.Unlock()
+		return nil
+	})
+
+	e.config.OnChange(config.MaxMemoryPolicy, e.setMaxMemoryPolicy)
+
+	e.config.OnChange(config.MaxMemorySamples, func(value string) error {
+		samples, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || samples < 1 {
+			return config.InvalidArgument
+		}
+		e.maxMemorySamples.Store(samples)
+		return nil
+	})
+
+	e.config.OnChange(config.Save, func(value string) error {
+		params, err := ParseSaveParams(value)
+		if err != nil {
+			return err
+		}
+		e.saveParams.Store(&params)
+		return nil
+	})
+
+	e.bindSlowlog()
+	e.bindLatency()
+	return nil
+}
+
+func (e *Engine) configCommand(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, WrongNumberOfArguments
+	}
+
+	args := make([]string, 0, len(payloadArray)-1)
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, UnsupportedTypeForCommand
+		}
+		args = append(args, str)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) < 2 {
+			return nil, WrongNumberOfArguments
+		}
+		// Parameters matched by several patterns are returned once
+		seen := make(map[string]bool)
+		reply := make([]interface{}, 0)
+		for _, pattern := range args[1:] {
+			for _, pair := range e.config.Match(pattern) {
+				if seen[pair[0]] {
+					continue
+				}
+				seen[pair[0]] = true
+				reply = append(reply, pair[0], pair[1])
+			}
+		}
+		return reply, nil
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return nil, WrongNumberOfArguments
+		}
+		pairs := make([][2]string, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			pairs = append(pairs, [2]string{args[i], args[i+1]})
+		}
+		if err := e.config.SetMany(pairs); err != nil {
+			return nil, fmt.Errorf("CONFIG SET failed: %w", err)
+		}
+		return OK, nil
+	case "REWRITE":
+		if err := e.config.Rewrite(); err != nil {
+			return nil, fmt.Errorf("rewriting config file: %w", err)
+		}
+		return OK, nil
+	case "RESETSTAT":
+		e.stats.reset()
+		return OK, nil
+	default:
+		return nil, UnsupportedCommandError
+	}
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEngine_CONFIG(t *testing.T) {
+	tests := []struct {
+		name   string
+		assert func(t *testing.T, eng *Engine)
+	}{
+		{
+			name: "GET with patterns",
+			assert: func(t *testing.T, eng *Engine) {
+				res, err := eng.Process(toCommand("CONFIG GET maxmemory-p* maxmemory*"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []interface{}{
+					"maxmemory-policy", "noeviction",
+					"maxmemory", "0",
+					"maxmemory-samples", "5",
+				}
+				if !reflect.DeepEqual(res, want) {
+					t.Errorf("got %v, want %v", res, want)
+				}
+			},
+		},
+		{
+			name: "SET maxmemory applies live",
+			assert: func(t *testing.T, eng *Engine) {
+				for i := 0; i < 10; i++ {
+					eng.Process(toCommand(fmt.Sprintf("SET key%d value", i)))
+				}
+				_, err := eng.Process(toCommand(fmt.Sprintf("CONFIG SET maxmemory-policy allkeys-lru maxmemory %d", 3*keySize)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if eng.memory.Used() > 3*keySize {
+					t.Errorf("expected keys to be evicted when maxmemory is lowered, used %d", eng.memory.Used())
+				}
+				res, _ := eng.Process(toCommand("CONFIG GET maxmemory"))
+				if res.([]interface{})[1] != fmt.Sprint(3*keySize) {
+					t.Errorf("unexpected maxmemory %v", res)
+				}
+			},
+		},
+		{
+			name: "SET invalid values are rejected",
+			assert: func(t *testing.T, eng *Engine) {
+				_, err := eng.Process(toCommand("CONFIG SET maxmemory 100 maxmemory-policy allkeys-fifo"))
+				if !errors.Is(err, InvalidEvictionPolicy) {
+					t.Fatalf("expected invalid policy, got %v", err)
+				}
+				if eng.maxMemory.Load() != 0 {
+					t.Errorf("expected maxmemory to be restored, got %d", eng.maxMemory.Load())
+				}
+				_, err = eng.Process(toCommand("CONFIG SET port 7000"))
+				if !errors.Is(err, config.ImmutableParameter) {
+					t.Errorf("expected immutable parameter, got %v", err)
+				}
+				_, err = eng.Process(toCommand("CONFIG SET save 100"))
+				if !errors.Is(err, InvalidSaveParams) {
+					t.Errorf("expected invalid save params, got %v", err)
+				}
+			},
+		},
+		{
+			name: "SET save rules",
+			assert: func(t *testing.T, eng *Engine) {
+				_, err := eng.Process([]interface{}{"CONFIG", "SET", "save", "60 1 10 100"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := []SaveParam{{Seconds: 60, Changes: 1}, {Seconds: 10, Changes: 100}}
+				if !reflect.DeepEqual(*eng.saveParams.Load(), want) {
+					t.Errorf("got %v, want %v", *eng.saveParams.Load(), want)
+				}
+			},
+		},
+		{
+			name: "REWRITE without a config file",
+			assert: func(t *testing.T, eng *Engine) {
+				_, err := eng.Process(toCommand("CONFIG REWRITE"))
+				if !errors.Is(err, config.NoConfigFile) {
+					t.Errorf("expected no config file error, got %v", err)
+				}
+			},
+		},
+		{
+			name: "RESETSTAT",
+			assert: func(t *testing.T, eng *Engine) {
+				eng.Process(toCommand("GET missing"))
+				eng.Process(toCommand("CONFIG RESETSTAT"))
+				if eng.stats.keyspaceMisses.Load() != 0 || eng.stats.totalCommands.Load() > 1 {
+					t.Error("expected stats to be reset")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng, _ := NewEngine(EngineOptions{})
+			tt.assert(t, eng)
+		})
+	}
+}
+
+func TestParseSaveParams(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []SaveParam
+		wantErr bool
+	}{
+		{value: "", want: []SaveParam{}},
+		{value: "3600 1 300 100", want: []SaveParam{{3600, 1}, {300, 100}}},
+		{value: "3600", wantErr: true},
+		{value: "0 1", wantErr: true},
+		{value: "10 a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseSaveParams(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSaveParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSaveParams() got = %v, want %v", got, tt.want)
+			}
+			if !tt.wantErr && FormatSaveParams(got) != tt.value {
+				t.Errorf("FormatSaveParams() got = %q, want %q", FormatSaveParams(got), tt.value)
+			}
+		})
+	}
+}
+
+func TestEngine_saveIfNeeded(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.resp")
+	global := true
+	eng, _ := NewEngine(EngineOptions{
+		File:       &file,
+		GlobalPath: &global,
+		SaveParams: []SaveParam{{Seconds: 60, Changes: 2}},
+	})
+
+	now := time.Now()
+	eng.Process(toCommand("SET key value"))
+	if eng.saveIfNeeded(now.Add(time.Hour), time.Time{}) {
+		t.Fatal("expected no save before reaching the changes")
+	}
+
+	eng.Process(toCommand("SET key2 value"))
+	if eng.saveIfNeeded(now.Add(time.Second), time.Time{}) {
+		t.Fatal("expected no save before reaching the seconds")
+	}
+
+	if !eng.saveIfNeeded(now.Add(time.Minute), time.Time{}) {
+		t.Fatal("expected a save once the rule is met")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("expected the file to be saved, got %v", err)
+	}
+	if eng.stats.dirty.Load() != 0 {
+		t.Errorf("expected changes to be reset after saving, got %d", eng.stats.dirty.Load())
+	}
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronPeriod is how often Cron runs its background tasks, like hz 10 in Redis
+const CronPeriod = 100 * time.Millisecond
+
+// saveRetryDelay is the time to wait before retrying a failed automatic save
+const saveRetryDelay = 5 * time.Second
+
+var InvalidSaveParams = errors.New("invalid save parameters")
+
+// SaveParam is a save rule, the dataset is saved when it had at least
+// Changes writes and the last save is older than Seconds
+type SaveParam struct {
+	Seconds int64
+	Changes int64
+}
+
+// ParseSaveParams parses rules in the redis.conf format, like "3600 1 300 100".
+// An empty string disables automatic saves.
+func ParseSaveParams(value string) ([]SaveParam, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, InvalidSaveParams
+	}
+
+	params := make([]SaveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, InvalidSaveParams
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, InvalidSaveParams
+		}
+		params = append(params, SaveParam{Seconds: seconds, Changes: changes})
+	}
+
+	return params, nil
+}
+
+func FormatSaveParams(params []SaveParam) string {
+	fields := make([]string, 0, len(params)*2)
+	for _, param := range params {
+		fields = append(fields, strconv.FormatInt(param.Seconds, 10), strconv.FormatInt(param.Changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// Cron runs the background tasks of the engine until ctx is done
+func (e *Engine) Cron(ctx context.Context) {
+	ticker := time.NewTicker(CronPeriod)
+	defer ticker.Stop()
+
+	var lastAttempt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.stats.ops.sample(now, e.stats.totalCommands.Load())
+			if e.saveIfNeeded(now, lastAttempt) {
+				lastAttempt = now
+			}
+		}
+	}
+}
+
+// saveIfNeeded saves the dataset when a save rule is met and reports if it tried
+func (e *Engine) saveIfNeeded(now time.Time, lastAttempt time.Time) bool {
+	// Like Redis, a failed save is retried after a delay and not on every tick
+	if !e.stats.lastSaveOK.Load() && now.Sub(lastAttempt) < saveRetryDelay {
+		return false
+	}
+
+	dirty := e.stats.dirty.Load()
+	elapsed := now.Unix() - e.stats.lastSave.Load()
+	for _, param := range *e.saveParams.Load() {
+		if dirty >= param.Changes && dirty > 0 && elapsed >= param.Seconds {
+			e.stats.recordSave(e.save())
+			return true
+		}
+	}
+
+	return false
+}
@@ -3,41 +3,126 @@ package engine
 import (
 	"errors"
 	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/cluster"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/concurrency"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/glob"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var UnsupportedCommandError = errors.New("unsupported command")
 
 var UnsupportedTypeForCommand = errors.New("unsupported type")
 
-func ConcurrentListConstructor() interface{} {
-	return concurrency.NewConcurrentList()
+var NotAnInteger = errors.New("value is not an integer or out of range")
+
+var SyntaxError = errors.New("syntax error")
+
+var InvalidCursor = errors.New("invalid cursor")
+
+func ListConstructor() interface{} {
+	return values.NewList()
 }
 
 type Engine struct {
 	memory     *concurrency.ConcurrentMap
 	serializer *resp.RespSerializer
 	parser     *resp.RespParser
+	config     *config.Config
 	file       string
 	global     bool
+	// Settings below can be changed at runtime with CONFIG SET
+	maxMemory        atomic.Int64
+	maxMemoryPolicy  atomic.Pointer[string]
+	maxMemorySamples atomic.Int64
+	saveParams       atomic.Pointer[[]SaveParam]
+	evictionLock     sync.Mutex
+	saveLock         sync.Mutex
+	stats            *Stats
+	// writeLock orders the write commands. Writes share it, so they run
+	// in parallel on the shards of the dataset, until the first OnWrite
+	// function is registered. From then on, each write holds it alone,
+	// so the writes are propagated in the order they are applied. While
+	// it is shared, each write of a key must be a single operation of the
+	// map, like SetIf for SET NX and XX or Mutate for the pushes. Writes
+	// that can't, like the ones of the extensions, scripts and MIGRATE,
+	// always hold it alone.
+	writeLock       sync.RWMutex
+	propagating     atomic.Bool
+	onWrite         []WriteFunc
+	replica         atomic.Bool
+	replicationInfo atomic.Pointer[func() ReplicationInfo]
+	scripting       scripting
+	functions       functionRegistry
+	slowlog         slowlog
+	latency         latencyMonitor
 }
 
 type EngineOptions struct {
 	File       *string
 	Load       *bool
 	GlobalPath *bool
+	// MaxMemory is the limit in bytes of the dataset, zero means no limit
+	MaxMemory        *int64
+	MaxMemoryPolicy  *string
+	MaxMemorySamples *int
+	// SaveParams are the rules for automatic saves, see Cron
+	SaveParams []SaveParam
+	// Config is used by the CONFIG command, a default one is created when nil.
+	// The engine settings are written to it and updated on CONFIG SET.
+	Config *config.Config
 }
 
 func NewEngine(opts EngineOptions) (*Engine, error) {
+	mapOptions := concurrency.MapOptions{Sizer: sizeOf}
+	if opts.Config != nil && opts.Config.GetBool(config.ClusterEnabled) {
+		// Like Redis, the keys are indexed by hash slot in cluster mode only
+		mapOptions.Group = cluster.KeySlot
+		mapOptions.Groups = cluster.Slots
+	}
+
 	eng := &Engine{
-		memory:     concurrency.NewConcurrentMap(),
+		memory:     concurrency.NewConcurrentMapWithOptions(mapOptions),
 		serializer: &resp.RespSerializer{},
 		parser:     &resp.RespParser{},
+		config:     opts.Config,
+		stats:      NewStats(),
+	}
+
+	policy := NoEviction
+	eng.maxMemoryPolicy.Store(&policy)
+	eng.maxMemorySamples.Store(DefaultMaxMemorySamples)
+	eng.saveParams.Store(&opts.SaveParams)
+
+	if opts.MaxMemory != nil {
+		eng.maxMemory.Store(*opts.MaxMemory)
+	}
+
+	if opts.MaxMemoryPolicy != nil {
+		if err := eng.setMaxMemoryPolicy(*opts.MaxMemoryPolicy); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxMemorySamples != nil && *opts.MaxMemorySamples > 0 {
+		eng.maxMemorySamples.Store(int64(*opts.MaxMemorySamples))
+	}
+
+	if eng.config == nil {
+		eng.config = config.New()
+	}
+	if err := eng.bindConfig(); err != nil {
+		return nil, err
 	}
 
 	if opts.File != nil {
@@ -72,23 +157,116 @@ const DECR = "DECR"
 const RPUSH = "RPUSH"
 const LPUSH = "LPUSH"
 const SAVE = "SAVE"
+const TYPE = "TYPE"
+const OBJECT = "OBJECT"
+const MEMORY = "MEMORY"
+const INFO = "INFO"
+const CONFIG = "CONFIG"
+const SCAN = "SCAN"
 
 var DOCS = []interface{}{}
 
 const OK = "OK"
 const PONG = "PONG"
 
+// Stats returns the counters reported by INFO, the server updates the client ones
+func (e *Engine) Stats() *Stats {
+	return e.stats
+}
+
+// Loading reports whether the dataset is being loaded, from the dump file
+// or from the snapshot of a primary
+func (e *Engine) Loading() bool {
+	return e.stats.loading.Load()
+}
+
+// Config returns the configuration changed by CONFIG SET
+func (e *Engine) Config() *config.Config {
+	return e.config
+}
+
+// parseCommand returns the command name and the full command, including the name
+func parseCommand(payload interface{}) (string, []interface{}, error) {
+	payloadArray, ok := payload.([]interface{})
+	if !ok || len(payloadArray) == 0 {
+		return "", nil, UnsupportedCommandError
+	}
+
+	name, ok := payloadArray[0].(string)
+	if !ok {
+		return "", nil, UnsupportedCommandError
+	}
+
+	return name, payloadArray, nil
+}
+
 func (e *Engine) Process(payload interface{}) (interface{}, error) {
-	if reflect.TypeOf(payload).Kind() != reflect.Slice {
-		return nil, UnsupportedCommandError
+	return e.ProcessFrom(payload, nil)
+}
+
+// ProcessFrom runs the command of a client, the commands slower than
+// slowlog-log-slower-than are logged with its address and name
+func (e *Engine) ProcessFrom(payload interface{}, caller Caller) (interface{}, error) {
+	name, payloadArray, err := parseCommand(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case EVAL, EVALSHA, FCALL, FCALL_RO:
+		return e.Eval(payloadArray, ScriptOptions{Caller: caller})
+	case SCRIPT:
+		start := time.Now()
+		res, err := e.scriptCommand(payloadArray)
+		e.stats.recordCommand(name, start, err)
+		e.slowlog.record(start, payloadArray, caller)
+		e.RecordCommandLatency(payloadArray, start)
+		return res, err
+	}
+
+	if err := e.acquireScripting(false); err != nil {
+		return nil, err
+	}
+	defer e.scripting.lock.RUnlock()
+
+	info, _ := lookupCommand(payloadArray)
+	write := info.write
+	if write {
+		// The handlers of the extensions may read and then write keys
+		defer e.lockWrite(info.handler != nil)()
+	}
+
+	start := time.Now()
+	res, err := e.execute(name, payloadArray)
+	e.stats.recordCommand(name, start, err)
+	e.slowlog.record(start, payloadArray, caller)
+	e.RecordCommandLatency(payloadArray, start)
+
+	if err == nil && write {
+		e.stats.dirty.Add(1)
+		e.propagate(payloadArray)
+	}
+
+	return res, err
+}
+
+func (e *Engine) execute(firstPart string, payloadArray []interface{}) (interface{}, error) {
+	info, _ := lookupCommand(payloadArray)
+	if !info.checkArity(len(payloadArray)) {
+		return nil, WrongNumberOfArguments
+	}
+	if info.denyOOM {
+		if err := e.freeMemoryIfNeeded(); err != nil {
+			return nil, err
+		}
+	}
+	if info.handler != nil {
+		return e.runExtension(info, payloadArray)
 	}
 
-	payloadArray := payload.([]interface{})
-	firstPart := payloadArray[0].(string)
 	switch firstPart {
 	case COMMAND:
-		command := payloadArray[1].(string)
-		switch command {
+		switch Subcommand(payloadArray) {
 		case "DOCS":
 			return DOCS, nil
 		default:
@@ -103,23 +281,57 @@ func (e *Engine) Process(payload interface{}) (interface{}, error) {
 		return payloadArray[1], nil
 	case GET:
 		key := payloadArray[1].(string)
-		val, ok := e.memory.Get(key)
+		val, ok := e.get(key)
 
 		if !ok {
+			e.stats.keyspaceMisses.Add(1)
 			return nil, nil
 		}
 
+		e.stats.keyspaceHits.Add(1)
+		if _, ok := val.(*values.Custom); ok {
+			return nil, WrongType
+		}
 		return val, nil
 	case SET:
-		key := payloadArray[1].(string)
-		val := payloadArray[2]
-		kind := reflect.TypeOf(val).Kind()
-		if kind != reflect.Slice && kind != reflect.Array {
-			e.memory.Set(key, val)
-			return OK, nil
+		return e.set(payloadArray)
+	case TYPE:
+		if len(payloadArray) != 2 {
+			return nil, UnsupportedTypeForCommand
 		}
-		e.memory.Set(key, concurrency.NewConcurrentListFromSlice(val.([]interface{})))
-		return OK, nil
+		val, ok := e.get(payloadArray[1].(string))
+		if !ok {
+			return values.TypeNone.String(), nil
+		}
+		return typeOf(val), nil
+	case OBJECT:
+		if len(payloadArray) != 3 {
+			return nil, UnsupportedCommandError
+		}
+		switch Subcommand(payloadArray) {
+		case "ENCODING":
+			val, ok := e.get(payloadArray[2].(string))
+			if !ok {
+				return nil, nil
+			}
+			return val.Encoding().String(), nil
+		default:
+			return nil, UnsupportedCommandError
+		}
+	case MEMORY:
+		return e.memoryCommand(payloadArray)
+	case INFO:
+		return e.info(payloadArray[1:])
+	case CONFIG:
+		return e.configCommand(payloadArray)
+	case SLOWLOG:
+		return e.slowlogCommand(payloadArray)
+	case LATENCY:
+		return e.latencyCommand(payloadArray)
+	case FUNCTION:
+		return e.functionCommand(payloadArray)
+	case LOADVALUE:
+		return e.loadValue(payloadArray)
 	case DEL:
 		for _, key := range payloadArray[1:] {
 			e.memory.Delete(key.(string))
@@ -141,43 +353,34 @@ func (e *Engine) Process(payload interface{}) (interface{}, error) {
 		return count, nil
 	case INCR:
 		key := payloadArray[1].(string)
-		err := e.memory.Map(key, e.incrementMapper)
+		err := e.memory.Map(key, e.incrementBy(1))
 		if err != nil {
 			return nil, err
 		}
 		return OK, nil
 	case DECR:
 		key := payloadArray[1].(string)
-		err := e.memory.Map(key, e.decrementMapper)
+		err := e.memory.Map(key, e.incrementBy(-1))
 		if err != nil {
 			return nil, err
 		}
 		return OK, nil
 	case RPUSH:
-		key := payloadArray[1].(string)
-		var val interface{}
-		var err error
-		for _, newValue := range payloadArray[2:] {
-			val, err = e.memory.Mutate(key, e.pushRight(newValue), ConcurrentListConstructor)
-			if err != nil {
-				return nil, err
-			}
+		if len(payloadArray) < 3 {
+			return nil, WrongNumberOfArguments
 		}
-		return val, nil
-	case LPUSH:
 		key := payloadArray[1].(string)
-		var val interface{}
-		var err error
-		for _, newValue := range payloadArray[2:] {
-			val, err = e.memory.Mutate(key, e.pushLeft(newValue), ConcurrentListConstructor)
-			if err != nil {
-				return nil, err
-			}
+		return e.memory.Mutate(key, e.pushRight(payloadArray[2:]), ListConstructor)
+	case LPUSH:
+		if len(payloadArray) < 3 {
+			return nil, WrongNumberOfArguments
 		}
-		return val, nil
+		key := payloadArray[1].(string)
+		return e.memory.Mutate(key, e.pushLeft(payloadArray[2:]), ListConstructor)
+	case SCAN:
+		return e.scan(payloadArray)
 	case SAVE:
-		err := e.save()
-		if err != nil {
+		if err := e.Save(); err != nil {
 			return nil, err
 		}
 		return OK, nil
@@ -207,13 +410,28 @@ func (e *Engine) load() error {
 		return fmt.Errorf("failed to open File: %w", err)
 	}
 	defer file.Close()
-	scanner := e.parser.CreateScanner(file)
+
+	e.stats.loading.Store(true)
+	defer e.stats.loading.Store(false)
+
+	return e.replay(file)
+}
+
+// replay executes the commands of a dump file
+func (e *Engine) replay(r io.Reader) error {
+	scanner := e.parser.CreateScanner(r)
 	for result := range e.parser.Iterate(scanner) {
 		if result.Err() != nil {
 			return result.Err()
 		}
 
-		_, err = e.Process(result.Value())
+		// Commands replayed from the file are not reported in the stats
+		name, payloadArray, err := parseCommand(result.Value())
+		if err != nil {
+			return err
+		}
+
+		_, err = e.execute(name, payloadArray)
 		if err != nil {
 			return err
 		}
@@ -237,7 +455,25 @@ func (e *Engine) getPath() (string, error) {
 	return savePath, nil
 }
 
+// Save writes the dataset to the file, like SAVE
+func (e *Engine) Save() error {
+	err := e.save()
+	e.stats.recordSave(err)
+	return err
+}
+
+// SaveOnShutdown reports whether the dataset is saved on shutdown by
+// default, like in Redis it is when there are save rules
+func (e *Engine) SaveOnShutdown() bool {
+	return len(*e.saveParams.Load()) > 0
+}
+
 func (e *Engine) save() error {
+	e.saveLock.Lock()
+	defer e.saveLock.Unlock()
+	start := time.Now()
+	defer func() { e.latency.add(LatencySave, time.Since(start)) }()
+
 	savePath, err := e.getPath()
 	if err != nil {
 		return err
@@ -263,14 +499,28 @@ func (e *Engine) save() error {
 	}
 	defer file.Close()
 
+	return e.writeSnapshot(file)
+}
+
+// writeSnapshot writes the function libraries as FUNCTION LOAD commands,
+// then the dataset as SET commands, or LOADVALUE for custom values
+func (e *Engine) writeSnapshot(w io.Writer) error {
+	if err := e.writeFunctions(w); err != nil {
+		return err
+	}
+
 	for pair := range e.memory.Iterable() {
-		command := []interface{}{SET, pair.Key, pair.Value}
+		command, err := RestoreCommand(pair.Key, pair.Value)
+		if err != nil {
+			return err
+		}
 		payload, err := e.serializer.Serialize(command)
 		if err != nil {
 			return err
 		}
 
-		_, err = file.Write(payload.Bytes())
+		_, err = w.Write(payload.Bytes())
+		e.serializer.Release(payload)
 		if err != nil {
 			return err
 		}
@@ -279,70 +529,175 @@ func (e *Engine) save() error {
 	return nil
 }
 
-func (e *Engine) pushRight(newValue interface{}) concurrency.MapperFunc {
-	return func(val interface{}) (interface{}, error) {
-		ls, ok := val.(*concurrency.ConcurrentList)
-		if !ok {
-			return nil, UnsupportedTypeForCommand
+// set implements SET key value [NX | XX], NX only sets keys that do not
+// exist and XX keys that exist. The reply is nil when the key is not set.
+func (e *Engine) set(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 3 {
+		return nil, WrongNumberOfArguments
+	}
+	key := payloadArray[1].(string)
+
+	var nx, xx bool
+	for _, option := range payloadArray[3:] {
+		option, _ := option.(string)
+		switch {
+		case strings.EqualFold(option, "NX"):
+			nx = true
+		case strings.EqualFold(option, "XX"):
+			xx = true
+		default:
+			return nil, SyntaxError
 		}
-		ls.PushRight(newValue)
-		return ls.Len(), nil
 	}
-}
+	if nx && xx {
+		return nil, SyntaxError
+	}
 
-func (e *Engine) pushLeft(newValue interface{}) concurrency.MapperFunc {
-	return func(val interface{}) (interface{}, error) {
-		ls, ok := val.(*concurrency.ConcurrentList)
-		if !ok {
-			return nil, UnsupportedTypeForCommand
-		}
-		ls.PushLeft(newValue)
-		return ls.Len(), nil
+	var value values.Value
+	switch val := payloadArray[2].(type) {
+	case string:
+		value = values.NewString(val)
+	case int64:
+		value = values.NewInt(val)
+	case []interface{}:
+		value = values.NewListFromSlice(val)
+	default:
+		return nil, UnsupportedTypeForCommand
+	}
+
+	if !nx && !xx {
+		e.memory.Set(key, value)
+		return OK, nil
 	}
+	// Writes share the write lock, so the existence check and the store
+	// must be a single operation of the map
+	set := e.memory.SetIf(key, value, func(exists bool) bool {
+		return nx && !exists || xx && exists
+	})
+	if !set {
+		return nil, nil
+	}
+	return OK, nil
 }
 
-func (e *Engine) decrementMapper(val interface{}) (interface{}, error) {
-	if val == nil {
-		return int64(-1), nil
+// scan implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type],
+// the cursor is the index of the next shard of the keyspace
+func (e *Engine) scan(payloadArray []interface{}) (interface{}, error) {
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || len(args)%2 == 0 {
+		return nil, WrongNumberOfArguments
+	}
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return nil, InvalidCursor
 	}
 
-	t := reflect.TypeOf(val)
+	pattern, typeName, count := "*", "", 10
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return nil, SyntaxError
+			}
+		case "TYPE":
+			typeName = args[i+1]
+		default:
+			return nil, SyntaxError
+		}
+	}
 
-	if t.Kind() == reflect.Int64 {
-		return val.(int64) - 1, nil
+	keys, next := e.memory.Scan(cursor, count)
+	matched := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if !glob.Match(pattern, key) {
+			continue
+		}
+		if typeName != "" {
+			val, ok := e.get(key)
+			if !ok || typeOf(val) != typeName {
+				continue
+			}
+		}
+		matched = append(matched, key)
 	}
+	return []interface{}{strconv.Itoa(next), matched}, nil
+}
 
-	if t.Kind() != reflect.String {
-		return 0, UnsupportedTypeForCommand
+// typeOf returns the type reported by TYPE
+func typeOf(val values.Value) string {
+	if custom, ok := val.(*values.Custom); ok {
+		return custom.TypeName()
 	}
+	return val.Type().String()
+}
 
-	numberVal, err := strconv.ParseInt(val.(string), 10, 64)
-	if err != nil {
-		return 0, err
+// get returns the typed value stored under key
+func (e *Engine) get(key string) (values.Value, bool) {
+	val, ok := e.memory.Get(key)
+	if !ok || val == nil {
+		return nil, false
 	}
+	return val.(values.Value), true
+}
 
-	return numberVal - 1, nil
+// pushRight returns a mutator appending the values to a list. They are
+// pushed in a single mutation, so the pushes of other writes, which share
+// the write lock, are not interleaved with them.
+func (e *Engine) pushRight(newValues []interface{}) concurrency.MapperFunc {
+	return func(val interface{}) (interface{}, error) {
+		ls, ok := val.(*values.List)
+		if !ok {
+			return nil, UnsupportedTypeForCommand
+		}
+		for _, newValue := range newValues {
+			ls.PushRight(newValue)
+		}
+		return ls.Len(), nil
+	}
 }
 
-func (e *Engine) incrementMapper(val interface{}) (interface{}, error) {
-	if val == nil {
-		return int64(1), nil
+// pushLeft returns a mutator inserting the values at the head of a list,
+// in a single mutation like pushRight
+func (e *Engine) pushLeft(newValues []interface{}) concurrency.MapperFunc {
+	return func(val interface{}) (interface{}, error) {
+		ls, ok := val.(*values.List)
+		if !ok {
+			return nil, UnsupportedTypeForCommand
+		}
+		for _, newValue := range newValues {
+			ls.PushLeft(newValue)
+		}
+		return ls.Len(), nil
 	}
+}
 
-	t := reflect.TypeOf(val)
+// incrementBy returns a mapper that adds delta to an int encoded string
+func (e *Engine) incrementBy(delta int64) concurrency.MapperFunc {
+	return func(val interface{}) (interface{}, error) {
+		if val == nil {
+			return values.NewInt(delta), nil
+		}
 
-	if t.Kind() == reflect.Int64 {
-		return val.(int64) + 1, nil
-	}
+		str, ok := val.(*values.String)
+		if !ok {
+			return nil, UnsupportedTypeForCommand
+		}
 
-	if t.Kind() != reflect.String {
-		return 0, UnsupportedTypeForCommand
-	}
+		n, ok := str.Int()
+		if !ok {
+			return nil, NotAnInteger
+		}
 
-	numberVal, err := strconv.ParseInt(val.(string), 10, 64)
-	if err != nil {
-		return 0, err
-	}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, NotAnInteger
+		}
 
-	return numberVal + 1, nil
+		return values.NewInt(n + delta), nil
+	}
 }
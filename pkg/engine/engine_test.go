@@ -1,12 +1,16 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
-	"github.com/cdgn-coding/redis-compatible-challenge/pkg/concurrency"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestEngine_Process(t *testing.T) {
@@ -36,7 +40,7 @@ func TestEngine_Process(t *testing.T) {
 			assert: func(eng *Engine) bool {
 				eng.Process(toCommand("SET key hello"))
 				res, _ := eng.Process(toCommand("GET key"))
-				return res.(string) == "hello"
+				return toString(res) == "hello"
 			},
 		},
 		{
@@ -106,7 +110,7 @@ func TestEngine_Process(t *testing.T) {
 			assert: func(eng *Engine) bool {
 				eng.Process(toCommand("INCR counter"))
 				res, err := eng.Process(toCommand("GET counter"))
-				return err == nil && res.(int64) == 1
+				return err == nil && toString(res) == "1"
 			},
 		},
 		{
@@ -116,7 +120,7 @@ func TestEngine_Process(t *testing.T) {
 				eng.Process(toCommand("INCR counter"))
 				eng.Process(toCommand("INCR counter"))
 				res, err := eng.Process(toCommand("GET counter"))
-				return err == nil && res.(int64) == 3
+				return err == nil && toString(res) == "3"
 			},
 		},
 		{
@@ -124,7 +128,7 @@ func TestEngine_Process(t *testing.T) {
 			assert: func(eng *Engine) bool {
 				eng.Process(toCommand("DECR counter"))
 				res, err := eng.Process(toCommand("GET counter"))
-				return err == nil && res.(int64) == -1
+				return err == nil && toString(res) == "-1"
 			},
 		},
 		{
@@ -134,7 +138,7 @@ func TestEngine_Process(t *testing.T) {
 				eng.Process(toCommand("DECR counter"))
 				eng.Process(toCommand("DECR counter"))
 				res, err := eng.Process(toCommand("GET counter"))
-				return err == nil && res.(int64) == -3
+				return err == nil && toString(res) == "-3"
 			},
 		},
 		{
@@ -157,7 +161,7 @@ func TestEngine_Process(t *testing.T) {
 					return false
 				}
 
-				cl := res.(*concurrency.ConcurrentList)
+				cl := res.(*values.List)
 				return cl.Len() == 3
 			},
 		},
@@ -181,10 +185,81 @@ func TestEngine_Process(t *testing.T) {
 					return false
 				}
 
-				cl := res.(*concurrency.ConcurrentList)
+				cl := res.(*values.List)
 				return cl.Len() == 3
 			},
 		},
+		{
+			name: "INCR a non integer",
+			assert: func(eng *Engine) bool {
+				eng.Process(toCommand("SET key hello"))
+				_, err := eng.Process(toCommand("INCR key"))
+				return errors.Is(err, NotAnInteger)
+			},
+		},
+		{
+			name: "INCR overflow",
+			assert: func(eng *Engine) bool {
+				eng.Process(toCommand("SET counter 9223372036854775807"))
+				_, err := eng.Process(toCommand("INCR counter"))
+				return errors.Is(err, NotAnInteger)
+			},
+		},
+		{
+			name: "RPUSH on a string",
+			assert: func(eng *Engine) bool {
+				eng.Process(toCommand("SET key hello"))
+				_, err := eng.Process(toCommand("RPUSH key 1"))
+				return errors.Is(err, UnsupportedTypeForCommand)
+			},
+		},
+		{
+			name: "TYPE",
+			assert: func(eng *Engine) bool {
+				eng.Process(toCommand("SET key hello"))
+				eng.Process(toCommand("RPUSH arr 1"))
+				str, _ := eng.Process(toCommand("TYPE key"))
+				list, _ := eng.Process(toCommand("TYPE arr"))
+				none, _ := eng.Process(toCommand("TYPE missing"))
+				return str == "string" && list == "list" && none == "none"
+			},
+		},
+		{
+			name: "OBJECT ENCODING",
+			assert: func(eng *Engine) bool {
+				eng.Process(toCommand("SET key hello"))
+				eng.Process(toCommand("SET counter 10"))
+				eng.Process(toCommand("SET long " + strings.Repeat("a", 45)))
+				eng.Process(toCommand("RPUSH arr 1"))
+				embstr, _ := eng.Process(toCommand("OBJECT ENCODING key"))
+				integer, _ := eng.Process(toCommand("OBJECT ENCODING counter"))
+				raw, _ := eng.Process(toCommand("OBJECT ENCODING long"))
+				list, _ := eng.Process(toCommand("OBJECT ENCODING arr"))
+				missing, err := eng.Process(toCommand("OBJECT ENCODING missing"))
+				return embstr == "embstr" && integer == "int" && raw == "raw" &&
+					list == "linkedlist" && missing == nil && err == nil
+			},
+		},
+		{
+			name: "lowercase subcommands",
+			assert: func(eng *Engine) bool {
+				eng.Process(toCommand("SET key hello"))
+				encoding, err := eng.Process(toCommand("OBJECT encoding key"))
+				if encoding != "embstr" || err != nil {
+					return false
+				}
+				usage, err := eng.Process(toCommand("MEMORY usage key"))
+				if _, ok := usage.(int64); !ok || err != nil {
+					return false
+				}
+				config, err := eng.Process(toCommand("CONFIG get maxmemory"))
+				if len(config.([]interface{})) != 2 || err != nil {
+					return false
+				}
+				_, err = eng.Process(toCommand("SLOWLOG get"))
+				return err == nil
+			},
+		},
 		{
 			dataFile: &data,
 			name:     "SAVE",
@@ -208,11 +283,11 @@ func TestEngine_Process(t *testing.T) {
 			name:     "LOAD",
 			assert: func(eng *Engine) bool {
 				resp, err := eng.Process(toCommand("GET key"))
-				if err != nil || resp.(string) != "hello" {
+				if err != nil || toString(resp) != "hello" {
 					return false
 				}
 				resp, err = eng.Process(toCommand("GET key2"))
-				return err == nil || resp.(string) == "world"
+				return err == nil || toString(resp) == "world"
 			},
 		},
 	}
@@ -244,6 +319,14 @@ func toCommand(command string) []interface{} {
 	return payload
 }
 
+func toString(res interface{}) string {
+	str, ok := res.(*values.String)
+	if !ok {
+		return ""
+	}
+	return str.String()
+}
+
 func BenchmarkEngine_Process_LPUSH(b *testing.B) {
 	eng, _ := NewEngine(EngineOptions{})
 
@@ -258,3 +341,177 @@ func BenchmarkEngine_Process_LPUSH(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkEngine_Process_SET(b *testing.B) {
+	eng, _ := NewEngine(EngineOptions{})
+	command := []interface{}{"SET", "key", "value"}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := eng.Process(command); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEngine_Process_GET(b *testing.B) {
+	eng, _ := NewEngine(EngineOptions{})
+	_, _ = eng.Process([]interface{}{"SET", "key", "value"})
+	command := []interface{}{"GET", "key"}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := eng.Process(command); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEngine_Process_INCR(b *testing.B) {
+	eng, _ := NewEngine(EngineOptions{})
+	command := []interface{}{"INCR", "counter"}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := eng.Process(command); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEngine_SCAN(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	for i := 0; i < 50; i++ {
+		eng.Process(toCommand(fmt.Sprintf("SET user:%d value", i)))
+	}
+	eng.Process(toCommand("RPUSH user:list a"))
+	eng.Process(toCommand("SET other value"))
+
+	found := 0
+	cursor := "0"
+	for {
+		res, err := eng.Process([]interface{}{SCAN, cursor, "MATCH", "user:*", "COUNT", "5", "TYPE", "string"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := res.([]interface{})
+		cursor = reply[0].(string)
+		for _, key := range reply[1].([]interface{}) {
+			if !strings.HasPrefix(key.(string), "user:") || key == "user:list" {
+				t.Errorf("unexpected key %v", key)
+			}
+			found++
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if found != 50 {
+		t.Errorf("expected 50 keys, got %d", found)
+	}
+
+	if _, err := eng.Process(toCommand("SCAN abc")); !errors.Is(err, InvalidCursor) {
+		t.Errorf("expected invalid cursor, got %v", err)
+	}
+	if _, err := eng.Process(toCommand("SCAN 0 LIMIT 1")); !errors.Is(err, SyntaxError) {
+		t.Errorf("expected syntax error, got %v", err)
+	}
+}
+
+func TestEngine_lockWrite(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+
+	// Without OnWrite functions the writes share the lock
+	unlock := eng.lockWrite(false)
+	shared := make(chan struct{})
+	go func() {
+		eng.lockWrite(false)()
+		close(shared)
+	}()
+	select {
+	case <-shared:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a shared write lock")
+	}
+	unlock()
+
+	var running, overlaps, calls atomic.Int64
+	eng.OnWrite(func(command []interface{}) {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		calls.Add(1)
+		running.Add(-1)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := eng.Process(toCommand("INCR counter")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlaps.Load() != 0 {
+		t.Errorf("expected the writes to be propagated one at a time, %d overlapped", overlaps.Load())
+	}
+	if calls.Load() != 800 {
+		t.Errorf("expected 800 propagated writes, got %d", calls.Load())
+	}
+	if res, _ := eng.Process(toCommand("GET counter")); toString(res) != "800" {
+		t.Errorf("expected 800, got %v", res)
+	}
+}
+
+func TestEngine_sharedWrites(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+
+	// Without OnWrite functions the writes share the lock, the conditional
+	// and multi value writes must still be atomic
+	var wg sync.WaitGroup
+	var created, updated atomic.Int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key:%d", j)
+				if res, _ := eng.Process(toCommand("SET " + key + " v NX")); res == OK {
+					created.Add(1)
+				}
+				if res, _ := eng.Process(toCommand("SET " + key + " w XX")); res == OK {
+					updated.Add(1)
+				}
+				eng.Process(toCommand(fmt.Sprintf("RPUSH list %d-a %d-b", i, i)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if created.Load() != 100 {
+		t.Errorf("expected 100 keys created by NX, got %d", created.Load())
+	}
+	if updated.Load() != 800 {
+		t.Errorf("expected 800 keys updated by XX, got %d", updated.Load())
+	}
+
+	res, _ := eng.Process(toCommand("RPUSH list end"))
+	if res != 1601 {
+		t.Fatalf("expected 1601 elements, got %v", res)
+	}
+	val, _ := eng.get("list")
+	items := make([]string, 0, 1601)
+	for item := range val.(*values.List).Iterator() {
+		items = append(items, item.(string))
+	}
+	for i := 0; i+1 < len(items)-1; i += 2 {
+		first, second := items[i], items[i+1]
+		if strings.TrimSuffix(first, "-a") != strings.TrimSuffix(second, "-b") {
+			t.Fatalf("expected the values of a push to be adjacent, got %s and %s", first, second)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	"strings"
+)
+
+// LOADVALUE key type payload restores a value of a custom type, the
+// snapshots write it for the keys holding custom values
+const LOADVALUE = "LOADVALUE"
+
+var WrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+var CommandExists = errors.New("command already exists")
+
+var TypeExists = errors.New("type already exists")
+
+var UnknownType = errors.New("unknown type")
+
+var InvalidExtension = errors.New("invalid extension")
+
+// CommandFunc runs a command registered with RegisterCommand. It gets the
+// arguments after the name, integers are formatted in base 10.
+type CommandFunc func(ks Keyspace, args []string) (interface{}, error)
+
+// Command is a command added by an extension
+type Command struct {
+	Name string
+	// Write commands modify the dataset, they hold the write lock alone, so
+	// they are run one at a time, apart from the other writes. They are
+	// replicated as they were received and counted for the automatic saves.
+	Write bool
+	// DenyOOM commands may increase memory usage, they are rejected when
+	// memory cannot be freed below maxmemory
+	DenyOOM bool
+	// Categories are the ACL categories of the command, without the @
+	Categories []string
+	// FirstKey, LastKey and Step locate the keys in the arguments, counting
+	// the name. A negative LastKey counts from the end and a zero FirstKey
+	// means the command has no keys.
+	FirstKey int
+	LastKey  int
+	Step     int
+	// Arity is the number of arguments including the name, a negative
+	// arity is a minimum. Zero skips the check.
+	Arity   int
+	Handler CommandFunc
+}
+
+// CustomType is a type of values added by an extension
+type CustomType struct {
+	// Name is reported by TYPE
+	Name string
+	// Unmarshal decodes the data serialized by MarshalBinary, when the dump
+	// file is loaded and on the replicas
+	Unmarshal func(data []byte) (values.CustomData, error)
+}
+
+// customTypes holds the types registered with RegisterType
+var customTypes = map[string]CustomType{}
+
+// RegisterCommand adds a command to every engine. Like the other
+// registries of the process, it must be called before the engines start,
+// usually from init functions of the extensions compiled into main.
+func RegisterCommand(cmd Command) error {
+	name := strings.ToUpper(cmd.Name)
+	if name == "" || strings.ContainsAny(name, " |") || cmd.Handler == nil {
+		return fmt.Errorf("%w: commands need a name and a handler", InvalidExtension)
+	}
+	if _, exists := commandTable[name]; exists {
+		return fmt.Errorf("%w: %s", CommandExists, name)
+	}
+
+	categories := append([]string{}, cmd.Categories...)
+	if cmd.Write {
+		categories = append(categories, "write")
+	}
+	step := cmd.Step
+	if step == 0 && cmd.FirstKey > 0 {
+		step = 1
+	}
+	commandTable[name] = commandInfo{
+		write:      cmd.Write,
+		denyOOM:    cmd.DenyOOM,
+		categories: categories,
+		firstKey:   cmd.FirstKey,
+		lastKey:    cmd.LastKey,
+		step:       step,
+		arity:      cmd.Arity,
+		handler:    cmd.Handler,
+	}
+	return nil
+}
+
+// RegisterType adds a type of values, it must be called before the
+// engines start, like RegisterCommand
+func RegisterType(t CustomType) error {
+	if t.Name == "" || strings.ContainsAny(t.Name, " \r\n") || t.Unmarshal == nil {
+		return fmt.Errorf("%w: types need a name and an unmarshal function", InvalidExtension)
+	}
+	for typ := values.TypeNone; typ <= values.TypeCustom; typ++ {
+		if typ.String() == t.Name {
+			return fmt.Errorf("%w: %s", TypeExists, t.Name)
+		}
+	}
+	if _, exists := customTypes[t.Name]; exists {
+		return fmt.Errorf("%w: %s", TypeExists, t.Name)
+	}
+	customTypes[t.Name] = t
+	return nil
+}
+
+// Keyspace is the view of the dataset given to the commands of the
+// extensions. Write commands hold the write lock alone, so their reads and
+// writes are atomic with respect to the other writes. Commands that are
+// not writes may run alongside writes and must not modify the dataset.
+type Keyspace struct {
+	e *Engine
+}
+
+// Get returns the value stored under the key
+func (ks Keyspace) Get(key string) (values.Value, bool) {
+	return ks.e.get(key)
+}
+
+// Set stores the value under the key. Stored values must not be changed in
+// place, the snapshots and the commands that are not writes read them
+// without the write lock, so write commands set a modified copy.
+func (ks Keyspace) Set(key string, value values.Value) {
+	ks.e.memory.Set(key, value)
+}
+
+// Delete removes the key and reports whether it existed
+func (ks Keyspace) Delete(key string) bool {
+	return ks.e.memory.Delete(key)
+}
+
+// Exists reports whether the key is stored
+func (ks Keyspace) Exists(key string) bool {
+	return ks.e.memory.Has(key)
+}
+
+// GetCustom returns the data of the value of a custom type stored under
+// the key, keys holding values of other types fail with WrongType. The
+// data is shared with the readers, it must not be modified.
+func (ks Keyspace) GetCustom(key string, typeName string) (values.CustomData, bool, error) {
+	val, ok := ks.e.get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	custom, ok := val.(*values.Custom)
+	if !ok || custom.TypeName() != typeName {
+		return nil, false, WrongType
+	}
+	return custom.Data(), true, nil
+}
+
+// SetCustom stores data of a registered type under the key
+func (ks Keyspace) SetCustom(key string, typeName string, data values.CustomData) error {
+	if _, ok := customTypes[typeName]; !ok {
+		return fmt.Errorf("%w: %s", UnknownType, typeName)
+	}
+	ks.e.memory.Set(key, values.NewCustom(typeName, data))
+	return nil
+}
+
+// runExtension runs a command registered with RegisterCommand
+func (e *Engine) runExtension(info commandInfo, payloadArray []interface{}) (interface{}, error) {
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+	return info.handler(Keyspace{e: e}, args)
+}
+
+// loadValue implements LOADVALUE, it decodes a value of a custom type
+func (e *Engine) loadValue(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) != 4 {
+		return nil, WrongNumberOfArguments
+	}
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+	t, ok := customTypes[args[1]]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", UnknownType, args[1])
+	}
+	data, err := t.Unmarshal([]byte(args[2]))
+	if err != nil {
+		return nil, err
+	}
+	e.memory.Set(args[0], values.NewCustom(t.Name, data))
+	return OK, nil
+}
+
+// RestoreCommand returns the command that restores a key of the dataset,
+// the one written by the snapshots
+func RestoreCommand(key string, value interface{}) ([]interface{}, error) {
+	custom, ok := value.(*values.Custom)
+	if !ok {
+		return []interface{}{SET, key, value}, nil
+	}
+	data, err := custom.Data().MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{LOADVALUE, key, custom.TypeName(), string(data)}, nil
+}
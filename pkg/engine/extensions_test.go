@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// counter is a custom type that counts, its commands are registered once
+type counter struct {
+	n int64
+}
+
+func (c *counter) Size() int64 {
+	return 8
+}
+
+func (c *counter) MarshalBinary() ([]byte, error) {
+	return binary.AppendVarint(nil, c.n), nil
+}
+
+var registerCounter sync.Once
+
+func registerCounterExtension(t *testing.T) {
+	registerCounter.Do(func() {
+		err := RegisterType(CustomType{
+			Name: "counter",
+			Unmarshal: func(data []byte) (values.CustomData, error) {
+				n, read := binary.Varint(data)
+				if read <= 0 {
+					return nil, errors.New("invalid counter")
+				}
+				return &counter{n: n}, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = RegisterCommand(Command{
+			Name:       "counter.incrby",
+			Write:      true,
+			DenyOOM:    true,
+			Categories: []string{"fast"},
+			FirstKey:   1,
+			LastKey:    1,
+			Arity:      3,
+			Handler: func(ks Keyspace, args []string) (interface{}, error) {
+				delta, err := strconv.ParseInt(args[1], 10, 64)
+				if err != nil {
+					return nil, NotAnInteger
+				}
+				data, ok, err := ks.GetCustom(args[0], "counter")
+				if err != nil {
+					return nil, err
+				}
+				// The stored counter is read by SAVE and COUNTER.GET, a new
+				// one replaces it
+				c := &counter{n: delta}
+				if ok {
+					c.n += data.(*counter).n
+				}
+				return c.n, ks.SetCustom(args[0], "counter", c)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = RegisterCommand(Command{
+			Name:     "counter.get",
+			FirstKey: 1,
+			LastKey:  1,
+			Arity:    2,
+			Handler: func(ks Keyspace, args []string) (interface{}, error) {
+				data, ok, err := ks.GetCustom(args[0], "counter")
+				if err != nil || !ok {
+					return nil, err
+				}
+				return data.(*counter).n, nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRegisterCommand(t *testing.T) {
+	registerCounterExtension(t)
+	eng, _ := NewEngine(EngineOptions{})
+
+	res, err := eng.Process(toCommand("COUNTER.INCRBY hits 5"))
+	if err != nil || res != int64(5) {
+		t.Fatalf("expected 5, got %v, error %v", res, err)
+	}
+	res, _ = eng.Process(toCommand("COUNTER.INCRBY hits -2"))
+	if res != int64(3) {
+		t.Errorf("expected 3, got %v", res)
+	}
+	if _, err := eng.Process(toCommand("COUNTER.INCRBY hits")); !errors.Is(err, WrongNumberOfArguments) {
+		t.Errorf("expected wrong number of arguments, got %v", err)
+	}
+
+	eng.Process(toCommand("SET name value"))
+	if _, err := eng.Process(toCommand("COUNTER.INCRBY name 1")); !errors.Is(err, WrongType) {
+		t.Errorf("expected WRONGTYPE, got %v", err)
+	}
+	if _, err := eng.Process(toCommand("GET hits")); !errors.Is(err, WrongType) {
+		t.Errorf("expected WRONGTYPE, got %v", err)
+	}
+	if res, _ := eng.Process(toCommand("TYPE hits")); res != "counter" {
+		t.Errorf("expected counter, got %v", res)
+	}
+
+	if !IsWriteCommand(toCommand("COUNTER.INCRBY hits 1")) {
+		t.Error("expected a write command")
+	}
+	if keys := CommandKeys(toCommand("COUNTER.INCRBY hits 1")); len(keys) != 1 || keys[0] != "hits" {
+		t.Errorf("expected the key hits, got %v", keys)
+	}
+	if categories, _ := CommandCategories("counter.incrby"); len(categories) != 2 || categories[1] != "write" {
+		t.Errorf("expected the fast and write categories, got %v", categories)
+	}
+
+	if err := RegisterCommand(Command{Name: "GET", Handler: func(Keyspace, []string) (interface{}, error) { return nil, nil }}); !errors.Is(err, CommandExists) {
+		t.Errorf("expected existing command, got %v", err)
+	}
+	if err := RegisterCommand(Command{Name: "NOHANDLER"}); !errors.Is(err, InvalidExtension) {
+		t.Errorf("expected invalid extension, got %v", err)
+	}
+	if err := RegisterType(CustomType{Name: "list", Unmarshal: func([]byte) (values.CustomData, error) { return nil, nil }}); !errors.Is(err, TypeExists) {
+		t.Errorf("expected existing type, got %v", err)
+	}
+}
+
+func TestRegisterCommand_concurrentWrites(t *testing.T) {
+	registerCounterExtension(t)
+	eng, _ := NewEngine(EngineOptions{})
+
+	// The handler reads the counter and then writes it, the writes of the
+	// extensions must not overlap
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := eng.Process(toCommand("COUNTER.INCRBY hits 1")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if res, _ := eng.Process(toCommand("COUNTER.INCRBY hits 0")); res != int64(800) {
+		t.Errorf("expected 800, got %v", res)
+	}
+}
+
+func TestRegisterType_concurrentSave(t *testing.T) {
+	registerCounterExtension(t)
+	file := filepath.Join(t.TempDir(), "data.resp")
+	global := true
+	eng, _ := NewEngine(EngineOptions{File: &file, GlobalPath: &global})
+
+	// SAVE and COUNTER.GET read the counters while COUNTER.INCRBY replaces
+	// them, the race detector checks they are not modified in place
+	var wg sync.WaitGroup
+	run := func(command string, times int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range times {
+				if _, err := eng.Process(toCommand(command)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	run("COUNTER.INCRBY hits 1", 2000)
+	run("SAVE", 20)
+	run("COUNTER.GET hits", 2000)
+	wg.Wait()
+
+	if res, _ := eng.Process(toCommand("COUNTER.GET hits")); res != int64(2000) {
+		t.Errorf("expected 2000, got %v", res)
+	}
+}
+
+func TestRegisterType_persisted(t *testing.T) {
+	registerCounterExtension(t)
+	file := filepath.Join(t.TempDir(), "data.resp")
+	global := true
+	eng, _ := NewEngine(EngineOptions{File: &file, GlobalPath: &global})
+	eng.Process(toCommand("COUNTER.INCRBY hits 42"))
+	eng.Process(toCommand("SET name value"))
+
+	if _, err := eng.Process(toCommand("SAVE")); err != nil {
+		t.Fatal(err)
+	}
+	load := true
+	loaded, err := NewEngine(EngineOptions{File: &file, GlobalPath: &global, Load: &load})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := loaded.Process(toCommand("COUNTER.INCRBY hits 1")); res != int64(43) {
+		t.Errorf("expected 43 after loading, got %v", res)
+	}
+
+	var snapshot bytes.Buffer
+	if err := eng.Snapshot(&snapshot, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	replica, _ := NewEngine(EngineOptions{})
+	if err := replica.Replace(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := replica.Process(toCommand("TYPE hits")); res != "counter" {
+		t.Errorf("expected counter on the replica, got %v", res)
+	}
+	if res, _ := replica.Process(toCommand("GET name")); toString(res) != "value" {
+		t.Errorf("expected value on the replica, got %v", res)
+	}
+
+	if _, err := replica.Process([]interface{}{LOADVALUE, "key", "unknown", "data"}); !errors.Is(err, UnknownType) {
+		t.Errorf("expected unknown type, got %v", err)
+	}
+
+	// LOADVALUE is checked like the other writes
+	loadValue := []interface{}{LOADVALUE, "key", "counter", "1"}
+	if !IsWriteCommand(loadValue) || !IsAdminCommand(loadValue) {
+		t.Error("expected LOADVALUE to be an admin write")
+	}
+	if keys := CommandKeys(loadValue); len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("expected the key of LOADVALUE, got %v", keys)
+	}
+}
@@ -0,0 +1,543 @@
+package engine
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/glob"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/lua"
+	glua "github.com/yuin/gopher-lua"
+	"hash/crc64"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FUNCTION = "FUNCTION"
+const FCALL = "FCALL"
+const FCALL_RO = "FCALL_RO"
+
+// functionChunk names the libraries in their error messages, like Redis
+const functionChunk = "user_function"
+
+// functionLoadTimeout limits the time the code of a library runs on load
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionsDumpVersion is the version of the FUNCTION DUMP payloads
+const functionsDumpVersion = 1
+
+// Flags of functions, given to redis.register_function
+const FlagNoWrites = "no-writes"
+const FlagAllowOOM = "allow-oom"
+const FlagAllowStale = "allow-stale"
+const FlagNoCluster = "no-cluster"
+const FlagAllowCrossSlotKeys = "allow-cross-slot-keys"
+
+var functionFlags = []string{FlagNoWrites, FlagAllowOOM, FlagAllowStale, FlagNoCluster, FlagAllowCrossSlotKeys}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+var MissingLibraryMetadata = errors.New("Missing library metadata")
+
+var InvalidLibraryName = errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+
+var InvalidFunctionName = errors.New("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+
+var NoFunctionsRegistered = errors.New("No functions registered")
+
+var LibraryNotFound = errors.New("Library not found")
+
+var FunctionNotFound = errors.New("Function not found")
+
+var FunctionWriteFlag = errors.New("Can not execute a script with write flag using *_ro command.")
+
+var RegisterOutsideLoad = errors.New("redis.register_function can only be called on FUNCTION LOAD command")
+
+var UnknownFunctionFlag = errors.New("unknown flag given")
+
+var InvalidFunctionsPayload = errors.New("payload version or checksum are wrong")
+
+var InvalidRestorePolicy = errors.New("Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+
+// functionLibrary is a library of functions, loaded with FUNCTION LOAD.
+// Its functions are closures of the Lua state where the code ran.
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*scriptFunction
+	state     *glua.LState
+	env       *scriptEnv
+	// loading is set while the code runs, redis.register_function can
+	// only be called then
+	loading bool
+}
+
+type scriptFunction struct {
+	name        string
+	description string
+	callback    *glua.LFunction
+	flags       []string
+	library     *functionLibrary
+}
+
+// functionRegistry holds the libraries and their functions by name
+type functionRegistry struct {
+	lock      sync.RWMutex
+	libraries map[string]*functionLibrary
+	functions map[string]*scriptFunction
+}
+
+// loadLibrary runs the code of a library, which must start with a
+// "#!lua name=<library>" line, and returns the functions it registers
+func (e *Engine) loadLibrary(code string) (*functionLibrary, error) {
+	header, body, _ := strings.Cut(code, "\n")
+	name, err := parseLibraryMetadata(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// The metadata line is kept empty, so errors have the right lines
+	chunk, err := lua.Compile(functionChunk, "\n"+body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ScriptCompileError, err)
+	}
+
+	lib := &functionLibrary{
+		name:      name,
+		code:      code,
+		functions: make(map[string]*scriptFunction),
+		state:     lua.NewState(),
+		env:       &scriptEnv{},
+		loading:   true,
+	}
+	redis := e.openRedis(lib.state, lib.env)
+	redis.RawSetString("register_function", lib.state.NewFunction(lib.registerFunction))
+	lua.Sandbox(lib.state)
+
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	_, err = lua.Run(ctx, lib.state, chunk)
+	lib.loading = false
+	if err != nil {
+		lib.state.Close()
+		return nil, fmt.Errorf("Error registering functions: %s", err)
+	}
+	if len(lib.functions) == 0 {
+		lib.state.Close()
+		return nil, NoFunctionsRegistered
+	}
+	return lib, nil
+}
+
+// parseLibraryMetadata returns the name in the first line of a library
+func parseLibraryMetadata(header string) (string, error) {
+	header = strings.TrimSuffix(header, "\r")
+	shebang, found := strings.CutPrefix(header, "#!")
+	if !found {
+		return "", MissingLibraryMetadata
+	}
+	parts := strings.Fields(shebang)
+	if len(parts) == 0 || parts[0] != "lua" {
+		return "", fmt.Errorf("Engine '%s' not found", strings.Join(parts[:min(len(parts), 1)], ""))
+	}
+
+	var name string
+	for _, part := range parts[1:] {
+		value, found := strings.CutPrefix(part, "name=")
+		if !found {
+			return "", fmt.Errorf("Invalid metadata value given: %s", part)
+		}
+		name = value
+	}
+	if !validFunctionName(name) {
+		return "", InvalidLibraryName
+	}
+	return name, nil
+}
+
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// registerFunction implements redis.register_function, called with the
+// name and the callback, or with a table of named arguments
+func (lib *functionLibrary) registerFunction(L *glua.LState) int {
+	if !lib.loading {
+		L.RaiseError("%s", RegisterOutsideLoad)
+	}
+
+	fn := &scriptFunction{library: lib}
+	var name, callback glua.LValue
+	switch L.GetTop() {
+	case 1:
+		t, ok := L.Get(1).(*glua.LTable)
+		if !ok {
+			L.RaiseError("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+		}
+		name, callback = t.RawGetString("function_name"), t.RawGetString("callback")
+		if description, ok := t.RawGetString("description").(glua.LString); ok {
+			fn.description = string(description)
+		}
+		if flags, ok := t.RawGetString("flags").(*glua.LTable); ok {
+			for i := 1; i <= flags.Len(); i++ {
+				flag, _ := flags.RawGetInt(i).(glua.LString)
+				if !slices.Contains(functionFlags, string(flag)) {
+					L.RaiseError("%s", UnknownFunctionFlag)
+				}
+				fn.flags = append(fn.flags, string(flag))
+			}
+		}
+	case 2:
+		name, callback = L.Get(1), L.Get(2)
+	default:
+		L.RaiseError("wrong number of arguments to redis.register_function")
+	}
+
+	if str, ok := name.(glua.LString); ok {
+		fn.name = string(str)
+	}
+	if !validFunctionName(fn.name) {
+		L.RaiseError("%s", InvalidFunctionName)
+	}
+	var ok bool
+	if fn.callback, ok = callback.(*glua.LFunction); !ok {
+		L.RaiseError("callback argument given to redis.register_function must be a function")
+	}
+	if _, exists := lib.functions[fn.name]; exists {
+		L.RaiseError("Function already exists in the library")
+	}
+	lib.functions[fn.name] = fn
+	return 0
+}
+
+// addLibraries adds the libraries to the registry. Libraries with the
+// name of existing ones replace them when replace is set, and fail
+// otherwise, like the functions with the name of functions of others.
+func (e *Engine) addLibraries(libs []*functionLibrary, replace bool) error {
+	r := &e.functions
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make(map[string]bool)
+	for _, lib := range libs {
+		if _, exists := r.libraries[lib.name]; (exists && !replace) || names[lib.name] {
+			return fmt.Errorf("Library '%s' already exists", lib.name)
+		}
+		names[lib.name] = true
+	}
+	functions := make(map[string]bool)
+	for _, lib := range libs {
+		for name := range lib.functions {
+			existing, exists := r.functions[name]
+			if (exists && !names[existing.library.name]) || functions[name] {
+				return fmt.Errorf("Function %s already exists", name)
+			}
+			functions[name] = true
+		}
+	}
+
+	if r.libraries == nil {
+		r.libraries = make(map[string]*functionLibrary)
+		r.functions = make(map[string]*scriptFunction)
+	}
+	for _, lib := range libs {
+		if old, exists := r.libraries[lib.name]; exists {
+			r.remove(old)
+		}
+		r.libraries[lib.name] = lib
+		for name, fn := range lib.functions {
+			r.functions[name] = fn
+		}
+	}
+	return nil
+}
+
+// remove deletes a library and its functions, the lock must be held
+func (r *functionRegistry) remove(lib *functionLibrary) {
+	delete(r.libraries, lib.name)
+	for name := range lib.functions {
+		delete(r.functions, name)
+	}
+}
+
+func (e *Engine) flushFunctions() {
+	e.functions.lock.Lock()
+	defer e.functions.lock.Unlock()
+	e.functions.libraries = nil
+	e.functions.functions = nil
+}
+
+// sortedLibraries returns the libraries sorted by name
+func (e *Engine) sortedLibraries() []*functionLibrary {
+	e.functions.lock.RLock()
+	defer e.functions.lock.RUnlock()
+	libs := make([]*functionLibrary, 0, len(e.functions.libraries))
+	for _, lib := range e.functions.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// functionCommand runs FUNCTION, the libraries are persisted in the dump
+// file and the write subcommands are propagated to the replicas
+func (e *Engine) functionCommand(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, WrongNumberOfArguments
+	}
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		return e.functionLoad(args[1:])
+	case "DELETE":
+		if len(args) != 2 {
+			return nil, WrongNumberOfArguments
+		}
+		e.functions.lock.Lock()
+		defer e.functions.lock.Unlock()
+		lib, ok := e.functions.libraries[args[1]]
+		if !ok {
+			return nil, LibraryNotFound
+		}
+		e.functions.remove(lib)
+		return OK, nil
+	case "FLUSH":
+		if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "SYNC") && !strings.EqualFold(args[1], "ASYNC")) {
+			return nil, ScriptFlushOption
+		}
+		e.flushFunctions()
+		return OK, nil
+	case "LIST":
+		return e.functionList(args[1:])
+	case "DUMP":
+		if len(args) != 1 {
+			return nil, WrongNumberOfArguments
+		}
+		return e.dumpFunctions(), nil
+	case "RESTORE":
+		return e.functionRestore(args[1:])
+	default:
+		return nil, UnsupportedCommandError
+	}
+}
+
+// functionLoad implements FUNCTION LOAD [REPLACE] code
+func (e *Engine) functionLoad(args []string) (interface{}, error) {
+	replace := false
+	if len(args) == 2 && strings.EqualFold(args[0], "REPLACE") {
+		replace = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return nil, WrongNumberOfArguments
+	}
+
+	lib, err := e.loadLibrary(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = e.addLibraries([]*functionLibrary{lib}, replace); err != nil {
+		return nil, err
+	}
+	return lib.name, nil
+}
+
+// functionList implements FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func (e *Engine) functionList(args []string) (interface{}, error) {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "WITHCODE"):
+			withCode = true
+		case strings.EqualFold(args[i], "LIBRARYNAME") && i+1 < len(args):
+			i++
+			pattern = args[i]
+		default:
+			return nil, fmt.Errorf("Unknown argument %s", args[i])
+		}
+	}
+
+	reply := make([]interface{}, 0)
+	for _, lib := range e.sortedLibraries() {
+		if pattern != "" && !glob.Match(pattern, lib.name) {
+			continue
+		}
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		functions := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			fn := lib.functions[name]
+			var description interface{}
+			if fn.description != "" {
+				description = fn.description
+			}
+			flags := make([]interface{}, 0, len(fn.flags))
+			for _, flag := range fn.flags {
+				flags = append(flags, flag)
+			}
+			functions = append(functions, []interface{}{"name", name, "description", description, "flags", flags})
+		}
+
+		entry := []interface{}{"library_name", lib.name, "engine", "LUA", "functions", functions}
+		if withCode {
+			entry = append(entry, "library_code", lib.code)
+		}
+		reply = append(reply, entry)
+	}
+	return reply, nil
+}
+
+// dumpFunctions serializes the code of the libraries, followed by the
+// version of the payload and its CRC64, like the DUMP payloads of Redis
+func (e *Engine) dumpFunctions() string {
+	var payload []byte
+	for _, lib := range e.sortedLibraries() {
+		payload = binary.AppendUvarint(payload, uint64(len(lib.code)))
+		payload = append(payload, lib.code...)
+	}
+	payload = binary.LittleEndian.AppendUint16(payload, functionsDumpVersion)
+	return string(binary.LittleEndian.AppendUint64(payload, crc64.Checksum(payload, crc64Table)))
+}
+
+// parseFunctionsDump returns the code of the libraries in a FUNCTION DUMP payload
+func parseFunctionsDump(payload string) ([]string, error) {
+	if len(payload) < 10 {
+		return nil, InvalidFunctionsPayload
+	}
+	body, footer := []byte(payload[:len(payload)-8]), []byte(payload[len(payload)-8:])
+	if binary.LittleEndian.Uint64(footer) != crc64.Checksum(body, crc64Table) {
+		return nil, InvalidFunctionsPayload
+	}
+	if binary.LittleEndian.Uint16(body[len(body)-2:]) != functionsDumpVersion {
+		return nil, InvalidFunctionsPayload
+	}
+
+	var codes []string
+	for body = body[:len(body)-2]; len(body) > 0; {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return nil, InvalidFunctionsPayload
+		}
+		codes = append(codes, string(body[n:n+int(length)]))
+		body = body[n+int(length):]
+	}
+	return codes, nil
+}
+
+// functionRestore implements FUNCTION RESTORE payload [FLUSH | APPEND | REPLACE]
+func (e *Engine) functionRestore(args []string) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, WrongNumberOfArguments
+	}
+	policy := "APPEND"
+	if len(args) == 2 {
+		policy = strings.ToUpper(args[1])
+		if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+			return nil, InvalidRestorePolicy
+		}
+	}
+
+	codes, err := parseFunctionsDump(args[0])
+	if err != nil {
+		return nil, err
+	}
+	libs := make([]*functionLibrary, 0, len(codes))
+	for _, code := range codes {
+		lib, err := e.loadLibrary(code)
+		if err != nil {
+			return nil, err
+		}
+		libs = append(libs, lib)
+	}
+
+	if policy == "FLUSH" {
+		e.flushFunctions()
+	}
+	if err = e.addLibraries(libs, policy == "REPLACE"); err != nil {
+		return nil, err
+	}
+	return OK, nil
+}
+
+// fcall implements FCALL and FCALL_RO, the function gets the keys and the
+// arguments as tables
+func (e *Engine) fcall(payloadArray []interface{}, opts ScriptOptions) (interface{}, error) {
+	if len(payloadArray) < 3 {
+		return nil, WrongNumberOfArguments
+	}
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	e.functions.lock.RLock()
+	fn, ok := e.functions.functions[args[0]]
+	e.functions.lock.RUnlock()
+	if !ok {
+		return nil, FunctionNotFound
+	}
+
+	keys, argv, err := scriptArguments(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	readOnly := slices.Contains(fn.flags, FlagNoWrites)
+	if !readOnly && payloadArray[0] == FCALL_RO {
+		return nil, FunctionWriteFlag
+	}
+	if !readOnly && opts.DenyWrite != nil {
+		return nil, opts.DenyWrite
+	}
+
+	state := fn.library.state
+	results, err := e.runScript(fn.library.env, opts, readOnly, func(ctx context.Context) ([]glua.LValue, error) {
+		return lua.Call(ctx, state, fn.callback, stringsTable(state, keys), stringsTable(state, argv))
+	})
+	if err != nil {
+		if errors.Is(err, ScriptKilled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s script: %s", err, fn.name)
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return luaToReply(results[0])
+}
+
+// writeFunctions writes the libraries as FUNCTION LOAD commands, so the
+// dump file restores them
+func (e *Engine) writeFunctions(w io.Writer) error {
+	for _, lib := range e.sortedLibraries() {
+		payload, err := e.serializer.Serialize([]interface{}{FUNCTION, "LOAD", "REPLACE", lib.code})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(payload.Bytes())
+		e.serializer.Release(payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLibrary = `#!lua name=mylib
+local function set(keys, args)
+  return redis.call('SET', keys[1], args[1])
+end
+redis.register_function('myset', set)
+redis.register_function{
+  function_name = 'myget',
+  callback = function(keys) return redis.call('GET', keys[1]) end,
+  description = 'reads a key',
+  flags = {'no-writes'},
+}
+`
+
+func TestEngine_FUNCTION(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+
+	res, err := eng.Process([]interface{}{FUNCTION, "LOAD", testLibrary})
+	if err != nil || res != "mylib" {
+		t.Fatalf("expected mylib, got %v, error %v", res, err)
+	}
+	if _, err := eng.Process([]interface{}{FUNCTION, "LOAD", testLibrary}); err == nil || err.Error() != "Library 'mylib' already exists" {
+		t.Errorf("expected existing library, got %v", err)
+	}
+	if _, err := eng.Process([]interface{}{FUNCTION, "LOAD", "REPLACE", testLibrary}); err != nil {
+		t.Errorf("expected the library to be replaced, got %v", err)
+	}
+	other := "#!lua name=other\nredis.register_function('myset', function() return 1 end)"
+	if _, err := eng.Process([]interface{}{FUNCTION, "LOAD", other}); err == nil || err.Error() != "Function myset already exists" {
+		t.Errorf("expected existing function, got %v", err)
+	}
+
+	res, err = eng.Process([]interface{}{FCALL, "myset", "1", "key", "value"})
+	if err != nil || res != "OK" {
+		t.Fatalf("expected OK, got %v, error %v", res, err)
+	}
+	res, err = eng.Process([]interface{}{FCALL_RO, "myget", "1", "key"})
+	if err != nil || res != "value" {
+		t.Errorf("expected value, got %v, error %v", res, err)
+	}
+	if _, err := eng.Process([]interface{}{FCALL_RO, "myset", "1", "key", "value"}); !errors.Is(err, FunctionWriteFlag) {
+		t.Errorf("expected write flag error, got %v", err)
+	}
+	if _, err := eng.Process([]interface{}{FCALL, "missing", "0"}); !errors.Is(err, FunctionNotFound) {
+		t.Errorf("expected function not found, got %v", err)
+	}
+
+	res, _ = eng.Process([]interface{}{FUNCTION, "LIST", "LIBRARYNAME", "my*", "WITHCODE"})
+	expected := []interface{}{[]interface{}{
+		"library_name", "mylib", "engine", "LUA", "functions", []interface{}{
+			[]interface{}{"name", "myget", "description", "reads a key", "flags", []interface{}{"no-writes"}},
+			[]interface{}{"name", "myset", "description", nil, "flags", []interface{}{}},
+		},
+		"library_code", testLibrary,
+	}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("unexpected FUNCTION LIST %v", res)
+	}
+
+	if _, err := eng.Process([]interface{}{FUNCTION, "DELETE", "mylib"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eng.Process([]interface{}{FUNCTION, "DELETE", "mylib"}); !errors.Is(err, LibraryNotFound) {
+		t.Errorf("expected library not found, got %v", err)
+	}
+	if _, err := eng.Process([]interface{}{FCALL, "myset", "0"}); !errors.Is(err, FunctionNotFound) {
+		t.Errorf("expected the functions to be deleted, got %v", err)
+	}
+}
+
+func TestEngine_FUNCTION_LOAD_errors(t *testing.T) {
+	tt := []struct {
+		name string
+		code string
+		err  string
+	}{
+		{name: "missing metadata", code: "redis.register_function('f', function() end)", err: "Missing library metadata"},
+		{name: "unknown engine", code: "#!js name=lib\n", err: "Engine 'js' not found"},
+		{name: "invalid metadata", code: "#!lua name=lib version=1\n", err: "Invalid metadata value given: version=1"},
+		{name: "invalid library name", code: "#!lua name=my-lib\n", err: InvalidLibraryName.Error()},
+		{name: "no functions", code: "#!lua name=lib\nlocal a = 1", err: "No functions registered"},
+		{name: "invalid function name", code: "#!lua name=lib\nredis.register_function('my-f', function() end)", err: InvalidFunctionName.Error()},
+		{name: "unknown flag", code: "#!lua name=lib\nredis.register_function{function_name='f', callback=function() end, flags={'fast'}}", err: "unknown flag given"},
+		{name: "call on load", code: "#!lua name=lib\nredis.call('PING')", err: NotAllowedDuringLoad.Error()},
+		{name: "global write", code: "#!lua name=lib\nx = 1", err: "Attempt to modify a readonly table"},
+		{name: "compile error", code: "#!lua name=lib\nlocal x = = 1", err: "user_function line:2"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			eng, _ := NewEngine(EngineOptions{})
+			_, err := eng.Process([]interface{}{FUNCTION, "LOAD", tc.code})
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestEngine_FUNCTION_DUMP(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	if _, err := eng.Process([]interface{}{FUNCTION, "LOAD", testLibrary}); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := eng.Process(toCommand("FUNCTION DUMP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := NewEngine(EngineOptions{})
+	if _, err := target.Process([]interface{}{FUNCTION, "RESTORE", dump}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Process([]interface{}{FUNCTION, "RESTORE", dump}); err == nil || err.Error() != "Library 'mylib' already exists" {
+		t.Errorf("expected APPEND to fail on existing libraries, got %v", err)
+	}
+	if _, err := target.Process([]interface{}{FUNCTION, "RESTORE", dump, "REPLACE"}); err != nil {
+		t.Errorf("expected REPLACE to succeed, got %v", err)
+	}
+	if _, err := target.Process([]interface{}{FUNCTION, "RESTORE", dump, "FLUSH"}); err != nil {
+		t.Errorf("expected FLUSH to succeed, got %v", err)
+	}
+	if _, err := target.Process([]interface{}{FUNCTION, "RESTORE", dump, "MERGE"}); !errors.Is(err, InvalidRestorePolicy) {
+		t.Errorf("expected invalid policy, got %v", err)
+	}
+	if res, err := target.Process([]interface{}{FCALL, "myset", "1", "key", "value"}); err != nil || res != "OK" {
+		t.Errorf("expected the restored function to run, got %v, error %v", res, err)
+	}
+
+	corrupted := []byte(dump.(string))
+	corrupted[0] ^= 1
+	if _, err := target.Process([]interface{}{FUNCTION, "RESTORE", string(corrupted)}); !errors.Is(err, InvalidFunctionsPayload) {
+		t.Errorf("expected invalid payload, got %v", err)
+	}
+}
+
+func TestEngine_FUNCTION_persisted(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	if _, err := eng.Process([]interface{}{FUNCTION, "LOAD", testLibrary}); err != nil {
+		t.Fatal(err)
+	}
+	eng.Process(toCommand("SET key value"))
+
+	var snapshot bytes.Buffer
+	if err := eng.Snapshot(&snapshot, func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	replica, _ := NewEngine(EngineOptions{})
+	if err := replica.Replace(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	res, err := replica.Process([]interface{}{FCALL_RO, "myget", "1", "key"})
+	if err != nil || res != "value" {
+		t.Errorf("expected value, got %v, error %v", res, err)
+	}
+}
+
+func TestEngine_FCALL_readOnly(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	code := "#!lua name=lib\nredis.register_function{function_name='f', callback=function() return redis.call('SET', 'a', 'b') end, flags={'no-writes'}}"
+	if _, err := eng.Process([]interface{}{FUNCTION, "LOAD", code}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eng.Process(toCommand("FCALL f 0")); err == nil || !strings.Contains(err.Error(), WriteFromReadOnlyScript.Error()) {
+		t.Errorf("expected write from read only script, got %v", err)
+	}
+
+	denied := errors.New("READONLY")
+	if _, err := eng.Eval([]interface{}{FCALL, "myset", "0"}, ScriptOptions{DenyWrite: denied}); !errors.Is(err, FunctionNotFound) {
+		t.Errorf("expected function not found, got %v", err)
+	}
+	if _, err := eng.Process([]interface{}{FUNCTION, "LOAD", testLibrary}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eng.Eval([]interface{}{FCALL, "myset", "1", "a", "b"}, ScriptOptions{DenyWrite: denied}); !errors.Is(err, denied) {
+		t.Errorf("expected denied write, got %v", err)
+	}
+	if _, err := eng.Eval([]interface{}{FCALL, "myget", "1", "a"}, ScriptOptions{DenyWrite: denied}); err != nil {
+		t.Errorf("expected no-writes function to run, got %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RedisVersion is the version of the Redis API the server is compatible with
+const RedisVersion = "7.2.0"
+
+type infoSection struct {
+	name string
+	// inDefault sections are returned by INFO without arguments
+	inDefault bool
+	render    func(e *Engine, b *strings.Builder)
+}
+
+// infoSections are listed in the order Redis uses
+var infoSections = []infoSection{
+	{name: "server", inDefault: true, render: (*Engine).infoServer},
+	{name: "clients", inDefault: true, render: (*Engine).infoClients},
+	{name: "memory", inDefault: true, render: (*Engine).infoMemory},
+	{name: "persistence", inDefault: true, render: (*Engine).infoPersistence},
+	{name: "stats", inDefault: true, render: (*Engine).infoStats},
+	{name: "replication", inDefault: true, render: (*Engine).infoReplication},
+	{name: "commandstats", inDefault: false, render: (*Engine).infoCommandStats},
+	{name: "cluster", inDefault: true, render: (*Engine).infoCluster},
+	{name: "keyspace", inDefault: true, render: (*Engine).infoKeyspace},
+}
+
+// info renders the requested sections, the special "all" and "everything"
+// sections include every section, "default" the ones returned without arguments
+func (e *Engine) info(args []interface{}) (interface{}, error) {
+	requested := make(map[string]bool)
+	for _, arg := range args {
+		section, ok := arg.(string)
+		if !ok {
+			return nil, UnsupportedTypeForCommand
+		}
+		requested[strings.ToLower(section)] = true
+	}
+
+	all := requested["all"] || requested["everything"]
+	defaults := len(requested) == 0 || requested["default"]
+
+	b := strings.Builder{}
+	for _, section := range infoSections {
+		if !all && !requested[section.name] && !(defaults && section.inDefault) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# ")
+		b.WriteString(strings.ToUpper(section.name[:1]))
+		b.WriteString(section.name[1:])
+		b.WriteString("\r\n")
+		section.render(e, &b)
+	}
+
+	return b.String(), nil
+}
+
+// Info renders the INFO sections, all of them when none is given. Unlike
+// the INFO command, it is not counted in the command stats.
+func (e *Engine) Info(sections ...string) string {
+	args := []interface{}{"everything"}
+	if len(sections) > 0 {
+		args = make([]interface{}, len(sections))
+		for i, section := range sections {
+			args[i] = section
+		}
+	}
+	res, _ := e.info(args)
+	return res.(string)
+}
+
+func writeField(b *strings.Builder, name string, value interface{}) {
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(fmt.Sprint(value))
+	b.WriteString("\r\n")
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// bytesToHuman formats sizes like Redis does in the *_human fields
+func bytesToHuman(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", float64(n)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fG", float64(n)/(1024*1024*1024))
+	}
+}
+
+func (e *Engine) infoServer(b *strings.Builder) {
+	uptime := time.Since(e.stats.startTime)
+	writeField(b, "redis_version", RedisVersion)
+	mode := "standalone"
+	if e.config.GetBool(config.ClusterEnabled) {
+		mode = "cluster"
+	}
+	writeField(b, "redis_mode", mode)
+	writeField(b, "os", runtime.GOOS+" "+runtime.GOARCH)
+	writeField(b, "arch_bits", 32<<(^uint(0)>>63))
+	writeField(b, "go_version", runtime.Version())
+	writeField(b, "process_id", os.Getpid())
+	writeField(b, "run_id", e.stats.runID)
+	writeField(b, "uptime_in_seconds", int64(uptime.Seconds()))
+	writeField(b, "uptime_in_days", int64(uptime.Hours()/24))
+}
+
+func (e *Engine) infoClients(b *strings.Builder) {
+	writeField(b, "connected_clients", e.stats.connectedClients.Load())
+	writeField(b, "maxclients", e.config.GetInt(config.MaxClients))
+}
+
+func (e *Engine) infoMemory(b *strings.Builder) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	used := e.memory.Used()
+	writeField(b, "used_memory", used)
+	writeField(b, "used_memory_human", bytesToHuman(used))
+	writeField(b, "used_memory_rss", mem.Sys)
+	writeField(b, "used_memory_rss_human", bytesToHuman(int64(mem.Sys)))
+	writeField(b, "used_memory_dataset", used)
+	writeField(b, "used_memory_heap", mem.HeapAlloc)
+	maxMemory := e.maxMemory.Load()
+	writeField(b, "maxmemory", maxMemory)
+	writeField(b, "maxmemory_human", bytesToHuman(maxMemory))
+	writeField(b, "maxmemory_policy", *e.maxMemoryPolicy.Load())
+	writeField(b, "number_of_cached_scripts", e.cachedScripts())
+}
+
+func (e *Engine) infoPersistence(b *strings.Builder) {
+	status := "ok"
+	if !e.stats.lastSaveOK.Load() {
+		status = "err"
+	}
+	writeField(b, "loading", boolToInt(e.stats.loading.Load()))
+	writeField(b, "rdb_changes_since_last_save", e.stats.dirty.Load())
+	writeField(b, "rdb_last_save_time", e.stats.lastSave.Load())
+	writeField(b, "rdb_last_bgsave_status", status)
+	writeField(b, "aof_enabled", 0)
+}
+
+func (e *Engine) infoStats(b *strings.Builder) {
+	writeField(b, "total_connections_received", e.stats.totalConnections.Load())
+	writeField(b, "total_commands_processed", e.stats.totalCommands.Load())
+	e.stats.ops.sample(time.Now(), e.stats.totalCommands.Load())
+	writeField(b, "instantaneous_ops_per_sec", e.stats.ops.instantaneous())
+	writeField(b, "total_error_replies", e.stats.errorReplies.Load())
+	writeField(b, "rejected_connections", e.stats.rejectedConnections.Load())
+	writeField(b, "sync_full", e.stats.syncFull.Load())
+	writeField(b, "sync_partial_ok", e.stats.syncPartialOK.Load())
+	writeField(b, "sync_partial_err", e.stats.syncPartialErr.Load())
+	writeField(b, "evicted_keys", e.stats.evictedKeys.Load())
+	writeField(b, "keyspace_hits", e.stats.keyspaceHits.Load())
+	writeField(b, "keyspace_misses", e.stats.keyspaceMisses.Load())
+	writeField(b, "client_output_buffer_limit_disconnections", e.stats.outputBufferLimitDisconnections.Load())
+	writeField(b, "client_timeout_disconnections", e.stats.timeoutDisconnections.Load())
+}
+
+func (e *Engine) infoCommandStats(b *strings.Builder) {
+	names := make([]string, 0)
+	e.stats.commands.Range(func(key, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := e.stats.commandStats(name)
+		calls := stats.calls.Load()
+		usec := stats.usec.Load()
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		writeField(b, "cmdstat_"+strings.ToLower(name), fmt.Sprintf(
+			"calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			calls, usec, perCall, stats.rejectedCalls.Load(), stats.failedCalls.Load(),
+		))
+	}
+}
+
+func (e *Engine) infoKeyspace(b *strings.Builder) {
+	keys := e.memory.Len()
+	if keys == 0 {
+		return
+	}
+	writeField(b, "db0", fmt.Sprintf("keys=%d,expires=0,avg_ttl=0", keys))
+}
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func infoFields(t *testing.T, eng *Engine, args ...string) map[string]string {
+	command := []interface{}{INFO}
+	for _, arg := range args {
+		command = append(command, arg)
+	}
+
+	res, err := eng.Process(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make(map[string]string)
+	for _, line := range strings.Split(res.(string), "\r\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			t.Fatalf("malformed INFO line %q", line)
+		}
+		fields[name] = value
+	}
+	return fields
+}
+
+func TestEngine_INFO(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		assert func(t *testing.T, eng *Engine, fields map[string]string)
+	}{
+		{
+			name: "default sections",
+			assert: func(t *testing.T, eng *Engine, fields map[string]string) {
+				for _, field := range []string{"redis_version", "connected_clients", "used_memory", "loading", "total_commands_processed", "db0"} {
+					if _, ok := fields[field]; !ok {
+						t.Errorf("expected field %s", field)
+					}
+				}
+				if _, ok := fields["cmdstat_set"]; ok {
+					t.Error("commandstats is not a default section")
+				}
+			},
+		},
+		{
+			name: "keyspace hits and misses",
+			args: []string{"stats"},
+			assert: func(t *testing.T, eng *Engine, fields map[string]string) {
+				if fields["keyspace_hits"] != "1" || fields["keyspace_misses"] != "1" {
+					t.Errorf("unexpected hits %s and misses %s", fields["keyspace_hits"], fields["keyspace_misses"])
+				}
+				if fields["total_commands_processed"] != "4" {
+					t.Errorf("expected 4 commands processed, got %s", fields["total_commands_processed"])
+				}
+				// INCR of a non integer and the unknown command
+				if fields["total_error_replies"] != "2" {
+					t.Errorf("expected 2 error replies, got %s", fields["total_error_replies"])
+				}
+				if _, ok := fields["connected_clients"]; ok {
+					t.Error("only the stats section was requested")
+				}
+			},
+		},
+		{
+			name: "commandstats",
+			args: []string{"COMMANDSTATS"},
+			assert: func(t *testing.T, eng *Engine, fields map[string]string) {
+				if !strings.HasPrefix(fields["cmdstat_set"], "calls=1,usec=") {
+					t.Errorf("unexpected cmdstat_set %s", fields["cmdstat_set"])
+				}
+				if !strings.HasSuffix(fields["cmdstat_incr"], "rejected_calls=0,failed_calls=1") {
+					t.Errorf("unexpected cmdstat_incr %s", fields["cmdstat_incr"])
+				}
+				if _, ok := fields["cmdstat_unknown"]; ok {
+					t.Error("unknown commands should not be reported")
+				}
+			},
+		},
+		{
+			name: "persistence",
+			args: []string{"persistence", "keyspace"},
+			assert: func(t *testing.T, eng *Engine, fields map[string]string) {
+				if fields["rdb_changes_since_last_save"] != "1" {
+					t.Errorf("expected 1 change since last save, got %s", fields["rdb_changes_since_last_save"])
+				}
+				if fields["rdb_last_bgsave_status"] != "ok" || fields["loading"] != "0" {
+					t.Errorf("unexpected persistence status %v", fields)
+				}
+				if fields["db0"] != "keys=1,expires=0,avg_ttl=0" {
+					t.Errorf("unexpected keyspace %s", fields["db0"])
+				}
+			},
+		},
+		{
+			name: "everything",
+			args: []string{"everything"},
+			assert: func(t *testing.T, eng *Engine, fields map[string]string) {
+				if _, ok := fields["cmdstat_get"]; !ok {
+					t.Error("expected commandstats")
+				}
+				if _, ok := fields["process_id"]; !ok {
+					t.Error("expected server section")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eng, _ := NewEngine(EngineOptions{})
+			eng.Process(toCommand("SET key hello"))
+			eng.Process(toCommand("GET key"))
+			eng.Process(toCommand("GET missing"))
+			eng.Process(toCommand("INCR key"))
+			eng.Process(toCommand("UNKNOWN key"))
+			tt.assert(t, eng, infoFields(t, eng, tt.args...))
+		})
+	}
+}
+
+func TestBytesToHuman(t *testing.T) {
+	tests := map[int64]string{
+		100:             "100B",
+		1024:            "1.00K",
+		1536:            "1.50K",
+		3 * 1024 * 1024: "3.00M",
+	}
+
+	for n, expected := range tests {
+		if got := bytesToHuman(n); got != expected {
+			t.Errorf("bytesToHuman(%d) got = %s, want %s", n, got, expected)
+		}
+	}
+}
+
+func TestInfo_resetStat(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	// The samples of 1000 commands per second end before the commands
+	now := time.Now().Add(-opsSamples * opsSamplePeriod)
+	for i := range opsSamples + 1 {
+		eng.stats.ops.sample(now.Add(time.Duration(i-1)*opsSamplePeriod), int64(i)*100)
+	}
+	if fields := infoFields(t, eng, "stats"); fields["instantaneous_ops_per_sec"] == "0" {
+		t.Fatal("expected commands per second before the reset")
+	}
+
+	if _, err := eng.Process(toCommand("CONFIG RESETSTAT")); err != nil {
+		t.Fatal(err)
+	}
+	fields := infoFields(t, eng, "stats")
+	if fields["instantaneous_ops_per_sec"] != "0" || fields["total_commands_processed"] != "1" {
+		t.Errorf("expected the stats to be reset, got %s ops per second and %s commands",
+			fields["instantaneous_ops_per_sec"], fields["total_commands_processed"])
+	}
+}
+
+func TestOpsSampler_idle(t *testing.T) {
+	var ops opsSampler
+	now := time.Now()
+	for i := range opsSamples + 1 {
+		ops.sample(now.Add(time.Duration(i)*opsSamplePeriod), int64(i)*100)
+	}
+	if got := ops.instantaneous(); got != 1000 {
+		t.Fatalf("expected 1000 ops per second while busy, got %d", got)
+	}
+
+	// Half of the samples are idle after 800ms without commands
+	now = now.Add(opsSamples * opsSamplePeriod)
+	ops.sample(now.Add(opsSamples/2*opsSamplePeriod), opsSamples*100)
+	if got := ops.instantaneous(); got != 500 {
+		t.Fatalf("expected 500 ops per second after 800ms idle, got %d", got)
+	}
+
+	ops.sample(now.Add(time.Minute), opsSamples*100)
+	if got := ops.instantaneous(); got != 0 {
+		t.Fatalf("expected 0 ops per second once idle, got %d", got)
+	}
+}
@@ -0,0 +1,328 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const LATENCY = "LATENCY"
+
+// Latency events, named like the ones of Redis
+const (
+	LatencyCommand       = "command"
+	LatencyFastCommand   = "fast-command"
+	LatencySave          = "save"
+	LatencyEvictionCycle = "eviction-cycle"
+)
+
+// latencyHistoryLen is the number of samples kept for each event, like
+// LATENCY_TS_LEN
+const latencyHistoryLen = 160
+
+// latencyBuckets are the power of two buckets of the command histograms,
+// from 1 microsecond to about 18 minutes
+const latencyBuckets = 31
+
+// latencyAdvice is the advice of LATENCY DOCTOR for each event
+var latencyAdvice = map[string]string{
+	LatencyCommand:       "Check SLOWLOG GET for the slow commands. Commands like SCAN with a large COUNT, EVAL and SAVE take time proportional to the data they touch.",
+	LatencyFastCommand:   "Fast commands were delayed, usually because the host is overloaded or the process was paused. Check the CPU usage and the swap of the host.",
+	LatencySave:          "Saves take time proportional to the dataset. Consider less frequent save rules or a faster disk.",
+	LatencyEvictionCycle: "Evicting keys to stay under maxmemory took long. Consider a larger maxmemory or a lower maxmemory-samples.",
+}
+
+// latencySample is the highest latency of an event in a second
+type latencySample struct {
+	time    int64 // unix seconds
+	latency int64 // milliseconds
+}
+
+// latencyEvent keeps the last samples of an event in a ring
+type latencyEvent struct {
+	samples [latencyHistoryLen]latencySample
+	next    int
+	count   int
+	max     int64
+}
+
+// history returns the samples, the oldest first
+func (ev *latencyEvent) history() []latencySample {
+	history := make([]latencySample, ev.count)
+	for i := range history {
+		history[i] = ev.samples[(ev.next-ev.count+i+latencyHistoryLen)%latencyHistoryLen]
+	}
+	return history
+}
+
+func (ev *latencyEvent) latest() latencySample {
+	return ev.samples[(ev.next-1+latencyHistoryLen)%latencyHistoryLen]
+}
+
+// latencyMonitor records the events that take at least
+// latency-monitor-threshold milliseconds
+type latencyMonitor struct {
+	// threshold is in milliseconds, zero disables the monitor
+	threshold atomic.Int64
+
+	lock   sync.Mutex
+	events map[string]*latencyEvent
+}
+
+// bindLatency loads latency-monitor-threshold and follows its changes
+func (e *Engine) bindLatency() {
+	e.latency.threshold.Store(e.config.GetInt(config.LatencyMonitorThreshold))
+	e.config.OnChange(config.LatencyMonitorThreshold, func(value string) error {
+		threshold, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || threshold < 0 {
+			return config.InvalidArgument
+		}
+		e.latency.threshold.Store(threshold)
+		return nil
+	})
+}
+
+func (m *latencyMonitor) enabled(d time.Duration) bool {
+	threshold := m.threshold.Load()
+	return threshold > 0 && d.Milliseconds() >= threshold
+}
+
+func (m *latencyMonitor) add(event string, d time.Duration) {
+	if !m.enabled(d) {
+		return
+	}
+	latency := d.Milliseconds()
+	now := time.Now().Unix()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.events == nil {
+		m.events = make(map[string]*latencyEvent)
+	}
+	ev, ok := m.events[event]
+	if !ok {
+		ev = &latencyEvent{}
+		m.events[event] = ev
+	}
+	ev.max = max(ev.max, latency)
+
+	// Samples of the same second keep the highest latency
+	if ev.count > 0 && ev.latest().time == now {
+		last := &ev.samples[(ev.next-1+latencyHistoryLen)%latencyHistoryLen]
+		last.latency = max(last.latency, latency)
+		return
+	}
+	ev.samples[ev.next] = latencySample{time: now, latency: latency}
+	ev.next = (ev.next + 1) % latencyHistoryLen
+	ev.count = min(ev.count+1, latencyHistoryLen)
+}
+
+// RecordLatency adds a sample to the event when it took at least
+// latency-monitor-threshold
+func (e *Engine) RecordLatency(event string, d time.Duration) {
+	e.latency.add(event, d)
+}
+
+// RecordCommandLatency records the latency of a command that started at
+// "start", as a fast-command event for the commands in the fast category
+func (e *Engine) RecordCommandLatency(payloadArray []interface{}, start time.Time) {
+	d := time.Since(start)
+	if !e.latency.enabled(d) {
+		return
+	}
+	event := LatencyCommand
+	if info, _ := lookupCommand(payloadArray); hasCategory(info, "fast") {
+		event = LatencyFastCommand
+	}
+	e.latency.add(event, d)
+}
+
+func hasCategory(info commandInfo, category string) bool {
+	for _, c := range info.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// latencyBucket returns the histogram bucket of a duration, bucket i
+// holds the durations up to 2^i microseconds
+func latencyBucket(d time.Duration) int {
+	usec := (d + time.Microsecond - 1) / time.Microsecond
+	if usec <= 1 {
+		return 0
+	}
+	return min(bits.Len64(uint64(usec-1)), latencyBuckets-1)
+}
+
+// latencyCommand implements LATENCY LATEST, HISTORY, RESET, DOCTOR and HISTOGRAM
+func (e *Engine) latencyCommand(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, WrongNumberOfArguments
+	}
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	m := &e.latency
+	switch strings.ToUpper(args[0]) {
+	case "LATEST":
+		if len(args) != 1 {
+			return nil, WrongNumberOfArguments
+		}
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		reply := make([]interface{}, 0, len(m.events))
+		for _, name := range m.eventNames() {
+			ev := m.events[name]
+			latest := ev.latest()
+			reply = append(reply, []interface{}{name, latest.time, latest.latency, ev.max})
+		}
+		return reply, nil
+	case "HISTORY":
+		if len(args) != 2 {
+			return nil, WrongNumberOfArguments
+		}
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		reply := make([]interface{}, 0)
+		if ev, ok := m.events[args[1]]; ok {
+			for _, sample := range ev.history() {
+				reply = append(reply, []interface{}{sample.time, sample.latency})
+			}
+		}
+		return reply, nil
+	case "RESET":
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if len(args) == 1 {
+			n := len(m.events)
+			clear(m.events)
+			return int64(n), nil
+		}
+		var n int64
+		for _, name := range args[1:] {
+			if _, ok := m.events[name]; ok {
+				delete(m.events, name)
+				n++
+			}
+		}
+		return n, nil
+	case "DOCTOR":
+		if len(args) != 1 {
+			return nil, WrongNumberOfArguments
+		}
+		return m.doctor(), nil
+	case "HISTOGRAM":
+		return e.latencyHistogram(args[1:]), nil
+	default:
+		return nil, UnsupportedCommandError
+	}
+}
+
+// eventNames returns the sorted names of the events, the lock must be held
+func (m *latencyMonitor) eventNames() []string {
+	names := make([]string, 0, len(m.events))
+	for name := range m.events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// doctor describes the spikes of each event and gives advice about them
+func (m *latencyMonitor) doctor() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	threshold := m.threshold.Load()
+	if len(m.events) == 0 {
+		if threshold == 0 {
+			return "Latency monitoring is disabled. Enable it with CONFIG SET latency-monitor-threshold <milliseconds>.\n"
+		}
+		return fmt.Sprintf("No latency spike was observed over latency-monitor-threshold, %d milliseconds.\n", threshold)
+	}
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "Latency spikes were observed over latency-monitor-threshold, %d milliseconds:\n\n", threshold)
+	for i, name := range m.eventNames() {
+		ev := m.events[name]
+		history := ev.history()
+
+		var sum int64
+		for _, sample := range history {
+			sum += sample.latency
+		}
+		avg := sum / int64(len(history))
+		var deviation int64
+		for _, sample := range history {
+			deviation += max(sample.latency-avg, avg-sample.latency)
+		}
+		deviation /= int64(len(history))
+
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %dms, mean deviation %dms", i+1, name, len(history), avg, deviation)
+		if len(history) > 1 {
+			period := (history[len(history)-1].time - history[0].time) / int64(len(history)-1)
+			fmt.Fprintf(&b, ", period %d sec", period)
+		}
+		fmt.Fprintf(&b, "). Worst all time event %dms.\n", ev.max)
+	}
+
+	b.WriteString("\nAdvice:\n\n")
+	for _, name := range m.eventNames() {
+		if advice, ok := latencyAdvice[name]; ok {
+			fmt.Fprintf(&b, "- %s\n", advice)
+		}
+	}
+	return b.String()
+}
+
+// latencyHistogram returns the calls and the cumulative histogram in
+// microseconds of the commands, or of every command called when none is given
+func (e *Engine) latencyHistogram(names []string) []interface{} {
+	if len(names) == 0 {
+		e.stats.commands.Range(func(key, _ interface{}) bool {
+			names = append(names, key.(string))
+			return true
+		})
+	}
+	sort.Strings(names)
+
+	reply := make([]interface{}, 0)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		value, ok := e.stats.commands.Load(name)
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		stats := value.(*commandStats)
+		calls := stats.calls.Load()
+		if calls == 0 {
+			continue
+		}
+
+		// Like Redis, only the buckets where the count grows are reported
+		histogram := make([]interface{}, 0)
+		var cumulative int64
+		for i := range stats.histogram {
+			count := stats.histogram[i].Load()
+			if count == 0 {
+				continue
+			}
+			cumulative += count
+			histogram = append(histogram, int64(1)<<i, cumulative)
+		}
+		reply = append(reply, strings.ToLower(name), []interface{}{"calls", calls, "histogram_usec", histogram})
+	}
+	return reply
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEngine_LATENCY(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+
+	res, _ := eng.Process([]interface{}{LATENCY, "DOCTOR"})
+	if !strings.Contains(res.(string), "disabled") {
+		t.Errorf("expected a disabled monitor, got %q", res)
+	}
+	eng.RecordLatency(LatencySave, time.Second)
+	if res, _ := eng.Process([]interface{}{LATENCY, "LATEST"}); len(res.([]interface{})) != 0 {
+		t.Errorf("expected no events while disabled, got %v", res)
+	}
+
+	eng.Process([]interface{}{CONFIG, "SET", "latency-monitor-threshold", "100"})
+	eng.RecordLatency(LatencySave, 50*time.Millisecond)
+	eng.RecordLatency(LatencySave, 200*time.Millisecond)
+	eng.RecordLatency(LatencySave, 300*time.Millisecond)
+	eng.RecordLatency(LatencyEvictionCycle, 150*time.Millisecond)
+
+	res, _ = eng.Process([]interface{}{LATENCY, "LATEST"})
+	latest := res.([]interface{})
+	if len(latest) != 2 {
+		t.Fatalf("expected 2 events, got %v", latest)
+	}
+	eviction, save := latest[0].([]interface{}), latest[1].([]interface{})
+	if eviction[0] != LatencyEvictionCycle || eviction[2] != int64(150) || eviction[3] != int64(150) {
+		t.Errorf("expected the eviction cycle, got %v", eviction)
+	}
+	if save[0] != LatencySave || save[3] != int64(300) {
+		t.Errorf("expected the save, got %v", save)
+	}
+
+	// Samples of the same second are merged
+	res, _ = eng.Process([]interface{}{LATENCY, "HISTORY", LatencySave})
+	history := res.([]interface{})
+	if len(history) != 1 || history[0].([]interface{})[1] != int64(300) {
+		t.Errorf("expected one sample of 300ms, got %v", history)
+	}
+
+	res, _ = eng.Process([]interface{}{LATENCY, "DOCTOR"})
+	if report := res.(string); !strings.Contains(report, "save: 1 latency spikes") || !strings.Contains(report, "Worst all time event 300ms") {
+		t.Errorf("expected a report of the save, got %q", report)
+	}
+
+	if n, _ := eng.Process([]interface{}{LATENCY, "RESET", LatencySave, "unknown"}); n != int64(1) {
+		t.Errorf("expected 1 event reset, got %v", n)
+	}
+	if n, _ := eng.Process([]interface{}{LATENCY, "RESET"}); n != int64(1) {
+		t.Errorf("expected 1 event reset, got %v", n)
+	}
+}
+
+func TestEngine_LATENCY_command(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	eng.Process([]interface{}{CONFIG, "SET", "latency-monitor-threshold", "1"})
+
+	eng.Process([]interface{}{EVAL, "local i = 0 while i < 200000 do i = i + 1 end", "0"})
+	res, _ := eng.Process([]interface{}{LATENCY, "LATEST"})
+	latest := res.([]interface{})
+	if len(latest) != 1 || latest[0].([]interface{})[0] != LatencyCommand {
+		t.Errorf("expected a command event, got %v", latest)
+	}
+}
+
+func TestEngine_LATENCY_HISTOGRAM(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	for range 3 {
+		eng.Process([]interface{}{SET, "key", "value"})
+	}
+	eng.Process([]interface{}{GET, "key"})
+
+	res, _ := eng.Process([]interface{}{LATENCY, "HISTOGRAM", "set", "unknown"})
+	reply := res.([]interface{})
+	if len(reply) != 2 || reply[0] != "set" {
+		t.Fatalf("expected the histogram of set, got %v", reply)
+	}
+	stats := reply[1].([]interface{})
+	if stats[0] != "calls" || stats[1] != int64(3) || stats[2] != "histogram_usec" {
+		t.Errorf("expected 3 calls, got %v", stats)
+	}
+	histogram := stats[3].([]interface{})
+	if len(histogram) == 0 || histogram[len(histogram)-1] != int64(3) {
+		t.Errorf("expected a cumulative count of 3, got %v", histogram)
+	}
+
+	res, _ = eng.Process([]interface{}{LATENCY, "HISTOGRAM"})
+	if len(res.([]interface{})) < 4 {
+		t.Errorf("expected every command called, got %v", res)
+	}
+}
+
+func TestLatencyBucket(t *testing.T) {
+	tests := map[time.Duration]int{
+		0:                       0,
+		time.Microsecond:        0,
+		1500 * time.Nanosecond:  1,
+		2 * time.Microsecond:    1,
+		3 * time.Microsecond:    2,
+		1024 * time.Microsecond: 10,
+		time.Hour:               latencyBuckets - 1,
+	}
+	for d, want := range tests {
+		if got := latencyBucket(d); got != want {
+			t.Errorf("latencyBucket(%s) = %d, want %d", d, got, want)
+		}
+	}
+}
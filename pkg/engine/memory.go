@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	"time"
+)
+
+// Eviction policies, they have the same names as the maxmemory-policy values of Redis
+const (
+	NoEviction     = "noeviction"
+	AllKeysLRU     = "allkeys-lru"
+	AllKeysLFU     = "allkeys-lfu"
+	AllKeysRandom  = "allkeys-random"
+	VolatileLRU    = "volatile-lru"
+	VolatileLFU    = "volatile-lfu"
+	VolatileRandom = "volatile-random"
+	VolatileTTL    = "volatile-ttl"
+)
+
+const DefaultMaxMemorySamples = 5
+
+// entryOverhead approximates the memory used by the map slot, the entry and the key header
+const entryOverhead = 96
+
+var OOMError = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+var InvalidEvictionPolicy = errors.New("invalid maxmemory-policy")
+
+func (e *Engine) setMaxMemoryPolicy(policy string) error {
+	if !validEvictionPolicy(policy) {
+		return fmt.Errorf("%w: %s", InvalidEvictionPolicy, policy)
+	}
+	e.maxMemoryPolicy.Store(&policy)
+	return nil
+}
+
+func validEvictionPolicy(policy string) bool {
+	switch policy {
+	case NoEviction, AllKeysLRU, AllKeysLFU, AllKeysRandom,
+		VolatileLRU, VolatileLFU, VolatileRandom, VolatileTTL:
+		return true
+	default:
+		return false
+	}
+}
+
+// sizeOf estimates the memory used by a key and its value
+func sizeOf(key string, value interface{}) int64 {
+	size := int64(entryOverhead + len(key))
+	if val, ok := value.(values.Value); ok {
+		size += val.Size()
+	}
+	return size
+}
+
+// freeMemoryIfNeeded evicts keys until the used memory is below maxmemory.
+// Keys are chosen by sampling, so LRU and LFU are approximated like in Redis.
+// The evictions are propagated as DEL, so the write lock must be held.
+func (e *Engine) freeMemoryIfNeeded() error {
+	maxMemory := e.maxMemory.Load()
+	if maxMemory == 0 || e.memory.Used() <= maxMemory || e.replica.Load() {
+		return nil
+	}
+
+	e.evictionLock.Lock()
+	defer e.evictionLock.Unlock()
+	start := time.Now()
+	defer func() { e.latency.add(LatencyEvictionCycle, time.Since(start)) }()
+
+	for e.memory.Used() > maxMemory {
+		key, ok := e.evictionCandidate()
+		if !ok {
+			return OOMError
+		}
+
+		if e.memory.Delete(key) {
+			e.stats.evictedKeys.Add(1)
+			e.propagate([]interface{}{DEL, key})
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) evictionCandidate() (string, bool) {
+	policy := *e.maxMemoryPolicy.Load()
+	switch policy {
+	case AllKeysLRU, AllKeysLFU, AllKeysRandom:
+	default:
+		// Volatile policies only evict keys with an expire set, there are none
+		// since expiration is not supported yet, so they behave like noeviction
+		return "", false
+	}
+
+	samples := e.memory.Sample(int(e.maxMemorySamples.Load()))
+	if len(samples) == 0 {
+		return "", false
+	}
+
+	best := samples[0]
+	for _, sample := range samples[1:] {
+		switch policy {
+		case AllKeysLRU:
+			if sample.LastAccess < best.LastAccess {
+				best = sample
+			}
+		case AllKeysLFU:
+			if sample.Frequency < best.Frequency ||
+				(sample.Frequency == best.Frequency && sample.LastAccess < best.LastAccess) {
+				best = sample
+			}
+		}
+	}
+
+	// For allkeys-random the first sample is already a random key
+	return best.Key, true
+}
+
+func (e *Engine) memoryCommand(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, UnsupportedCommandError
+	}
+
+	switch Subcommand(payloadArray) {
+	case "USAGE":
+		if len(payloadArray) != 3 {
+			return nil, UnsupportedTypeForCommand
+		}
+		key := payloadArray[2].(string)
+		val, ok := e.get(key)
+		if !ok {
+			return nil, nil
+		}
+		return sizeOf(key, val), nil
+	case "STATS":
+		return []interface{}{
+			"keys.count", int64(e.memory.Len()),
+			"dataset.bytes", e.memory.Used(),
+			"maxmemory", e.maxMemory.Load(),
+			"maxmemory-policy", *e.maxMemoryPolicy.Load(),
+			"evicted.keys", e.stats.evictedKeys.Load(),
+		}, nil
+	default:
+		return nil, UnsupportedCommandError
+	}
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newEngineWithPolicy(t *testing.T, maxMemory int64, policy string) *Engine {
+	eng, err := NewEngine(EngineOptions{
+		MaxMemory:       &maxMemory,
+		MaxMemoryPolicy: &policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eng
+}
+
+// keySize is the accounted size of the keys used by the eviction tests
+var keySize = sizeOf("key0", nil) + stringSize("value")
+
+func stringSize(s string) int64 {
+	eng, _ := NewEngine(EngineOptions{})
+	eng.Process(toCommand("SET k " + s))
+	return eng.memory.Used() - sizeOf("k", nil)
+}
+
+func TestEngine_Eviction(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		assert func(t *testing.T, eng *Engine)
+	}{
+		{
+			name:   "noeviction rejects writes",
+			policy: NoEviction,
+			assert: func(t *testing.T, eng *Engine) {
+				for i := 0; i < 4; i++ {
+					eng.Process(toCommand(fmt.Sprintf("SET key%d value", i)))
+				}
+				_, err := eng.Process(toCommand("SET key4 value"))
+				if !errors.Is(err, OOMError) {
+					t.Fatalf("expected OOM error, got %v", err)
+				}
+				// Reads and deletes are still allowed
+				if _, err = eng.Process(toCommand("GET key0")); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = eng.Process(toCommand("DEL key0 key1")); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = eng.Process(toCommand("SET key4 value")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:   "volatile policies behave like noeviction without expires",
+			policy: VolatileLRU,
+			assert: func(t *testing.T, eng *Engine) {
+				for i := 0; i < 4; i++ {
+					eng.Process(toCommand(fmt.Sprintf("SET key%d value", i)))
+				}
+				_, err := eng.Process(toCommand("SET key4 value"))
+				if !errors.Is(err, OOMError) {
+					t.Fatalf("expected OOM error, got %v", err)
+				}
+			},
+		},
+		{
+			name:   "allkeys-lru evicts the least recently used key",
+			policy: AllKeysLRU,
+			assert: func(t *testing.T, eng *Engine) {
+				for i := 0; i < 3; i++ {
+					eng.Process(toCommand(fmt.Sprintf("SET key%d value", i)))
+					<-time.After(2 * time.Millisecond)
+				}
+				eng.Process(toCommand("GET key0"))
+				<-time.After(2 * time.Millisecond)
+				eng.Process(toCommand("SET key3 value"))
+				eng.Process(toCommand("SET key4 value"))
+
+				if res, _ := eng.Process(toCommand("EXISTS key1")); res.(int64) != 0 {
+					t.Error("expected key1 to be evicted")
+				}
+				if res, _ := eng.Process(toCommand("EXISTS key0")); res.(int64) != 1 {
+					t.Error("expected recently used key0 to be kept")
+				}
+				if eng.stats.evictedKeys.Load() == 0 {
+					t.Error("expected evictions to be counted")
+				}
+			},
+		},
+		{
+			name:   "allkeys-lfu evicts the least frequently used key",
+			policy: AllKeysLFU,
+			assert: func(t *testing.T, eng *Engine) {
+				for i := 0; i < 3; i++ {
+					eng.Process(toCommand(fmt.Sprintf("SET key%d value", i)))
+				}
+				for i := 0; i < 100; i++ {
+					eng.Process(toCommand("GET key0"))
+					eng.Process(toCommand("GET key2"))
+				}
+				// key3 ties with key1 on frequency, it is kept for being more recent
+				<-time.After(2 * time.Millisecond)
+				eng.Process(toCommand("SET key3 value"))
+				eng.Process(toCommand("SET key4 value"))
+
+				if res, _ := eng.Process(toCommand("EXISTS key1")); res.(int64) != 0 {
+					t.Error("expected key1 to be evicted")
+				}
+				if res, _ := eng.Process(toCommand("EXISTS key0 key2")); res.(int64) != 2 {
+					t.Error("expected frequently used keys to be kept")
+				}
+			},
+		},
+		{
+			name:   "allkeys-random keeps memory under the limit",
+			policy: AllKeysRandom,
+			assert: func(t *testing.T, eng *Engine) {
+				for i := 0; i < 100; i++ {
+					_, err := eng.Process(toCommand(fmt.Sprintf("SET key%d value", i)))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if eng.memory.Used() > eng.maxMemory.Load()+keySize {
+					t.Errorf("expected used memory %d to stay around %d", eng.memory.Used(), eng.maxMemory.Load())
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Like Redis, memory is checked before each write so the fourth key
+			// goes over the limit, and writing the fifth one requires an eviction
+			tt.assert(t, newEngineWithPolicy(t, 3*keySize, tt.policy))
+		})
+	}
+}
+
+func TestEngine_InvalidEvictionPolicy(t *testing.T) {
+	policy := "allkeys-fifo"
+	_, err := NewEngine(EngineOptions{MaxMemoryPolicy: &policy})
+	if !errors.Is(err, InvalidEvictionPolicy) {
+		t.Errorf("expected invalid policy error, got %v", err)
+	}
+}
+
+func TestEngine_MEMORY(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	eng.Process(toCommand("SET key value"))
+	eng.Process(toCommand("RPUSH list a b c"))
+
+	usage, err := eng.Process(toCommand("MEMORY USAGE key"))
+	if err != nil || usage.(int64) != sizeOf("key", nil)+stringSize("value") {
+		t.Errorf("unexpected MEMORY USAGE %v, error %v", usage, err)
+	}
+
+	usage, err = eng.Process(toCommand("MEMORY USAGE missing"))
+	if err != nil || usage != nil {
+		t.Errorf("expected nil MEMORY USAGE for missing key, got %v", usage)
+	}
+
+	stats, err := eng.Process(toCommand("MEMORY STATS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := stats.([]interface{})
+	if fields[0] != "keys.count" || fields[1].(int64) != 2 {
+		t.Errorf("expected 2 keys, got %v", fields[1])
+	}
+	if fields[3].(int64) != eng.memory.Used() {
+		t.Errorf("expected dataset.bytes %d, got %v", eng.memory.Used(), fields[3])
+	}
+}
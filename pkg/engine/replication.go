@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// WriteFunc receives a write command after the engine applies it
+type WriteFunc func(command []interface{})
+
+// ReplicationInfo is the state reported by INFO replication, the server
+// maintains it
+type ReplicationInfo struct {
+	// Role is "master" or "slave", like in ROLE
+	Role string
+	// MasterHost and MasterPort are the primary of replicas
+	MasterHost string
+	MasterPort string
+	// MasterLinkUp reports whether the replica is streaming from its primary
+	MasterLinkUp bool
+	// MasterLastIO is the seconds since the last data from the primary
+	MasterLastIO   int64
+	SyncInProgress bool
+	ReadOnly       bool
+	Replicas       []ReplicaInfo
+	// ReplID and Offset identify the replication stream, ReplID2 and
+	// SecondOffset the stream of the previous primary after a failover
+	ReplID       string
+	ReplID2      string
+	Offset       int64
+	SecondOffset int64
+	// BacklogSize is zero until the first replica connects
+	BacklogSize            int64
+	BacklogFirstByteOffset int64
+	BacklogHistLen         int64
+}
+
+// ReplicaInfo describes a replica connected to the primary
+type ReplicaInfo struct {
+	IP    string
+	Port  string
+	State string
+	// Offset is the last offset acknowledged by the replica, Lag the
+	// seconds since the acknowledgement
+	Offset int64
+	Lag    int64
+}
+
+// OnWrite registers fn to receive the write commands, in the order they are
+// applied, like the commands Redis propagates to its replicas. Writes are
+// held while fn runs, so it must not block. Once there is a function, the
+// writes run one at a time to keep their order, so it should be registered
+// only when there is somewhere to propagate them, like a replica.
+func (e *Engine) OnWrite(fn WriteFunc) {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+	e.onWrite = append(e.onWrite, fn)
+	e.propagating.Store(true)
+}
+
+// lockWrite acquires the write lock for a write command, shared until the
+// writes are propagated, and returns the function that releases it.
+// Exclusive writes, like the ones of the extensions, always hold it alone.
+func (e *Engine) lockWrite(exclusive bool) func() {
+	if !exclusive && !e.propagating.Load() {
+		e.writeLock.RLock()
+		// OnWrite holds the lock alone, so the flag can't change while it
+		// is shared
+		if !e.propagating.Load() {
+			return e.writeLock.RUnlock
+		}
+		e.writeLock.RUnlock()
+	}
+	e.writeLock.Lock()
+	return e.writeLock.Unlock
+}
+
+// propagate passes the command to the OnWrite functions, the write lock
+// must be held, alone when there are functions
+func (e *Engine) propagate(command []interface{}) {
+	for _, fn := range e.onWrite {
+		fn(command)
+	}
+}
+
+// SetReplica switches the engine to a replica of another server. Replicas
+// don't evict keys, the evictions of the primary are replicated instead.
+func (e *Engine) SetReplica(replica bool) {
+	e.replica.Store(replica)
+}
+
+// SetReplicationInfo sets the function reporting the INFO replication fields
+func (e *Engine) SetReplicationInfo(fn func() ReplicationInfo) {
+	e.replicationInfo.Store(&fn)
+}
+
+// ApplyReplicated executes a command received from the primary. The
+// command is not passed to the OnWrite functions, replicas forward the
+// stream of their primary as it is.
+func (e *Engine) ApplyReplicated(payload interface{}) error {
+	name, payloadArray, err := parseCommand(payload)
+	if err != nil {
+		return err
+	}
+
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	start := time.Now()
+	_, err = e.execute(name, payloadArray)
+	e.stats.recordCommand(name, start, err)
+	if err == nil && IsWriteCommand(payloadArray) {
+		e.stats.dirty.Add(1)
+	}
+	return err
+}
+
+// Snapshot writes the dataset in the format of the dump file. Writes are
+// held until attach returns, so the commands propagated after attach are
+// exactly the ones missing from the snapshot.
+func (e *Engine) Snapshot(w io.Writer, attach func()) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	if err := e.writeSnapshot(w); err != nil {
+		return err
+	}
+	attach()
+	return nil
+}
+
+// Replace replaces the dataset with a snapshot, like replicas do on a full
+// synchronization with their primary
+func (e *Engine) Replace(r io.Reader) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	e.stats.loading.Store(true)
+	defer e.stats.loading.Store(false)
+
+	e.memory.Clear()
+	e.flushFunctions()
+	e.stats.dirty.Add(1)
+	return e.replay(r)
+}
+
+func (e *Engine) infoReplication(b *strings.Builder) {
+	info := ReplicationInfo{Role: "master", SecondOffset: -1}
+	if fn := e.replicationInfo.Load(); fn != nil {
+		info = (*fn)()
+	}
+
+	writeField(b, "role", info.Role)
+	if info.Role == "slave" {
+		link := "down"
+		if info.MasterLinkUp {
+			link = "up"
+		}
+		writeField(b, "master_host", info.MasterHost)
+		writeField(b, "master_port", info.MasterPort)
+		writeField(b, "master_link_status", link)
+		writeField(b, "master_last_io_seconds_ago", info.MasterLastIO)
+		writeField(b, "master_sync_in_progress", boolToInt(info.SyncInProgress))
+		writeField(b, "slave_read_repl_offset", info.Offset)
+		writeField(b, "slave_repl_offset", info.Offset)
+		writeField(b, "slave_read_only", boolToInt(info.ReadOnly))
+	}
+
+	writeField(b, "connected_slaves", len(info.Replicas))
+	for i, replica := range info.Replicas {
+		writeField(b, fmt.Sprintf("slave%d", i), fmt.Sprintf("ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+			replica.IP, replica.Port, replica.State, replica.Offset, replica.Lag))
+	}
+
+	writeField(b, "master_replid", info.ReplID)
+	writeField(b, "master_replid2", info.ReplID2)
+	writeField(b, "master_repl_offset", info.Offset)
+	writeField(b, "second_repl_offset", info.SecondOffset)
+	writeField(b, "repl_backlog_active", boolToInt(info.BacklogSize > 0))
+	writeField(b, "repl_backlog_size", info.BacklogSize)
+	writeField(b, "repl_backlog_first_byte_offset", info.BacklogFirstByteOffset)
+	writeField(b, "repl_backlog_histlen", info.BacklogHistLen)
+}
@@ -0,0 +1,634 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/lua"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	glua "github.com/yuin/gopher-lua"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const EVAL = "EVAL"
+const EVALSHA = "EVALSHA"
+const SCRIPT = "SCRIPT"
+
+// scriptChunk names the scripts in their error messages, like Redis
+const scriptChunk = "user_script"
+
+var NoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+var Busy = errors.New("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+
+var NotBusy = errors.New("NOTBUSY No scripts in execution right now.")
+
+var Unkillable = errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+
+var ScriptKilled = errors.New("Script killed by user with SCRIPT KILL...")
+
+var NegativeNumberOfKeys = errors.New("Number of keys can't be negative")
+
+var TooManyKeys = errors.New("Number of keys can't be greater than number of args")
+
+var ScriptCompileError = errors.New("Error compiling script (new function)")
+
+var NotAllowedFromScript = errors.New("This Redis command is not allowed from script")
+
+var UnknownScriptCommand = errors.New("Unknown Redis command called from script")
+
+var ScriptWrongArguments = errors.New("Please specify at least one argument for this redis lib call")
+
+var ScriptInvalidArgument = errors.New("Lua redis lib command arguments must be strings or integers")
+
+var WriteFromReadOnlyScript = errors.New("Write commands are not allowed from read-only scripts.")
+
+var ScriptCommandFailed = errors.New("Error running script command")
+
+var NotAllowedDuringLoad = errors.New("Redis commands can't be called while loading a library")
+
+var ScriptFlushOption = errors.New("SCRIPT FLUSH only support SYNC|ASYNC option")
+
+// ScriptOptions are the checks the server runs on the commands called by
+// scripts, like the permissions of the client running them
+type ScriptOptions struct {
+	// Check is called before each command, an error fails the command
+	Check func(command []interface{}) error
+	// DenyWrite is returned by the functions that may write, the ones
+	// without the no-writes flag, like on read only replicas
+	DenyWrite error
+	// Caller is the client that runs the script, for the slow log
+	Caller Caller
+}
+
+// scripting holds the script cache and the script in progress
+type scripting struct {
+	// lock is held exclusively while a script runs and shared by the
+	// other commands, so scripts are atomic
+	lock    sync.RWMutex
+	running atomic.Pointer[scriptRun]
+	// changed is closed when the script in progress ends or turns busy,
+	// so the commands waiting for it check it again
+	changedLock sync.Mutex
+	changed     chan struct{}
+	// cacheLock guards cache, the compiled scripts by SHA1
+	cacheLock sync.RWMutex
+	cache     map[string]*glua.FunctionProto
+}
+
+// scriptRun is a script in progress
+type scriptRun struct {
+	start  time.Time
+	cancel context.CancelFunc
+	// wrote is set by the first write command, then the script can't be
+	// killed without leaving the dataset half modified
+	wrote  atomic.Bool
+	killed atomic.Bool
+}
+
+// ScriptSHA returns the SHA1 of a script in hexadecimal, its name in EVALSHA
+func ScriptSHA(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadScript compiles the script and caches it, like SCRIPT LOAD
+func (e *Engine) loadScript(body string) (string, *glua.FunctionProto, error) {
+	sha := ScriptSHA(body)
+	e.scripting.cacheLock.RLock()
+	chunk, ok := e.scripting.cache[sha]
+	e.scripting.cacheLock.RUnlock()
+	if ok {
+		return sha, chunk, nil
+	}
+
+	chunk, err := lua.Compile(scriptChunk, body)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s", ScriptCompileError, err)
+	}
+	e.scripting.cacheLock.Lock()
+	if e.scripting.cache == nil {
+		e.scripting.cache = make(map[string]*glua.FunctionProto)
+	}
+	e.scripting.cache[sha] = chunk
+	e.scripting.cacheLock.Unlock()
+	return sha, chunk, nil
+}
+
+func (e *Engine) cachedScript(sha string) (*glua.FunctionProto, bool) {
+	e.scripting.cacheLock.RLock()
+	defer e.scripting.cacheLock.RUnlock()
+	chunk, ok := e.scripting.cache[strings.ToLower(sha)]
+	return chunk, ok
+}
+
+// ScriptBusy reports whether a script runs for longer than busy-reply-threshold
+func (e *Engine) ScriptBusy() bool {
+	run := e.scripting.running.Load()
+	if run == nil {
+		return false
+	}
+	threshold := time.Duration(e.config.GetInt(config.BusyReplyThreshold)) * time.Millisecond
+	return time.Since(run.start) >= threshold
+}
+
+// changes returns the channel closed on the next change of the script in
+// progress
+func (s *scripting) changes() <-chan struct{} {
+	s.changedLock.Lock()
+	defer s.changedLock.Unlock()
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
+
+// notify wakes the commands waiting for the script in progress
+func (s *scripting) notify() {
+	s.changedLock.Lock()
+	defer s.changedLock.Unlock()
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// acquireScripting waits for the script in progress, commands get Busy
+// instead once the script runs for longer than busy-reply-threshold.
+// Scripts block when no script runs, so readers don't starve them.
+func (e *Engine) acquireScripting(exclusive bool) error {
+	if !exclusive && !e.ScriptBusy() && e.scripting.lock.TryRLock() {
+		return nil
+	}
+
+	for {
+		// The channel is taken before checking, so a change in between
+		// is not missed
+		changed := e.scripting.changes()
+		if e.ScriptBusy() {
+			return Busy
+		}
+		if exclusive {
+			if e.scripting.running.Load() == nil {
+				e.scripting.lock.Lock()
+				return nil
+			}
+			if e.scripting.lock.TryLock() {
+				return nil
+			}
+		} else if e.scripting.lock.TryRLock() {
+			return nil
+		}
+		<-changed
+	}
+}
+
+// Eval runs EVAL, EVALSHA, FCALL and FCALL_RO. The script runs
+// atomically: other commands wait for it, and its write commands are
+// propagated one by one, like the effects replication of Redis.
+func (e *Engine) Eval(payloadArray []interface{}, opts ScriptOptions) (interface{}, error) {
+	start := time.Now()
+	var res interface{}
+	var err error
+	switch payloadArray[0] {
+	case FCALL, FCALL_RO:
+		res, err = e.fcall(payloadArray, opts)
+	default:
+		res, err = e.eval(payloadArray, opts)
+	}
+	e.stats.recordCommand(payloadArray[0].(string), start, err)
+	e.slowlog.record(start, payloadArray, opts.Caller)
+	e.RecordCommandLatency(payloadArray, start)
+	return res, err
+}
+
+func (e *Engine) eval(payloadArray []interface{}, opts ScriptOptions) (interface{}, error) {
+	if len(payloadArray) < 3 {
+		return nil, WrongNumberOfArguments
+	}
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	var sha string
+	var chunk *glua.FunctionProto
+	if payloadArray[0] == EVAL {
+		if sha, chunk, err = e.loadScript(args[0]); err != nil {
+			return nil, err
+		}
+	} else {
+		sha = strings.ToLower(args[0])
+		var ok bool
+		if chunk, ok = e.cachedScript(sha); !ok {
+			return nil, NoScript
+		}
+	}
+
+	keys, argv, err := scriptArguments(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	state := lua.NewState()
+	defer state.Close()
+	env := &scriptEnv{}
+	e.openRedis(state, env)
+	state.SetGlobal("KEYS", stringsTable(state, keys))
+	state.SetGlobal("ARGV", stringsTable(state, argv))
+	lua.Sandbox(state)
+
+	results, err := e.runScript(env, opts, false, func(ctx context.Context) ([]glua.LValue, error) {
+		return lua.Run(ctx, state, chunk)
+	})
+	if err != nil {
+		if errors.Is(err, ScriptKilled) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s script: %s", err, sha)
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return luaToReply(results[0])
+}
+
+// scriptArguments splits the arguments after the number of keys, its
+// first argument, in keys and the other arguments
+func scriptArguments(args []string) ([]string, []string, error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, NotAnInteger
+	}
+	if numKeys < 0 {
+		return nil, nil, NegativeNumberOfKeys
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, TooManyKeys
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+// runScript runs a script with the locks that make it atomic, the
+// commands it calls are run in env
+func (e *Engine) runScript(env *scriptEnv, opts ScriptOptions, readOnly bool, script func(ctx context.Context) ([]glua.LValue, error)) ([]glua.LValue, error) {
+	if err := e.acquireScripting(true); err != nil {
+		return nil, err
+	}
+	defer e.scripting.notify()
+	defer e.scripting.lock.Unlock()
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := &scriptRun{start: time.Now(), cancel: cancel}
+	e.scripting.running.Store(run)
+	defer e.scripting.running.Store(nil)
+	// The commands waiting for the script reply Busy once it turns busy
+	threshold := time.Duration(e.config.GetInt(config.BusyReplyThreshold)) * time.Millisecond
+	busy := time.AfterFunc(threshold, e.scripting.notify)
+	defer busy.Stop()
+	env.run, env.opts, env.readOnly = run, opts, readOnly
+	defer func() { env.run = nil }()
+
+	results, err := script(ctx)
+	if run.killed.Load() {
+		return nil, ScriptKilled
+	}
+	return results, err
+}
+
+// KillScript stops the script in progress, like SCRIPT KILL. Scripts that
+// wrote are only stopped when force is set, like by SHUTDOWN NOSAVE.
+func (e *Engine) KillScript(force bool) error {
+	run := e.scripting.running.Load()
+	if run == nil {
+		return NotBusy
+	}
+	if run.wrote.Load() && !force {
+		return Unkillable
+	}
+	run.killed.Store(true)
+	run.cancel()
+	return nil
+}
+
+// scriptCommand runs SCRIPT, it doesn't wait for the script in progress
+// so SCRIPT KILL can stop it
+func (e *Engine) scriptCommand(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, WrongNumberOfArguments
+	}
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "LOAD":
+		if len(args) != 2 {
+			return nil, WrongNumberOfArguments
+		}
+		sha, _, err := e.loadScript(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return sha, nil
+	case "EXISTS":
+		if len(args) < 2 {
+			return nil, WrongNumberOfArguments
+		}
+		reply := make([]interface{}, 0, len(args)-1)
+		for _, sha := range args[1:] {
+			_, ok := e.cachedScript(sha)
+			reply = append(reply, int64(boolToInt(ok)))
+		}
+		return reply, nil
+	case "FLUSH":
+		if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "SYNC") && !strings.EqualFold(args[1], "ASYNC")) {
+			return nil, ScriptFlushOption
+		}
+		e.scripting.cacheLock.Lock()
+		e.scripting.cache = nil
+		e.scripting.cacheLock.Unlock()
+		return OK, nil
+	case "KILL":
+		if err := e.KillScript(false); err != nil {
+			return nil, err
+		}
+		return OK, nil
+	default:
+		return nil, UnsupportedCommandError
+	}
+}
+
+// cachedScripts is the number of scripts in the cache
+func (e *Engine) cachedScripts() int {
+	e.scripting.cacheLock.RLock()
+	defer e.scripting.cacheLock.RUnlock()
+	return len(e.scripting.cache)
+}
+
+// scriptEnv is where the commands called by a script run
+type scriptEnv struct {
+	// run is the script in progress, commands can't be called without it
+	run  *scriptRun
+	opts ScriptOptions
+	// readOnly scripts can't call write commands
+	readOnly bool
+}
+
+// openRedis registers the redis library of scripts
+func (e *Engine) openRedis(L *glua.LState, env *scriptEnv) *glua.LTable {
+	redis := L.NewTable()
+	call := func(protected bool) glua.LGFunction {
+		return func(L *glua.LState) int {
+			args := make([]glua.LValue, L.GetTop())
+			for i := range args {
+				args[i] = L.Get(i + 1)
+			}
+			res, err := e.scriptCall(L, env, args)
+			if err != nil {
+				reply := errorTable(L, err.Error())
+				if !protected {
+					L.Error(reply, 0)
+				}
+				res = reply
+			}
+			L.Push(res)
+			return 1
+		}
+	}
+	L.SetFuncs(redis, map[string]glua.LGFunction{
+		"call":  call(false),
+		"pcall": call(true),
+		"error_reply": func(L *glua.LState) int {
+			L.Push(errorTable(L, L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *glua.LState) int {
+			t := L.NewTable()
+			t.RawSetString("ok", glua.LString(L.CheckString(1)))
+			L.Push(t)
+			return 1
+		},
+		"sha1hex": func(L *glua.LState) int {
+			L.Push(glua.LString(ScriptSHA(L.ToString(1))))
+			return 1
+		},
+		// The engine has no log, the messages of scripts are discarded
+		"log": func(L *glua.LState) int {
+			return 0
+		},
+		// Write commands are always replicated one by one
+		"replicate_commands": func(L *glua.LState) int {
+			L.Push(glua.LTrue)
+			return 1
+		},
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, glua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+	return redis
+}
+
+// scriptCall runs a command of redis.call, the script holds the locks
+func (e *Engine) scriptCall(L *glua.LState, env *scriptEnv, args []glua.LValue) (res glua.LValue, err error) {
+	// A command that panics fails the call instead of the server
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("%w: %v", ScriptCommandFailed, r)
+		}
+	}()
+	if env.run == nil {
+		return nil, NotAllowedDuringLoad
+	}
+	if len(args) == 0 {
+		return nil, ScriptWrongArguments
+	}
+	command := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case glua.LString:
+			command[i] = string(arg)
+		case glua.LNumber:
+			command[i] = strconv.FormatFloat(float64(arg), 'g', 17, 64)
+		default:
+			return nil, ScriptInvalidArgument
+		}
+	}
+	name := strings.ToUpper(command[0].(string))
+	command[0] = name
+
+	info, ok := lookupCommand(command)
+	if !ok {
+		return nil, UnknownScriptCommand
+	}
+	if info.noScript {
+		return nil, NotAllowedFromScript
+	}
+	if info.write && env.readOnly {
+		return nil, WriteFromReadOnlyScript
+	}
+	if env.opts.Check != nil {
+		if err := env.opts.Check(command); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	reply, err := e.execute(name, command)
+	e.stats.recordCommand(name, start, err)
+	if err != nil {
+		return nil, err
+	}
+	if info.write {
+		env.run.wrote.Store(true)
+		e.stats.dirty.Add(1)
+		e.propagate(command)
+	}
+	return replyToLua(L, reply, statusReply(name, reply)), nil
+}
+
+// statusReply reports whether Redis sends the reply as a status, which
+// scripts receive as a table with an ok field
+func statusReply(name string, res interface{}) bool {
+	if _, ok := res.(string); !ok {
+		return false
+	}
+	switch name {
+	case ECHO, INFO, OBJECT, MEMORY:
+		return false
+	}
+	return true
+}
+
+// replyToLua converts replies following the rules of Redis: integers to
+// numbers, nil to false, arrays to tables and status replies to tables
+// with an ok field
+func replyToLua(L *glua.LState, res interface{}, status bool) glua.LValue {
+	switch v := res.(type) {
+	case string:
+		if status {
+			t := L.NewTable()
+			t.RawSetString("ok", glua.LString(v))
+			return t
+		}
+		return glua.LString(v)
+	case *values.String:
+		return glua.LString(v.String())
+	case int64:
+		return glua.LNumber(v)
+	case int:
+		return glua.LNumber(v)
+	case *values.List:
+		t := L.NewTable()
+		for element := range v.Iterator() {
+			t.Append(replyToLua(L, element, false))
+		}
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, element := range v {
+			t.Append(replyToLua(L, element, false))
+		}
+		return t
+	case error:
+		return errorTable(L, v.Error())
+	}
+	return glua.LFalse
+}
+
+// maxReplyDepth bounds the nesting of the tables returned by scripts,
+// like LUAI_MAXCSTACK, deeper replies are errors
+const maxReplyDepth = 8000
+
+var ReplyTooDeep = errors.New("reached lua stack limit")
+
+// luaToReply converts the result of a script following the rules of
+// Redis: numbers are truncated to integers, true is 1, false is nil, and
+// tables are arrays up to their first nil, or errors and status replies
+// when they have an err or ok field
+func luaToReply(v glua.LValue) (interface{}, error) {
+	return luaToReplyDepth(v, 0)
+}
+
+func luaToReplyDepth(v glua.LValue, depth int) (interface{}, error) {
+	switch v := v.(type) {
+	case glua.LBool:
+		if v {
+			return int64(1), nil
+		}
+		return nil, nil
+	case glua.LNumber:
+		return int64(v), nil
+	case glua.LString:
+		return string(v), nil
+	case *glua.LTable:
+		if depth >= maxReplyDepth {
+			return nil, ReplyTooDeep
+		}
+		if msg, ok := v.RawGetString("err").(glua.LString); ok {
+			return nil, errors.New(string(msg))
+		}
+		if msg, ok := v.RawGetString("ok").(glua.LString); ok {
+			return string(msg), nil
+		}
+		reply := make([]interface{}, 0, v.Len())
+		for i := 1; ; i++ {
+			element := v.RawGetInt(i)
+			if element == glua.LNil {
+				break
+			}
+			res, err := luaToReplyDepth(element, depth+1)
+			if errors.Is(err, ReplyTooDeep) {
+				return nil, err
+			}
+			if err != nil {
+				res = err
+			}
+			reply = append(reply, res)
+		}
+		return reply, nil
+	}
+	return nil, nil
+}
+
+func errorTable(L *glua.LState, msg string) *glua.LTable {
+	t := L.NewTable()
+	t.RawSetString("err", glua.LString(msg))
+	return t
+}
+
+func stringsTable(L *glua.LState, strs []string) *glua.LTable {
+	t := L.CreateTable(len(strs), 0)
+	for _, str := range strs {
+		t.Append(glua.LString(str))
+	}
+	return t
+}
+
+// toStrings converts the arguments of a command, integers are formatted
+func toStrings(payload []interface{}) ([]string, error) {
+	strs := make([]string, 0, len(payload))
+	for _, arg := range payload {
+		switch arg := arg.(type) {
+		case string:
+			strs = append(strs, arg)
+		case int64:
+			strs = append(strs, strconv.FormatInt(arg, 10))
+		default:
+			return nil, UnsupportedTypeForCommand
+		}
+	}
+	return strs, nil
+}
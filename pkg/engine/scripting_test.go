@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func eval(eng *Engine, script string, keys []string, args ...string) (interface{}, error) {
+	command := []interface{}{EVAL, script, int64(len(keys))}
+	for _, key := range keys {
+		command = append(command, key)
+	}
+	for _, arg := range args {
+		command = append(command, arg)
+	}
+	return eng.Process(command)
+}
+
+func TestEngine_EVAL(t *testing.T) {
+	// The command exists already when the tests run again with -count
+	_ = RegisterCommand(Command{
+		Name: "TEST.SCRIPTPANIC",
+		Handler: func(ks Keyspace, args []string) (interface{}, error) {
+			panic("test panic")
+		},
+	})
+
+	tt := []struct {
+		name     string
+		script   string
+		keys     []string
+		args     []string
+		expected interface{}
+		err      string
+	}{
+		{name: "integer", script: "return 3.99", expected: int64(3)},
+		{name: "string", script: "return 'hello'", expected: "hello"},
+		{name: "true", script: "return true", expected: int64(1)},
+		{name: "false", script: "return false", expected: nil},
+		{name: "nothing", script: "local a = 1", expected: nil},
+		{name: "array stops at nil", script: "return {1, 'two', nil, 4}", expected: []interface{}{int64(1), "two"}},
+		{name: "nested array", script: "return {1, {2, 3}}", expected: []interface{}{int64(1), []interface{}{int64(2), int64(3)}}},
+		{name: "status reply", script: "return redis.status_reply('FINE')", expected: "FINE"},
+		{name: "error reply", script: "return redis.error_reply('MY error')", err: "MY error"},
+		{name: "keys and args", script: "return {KEYS[1], KEYS[2], ARGV[1]}", keys: []string{"a", "b"}, args: []string{"c"}, expected: []interface{}{"a", "b", "c"}},
+		{name: "call", script: "redis.call('set', KEYS[1], ARGV[1]) return redis.call('GET', KEYS[1])", keys: []string{"key"}, args: []string{"value"}, expected: "value"},
+		{name: "call status", script: "return redis.call('SET', 'key', 'value').ok", expected: "OK"},
+		{name: "call missing key", script: "return redis.call('GET', 'missing') == false", expected: int64(1)},
+		{name: "call integer", script: "return redis.call('RPUSH', 'list', 'a', 'b') + redis.call('EXISTS', 'list')", expected: int64(3)},
+		{name: "call list", script: "redis.call('RPUSH', 'list', 'a', 'b') return redis.call('GET', 'list')", expected: []interface{}{"a", "b"}},
+		{name: "call number argument", script: "redis.call('SET', 'n', 10) return redis.call('GET', 'n')", expected: "10"},
+		{name: "call raises errors", script: "redis.call('SET', 'key', 'value') return redis.call('INCR', 'key')", err: "value is not an integer or out of range script: "},
+		{name: "pcall returns errors", script: "local r = redis.pcall('NOPE') return r.err", expected: "Unknown Redis command called from script"},
+		{name: "call wrong arity", script: "return redis.call('GET')", err: "wrong number of arguments"},
+		{name: "pcall wrong arity", script: "return redis.pcall('SET', 'k').err", expected: "wrong number of arguments"},
+		{name: "call panic", script: "return redis.call('TEST.SCRIPTPANIC')", err: "Error running script command: test panic"},
+		{name: "command not allowed", script: "return redis.call('SAVE')", err: "This Redis command is not allowed from script"},
+		{name: "invalid argument", script: "return redis.call('GET', {})", err: "Lua redis lib command arguments must be strings or integers"},
+		{name: "sha1hex", script: "return redis.sha1hex('')", expected: "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{name: "global access", script: "return foo", err: "Script attempted to access nonexistent global variable 'foo'"},
+		{name: "global write", script: "foo = 1", err: "Attempt to modify a readonly table"},
+		{name: "runtime error", script: "error('boom')", err: "boom script: "},
+		{name: "compile error", script: "return (", err: "Error compiling script (new function)"},
+		{name: "negative number truncated", script: "return -3.99", expected: int64(-3)},
+		{name: "error in array", script: "return {1, redis.error_reply('E')}", expected: []interface{}{int64(1), errors.New("E")}},
+		{name: "status in array", script: "return {redis.status_reply('FINE')}", expected: []interface{}{"FINE"}},
+		{name: "call float argument", script: "redis.call('SET', 'n', 1.5) return redis.call('GET', 'n')", expected: "1.5"},
+		{name: "call reply types", script: "redis.call('SET', 'k', 'v') return {type(redis.call('SET', 'k', 'v')), type(redis.call('EXISTS', 'k')), type(redis.call('GET', 'k')), type(redis.call('GET', 'missing'))}", expected: []interface{}{"table", "number", "string", "boolean"}},
+		{name: "call nested reply", script: "redis.call('SET', 'k', 'v') local r = redis.call('SCAN', 0) return {r[1], r[2][1]}", expected: []interface{}{"0", "k"}},
+		{name: "pcall error table", script: "redis.call('SET', 'k', 'v') local r = redis.pcall('INCR', 'k') return {type(r), r.err}", expected: []interface{}{"table", "value is not an integer or out of range"}},
+		{name: "pcall error returned", script: "redis.call('SET', 'k', 'v') return redis.pcall('INCR', 'k')", err: "value is not an integer or out of range"},
+		{name: "call error caught by pcall", script: "local ok, err = pcall(redis.call, 'NOPE') return {tostring(ok), type(err)}", expected: []interface{}{"false", "table"}},
+		{name: "reply too deep", script: "local t = {} for i = 1, 10000 do t = {t} end return t", err: "reached lua stack limit"},
+		{name: "bit library", script: "return {bit.band(0xff, 0x0f), bit.tobit(0xffffffff), bit.tohex(255, 2)}", expected: []interface{}{int64(15), int64(-1), "ff"}},
+		{name: "struct library", script: "local s = struct.pack('>I2s', 258, 'ab') return {s, struct.unpack('>I2s', s)}", expected: []interface{}{"\x01\x02ab\x00", int64(258), "ab", int64(6)}},
+		{name: "cjson null", script: "return {cjson.encode(cjson.decode('[null]')), tostring(cjson.decode('[null]')[1] == cjson.null)}", expected: []interface{}{"[null]", "true"}},
+		{name: "cmsgpack", script: "return cmsgpack.unpack(cmsgpack.pack({1, 'a'}))", expected: []interface{}{int64(1), "a"}},
+		{name: "metatables", script: "local t = setmetatable({}, {__index = function(t, k) return k .. '!' end}) return {t.x, tostring(getmetatable(t) ~= nil)}", expected: []interface{}{"x!", "true"}},
+		{name: "math random", script: "local n = math.random(10) return n >= 1 and n <= 10", expected: int64(1)},
+		{name: "protected globals", script: "setmetatable(_G, nil)", err: "cannot change a protected metatable"},
+		{name: "syntax too deep", script: "return " + strings.Repeat("{", 1000) + strings.Repeat("}", 1000), err: "chunk has too many syntax levels"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			eng, _ := NewEngine(EngineOptions{})
+			res, err := eval(eng, tc.script, tc.keys, tc.args...)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, tc.expected) {
+				t.Errorf("expected %#v, got %#v", tc.expected, res)
+			}
+		})
+	}
+}
+
+func TestEngine_EVAL_numkeys(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	if _, err := eng.Process(toCommand("EVAL return 2 a")); !errors.Is(err, TooManyKeys) {
+		t.Errorf("expected too many keys, got %v", err)
+	}
+	if _, err := eng.Process(toCommand("EVAL return -1")); !errors.Is(err, NegativeNumberOfKeys) {
+		t.Errorf("expected negative keys, got %v", err)
+	}
+	if keys := CommandKeys(toCommand("EVAL return 2 a b c")); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("expected keys a and b, got %v", keys)
+	}
+}
+
+func TestEngine_SCRIPT(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	script := "return ARGV[1]"
+	sha := ScriptSHA(script)
+
+	if _, err := eng.Process([]interface{}{EVALSHA, sha, "0", "a"}); !errors.Is(err, NoScript) {
+		t.Fatalf("expected NOSCRIPT, got %v", err)
+	}
+
+	res, err := eng.Process([]interface{}{SCRIPT, "LOAD", script})
+	if err != nil || res != sha {
+		t.Fatalf("expected %s, got %v, error %v", sha, res, err)
+	}
+	res, err = eng.Process([]interface{}{EVALSHA, strings.ToUpper(sha), "0", "a"})
+	if err != nil || res != "a" {
+		t.Errorf("expected a, got %v, error %v", res, err)
+	}
+
+	res, _ = eng.Process([]interface{}{SCRIPT, "EXISTS", sha, "missing"})
+	if !reflect.DeepEqual(res, []interface{}{int64(1), int64(0)}) {
+		t.Errorf("unexpected SCRIPT EXISTS %v", res)
+	}
+	if fields := infoFields(t, eng, "memory"); fields["number_of_cached_scripts"] != "1" {
+		t.Errorf("expected 1 cached script, got %s", fields["number_of_cached_scripts"])
+	}
+
+	if _, err := eng.Process([]interface{}{SCRIPT, "FLUSH", "ASYNC"}); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = eng.Process([]interface{}{SCRIPT, "EXISTS", sha})
+	if !reflect.DeepEqual(res, []interface{}{int64(0)}) {
+		t.Errorf("expected flushed script, got %v", res)
+	}
+
+	if _, err := eng.Process(toCommand("SCRIPT KILL")); !errors.Is(err, NotBusy) {
+		t.Errorf("expected NOTBUSY, got %v", err)
+	}
+}
+
+func TestEngine_EVAL_propagatesWrites(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	var commands [][]interface{}
+	eng.OnWrite(func(command []interface{}) {
+		commands = append(commands, command)
+	})
+
+	_, err := eval(eng, "redis.call('set', 'a', '1') redis.call('get', 'a') redis.call('incr', 'a')", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]interface{}{{"SET", "a", "1"}, {"INCR", "a"}}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+}
+
+func TestEngine_SCRIPT_KILL(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	if err := eng.Config().Set(config.BusyReplyThreshold, "50"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := eval(eng, "while true do end", nil)
+		done <- err
+	}()
+
+	// Commands wait for the script until it is busy
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if _, err = eng.Process(toCommand("GET key")); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, Busy) {
+		t.Fatalf("expected BUSY, got %v", err)
+	}
+
+	if _, err := eng.Process(toCommand("SCRIPT KILL")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ScriptKilled) {
+		t.Errorf("expected killed script, got %v", err)
+	}
+	if _, err := eng.Process(toCommand("GET key")); err != nil {
+		t.Errorf("expected GET after the script, got %v", err)
+	}
+}
+
+func TestEngine_EVAL_waitingCommands(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+
+	done := make(chan error)
+	go func() {
+		_, err := eval(eng, "while true do end", nil)
+		done <- err
+	}()
+	for eng.scripting.running.Load() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The command blocks until the script ends, before it is busy
+	replied := make(chan error)
+	go func() {
+		_, err := eng.Process(toCommand("GET key"))
+		replied <- err
+	}()
+	select {
+	case err := <-replied:
+		t.Fatalf("expected GET to wait for the script, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := eng.KillScript(false); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	select {
+	case err := <-replied:
+		if err != nil {
+			t.Errorf("expected GET after the script, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected GET to run once the script ended")
+	}
+}
+
+func TestEngine_SCRIPT_KILL_unkillable(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	if err := eng.Config().Set(config.BusyReplyThreshold, "50"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := eval(eng, "redis.call('SET', 'a', 'b') while true do end", nil)
+		done <- err
+	}()
+
+	for !eng.ScriptBusy() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := eng.Process(toCommand("SCRIPT KILL")); !errors.Is(err, Unkillable) {
+		t.Errorf("expected UNKILLABLE, got %v", err)
+	}
+	if err := eng.KillScript(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ScriptKilled) {
+		t.Errorf("expected killed script, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SLOWLOG = "SLOWLOG"
+
+// slowlogMaxArgs and slowlogMaxString truncate the arguments of the
+// entries, like SLOWLOG_ENTRY_MAX_ARGC and SLOWLOG_ENTRY_MAX_STRING
+const slowlogMaxArgs = 32
+const slowlogMaxString = 128
+
+// slowlogDefaultCount is the number of entries of SLOWLOG GET without count
+const slowlogDefaultCount = 10
+
+var InvalidCount = errors.New("count should be greater than or equal to -1")
+
+// Caller is the client of a command, it identifies the entries of the
+// slow log. Commands without a client, like the ones of the typed API,
+// are logged with an empty address and name.
+type Caller interface {
+	Addr() string
+	Name() string
+}
+
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []interface{}
+	addr     string
+	name     string
+}
+
+// slowlog keeps the commands that ran for longer than
+// slowlog-log-slower-than in a ring of slowlog-max-len entries
+type slowlog struct {
+	// threshold is in microseconds, negative values disable the log
+	threshold atomic.Int64
+
+	lock    sync.Mutex
+	entries []slowlogEntry
+	// next is the index of the next entry, count the entries in the ring
+	next   int
+	count  int
+	lastID int64
+}
+
+// bindSlowlog loads the slow log settings and follows their changes
+func (e *Engine) bindSlowlog() {
+	e.slowlog.threshold.Store(e.config.GetInt(config.SlowlogLogSlowerThan))
+	e.config.OnChange(config.SlowlogLogSlowerThan, func(value string) error {
+		threshold, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return config.InvalidArgument
+		}
+		e.slowlog.threshold.Store(threshold)
+		return nil
+	})
+
+	e.slowlog.setMaxLen(int(e.config.GetInt(config.SlowlogMaxLen)))
+	e.config.OnChange(config.SlowlogMaxLen, func(value string) error {
+		maxLen, err := strconv.Atoi(value)
+		if err != nil || maxLen < 0 {
+			return config.InvalidArgument
+		}
+		e.slowlog.setMaxLen(maxLen)
+		return nil
+	})
+}
+
+// RecordSlowlog logs a command run outside of the engine, like the ones of
+// the server, when it ran for longer than slowlog-log-slower-than
+func (e *Engine) RecordSlowlog(start time.Time, payloadArray []interface{}, caller Caller) {
+	e.slowlog.record(start, payloadArray, caller)
+}
+
+// record logs the command when it ran for longer than the threshold
+func (l *slowlog) record(start time.Time, payloadArray []interface{}, caller Caller) {
+	duration := time.Since(start)
+	threshold := l.threshold.Load()
+	if threshold < 0 || duration < time.Duration(threshold)*time.Microsecond {
+		return
+	}
+
+	entry := slowlogEntry{time: start, duration: duration, args: slowlogArgs(payloadArray)}
+	if caller != nil {
+		entry.addr, entry.name = caller.Addr(), caller.Name()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lastID++
+	entry.id = l.lastID
+	l.push(entry)
+}
+
+// push adds an entry to the ring, the lock must be held
+func (l *slowlog) push(entry slowlogEntry) {
+	if len(l.entries) == 0 {
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	l.count = min(l.count+1, len(l.entries))
+}
+
+// newest returns up to n entries, the newest first, the lock must be held
+func (l *slowlog) newest(n int) []slowlogEntry {
+	n = min(n, l.count)
+	entries := make([]slowlogEntry, n)
+	for i := range entries {
+		entries[i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	return entries
+}
+
+// setMaxLen resizes the ring, keeping the newest entries
+func (l *slowlog) setMaxLen(maxLen int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	kept := l.newest(maxLen)
+	l.entries = make([]slowlogEntry, maxLen)
+	l.next, l.count = 0, 0
+	for i := len(kept) - 1; i >= 0; i-- {
+		l.push(kept[i])
+	}
+}
+
+func (l *slowlog) reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	clear(l.entries)
+	l.next, l.count = 0, 0
+}
+
+// slowlogArgs copies the arguments redacted and truncated like Redis: the
+// last one of the logged arguments tells how many more there are, and long
+// strings tell how many more bytes they have
+func slowlogArgs(payloadArray []interface{}) []interface{} {
+	payloadArray = RedactArgs(payloadArray)
+	argc := min(len(payloadArray), slowlogMaxArgs)
+	args := make([]interface{}, argc)
+	for i := range args {
+		if argc != len(payloadArray) && i == argc-1 {
+			args[i] = fmt.Sprintf("... (%d more arguments)", len(payloadArray)-argc+1)
+			break
+		}
+		arg := fmt.Sprint(payloadArray[i])
+		if len(arg) > slowlogMaxString {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxString], len(arg)-slowlogMaxString)
+		}
+		args[i] = arg
+	}
+	return args
+}
+
+// slowlogCommand implements SLOWLOG GET [count], SLOWLOG LEN and SLOWLOG RESET
+func (e *Engine) slowlogCommand(payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, WrongNumberOfArguments
+	}
+	args, err := toStrings(payloadArray[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) > 2 {
+			return nil, WrongNumberOfArguments
+		}
+		count := slowlogDefaultCount
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < -1 {
+				return nil, InvalidCount
+			}
+			count = n
+		}
+
+		e.slowlog.lock.Lock()
+		if count == -1 {
+			count = e.slowlog.count
+		}
+		entries := e.slowlog.newest(count)
+		e.slowlog.lock.Unlock()
+
+		reply := make([]interface{}, len(entries))
+		for i, entry := range entries {
+			reply[i] = []interface{}{
+				entry.id,
+				entry.time.Unix(),
+				entry.duration.Microseconds(),
+				entry.args,
+				entry.addr,
+				entry.name,
+			}
+		}
+		return reply, nil
+	case "LEN":
+		if len(args) != 1 {
+			return nil, WrongNumberOfArguments
+		}
+		e.slowlog.lock.Lock()
+		defer e.slowlog.lock.Unlock()
+		return int64(e.slowlog.count), nil
+	case "RESET":
+		if len(args) != 1 {
+			return nil, WrongNumberOfArguments
+		}
+		e.slowlog.reset()
+		return OK, nil
+	default:
+		return nil, UnsupportedCommandError
+	}
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testCaller struct{}
+
+func (testCaller) Addr() string { return "127.0.0.1:5000" }
+func (testCaller) Name() string { return "worker" }
+
+func TestEngine_SLOWLOG(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	if _, err := eng.Process([]interface{}{CONFIG, "SET", "slowlog-log-slower-than", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	eng.Process([]interface{}{SLOWLOG, "RESET"})
+
+	eng.ProcessFrom([]interface{}{SET, "key", "value"}, testCaller{})
+	eng.Process([]interface{}{GET, "key"})
+
+	// RESET is logged too, like in Redis
+	if n, _ := eng.Process([]interface{}{SLOWLOG, "LEN"}); n != int64(3) {
+		t.Fatalf("expected 3 entries, got %v", n)
+	}
+
+	res, err := eng.Process([]interface{}{SLOWLOG, "GET", "-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := res.([]interface{})
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries with LEN, got %v", entries)
+	}
+	newest, oldest := entries[1].([]interface{}), entries[2].([]interface{})
+	if !reflect.DeepEqual(newest[3], []interface{}{GET, "key"}) || newest[4] != "" || newest[5] != "" {
+		t.Errorf("expected GET without a client first, got %v", newest)
+	}
+	if !reflect.DeepEqual(oldest[3], []interface{}{SET, "key", "value"}) || oldest[4] != "127.0.0.1:5000" || oldest[5] != "worker" {
+		t.Errorf("expected SET of the caller, got %v", oldest)
+	}
+	if newest[0].(int64) != oldest[0].(int64)+1 {
+		t.Errorf("expected increasing ids, got %v and %v", oldest[0], newest[0])
+	}
+
+	if res, _ := eng.Process([]interface{}{SLOWLOG, "GET", "1"}); len(res.([]interface{})) != 1 {
+		t.Errorf("expected one entry, got %v", res)
+	}
+	if _, err := eng.Process([]interface{}{SLOWLOG, "GET", "-2"}); !errors.Is(err, InvalidCount) {
+		t.Errorf("expected an invalid count, got %v", err)
+	}
+
+	eng.Process([]interface{}{CONFIG, "SET", "slowlog-log-slower-than", "-1"})
+	eng.Process([]interface{}{SLOWLOG, "RESET"})
+	eng.Process([]interface{}{GET, "key"})
+	if n, _ := eng.Process([]interface{}{SLOWLOG, "LEN"}); n != int64(0) {
+		t.Errorf("expected a disabled slow log, got %v entries", n)
+	}
+}
+
+func TestEngine_SLOWLOG_MaxLen(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	eng.Process([]interface{}{CONFIG, "SET", "slowlog-log-slower-than", "0"})
+	eng.Process([]interface{}{CONFIG, "SET", "slowlog-max-len", "3"})
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		eng.Process([]interface{}{GET, key})
+	}
+
+	// Shrinking keeps the newest entries, then CONFIG SET is logged
+	eng.Process([]interface{}{CONFIG, "SET", "slowlog-max-len", "2"})
+	res, _ := eng.Process([]interface{}{SLOWLOG, "GET"})
+	entries := res.([]interface{})
+	if len(entries) != 2 || !reflect.DeepEqual(entries[1].([]interface{})[3], []interface{}{GET, "d"}) {
+		t.Errorf("expected CONFIG SET and the GET of d, got %v", entries)
+	}
+}
+
+func TestSlowlogArgs(t *testing.T) {
+	long := strings.Repeat("x", slowlogMaxString+10)
+	if args := slowlogArgs([]interface{}{SET, "key", long}); args[2] != strings.Repeat("x", slowlogMaxString)+"... (10 more bytes)" {
+		t.Errorf("expected a truncated string, got %q", args[2])
+	}
+
+	payload := []interface{}{DEL}
+	for range 40 {
+		payload = append(payload, "key")
+	}
+	args := slowlogArgs(payload)
+	if len(args) != slowlogMaxArgs || args[slowlogMaxArgs-1] != "... (10 more arguments)" {
+		t.Errorf("expected %d arguments, the last one counting the rest, got %q", slowlogMaxArgs, args)
+	}
+}
+
+func TestEngine_SLOWLOG_Redacted(t *testing.T) {
+	eng, _ := NewEngine(EngineOptions{})
+	eng.Process([]interface{}{CONFIG, "SET", "slowlog-log-slower-than", "0"})
+	eng.Process([]interface{}{CONFIG, "SET", "maxmemory-samples", "7", "masterauth", "secret"})
+
+	res, _ := eng.Process([]interface{}{SLOWLOG, "GET", "1"})
+	args := res.([]interface{})[0].([]interface{})[3]
+	want := []interface{}{CONFIG, "SET", "maxmemory-samples", "7", "masterauth", Redacted}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("expected the password redacted, got %v", args)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	payload := []interface{}{MIGRATE, "host", "6379", "", "0", "5000", "AUTH2", "user", "secret", "KEYS", "AUTH"}
+	want := []interface{}{MIGRATE, "host", "6379", "", "0", "5000", "AUTH2", Redacted, Redacted, "KEYS", "AUTH"}
+	if got := RedactArgs(payload); !reflect.DeepEqual(got, want) {
+		t.Errorf("RedactArgs() got = %v, want %v", got, want)
+	}
+	if payload[8] != "secret" {
+		t.Error("expected the arguments to be copied")
+	}
+
+	payload = []interface{}{ACL, "SETUSER", "bob", "on", ">secret", "#5e88", "~*"}
+	want = []interface{}{ACL, "SETUSER", "bob", "on", Redacted, Redacted, "~*"}
+	if got := RedactArgs(payload); !reflect.DeepEqual(got, want) {
+		t.Errorf("RedactArgs() got = %v, want %v", got, want)
+	}
+}
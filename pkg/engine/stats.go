@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// opsSamples and opsSamplePeriod mirror how Redis computes instantaneous_ops_per_sec
+const opsSamples = 16
+const opsSamplePeriod = 100 * time.Millisecond
+
+// Stats holds the counters reported by INFO. The engine maintains the
+// command, keyspace and persistence ones, the server maintains the clients.
+type Stats struct {
+	startTime time.Time
+	runID     string
+
+	connectedClients atomic.Int64
+	totalConnections atomic.Int64
+	// rejectedConnections counts the connections refused by maxclients
+	rejectedConnections atomic.Int64
+	// outputBufferLimitDisconnections and timeoutDisconnections count the
+	// clients closed by client-output-buffer-limit and timeout
+	outputBufferLimitDisconnections atomic.Int64
+	timeoutDisconnections           atomic.Int64
+	// syncFull, syncPartialOK and syncPartialErr count the synchronizations
+	// of replicas, the partial ones that failed became full ones
+	syncFull       atomic.Int64
+	syncPartialOK  atomic.Int64
+	syncPartialErr atomic.Int64
+
+	totalCommands  atomic.Int64
+	errorReplies   atomic.Int64
+	keyspaceHits   atomic.Int64
+	keyspaceMisses atomic.Int64
+	evictedKeys    atomic.Int64
+	commands       sync.Map // command name to *commandStats
+	ops            opsSampler
+
+	// dirty counts the writes since the last save
+	dirty      atomic.Int64
+	loading    atomic.Bool
+	lastSave   atomic.Int64 // unix seconds
+	lastSaveOK atomic.Bool
+}
+
+type commandStats struct {
+	calls         atomic.Int64
+	usec          atomic.Int64
+	rejectedCalls atomic.Int64
+	failedCalls   atomic.Int64
+	// histogram counts the calls by duration, see latencyBucket
+	histogram [latencyBuckets]atomic.Int64
+}
+
+func NewStats() *Stats {
+	s := &Stats{
+		startTime: time.Now(),
+		runID:     newRunID(),
+	}
+	s.lastSave.Store(s.startTime.Unix())
+	s.lastSaveOK.Store(true)
+	return s
+}
+
+func newRunID() string {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (s *Stats) ClientConnected() {
+	s.connectedClients.Add(1)
+	s.totalConnections.Add(1)
+}
+
+func (s *Stats) ClientDisconnected() {
+	s.connectedClients.Add(-1)
+}
+
+// RejectedConnection counts a connection refused because of maxclients
+func (s *Stats) RejectedConnection() {
+	s.rejectedConnections.Add(1)
+}
+
+// OutputBufferLimitDisconnection counts a client closed for exceeding its
+// output buffer limits
+func (s *Stats) OutputBufferLimitDisconnection() {
+	s.outputBufferLimitDisconnections.Add(1)
+}
+
+// TimeoutDisconnection counts a client closed for being idle
+func (s *Stats) TimeoutDisconnection() {
+	s.timeoutDisconnections.Add(1)
+}
+
+// SyncFull counts a full synchronization of a replica
+func (s *Stats) SyncFull() {
+	s.syncFull.Add(1)
+}
+
+// SyncPartial counts a partial synchronization request of a replica,
+// accepted or not
+func (s *Stats) SyncPartial(ok bool) {
+	if ok {
+		s.syncPartialOK.Add(1)
+	} else {
+		s.syncPartialErr.Add(1)
+	}
+}
+
+func (s *Stats) commandStats(name string) *commandStats {
+	stats, ok := s.commands.Load(name)
+	if !ok {
+		stats, _ = s.commands.LoadOrStore(name, &commandStats{})
+	}
+	return stats.(*commandStats)
+}
+
+// RecordCommand updates the stats of a command executed outside the engine,
+// like the CLIENT commands handled by the server
+func (s *Stats) RecordCommand(name string, start time.Time, err error) {
+	s.recordCommand(name, start, err)
+}
+
+// RecordRejected counts a command the server rejected before executing it,
+// like the commands denied by the ACLs
+func (s *Stats) RecordRejected(name string) {
+	s.errorReplies.Add(1)
+	if _, ok := commandTable[name]; ok {
+		s.commandStats(name).rejectedCalls.Add(1)
+	}
+}
+
+// recordCommand updates the stats of a command that started at "start"
+func (s *Stats) recordCommand(name string, start time.Time, err error) {
+	now := time.Now()
+	s.ops.sample(now, s.totalCommands.Load())
+
+	if err != nil {
+		s.errorReplies.Add(1)
+	}
+
+	// Unknown commands don't get their own stats, like in Redis
+	if errors.Is(err, UnsupportedCommandError) {
+		return
+	}
+
+	stats := s.commandStats(name)
+
+	// Rejected commands are not executed
+	if errors.Is(err, OOMError) {
+		stats.rejectedCalls.Add(1)
+		return
+	}
+
+	s.totalCommands.Add(1)
+	stats.calls.Add(1)
+	stats.usec.Add(now.Sub(start).Microseconds())
+	stats.histogram[latencyBucket(now.Sub(start))].Add(1)
+	if err != nil {
+		stats.failedCalls.Add(1)
+	}
+}
+
+// reset clears the counters like CONFIG RESETSTAT, gauges like the connected clients are kept
+func (s *Stats) reset() {
+	s.totalConnections.Store(0)
+	s.rejectedConnections.Store(0)
+	s.outputBufferLimitDisconnections.Store(0)
+	s.timeoutDisconnections.Store(0)
+	s.syncFull.Store(0)
+	s.syncPartialOK.Store(0)
+	s.syncPartialErr.Store(0)
+	s.ops.reset(&s.totalCommands)
+	s.errorReplies.Store(0)
+	s.keyspaceHits.Store(0)
+	s.keyspaceMisses.Store(0)
+	s.evictedKeys.Store(0)
+	s.commands.Range(func(key, _ interface{}) bool {
+		s.commands.Delete(key)
+		return true
+	})
+}
+
+func (s *Stats) recordSave(err error) {
+	s.lastSaveOK.Store(err == nil)
+	if err == nil {
+		s.lastSave.Store(time.Now().Unix())
+		s.dirty.Store(0)
+	}
+}
+
+// opsSampler keeps the commands per second of the last samples. It is
+// sampled by Cron and by the commands, and before it is read, so the rate
+// decays while the server is idle.
+type opsSampler struct {
+	lock      sync.Mutex
+	next      atomic.Int64 // unix nanoseconds of the next sample
+	lastTime  time.Time
+	lastCount int64
+	samples   [opsSamples]int64
+	index     int
+}
+
+func (o *opsSampler) sample(now time.Time, count int64) {
+	if now.UnixNano() < o.next.Load() || !o.lock.TryLock() {
+		return
+	}
+	defer o.lock.Unlock()
+
+	// A count below the last one was read before a reset, the sampling
+	// starts again from it
+	if !o.lastTime.IsZero() && count >= o.lastCount {
+		elapsed := now.Sub(o.lastTime)
+		rate := (count - o.lastCount) * int64(time.Second) / int64(elapsed)
+		// The periods missed since the last sample get the average rate
+		periods := min(max(int(elapsed/opsSamplePeriod), 1), opsSamples)
+		for range periods {
+			o.samples[o.index] = rate
+			o.index = (o.index + 1) % opsSamples
+		}
+	}
+
+	o.lastTime = now
+	o.lastCount = count
+	o.next.Store(now.Add(opsSamplePeriod).UnixNano())
+}
+
+// reset zeroes the count of commands and discards the samples, under the
+// lock so no sample is computed from the counts before and after it
+func (o *opsSampler) reset(count *atomic.Int64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	count.Store(0)
+	o.lastTime = time.Time{}
+	o.lastCount = 0
+	o.samples = [opsSamples]int64{}
+	o.index = 0
+	o.next.Store(0)
+}
+
+func (o *opsSampler) instantaneous() int64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var sum int64
+	for _, sample := range o.samples {
+		sum += sample
+	}
+	return sum / opsSamples
+}
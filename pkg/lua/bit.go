@@ -0,0 +1,102 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	glua "github.com/yuin/gopher-lua"
+)
+
+// openBit registers the bit library of Redis scripts, LuaBitOp, whose
+// operations work on the numbers as signed 32 bit integers
+func openBit(L *glua.LState) {
+	t := L.NewTable()
+	L.SetFuncs(t, map[string]glua.LGFunction{
+		"tobit": func(L *glua.LState) int {
+			return pushBit(L, checkBit(L, 1))
+		},
+		"tohex": bitTohex,
+		"bnot": func(L *glua.LState) int {
+			return pushBit(L, ^checkBit(L, 1))
+		},
+		"band": bitFold(func(a, b uint32) uint32 { return a & b }),
+		"bor":  bitFold(func(a, b uint32) uint32 { return a | b }),
+		"bxor": bitFold(func(a, b uint32) uint32 { return a ^ b }),
+		"lshift": bitShift(func(b uint32, n uint) uint32 {
+			return b << n
+		}),
+		"rshift": bitShift(func(b uint32, n uint) uint32 {
+			return b >> n
+		}),
+		"arshift": bitShift(func(b uint32, n uint) uint32 {
+			return uint32(int32(b) >> n)
+		}),
+		"rol": bitShift(func(b uint32, n uint) uint32 {
+			return bits.RotateLeft32(b, int(n))
+		}),
+		"ror": bitShift(func(b uint32, n uint) uint32 {
+			return bits.RotateLeft32(b, -int(n))
+		}),
+		"bswap": func(L *glua.LState) int {
+			return pushBit(L, bits.ReverseBytes32(checkBit(L, 1)))
+		},
+	})
+	L.SetGlobal("bit", t)
+}
+
+// checkBit converts the argument to 32 bits like LuaBitOp, rounding it and
+// keeping its lowest bits
+func checkBit(L *glua.LState, n int) uint32 {
+	f := math.RoundToEven(float64(L.CheckNumber(n)))
+	return uint32(int64(math.Mod(f, 1<<32)))
+}
+
+func pushBit(L *glua.LState, b uint32) int {
+	L.Push(glua.LNumber(int32(b)))
+	return 1
+}
+
+// bitFold applies the operation to all the arguments
+func bitFold(op func(a, b uint32) uint32) glua.LGFunction {
+	return func(L *glua.LState) int {
+		b := checkBit(L, 1)
+		for i := 2; i <= L.GetTop(); i++ {
+			b = op(b, checkBit(L, i))
+		}
+		return pushBit(L, b)
+	}
+}
+
+// bitShift applies the shift or the rotation by the lowest 5 bits of the
+// second argument
+func bitShift(op func(b uint32, n uint) uint32) glua.LGFunction {
+	return func(L *glua.LState) int {
+		b, n := checkBit(L, 1), checkBit(L, 2)
+		return pushBit(L, op(b, uint(n&31)))
+	}
+}
+
+// bitTohex formats the number with n hex digits, 8 by default, upper case
+// when n is negative
+func bitTohex(L *glua.LState) int {
+	b := checkBit(L, 1)
+	n := int32(8)
+	if L.Get(2) != glua.LNil {
+		n = int32(checkBit(L, 2))
+	}
+	format := "%0*x"
+	if n < 0 {
+		n, format = -n, "%0*X"
+	}
+	n = min(n, 8)
+	if n == 0 {
+		L.Push(glua.LString(""))
+		return 1
+	}
+	if n < 8 {
+		b &= 1<<(4*n) - 1
+	}
+	L.Push(glua.LString(fmt.Sprintf(format, n, b)))
+	return 1
+}
@@ -0,0 +1,261 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	glua "github.com/yuin/gopher-lua"
+)
+
+// cjsonMaxDepth bounds the nesting of encoded and decoded values, like
+// the default encode_max_depth and decode_max_depth of lua-cjson
+const cjsonMaxDepth = 1000
+
+// cjsonSparseRatio and cjsonSparseSafe are the defaults of
+// encode_sparse_array: arrays with a largest index over safe and over
+// ratio times their number of values are rejected
+const cjsonSparseRatio = 2
+const cjsonSparseSafe = 10
+
+// openCjson registers the cjson library of Redis scripts. JSON null is
+// decoded as cjson.null, a userdata that is encoded back as null.
+func openCjson(L *glua.LState) {
+	null := L.NewUserData()
+	t := L.NewTable()
+	L.SetFuncs(t, map[string]glua.LGFunction{
+		"encode": func(L *glua.LState) int {
+			var buf bytes.Buffer
+			if err := encodeJSON(&buf, L.CheckAny(1), null, 1); err != nil {
+				raise(L, err)
+			}
+			L.Push(glua.LString(buf.String()))
+			return 1
+		},
+		"decode": func(L *glua.LState) int {
+			value, err := cjsonDecode(L, L.CheckString(1), null)
+			if err != nil {
+				raise(L, err)
+			}
+			L.Push(value)
+			return 1
+		},
+	})
+	t.RawSetString("null", null)
+	L.SetGlobal("cjson", t)
+}
+
+// raise raises the error without a position, like the errors of the C
+// libraries
+func raise(L *glua.LState, err error) {
+	L.Error(glua.LString(err.Error()), 0)
+}
+
+// formatNumber formats numbers like Lua, with 14 significant digits
+func formatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return fmt.Sprintf("%.14g", f)
+}
+
+// arrayIndex returns the 0 based index of the positive integer keys
+func arrayIndex(key glua.LValue) (int, bool) {
+	n, ok := key.(glua.LNumber)
+	if !ok || float64(n) != math.Trunc(float64(n)) || n < 1 || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n) - 1, true
+}
+
+func encodeJSON(buf *bytes.Buffer, value glua.LValue, null *glua.LUserData, depth int) error {
+	switch v := value.(type) {
+	case *glua.LNilType:
+		buf.WriteString("null")
+	case glua.LBool:
+		buf.WriteString(strconv.FormatBool(bool(v)))
+	case glua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return errors.New("Cannot serialise number: must not be NaN or Inf")
+		}
+		buf.WriteString(formatNumber(f))
+	case glua.LString:
+		encodeJSONString(buf, string(v))
+	case *glua.LTable:
+		if depth > cjsonMaxDepth {
+			return fmt.Errorf("Cannot serialise, excessive nesting (%d)", depth)
+		}
+		return encodeJSONTable(buf, v, null, depth)
+	case *glua.LUserData:
+		if v != null {
+			return errors.New("Cannot serialise userdata: type not supported")
+		}
+		buf.WriteString("null")
+	default:
+		return fmt.Errorf("Cannot serialise %s: type not supported", value.Type())
+	}
+	return nil
+}
+
+// encodeJSONTable writes tables with only positive integer keys as
+// arrays, with null in their holes, and the others as objects
+func encodeJSONTable(buf *bytes.Buffer, t *glua.LTable, null *glua.LUserData, depth int) error {
+	size, items, isArray := 0, 0, true
+	for key, _ := t.Next(glua.LNil); key != glua.LNil; key, _ = t.Next(key) {
+		items++
+		i, ok := arrayIndex(key)
+		if !ok {
+			isArray = false
+			break
+		}
+		size = max(size, i+1)
+	}
+
+	if isArray && items > 0 {
+		if size > cjsonSparseSafe && size > items*cjsonSparseRatio {
+			return errors.New("Cannot serialise table: excessively sparse array")
+		}
+		buf.WriteByte('[')
+		for i := 1; i <= size; i++ {
+			if i > 1 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, t.RawGetInt(i), null, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+
+	buf.WriteByte('{')
+	first := true
+	for key, value := t.Next(glua.LNil); key != glua.LNil; key, value = t.Next(key) {
+		var name string
+		switch k := key.(type) {
+		case glua.LString:
+			name = string(k)
+		case glua.LNumber:
+			name = formatNumber(float64(k))
+		default:
+			return errors.New("Cannot serialise table: table key must be a number or string")
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		encodeJSONString(buf, name)
+		buf.WriteByte(':')
+		if err := encodeJSON(buf, value, null, depth+1); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// encodeJSONString escapes like lua-cjson, which escapes the slash too
+func encodeJSONString(buf *bytes.Buffer, str string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '/':
+			buf.WriteString(`\/`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(buf, `\u%04x`, c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+func cjsonDecode(L *glua.LState, str string, null *glua.LUserData) (glua.LValue, error) {
+	decoder := json.NewDecoder(strings.NewReader(str))
+	decoder.UseNumber()
+
+	value, err := decodeJSON(L, decoder, null, 1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("Expected the end but found invalid token")
+	}
+	return value, nil
+}
+
+// decodeJSON reads a value with the tokens of the decoder, the fields of
+// the objects keep their order in the tables
+func decodeJSON(L *glua.LState, decoder *json.Decoder, null *glua.LUserData, depth int) (glua.LValue, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("Expected value but found invalid token: %s", err)
+	}
+
+	switch token := token.(type) {
+	case json.Delim:
+		if depth > cjsonMaxDepth {
+			return nil, fmt.Errorf("Found too many nested data structures (%d)", depth)
+		}
+		t := L.NewTable()
+		for index := 1; decoder.More(); index++ {
+			if token == '[' {
+				value, err := decodeJSON(L, decoder, null, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				t.RawSetInt(index, value)
+				continue
+			}
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, fmt.Errorf("Expected object key string but found invalid token: %s", err)
+			}
+			value, err := decodeJSON(L, decoder, null, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			t.RawSetString(key.(string), value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, fmt.Errorf("Expected comma or end but found invalid token: %s", err)
+		}
+		return t, nil
+	case json.Number:
+		f, err := token.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("Expected value but found invalid number: %s", token)
+		}
+		return glua.LNumber(f), nil
+	case string:
+		return glua.LString(token), nil
+	case bool:
+		return glua.LBool(token), nil
+	case nil:
+		return null, nil
+	}
+	return nil, fmt.Errorf("Expected value but found invalid token: %v", token)
+}
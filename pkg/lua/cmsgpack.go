@@ -0,0 +1,300 @@
+package lua
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	glua "github.com/yuin/gopher-lua"
+)
+
+// cmsgpackMaxNesting bounds the nesting of packed tables, deeper tables
+// are packed as nil like LUACMSGPACK_MAX_NESTING
+const cmsgpackMaxNesting = 16
+
+// msgpackMaxDepth bounds the nesting of the unpacked data
+const msgpackMaxDepth = 1000
+
+var msgpackMissingBytes = errors.New("Missing bytes in input.")
+
+var msgpackBadFormat = errors.New("Bad data format in input.")
+
+// openCmsgpack registers the cmsgpack library of Redis scripts
+func openCmsgpack(L *glua.LState) {
+	t := L.NewTable()
+	L.SetFuncs(t, map[string]glua.LGFunction{
+		"pack":   cmsgpackPack,
+		"unpack": cmsgpackUnpack,
+	})
+	L.SetGlobal("cmsgpack", t)
+}
+
+// cmsgpackPack concatenates the encodings of its arguments
+func cmsgpackPack(L *glua.LState) int {
+	if L.GetTop() == 0 {
+		L.ArgError(1, "MessagePack pack needs input.")
+	}
+	var buf []byte
+	for i := 1; i <= L.GetTop(); i++ {
+		buf = packMsgpack(buf, L.Get(i), 0)
+	}
+	L.Push(glua.LString(buf))
+	return 1
+}
+
+func packMsgpack(buf []byte, value glua.LValue, level int) []byte {
+	switch v := value.(type) {
+	case glua.LBool:
+		if v {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case glua.LNumber:
+		return packMsgpackNumber(buf, float64(v))
+	case glua.LString:
+		return packMsgpackString(buf, string(v))
+	case *glua.LTable:
+		if level >= cmsgpackMaxNesting {
+			return append(buf, 0xc0)
+		}
+		return packMsgpackTable(buf, v, level)
+	}
+	// nil and the types without an encoding
+	return append(buf, 0xc0)
+}
+
+// packMsgpackNumber uses the smallest integer encoding for integers, and
+// float 32 for the other numbers when it is exact
+func packMsgpackNumber(buf []byte, f float64) []byte {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		if float64(float32(f)) == f || math.IsNaN(f) {
+			return binary.BigEndian.AppendUint32(append(buf, 0xca), math.Float32bits(float32(f)))
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(f))
+	}
+
+	n := int64(f)
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), uint64(n))
+	case n >= -32:
+		return append(buf, byte(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+	}
+}
+
+func packMsgpackString(buf []byte, str string) []byte {
+	switch n := len(str); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, str...)
+}
+
+// packMsgpackTable packs the tables with the keys 1 to n as arrays and
+// the others as maps
+func packMsgpackTable(buf []byte, t *glua.LTable, level int) []byte {
+	count, isArray := 0, true
+	for key, _ := t.Next(glua.LNil); key != glua.LNil; key, _ = t.Next(key) {
+		count++
+		if i, ok := arrayIndex(key); !ok || i >= t.Len() {
+			isArray = false
+		}
+	}
+
+	if isArray {
+		buf = packMsgpackHeader(buf, count, 0x90, 0xdc)
+		for i := 1; i <= count; i++ {
+			buf = packMsgpack(buf, t.RawGetInt(i), level+1)
+		}
+		return buf
+	}
+
+	buf = packMsgpackHeader(buf, count, 0x80, 0xde)
+	for key, value := t.Next(glua.LNil); key != glua.LNil; key, value = t.Next(key) {
+		buf = packMsgpack(buf, key, level+1)
+		buf = packMsgpack(buf, value, level+1)
+	}
+	return buf
+}
+
+// packMsgpackHeader writes the length of an array or a map, with the fix
+// code under 16 elements and the 16 bit code, plus one for 32 bits, above
+func packMsgpackHeader(buf []byte, n int, fix byte, code byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, code), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, code+1), uint32(n))
+	}
+}
+
+// cmsgpackUnpack returns the values encoded in the string
+func cmsgpackUnpack(L *glua.LState) int {
+	data := []byte(L.CheckString(1))
+	n := 0
+	for len(data) > 0 {
+		value, rest, err := unpackMsgpack(L, data, 0)
+		if err != nil {
+			raise(L, err)
+		}
+		L.Push(value)
+		data = rest
+		n++
+	}
+	return n
+}
+
+// unpackMsgpack decodes the value at the start of data and returns the
+// data after it
+func unpackMsgpack(L *glua.LState, data []byte, level int) (glua.LValue, []byte, error) {
+	if len(data) == 0 {
+		return glua.LNil, nil, msgpackMissingBytes
+	}
+	if level > msgpackMaxDepth {
+		return glua.LNil, nil, msgpackBadFormat
+	}
+	code, data := data[0], data[1:]
+
+	switch {
+	case code <= 0x7f:
+		return glua.LNumber(code), data, nil
+	case code >= 0xe0:
+		return glua.LNumber(int8(code)), data, nil
+	case code&0xe0 == 0xa0:
+		return unpackMsgpackString(data, int(code&0x1f))
+	case code&0xf0 == 0x90:
+		return unpackMsgpackArray(L, data, int(code&0x0f), level)
+	case code&0xf0 == 0x80:
+		return unpackMsgpackMap(L, data, int(code&0x0f), level)
+	}
+
+	switch code {
+	case 0xc0:
+		return glua.LNil, data, nil
+	case 0xc2:
+		return glua.LFalse, data, nil
+	case 0xc3:
+		return glua.LTrue, data, nil
+	case 0xca:
+		n, rest, err := readMsgpackUint(data, 4)
+		return glua.LNumber(math.Float32frombits(uint32(n))), rest, err
+	case 0xcb:
+		n, rest, err := readMsgpackUint(data, 8)
+		return glua.LNumber(math.Float64frombits(n)), rest, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, rest, err := readMsgpackUint(data, 1<<(code-0xcc))
+		return glua.LNumber(n), rest, err
+	case 0xd0:
+		n, rest, err := readMsgpackUint(data, 1)
+		return glua.LNumber(int8(n)), rest, err
+	case 0xd1:
+		n, rest, err := readMsgpackUint(data, 2)
+		return glua.LNumber(int16(n)), rest, err
+	case 0xd2:
+		n, rest, err := readMsgpackUint(data, 4)
+		return glua.LNumber(int32(n)), rest, err
+	case 0xd3:
+		n, rest, err := readMsgpackUint(data, 8)
+		return glua.LNumber(int64(n)), rest, err
+	case 0xc4, 0xd9:
+		return unpackMsgpackLength(data, 1, unpackMsgpackString)
+	case 0xc5, 0xda:
+		return unpackMsgpackLength(data, 2, unpackMsgpackString)
+	case 0xc6, 0xdb:
+		return unpackMsgpackLength(data, 4, unpackMsgpackString)
+	case 0xdc, 0xdd:
+		n, rest, err := readMsgpackUint(data, 2<<(code-0xdc))
+		if err != nil {
+			return glua.LNil, nil, err
+		}
+		return unpackMsgpackArray(L, rest, int(n), level)
+	case 0xde, 0xdf:
+		n, rest, err := readMsgpackUint(data, 2<<(code-0xde))
+		if err != nil {
+			return glua.LNil, nil, err
+		}
+		return unpackMsgpackMap(L, rest, int(n), level)
+	}
+	return glua.LNil, nil, msgpackBadFormat
+}
+
+// readMsgpackUint reads a big endian integer of size bytes
+func readMsgpackUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, msgpackMissingBytes
+	}
+	var n uint64
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	return n, data[size:], nil
+}
+
+func unpackMsgpackLength(data []byte, size int, unpack func(data []byte, n int) (glua.LValue, []byte, error)) (glua.LValue, []byte, error) {
+	n, rest, err := readMsgpackUint(data, size)
+	if err != nil {
+		return glua.LNil, nil, err
+	}
+	return unpack(rest, int(n))
+}
+
+func unpackMsgpackString(data []byte, n int) (glua.LValue, []byte, error) {
+	if len(data) < n {
+		return glua.LNil, nil, msgpackMissingBytes
+	}
+	return glua.LString(data[:n]), data[n:], nil
+}
+
+func unpackMsgpackArray(L *glua.LState, data []byte, n int, level int) (glua.LValue, []byte, error) {
+	t := L.NewTable()
+	for i := 1; i <= n; i++ {
+		value, rest, err := unpackMsgpack(L, data, level+1)
+		if err != nil {
+			return glua.LNil, nil, err
+		}
+		t.RawSetInt(i, value)
+		data = rest
+	}
+	return t, data, nil
+}
+
+func unpackMsgpackMap(L *glua.LState, data []byte, n int, level int) (glua.LValue, []byte, error) {
+	t := L.NewTable()
+	for range n {
+		key, rest, err := unpackMsgpack(L, data, level+1)
+		if err != nil {
+			return glua.LNil, nil, err
+		}
+		value, rest, err := unpackMsgpack(L, rest, level+1)
+		if err != nil {
+			return glua.LNil, nil, err
+		}
+		t.RawSet(key, value)
+		data = rest
+	}
+	return t, data, nil
+}
@@ -0,0 +1,261 @@
+// Package lua is the environment of Redis scripts on gopher-lua, a Lua 5.1
+// virtual machine: the sandboxed globals, the limits of the compiler and the
+// libraries Redis adds to the standard ones, cjson, cmsgpack, bit and struct.
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	glua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// maxSyntaxLevels bounds the nesting of the constructs of scripts, like
+// LUAI_MAXCCALLS, so the recursion of the compiler is bounded too
+const maxSyntaxLevels = 200
+
+// callStackSize bounds the calls in progress, deeper calls fail with a
+// stack overflow
+const callStackSize = 256
+
+// registryMaxSize bounds the values on the stack of a state, like
+// LUAI_MAXCSTACK bounds the results of unpack
+const registryMaxSize = 256 * 1024
+
+var TooManySyntaxLevels = errors.New("chunk has too many syntax levels")
+
+// Error is an error raised by a script, Value is the value given to error
+type Error struct {
+	Value glua.LValue
+}
+
+// Error returns the message of the error, the err field of the tables
+// raised by redis.call
+func (e *Error) Error() string {
+	if t, ok := e.Value.(*glua.LTable); ok {
+		if msg, ok := t.RawGetString("err").(glua.LString); ok {
+			return string(msg)
+		}
+	}
+	return e.Value.String()
+}
+
+// NewState returns a state with the libraries of Redis scripts
+func NewState() *glua.LState {
+	L := glua.NewState(glua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       callStackSize,
+		RegistryMaxSize:     registryMaxSize,
+		MinimizeStackMemory: true,
+	})
+	for name, open := range map[string]glua.LGFunction{
+		glua.BaseLibName:   glua.OpenBase,
+		glua.TabLibName:    glua.OpenTable,
+		glua.StringLibName: glua.OpenString,
+		glua.MathLibName:   glua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(glua.LString(name))
+		L.Call(1, 0)
+	}
+	// Scripts can't read files or load modules
+	for _, name := range []string{"dofile", "loadfile", "module", "require", "_printregs"} {
+		L.SetGlobal(name, glua.LNil)
+	}
+	openCjson(L)
+	openCmsgpack(L)
+	openBit(L)
+	openStruct(L)
+	return L
+}
+
+// Sandbox makes the globals read only, and reading undefined globals an
+// error, like scripts in Redis. The globals set afterward, like KEYS and
+// ARGV, have to be set with RawSetString.
+func Sandbox(L *glua.LState) {
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *glua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.ToString(2))
+		return 0
+	}))
+	mt.RawSetString("__newindex", L.NewFunction(func(L *glua.LState) int {
+		L.RaiseError("Attempt to modify a readonly table")
+		return 0
+	}))
+	// The metatable can't be replaced or removed by setmetatable
+	mt.RawSetString("__metatable", glua.LFalse)
+	L.SetMetatable(L.G.Global, mt)
+}
+
+// Compile compiles a script, the name prefixes the positions in its errors
+func Compile(name string, source string) (*glua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range chunk {
+		if err := checkStmt(stmt, 1); err != nil {
+			return nil, err
+		}
+	}
+	return glua.Compile(chunk, name)
+}
+
+// Run runs a compiled script in the state and returns its results. A done
+// context interrupts the script with the error of the context.
+func Run(ctx context.Context, L *glua.LState, proto *glua.FunctionProto, args ...glua.LValue) ([]glua.LValue, error) {
+	return Call(ctx, L, L.NewFunctionFromProto(proto), args...)
+}
+
+// Call calls a function of the state with the arguments and returns its
+// results, errors raised by the script are returned as an *Error
+func Call(ctx context.Context, L *glua.LState, fn glua.LValue, args ...glua.LValue) ([]glua.LValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	top := L.GetTop()
+	err := L.CallByParam(glua.P{Fn: fn, NRet: glua.MultRet, Protect: true}, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var apiErr *glua.ApiError
+		if errors.As(err, &apiErr) {
+			return nil, &Error{Value: apiErr.Object}
+		}
+		return nil, err
+	}
+
+	results := make([]glua.LValue, 0, L.GetTop()-top)
+	for i := top + 1; i <= L.GetTop(); i++ {
+		results = append(results, L.Get(i))
+	}
+	L.SetTop(top)
+	return results, nil
+}
+
+// checkStmt and checkExpr count the syntax levels like the parser of Lua,
+// the operands on the right of binary operators, the arguments, the fields
+// and the blocks nest, the chains on their left don't
+func checkStmt(stmt ast.Stmt, level int) error {
+	if level > maxSyntaxLevels {
+		return syntaxLevelsError(stmt.Line())
+	}
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		return checkExprs(append(s.Lhs, s.Rhs...), level+1)
+	case *ast.LocalAssignStmt:
+		return checkExprs(s.Exprs, level+1)
+	case *ast.FuncCallStmt:
+		return checkExpr(s.Expr, level)
+	case *ast.DoBlockStmt:
+		return checkBlock(s.Stmts, level+1)
+	case *ast.WhileStmt:
+		return checkBlocks(level+1, []ast.Expr{s.Condition}, s.Stmts)
+	case *ast.RepeatStmt:
+		return checkBlocks(level+1, []ast.Expr{s.Condition}, s.Stmts)
+	case *ast.IfStmt:
+		return checkBlocks(level+1, []ast.Expr{s.Condition}, s.Then, s.Else)
+	case *ast.NumberForStmt:
+		return checkBlocks(level+1, []ast.Expr{s.Init, s.Limit, s.Step}, s.Stmts)
+	case *ast.GenericForStmt:
+		return checkBlocks(level+1, s.Exprs, s.Stmts)
+	case *ast.FuncDefStmt:
+		return checkExpr(s.Func, level)
+	case *ast.ReturnStmt:
+		return checkExprs(s.Exprs, level+1)
+	}
+	return nil
+}
+
+func checkBlock(stmts []ast.Stmt, level int) error {
+	for _, stmt := range stmts {
+		if err := checkStmt(stmt, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBlocks(level int, exprs []ast.Expr, blocks ...[]ast.Stmt) error {
+	if err := checkExprs(exprs, level); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if err := checkBlock(block, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkExprs(exprs []ast.Expr, level int) error {
+	for _, expr := range exprs {
+		if err := checkExpr(expr, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkExpr(expr ast.Expr, level int) error {
+	// The chains on the left are walked in a loop, so long chains of
+	// operators, fields and calls don't recurse
+	for expr != nil {
+		if level > maxSyntaxLevels {
+			return syntaxLevelsError(expr.Line())
+		}
+		var right []ast.Expr
+		var next ast.Expr
+		switch e := expr.(type) {
+		case *ast.AttrGetExpr:
+			next, right = e.Object, []ast.Expr{e.Key}
+		case *ast.FuncCallExpr:
+			next, right = e.Func, e.Args
+			if e.Receiver != nil {
+				next = e.Receiver
+			}
+		case *ast.LogicalOpExpr:
+			next, right = e.Lhs, []ast.Expr{e.Rhs}
+		case *ast.RelationalOpExpr:
+			next, right = e.Lhs, []ast.Expr{e.Rhs}
+		case *ast.StringConcatOpExpr:
+			next, right = e.Lhs, []ast.Expr{e.Rhs}
+		case *ast.ArithmeticOpExpr:
+			next, right = e.Lhs, []ast.Expr{e.Rhs}
+		case *ast.UnaryMinusOpExpr:
+			next, level = e.Expr, level+1
+		case *ast.UnaryNotOpExpr:
+			next, level = e.Expr, level+1
+		case *ast.UnaryLenOpExpr:
+			next, level = e.Expr, level+1
+		case *ast.TableExpr:
+			for _, field := range e.Fields {
+				if field.Key != nil {
+					right = append(right, field.Key)
+				}
+				right = append(right, field.Value)
+			}
+		case *ast.FunctionExpr:
+			if err := checkBlock(e.Stmts, level+1); err != nil {
+				return err
+			}
+		}
+		if err := checkExprs(right, level+1); err != nil {
+			return err
+		}
+		expr = next
+	}
+	return nil
+}
+
+func syntaxLevelsError(line int) error {
+	return fmt.Errorf("line %d: %w", line, TooManySyntaxLevels)
+}
@@ -0,0 +1,380 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	glua "github.com/yuin/gopher-lua"
+)
+
+// results converts the results of scripts to Go values to compare them
+func results(values []glua.LValue) []any {
+	var converted []any
+	for _, value := range values {
+		switch v := value.(type) {
+		case glua.LNumber:
+			converted = append(converted, float64(v))
+		case glua.LString:
+			converted = append(converted, string(v))
+		case glua.LBool:
+			converted = append(converted, bool(v))
+		case *glua.LNilType:
+			converted = append(converted, nil)
+		default:
+			converted = append(converted, value)
+		}
+	}
+	return converted
+}
+
+func run(t *testing.T, source string) []any {
+	t.Helper()
+	proto, err := Compile("user_script", source)
+	if err != nil {
+		t.Fatalf("compile %q: %s", source, err)
+	}
+	values, err := Run(context.Background(), NewState(), proto)
+	if err != nil {
+		t.Fatalf("run %q: %s", source, err)
+	}
+	return results(values)
+}
+
+func runError(t *testing.T, source string) string {
+	t.Helper()
+	proto, err := Compile("user_script", source)
+	if err != nil {
+		return err.Error()
+	}
+	state := NewState()
+	Sandbox(state)
+	_, err = Run(context.Background(), state, proto)
+	if err == nil {
+		t.Fatalf("expected an error running %q", source)
+	}
+	return err.Error()
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []any
+	}{
+		{"return 1 + 2 * 3 ^ 2, 7 % 3, -7 % 3, 10 / 4", []any{19.0, 1.0, 2.0, 2.5}},
+		{"return 2 ^ 3 ^ 2, -2 ^ 2, not nil, 1 .. 2", []any{512.0, -4.0, true, "12"}},
+		{"return '10' + 1, 'a' < 'b', 1 == 1.0, 'x' ~= 'x'", []any{11.0, true, true, false}},
+		{"return nil and 1, false or 'x', 1 and 2, #'abc', #{1, 2, 3}", []any{nil, "x", 2.0, 3.0, 3.0}},
+		{"return 0x10, 1e2, .5, 'a\\tb\\65', [[\nlong]]", []any{16.0, 100.0, 0.5, "a\tbA", "long"}},
+		{"local a, b, c = 1, 2 return a, b, c", []any{1.0, 2.0, nil}},
+		{"local x = 1 do local x = 2 end return x", []any{1.0}},
+		{"local t = {} for i = 1, 10, 3 do t[#t + 1] = i end return unpack(t)", []any{1.0, 4.0, 7.0, 10.0}},
+		{"local n = 0 for i = 10, 1, -1 do n = n + i end return n", []any{55.0}},
+		{"local i = 0 while true do i = i + 1 if i == 5 then break end end return i", []any{5.0}},
+		{"local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", []any{4.0}},
+		{"local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end return fib(15)", []any{610.0}},
+		{"local function f(...) return select('#', ...), ... end return f(1, nil, 3)", []any{3.0, 1.0, nil, 3.0}},
+		{"local function f() return 1, 2 end local t = {f(), f()} return (f()), t[3], #t", []any{1.0, 2.0, 3.0}},
+		{`local t = {a = 1, ["b"] = 2, 3; [10] = 4} return t.a, t.b, t[1], t[10]`, []any{1.0, 2.0, 3.0, 4.0}},
+		{"local t = {} t[1] = 'a' t[3] = 'c' t[2] = 'b' return #t, table.concat(t, ',')", []any{3.0, "a,b,c"}},
+		{"local s = 0 for i, v in ipairs({5, 6, nil, 8}) do s = s + i * v end return s", []any{17.0}},
+		{"local keys = {} for k in pairs({x = 1, y = 2, z = 3}) do keys[#keys + 1] = k end return table.concat(keys)", []any{"xyz"}},
+		{"local t = {1, 2, 3} for k in pairs(t) do t[k] = nil end return next(t)", []any{nil}},
+		{
+			// Closures capture a new local on each iteration
+			"local fs = {} for i = 1, 3 do fs[i] = function() return i end end return fs[1](), fs[3]()",
+			[]any{1.0, 3.0},
+		},
+		{
+			"local function counter() local n = 0 return function() n = n + 1 return n end end " +
+				"local c = counter() c() return c(), counter()()",
+			[]any{2.0, 1.0},
+		},
+		{"local obj = {n = 1} function obj:add(x) self.n = self.n + x return self end return obj:add(2):add(3).n", []any{6.0}},
+		{"local t = {} t.a = {} t.a.b = function() return 'deep' end return t.a.b()", []any{"deep"}},
+		{"return pcall(error, 'boom', 0)", []any{false, "boom"}},
+		{"return pcall(function() error({code = 1}) end)", nil},
+		{"local ok, err = pcall(function() local x = nil return x.y end) return ok, err", []any{false, "user_script:1: attempt to index a non-table object(nil) with key 'y'"}},
+		{"return select(2, xpcall(function() error('x') end, function(e) return 'handled ' .. e end))", []any{"handled user_script:1: x"}},
+		{"return tonumber('0x1F'), tonumber(' 12 '), tonumber('z', 36), tonumber('abc'), tostring(1.5)", []any{31.0, 12.0, 35.0, nil, "1.5"}},
+		{"return type(nil), type({}), type(print), type(type)", []any{"nil", "table", "function", "function"}},
+		{"return math.floor(3.7), math.max(1, 5, 3), math.min(2, -1), math.abs(-2), math.huge > 1", []any{3.0, 5.0, -1.0, 2.0, true}},
+		{"local t = {3, 1, 2} table.sort(t) return unpack(t)", []any{1.0, 2.0, 3.0}},
+		{"local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return unpack(t)", []any{3.0, 2.0, 1.0}},
+		{"local t = {1, 2} table.insert(t, 3) table.insert(t, 1, 0) return table.remove(t), table.remove(t, 1), #t", []any{3.0, 0.0, 2.0}},
+		{"return tostring(-0.5), tostring(10 / 2), 2^53", []any{"-0.5", "5", 9007199254740992.0}},
+	}
+	for _, test := range tests {
+		values := run(t, test.source)
+		if test.expected == nil {
+			if len(values) != 2 || values[0] != false {
+				t.Errorf("%q returned %v", test.source, values)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%q returned %#v, expected %#v", test.source, values, test.expected)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []any
+	}{
+		{"return ('abc'):upper(), string.lower('ABC'), string.len('abcd'), ('x'):rep(3)", []any{"ABC", "abc", 4.0, "xxx"}},
+		{"return string.sub('hello', 2, 4), ('hello'):sub(-3), ('hello'):sub(2), ('hello'):sub(10)", []any{"ell", "llo", "ello", ""}},
+		{"return string.byte('A'), string.char(72, 105), string.reverse('abc')", []any{65.0, "Hi", "cba"}},
+		{"return string.format('%d %5.2f %s %x %q', 42, 3.14159, 'str', 255, 'a\"b')", []any{`42  3.14 str ff "a\"b"`}},
+		{"return string.format('%s %s %05d %-3s|', nil, true, 42, 'a')", []any{"nil true 00042 a  |"}},
+		{"return string.find('a.b', '.', 1, true), string.find('hello world', 'wor')", []any{2.0, 7.0, 9.0}},
+		{"return string.find('hello', 'xyz'), string.find('hello', 'l+')", []any{nil, 3.0, 4.0}},
+		{"return string.find('key=value', '(%w+)=(%w+)')", []any{1.0, 9.0, "key", "value"}},
+		{"return string.match('key:value', '(%w+):(%w+)')", []any{"key", "value"}},
+		{"return string.match('  trim  ', '^%s*(.-)%s*$'), string.match('2024-01-15', '(%d+)-(%d+)-(%d+)')", []any{"trim", "2024", "01", "15"}},
+		{"return string.match('[tag]', '%[(.*)%]'), string.match('f(a(b)c)', '%b()'), string.match('hello', '()ll()')", []any{"tag", "(a(b)c)", 3.0, 5.0}},
+		{"return string.match('abc', '[^a]+'), string.match('x=1', '[%w_]+')", []any{"bc", "x"}},
+		{"return string.gsub('hello world', 'o', '0')", []any{"hell0 w0rld", 2.0}},
+		{"return string.gsub('abc', '%w', '%0%0')", []any{"aabbcc", 3.0}},
+		{"return string.gsub('hello world', '(%w+)', '<%1>')", []any{"<hello> <world>", 2.0}},
+		{"return string.gsub('abc', '', '-')", []any{"-a-b-c-", 4.0}},
+		{"return string.gsub('$name is $age', '%$(%w+)', {name = 'Bob', age = 42})", []any{"Bob is 42", 2.0}},
+		{"return string.gsub('a b c', '%w', function(c) if c ~= 'b' then return c:upper() end end, 2)", []any{"A b c", 2.0}},
+		{"local words = {} for w in string.gmatch('one two  three', '%a+') do words[#words + 1] = w end return table.concat(words, ',')", []any{"one,two,three"}},
+		{"local t = {} for k, v in string.gmatch('a=1, b=2', '(%w+)=(%w+)') do t[k] = tonumber(v) end return t.a + t.b", []any{3.0}},
+		{"return string.match('aaa', 'a-b'), string.match('aaab', 'a-b'), string.match('ab', 'a?b'), string.match('b', 'a?b')", []any{nil, "aaab", "ab", "b"}},
+	}
+	for _, test := range tests {
+		if values := run(t, test.source); !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%q returned %#v, expected %#v", test.source, values, test.expected)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{"return undefined_global", "user_script:1: Script attempted to access nonexistent global variable 'undefined_global'"},
+		{"x = 1", "user_script:1: Attempt to modify a readonly table"},
+		{"local x = _G.missing", "user_script:1: Script attempted to access nonexistent global variable 'missing'"},
+		{"setmetatable(_G, nil)", "user_script:1: cannot change a protected metatable"},
+		{"return loadfile, dofile", "user_script:1: Script attempted to access nonexistent global variable 'loadfile'"},
+		{"return require", "user_script:1: Script attempted to access nonexistent global variable 'require'"},
+		{"error('custom')", "user_script:1: custom"},
+		{"error({err = 'table error'})", "table error"},
+		{"return string.rep()", "user_script:1: bad argument #1 to rep (string expected, got nil)"},
+		{"local function f() return f() + 1 end return f()", "stack overflow"},
+	}
+	for _, test := range tests {
+		if err := runError(t, test.source); !strings.Contains(err, test.expected) {
+			t.Errorf("%q failed with %q, expected %q", test.source, err, test.expected)
+		}
+	}
+}
+
+func TestCompile_syntaxLevels(t *testing.T) {
+	sources := []string{
+		"return " + strings.Repeat("{", 300) + strings.Repeat("}", 300),
+		"return " + strings.Repeat("'a' .. ", 300) + "'a'",
+		"return " + strings.Repeat("f(", 300) + strings.Repeat(")", 300),
+		strings.Repeat("do ", 300) + strings.Repeat("end ", 300),
+	}
+	for _, source := range sources {
+		if _, err := Compile("user_script", source); !errors.Is(err, TooManySyntaxLevels) {
+			t.Errorf("%.20q compiled with %v", source, err)
+		}
+	}
+
+	// Long chains on the left don't nest
+	if _, err := Compile("user_script", "return 1"+strings.Repeat(" + 1", 10000)); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRun_interrupt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// pcall can't catch interruptions
+	for _, source := range []string{"while true do end", "pcall(function() while true do end end) while true do end"} {
+		proto, err := Compile("user_script", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Run(ctx, NewState(), proto); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	state := NewState()
+	state.SetGlobal("greet", state.NewFunction(func(L *glua.LState) int {
+		name := L.CheckString(1)
+		if name == "table" {
+			errorTable := L.NewTable()
+			errorTable.RawSetString("err", glua.LString("raised"))
+			L.Error(errorTable, 0)
+		}
+		L.Push(glua.LString("hello " + name))
+		return 1
+	}))
+
+	values, err := Call(context.Background(), state, state.GetGlobal("greet"), glua.LString("world"))
+	if err != nil || !reflect.DeepEqual(results(values), []any{"hello world"}) {
+		t.Errorf("unexpected results %v %v", values, err)
+	}
+	_, err = Call(context.Background(), state, state.GetGlobal("greet"), glua.LString("table"))
+	var luaErr *Error
+	if !errors.As(err, &luaErr) || err.Error() != "raised" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if state.GetTop() != 0 {
+		t.Errorf("expected an empty stack, got %d values", state.GetTop())
+	}
+}
+
+func TestMetatables(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []any
+	}{
+		{"local t = setmetatable({}, {__index = function(t, k) return k .. '!' end}) return t.x, getmetatable(t) ~= nil", []any{"x!", true}},
+		{"local v = setmetatable({}, {__add = function(a, b) return 42 end}) return v + 1", []any{42.0}},
+		{"local t = setmetatable({}, {__metatable = 'locked'}) return getmetatable(t), pcall(setmetatable, t, {})", []any{"locked", false, "user_script:1: cannot change a protected metatable"}},
+		{"return getmetatable('').__index == string", []any{true}},
+	}
+	for _, test := range tests {
+		if values := run(t, test.source); !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%q returned %#v, expected %#v", test.source, values, test.expected)
+		}
+	}
+}
+
+func TestMathRandom(t *testing.T) {
+	values := run(t, "math.randomseed(42) local a, b = math.random(10), math.random(5, 6) "+
+		"math.randomseed(42) return a >= 1 and a <= 10, b == 5 or b == 6, math.random(10) == a, math.random() < 1")
+	if !reflect.DeepEqual(values, []any{true, true, true, true}) {
+		t.Errorf("unexpected results %v", values)
+	}
+}
+
+func TestBit(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []any
+	}{
+		{"return bit.tobit(0xffffffff), bit.tobit(2^32 + 5), bit.tobit(-1), bit.bnot(0)", []any{-1.0, 5.0, -1.0, -1.0}},
+		{"return bit.band(0xff, 0x0f), bit.bor(1, 2, 4), bit.bxor(3, 1), bit.band(-1, 0xffffffff)", []any{15.0, 7.0, 2.0, -1.0}},
+		{"return bit.lshift(1, 31), bit.rshift(-1, 28), bit.arshift(-16, 2), bit.lshift(1, 33)", []any{-2147483648.0, 15.0, -4.0, 2.0}},
+		{"return bit.rol(0x12345678, 8), bit.ror(0x12345678, 8), bit.bswap(0x12345678)", []any{878082066.0, 2014458966.0, 2018915346.0}},
+		{"return bit.tohex(65535), bit.tohex(65535, 4), bit.tohex(-1, -4), bit.tohex(255, 2)", []any{"0000ffff", "ffff", "FFFF", "ff"}},
+	}
+	for _, test := range tests {
+		if values := run(t, test.source); !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%q returned %#v, expected %#v", test.source, values, test.expected)
+		}
+	}
+
+	if msg := runError(t, "return bit.band('x')"); !strings.Contains(msg, "bad argument #1 to band") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestStruct(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []any
+	}{
+		{"return struct.pack('>i2', 258), struct.pack('<I4', 1), struct.pack('b', -1)", []any{"\x01\x02", "\x01\x00\x00\x00", "\xff"}},
+		{"return struct.unpack('>h', '\\255\\254')", []any{-2.0, 3.0}},
+		{"return struct.unpack('<HB', '\\1\\2\\3')", []any{513.0, 3.0, 4.0}},
+		{"return struct.pack('bsc2x', 1, 'ab', 'xyz')", []any{"\x01ab\x00xy\x00"}},
+		{"return struct.unpack('Bc0', '\\3abcd')", []any{"abc", 5.0}},
+		{"return struct.unpack('s', 'ab\\0cd', 1)", []any{"ab", 4.0}},
+		{"return struct.unpack('>I2', 'xx\\0\\1', 3)", []any{1.0, 5.0}},
+		{"return struct.unpack('d', struct.pack('d', 1.5)), struct.unpack('f', struct.pack('f', 0.5))", []any{1.5, 0.5, 5.0}},
+		{"return struct.size('bid'), struct.size('!bid'), struct.size('!4 b d'), struct.size('c10i3')", []any{13.0, 16.0, 12.0, 13.0}},
+		{"return struct.pack('!4bi', 1, 2), struct.pack('>l', -2)", []any{"\x01\x00\x00\x00\x02\x00\x00\x00", "\xff\xff\xff\xff\xff\xff\xff\xfe"}},
+	}
+	for _, test := range tests {
+		if values := run(t, test.source); !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%q returned %#v, expected %#v", test.source, values, test.expected)
+		}
+	}
+
+	errs := map[string]string{
+		"return struct.pack('z', 1)":        "invalid format option 'z'",
+		"return struct.pack('!3b', 1)":      "alignment 3 is not a power of 2",
+		"return struct.pack('i33', 1)":      "integral size 33 is larger than limit of 32",
+		"return struct.pack('c3', 'ab')":    "string too short",
+		"return struct.unpack('i4', 'ab')":  "data string too short",
+		"return struct.unpack('s', 'abc')":  "unfinished string in data",
+		"return struct.unpack('c0', 'abc')": "format 'c0' needs a previous size",
+		"return struct.unpack('b', 'a', 0)": "offset must be 1 or greater",
+		"return struct.size('s')":           "option 's' has no fixed size",
+	}
+	for source, expected := range errs {
+		if msg := runError(t, source); !strings.Contains(msg, expected) {
+			t.Errorf("%s: expected %q, got %q", source, expected, msg)
+		}
+	}
+}
+
+func TestCjson(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []any
+	}{
+		{`return cjson.encode({1, 2, "a/b", true, {}})`, []any{`[1,2,"a\/b",true,{}]`}},
+		{`return cjson.encode({name = "x", n = 1.5, [1] = "one"})`, []any{`{"1":"one","name":"x","n":1.5}`}},
+		{`return cjson.encode({[1] = 1, [3] = 3}), cjson.encode("\n\1")`, []any{`[1,null,3]`, `"\n\u0001"`}},
+		{`local t = cjson.decode('{"a": [1, null, "x"], "b": {"c": true}}') return t.a[1], t.a[2] == cjson.null, t.a[3], t.b.c`, []any{1.0, true, "x", true}},
+		{`return cjson.encode(cjson.decode('{"b":1,"a":[2,3]}'))`, []any{`{"b":1,"a":[2,3]}`}},
+		{`local t = cjson.decode('[null, {"a": null}]') return t[1] == cjson.null, t[2].a == cjson.null, cjson.encode(t)`, []any{true, true, `[null,{"a":null}]`}},
+	}
+	for _, tt := range tests {
+		if values := run(t, tt.source); !reflect.DeepEqual(values, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.source, tt.expected, values)
+		}
+	}
+
+	errs := map[string]string{
+		`return cjson.encode({[20] = 1})`: "excessively sparse array",
+		`return cjson.encode(type)`:       "Cannot serialise function",
+		`return cjson.decode('{"a":')`:    "Expected value",
+		`return cjson.decode('[1] 2')`:    "Expected the end",
+	}
+	for source, expected := range errs {
+		if msg := runError(t, source); !strings.Contains(msg, expected) {
+			t.Errorf("%s: expected %q, got %q", source, expected, msg)
+		}
+	}
+}
+
+func TestCmsgpack(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []any
+	}{
+		{`return cmsgpack.pack(1, -1, 200, -200, 70000, 1.5, true, nil)`, []any{"\x01\xff\xcc\xc8\xd1\xff\x38\xce\x00\x01\x11\x70\xca\x3f\xc0\x00\x00\xc3\xc0"}},
+		{`return cmsgpack.pack({1, 2}, {a = "b"}, {})`, []any{"\x92\x01\x02\x81\xa1a\xa1b\x90"}},
+		{`local t = cmsgpack.unpack(cmsgpack.pack({1, {x = "y"}, 2 ^ 40, 0.1})) return t[1], t[2].x, t[3], t[4]`, []any{1.0, "y", 1099511627776.0, 0.1}},
+		{`return cmsgpack.unpack(cmsgpack.pack("a", false, string.rep("x", 40)))`, []any{"a", false, strings.Repeat("x", 40)}},
+	}
+	for _, tt := range tests {
+		if values := run(t, tt.source); !reflect.DeepEqual(values, tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.source, tt.expected, values)
+		}
+	}
+
+	if msg := runError(t, `return cmsgpack.unpack("\205")`); !strings.Contains(msg, "Missing bytes") {
+		t.Errorf("expected missing bytes, got %q", msg)
+	}
+}
@@ -0,0 +1,319 @@
+package lua
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	glua "github.com/yuin/gopher-lua"
+)
+
+// structMaxIntSize bounds the size of the integers of i and I
+const structMaxIntSize = 32
+
+// structMaxAlign is the alignment of ! without a size, the one of doubles
+const structMaxAlign = 8
+
+// openStruct registers the struct library of Redis scripts, which packs
+// and unpacks binary data like lua_struct: < and > select the byte order,
+// !n the alignment, b h l T i[n] the signed integers of 1, 2, 8, 8 and n
+// bytes, in upper case unsigned, f and d the floats, s the strings ending
+// with a zero, c[n] the strings of n bytes and x the padding
+func openStruct(L *glua.LState) {
+	t := L.NewTable()
+	L.SetFuncs(t, map[string]glua.LGFunction{
+		"pack":   structPack,
+		"unpack": structUnpack,
+		"size":   structSize,
+	})
+	L.SetGlobal("struct", t)
+}
+
+// structFormat reads the options of a format, keeping the byte order and
+// the alignment selected so far
+type structFormat struct {
+	L         *glua.LState
+	format    string
+	pos       int
+	bigEndian bool
+	align     int
+}
+
+func newStructFormat(L *glua.LState) *structFormat {
+	return &structFormat{L: L, format: L.CheckString(1), align: 1}
+}
+
+// next returns the next option and its size, or false at the end
+func (f *structFormat) next() (byte, int, bool) {
+	if f.pos >= len(f.format) {
+		return 0, 0, false
+	}
+	opt := f.format[f.pos]
+	f.pos++
+	switch opt {
+	case 'b', 'B':
+		return opt, 1, true
+	case 'h', 'H':
+		return opt, 2, true
+	case 'l', 'L', 'T', 'd':
+		return opt, 8, true
+	case 'f':
+		return opt, 4, true
+	case 'x':
+		return opt, 1, true
+	case 'c':
+		return opt, f.number(1), true
+	case 'i', 'I':
+		size := f.number(4)
+		if size > structMaxIntSize {
+			f.L.RaiseError("integral size %d is larger than limit of %d", size, structMaxIntSize)
+		}
+		return opt, size, true
+	}
+	return opt, 0, true
+}
+
+// number reads the digits after an option, or returns the default
+func (f *structFormat) number(def int) int {
+	if f.pos >= len(f.format) || !isDigit(f.format[f.pos]) {
+		return def
+	}
+	n := 0
+	for ; f.pos < len(f.format) && isDigit(f.format[f.pos]); f.pos++ {
+		d := int(f.format[f.pos] - '0')
+		if n > (math.MaxInt32-d)/10 {
+			f.L.RaiseError("integral size overflow")
+		}
+		n = n*10 + d
+	}
+	return n
+}
+
+// control applies the options that don't read or write data
+func (f *structFormat) control(opt byte) {
+	switch opt {
+	case ' ':
+	case '>':
+		f.bigEndian = true
+	case '<':
+		f.bigEndian = false
+	case '!':
+		align := f.number(structMaxAlign)
+		if align&(align-1) != 0 {
+			f.L.RaiseError("alignment %d is not a power of 2", align)
+		}
+		f.align = align
+	default:
+		f.L.ArgError(1, fmt.Sprintf("invalid format option '%c'", opt))
+	}
+}
+
+// padding returns the bytes to align an option of the size at pos
+func (f *structFormat) padding(pos int, opt byte, size int) int {
+	if size == 0 || opt == 'c' {
+		return 0
+	}
+	size = min(size, f.align)
+	if size <= 1 {
+		return 0
+	}
+	return (size - pos&(size-1)) & (size - 1)
+}
+
+func (f *structFormat) byteOrder() interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+} {
+	if f.bigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func structPack(L *glua.LState) int {
+	f := newStructFormat(L)
+	var buf []byte
+	arg := 2
+	for {
+		opt, size, ok := f.next()
+		if !ok {
+			break
+		}
+		buf = append(buf, make([]byte, f.padding(len(buf), opt, size))...)
+		switch opt {
+		case 'b', 'B', 'h', 'H', 'l', 'L', 'T', 'i', 'I':
+			buf = appendStructInteger(buf, float64(L.CheckNumber(arg)), size, f.bigEndian)
+			arg++
+		case 'x':
+			buf = append(buf, 0)
+		case 'f':
+			buf = f.byteOrder().AppendUint32(buf, math.Float32bits(float32(L.CheckNumber(arg))))
+			arg++
+		case 'd':
+			buf = f.byteOrder().AppendUint64(buf, math.Float64bits(float64(L.CheckNumber(arg))))
+			arg++
+		case 'c', 's':
+			str := L.CheckString(arg)
+			if size == 0 {
+				size = len(str)
+			}
+			if len(str) < size {
+				L.ArgError(arg, "string too short")
+			}
+			buf = append(buf, str[:size]...)
+			if opt == 's' {
+				buf = append(buf, 0)
+			}
+			arg++
+		default:
+			f.control(opt)
+		}
+	}
+	L.Push(glua.LString(buf))
+	return 1
+}
+
+// appendStructInteger writes the integer in size bytes, the negative ones
+// in two's complement
+func appendStructInteger(buf []byte, n float64, size int, bigEndian bool) []byte {
+	var value uint64
+	if n < 0 {
+		value = uint64(int64(n))
+	} else {
+		value = uint64(n)
+	}
+	b := make([]byte, size)
+	for i := range size {
+		j := i
+		if bigEndian {
+			j = size - 1 - i
+		}
+		b[j] = byte(value)
+		value >>= 8
+	}
+	return append(buf, b...)
+}
+
+// readStructInteger reads an integer of size bytes, extending the sign of
+// the signed ones
+func readStructInteger(data string, signed bool, bigEndian bool) float64 {
+	var value uint64
+	size := len(data)
+	for i := range size {
+		j := size - 1 - i
+		if bigEndian {
+			j = i
+		}
+		value = value<<8 | uint64(data[j])
+	}
+	if !signed {
+		return float64(value)
+	}
+	if size*8-1 < 64 {
+		mask := ^uint64(0) << (size*8 - 1)
+		if value&mask != 0 {
+			value |= mask
+		}
+	}
+	return float64(int64(value))
+}
+
+// structUnpack returns the values of the format in the data from the
+// offset, then the position after them
+func structUnpack(L *glua.LState) int {
+	f := newStructFormat(L)
+	data := L.CheckString(2)
+	pos := L.OptInt(3, 1)
+	if pos <= 0 {
+		L.ArgError(3, "offset must be 1 or greater")
+	}
+	pos--
+
+	var results []glua.LValue
+	for {
+		opt, size, ok := f.next()
+		if !ok {
+			break
+		}
+		pos += f.padding(pos, opt, size)
+		if size > len(data) || pos > len(data)-size {
+			L.ArgError(2, "data string too short")
+		}
+		switch opt {
+		case 'b', 'B', 'h', 'H', 'l', 'L', 'T', 'i', 'I':
+			signed := unicode.IsLower(rune(opt))
+			results = append(results, glua.LNumber(readStructInteger(data[pos:pos+size], signed, f.bigEndian)))
+		case 'x':
+		case 'f':
+			bits := f.byteOrder().Uint32([]byte(data[pos : pos+size]))
+			results = append(results, glua.LNumber(math.Float32frombits(bits)))
+		case 'd':
+			bits := f.byteOrder().Uint64([]byte(data[pos : pos+size]))
+			results = append(results, glua.LNumber(math.Float64frombits(bits)))
+		case 'c':
+			if size == 0 {
+				// c0 takes its size from the previous value
+				n, isNumber := glua.LNumber(0), false
+				if len(results) > 0 {
+					n, isNumber = results[len(results)-1].(glua.LNumber)
+				}
+				if !isNumber {
+					L.RaiseError("format 'c0' needs a previous size")
+				}
+				results = results[:len(results)-1]
+				size = int(n)
+				if size < 0 || size > len(data) || pos > len(data)-size {
+					L.ArgError(2, "data string too short")
+				}
+			}
+			results = append(results, glua.LString(data[pos:pos+size]))
+		case 's':
+			end := strings.IndexByte(data[pos:], 0)
+			if end < 0 {
+				L.RaiseError("unfinished string in data")
+			}
+			results = append(results, glua.LString(data[pos:pos+end]))
+			size = end + 1
+		default:
+			f.control(opt)
+		}
+		pos += size
+	}
+
+	for _, result := range results {
+		L.Push(result)
+	}
+	L.Push(glua.LNumber(pos + 1))
+	return len(results) + 1
+}
+
+// structSize returns the size of the data of a format without strings
+// of variable size
+func structSize(L *glua.LState) int {
+	f := newStructFormat(L)
+	pos := 0
+	for {
+		opt, size, ok := f.next()
+		if !ok {
+			break
+		}
+		pos += f.padding(pos, opt, size)
+		if opt == 's' {
+			L.ArgError(1, "option 's' has no fixed size")
+		} else if opt == 'c' && size == 0 {
+			L.ArgError(1, "option 'c0' has no fixed size")
+		}
+		if !isDigit(opt) && !unicode.IsLetter(rune(opt)) {
+			f.control(opt)
+		}
+		pos += size
+	}
+	L.Push(glua.LNumber(pos))
+	return 1
+}
@@ -4,12 +4,19 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"iter"
+	"math"
 	"strconv"
 )
 
-type RespParser struct{}
+// RespParser parses RESP payloads, within DefaultLimits unless Limits is set
+type RespParser struct {
+	// Limits returns the limits of the next payload, it is called before
+	// each array and bulk string, so they can change between payloads
+	Limits func() Limits
+}
 
 var CannotReadDataError = errors.New("cannot read data")
 
@@ -21,23 +28,112 @@ var NumberOfBytesOff = errors.New("number of bytes off")
 
 var EmptyPayload = errors.New("empty")
 
+// ProtocolError prefixes the errors of malformed payloads, the server
+// replies them before closing the connection
+var ProtocolError = errors.New("ERR Protocol error")
+
+var InvalidMultibulkLength = fmt.Errorf("%w: invalid multibulk length", ProtocolError)
+
+var InvalidBulkLength = fmt.Errorf("%w: invalid bulk length", ProtocolError)
+
+var InlineTooBig = fmt.Errorf("%w: too big inline request", ProtocolError)
+
+// MaxBulkLength is the size limit of bulk strings, like proto-max-bulk-len
+const MaxBulkLength = 512 * 1024 * 1024
+
+// MaxMultibulkLength is the limit of the number of elements of arrays,
+// like the one of the commands in Redis
+const MaxMultibulkLength = math.MaxInt32
+
+// MaxInlineLength is the size limit of the lines other than the content of
+// bulk strings, like PROTO_INLINE_MAX_SIZE
+const MaxInlineLength = 64 * 1024
+
+// arrayPrealloc bounds the memory reserved for an array before its
+// elements are read
+const arrayPrealloc = 1024
+
+// Limits bounds the lengths accepted by a parser
+type Limits struct {
+	MultibulkLength int64
+	BulkLength      int
+}
+
+var DefaultLimits = Limits{MultibulkLength: MaxMultibulkLength, BulkLength: MaxBulkLength}
+
+// UnauthenticatedLimits are the limits of the commands of clients that are
+// not authenticated yet, like in Redis, so they can't make the server
+// allocate large buffers
+var UnauthenticatedLimits = Limits{MultibulkLength: 10, BulkLength: 16384}
+
+func (p RespParser) limits() Limits {
+	if p.Limits == nil {
+		return DefaultLimits
+	}
+	return p.Limits()
+}
+
 func (p RespParser) Parse(data []byte) (interface{}, error) {
-	reader := bytes.NewReader(data)
-	scanner := bufio.NewScanner(reader)
-	scanner.Split(bufio.ScanLines)
-	return p.ParseScanner(scanner)
+	return p.ParseScanner(p.CreateScanner(bytes.NewReader(data)))
 }
 
+// CreateScanner returns a scanner of the lines of RESP payloads, the
+// content of bulk strings is returned as a single token
 func (p RespParser) CreateScanner(reader io.Reader) *bufio.Scanner {
 	scanner := bufio.NewScanner(reader)
-	scanner.Split(bufio.ScanLines)
+	scanner.Buffer(nil, MaxBulkLength+2)
+	scanner.Split(p.SplitFunc())
 	return scanner
 }
 
+// ScanPayload returns a split function of the lines of RESP payloads,
+// after the header of a bulk string its content is read by length, so it
+// may contain line breaks
+func ScanPayload() bufio.SplitFunc {
+	return RespParser{}.SplitFunc()
+}
+
+// SplitFunc returns the split function of ScanPayload within the limits of
+// the parser, bulk strings over the limit are rejected before they are
+// buffered
+func (p RespParser) SplitFunc() bufio.SplitFunc {
+	bulk := -1
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if bulk < 0 {
+			advance, token, err := bufio.ScanLines(data, atEOF)
+			if advance == 0 && len(data) > MaxInlineLength {
+				return 0, nil, InlineTooBig
+			}
+			if len(token) > 1 && token[0] == '$' {
+				if length, err := strconv.Atoi(string(token[1:])); err == nil && length >= 0 {
+					if length > p.limits().BulkLength {
+						return 0, nil, InvalidBulkLength
+					}
+					bulk = length
+				}
+			}
+			return advance, token, err
+		}
+
+		if len(data) < bulk+2 {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		if data[bulk] != '\r' || data[bulk+1] != '\n' {
+			return 0, nil, errors.Join(CannotReadDataError, NumberOfBytesOff)
+		}
+		length := bulk
+		bulk = -1
+		return length + 2, data[:length], nil
+	}
+}
+
 func (p RespParser) ParseScanner(scanner *bufio.Scanner) (interface{}, error) {
 	var line []byte
 	var i, count int64
-	var read, totalBytes int
+	var totalBytes int
 	var err error
 	var part interface{}
 
@@ -50,6 +146,9 @@ func (p RespParser) ParseScanner(scanner *bufio.Scanner) (interface{}, error) {
 	}
 
 	line = scanner.Bytes()
+	if len(line) == 0 {
+		return nil, EmptyPayload
+	}
 
 	switch line[0] {
 	case '*':
@@ -58,7 +157,16 @@ func (p RespParser) ParseScanner(scanner *bufio.Scanner) (interface{}, error) {
 			return nil, errors.Join(err, TypeMismatchError)
 		}
 
-		result := make([]interface{}, count)
+		// Null array, -1 is the only negative length
+		if count == -1 {
+			return nil, nil
+		}
+		if count < 0 || count > p.limits().MultibulkLength {
+			return nil, InvalidMultibulkLength
+		}
+
+		// The elements are read before the array grows to its length
+		result := make([]interface{}, 0, min(count, arrayPrealloc))
 		for i = 0; i < count; i++ {
 			part, err = p.ParseScanner(scanner)
 
@@ -66,7 +174,7 @@ func (p RespParser) ParseScanner(scanner *bufio.Scanner) (interface{}, error) {
 				return nil, err
 			}
 
-			result[i] = part
+			result = append(result, part)
 		}
 		return result, nil
 	case ':':
@@ -86,26 +194,22 @@ func (p RespParser) ParseScanner(scanner *bufio.Scanner) (interface{}, error) {
 			return nil, errors.Join(err, CannotReadDataError)
 		}
 
-		read = 0
-		result := make([]byte, totalBytes)
-		for read < totalBytes {
-			scanner.Scan()
-			current := scanner.Bytes()
-
-			if current == nil {
-				return nil, errors.Join(CannotReadDataError, NumberOfBytesOff)
-			}
-
-			copy(result[read:read+len(current)], current)
-			read += len(current)
+		// Null bulk string
+		if totalBytes == -1 {
+			return nil, nil
+		}
+		if totalBytes < 0 || totalBytes > p.limits().BulkLength {
+			return nil, InvalidBulkLength
+		}
 
-			if read < totalBytes {
-				result[read] = '\n'
-				read += 1
-			}
+		if !scanner.Scan() {
+			return nil, errors.Join(CannotReadDataError, scanner.Err())
+		}
+		if len(scanner.Bytes()) != totalBytes {
+			return nil, errors.Join(CannotReadDataError, NumberOfBytesOff)
 		}
 
-		return string(result), nil
+		return string(scanner.Bytes()), nil
 	default:
 		return nil, UnsupportedType
 	}
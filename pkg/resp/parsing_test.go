@@ -3,6 +3,7 @@ package resp
 import (
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -43,12 +44,54 @@ func TestRespParser_Parse(t *testing.T) {
 			name:    "Bulk string with break line",
 			wantErr: false,
 		},
+		{
+			want:    "line\r\nbreaks\n",
+			data:    []byte("$13\r\nline\r\nbreaks\n\r\n"),
+			name:    "Bulk string with CRLF and trailing break line",
+			wantErr: false,
+		},
+		{
+			want:    []interface{}{"\r\n", "$1"},
+			data:    []byte("*2\r\n$2\r\n\r\n\r\n$2\r\n$1\r\n"),
+			name:    "Array of bulk strings that look like RESP",
+			wantErr: false,
+		},
 		{
 			want:    nil,
 			data:    []byte("$3000\r\nstring with\nbreak line\r\n"),
 			name:    "Bulk string bad number of bytes",
 			wantErr: true,
 		},
+		{
+			want:    "",
+			data:    []byte("$0\r\n\r\n"),
+			name:    "Empty bulk string",
+			wantErr: false,
+		},
+		{
+			want:    []interface{}{"", "value"},
+			data:    []byte("*2\r\n$0\r\n\r\n$5\r\nvalue\r\n"),
+			name:    "Array with empty bulk string",
+			wantErr: false,
+		},
+		{
+			want:    nil,
+			data:    []byte("$-1\r\n"),
+			name:    "Null bulk string",
+			wantErr: false,
+		},
+		{
+			want:    nil,
+			data:    []byte("*-1\r\n"),
+			name:    "Null array",
+			wantErr: false,
+		},
+		{
+			want:    nil,
+			data:    []byte("\r\n"),
+			name:    "Empty line",
+			wantErr: true,
+		},
 		{
 			want:    []interface{}{},
 			data:    []byte("*0\r\n"),
@@ -88,6 +131,30 @@ func TestRespParser_Parse(t *testing.T) {
 			name:    "Array with error",
 			wantErr: false,
 		},
+		{
+			want:    nil,
+			data:    []byte("*9223372036854775807\r\n"),
+			name:    "Array over the multibulk limit",
+			wantErr: true,
+		},
+		{
+			want:    nil,
+			data:    []byte("*-2\r\n"),
+			name:    "Negative array length",
+			wantErr: true,
+		},
+		{
+			want:    nil,
+			data:    []byte("$-2\r\n"),
+			name:    "Negative bulk length",
+			wantErr: true,
+		},
+		{
+			want:    nil,
+			data:    []byte("$536870913\r\n"),
+			name:    "Bulk string over the bulk limit",
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -103,3 +170,23 @@ func TestRespParser_Parse(t *testing.T) {
 		})
 	}
 }
+
+func TestRespParser_Limits(t *testing.T) {
+	p := RespParser{Limits: func() Limits { return UnauthenticatedLimits }}
+	tests := map[string]error{
+		"*11\r\n":                        InvalidMultibulkLength,
+		"*1\r\n$16385\r\n":               InvalidBulkLength,
+		"+" + strings.Repeat("a", 70000): InlineTooBig,
+	}
+	for data, expected := range tests {
+		if _, err := p.Parse([]byte(data)); !errors.Is(err, expected) {
+			t.Errorf("Parse(%.20q) error = %v, want %v", data, err, expected)
+		}
+	}
+
+	// Commands within the limits, like AUTH, are parsed
+	got, err := p.Parse([]byte("*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n"))
+	if err != nil || !reflect.DeepEqual(got, []interface{}{"AUTH", "secret"}) {
+		t.Errorf("Parse() got = %v, error %v", got, err)
+	}
+}
@@ -5,14 +5,12 @@ import (
 	"container/list"
 	"errors"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/concurrency"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
 	"iter"
-	"reflect"
 	"strconv"
 	"sync"
 )
 
-var listType = reflect.TypeOf(&list.List{})
-
 var EmptyError = errors.New("cannot serialize empty error")
 
 var SimpleStringsError = errors.New("cannot serialize simple strings with \\n or \\r")
@@ -23,8 +21,6 @@ var ArrayError = errors.New("cannot serialize array")
 
 var RespNull = "$-1\r\n"
 
-var errorInterface = reflect.TypeOf((*error)(nil)).Elem()
-
 var bufferPool = sync.Pool{
 	New: func() interface{} {
 		return bytes.NewBuffer(make([]byte, 0, 4096))
@@ -37,43 +33,50 @@ func (s RespSerializer) Serialize(element interface{}) (*bytes.Buffer, error) {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	err := s.SerializeWithBuffer(buf, element)
+	if err != nil {
+		bufferPool.Put(buf)
+	}
 	return buf, err
 }
 
-func (s RespSerializer) SerializeWithBuffer(buf *bytes.Buffer, element interface{}) error {
-	if element == nil {
-		buf.WriteString(RespNull)
-		return nil
-	}
-
-	t := reflect.TypeOf(element)
+// Release returns a buffer obtained from Serialize to the pool, it must not be used afterward
+func (RespSerializer) Release(buf *bytes.Buffer) {
+	bufferPool.Put(buf)
+}
 
+// SerializeWithBuffer dispatches on the element type with a type switch. On
+// error, buf is truncated back to its original length.
+func (s RespSerializer) SerializeWithBuffer(buf *bytes.Buffer, element interface{}) error {
 	var err error
-	switch t.Kind() {
-	case reflect.Slice, reflect.Array:
-		err = s.SerializeArray(buf, element.([]interface{}))
-	case reflect.Int:
-		err = s.SerializeInteger(buf, int64(element.(int)))
-	case reflect.Int64:
-		err = s.SerializeInteger(buf, element.(int64))
-	case reflect.String:
-		err = s.SerializeBulkString(buf, element.(string))
-	case reflect.Ptr:
-		if t.Implements(errorInterface) {
-			err = s.SerializeError(buf, element.(error))
-		} else if t.AssignableTo(concurrency.ConcurrentListType) {
-			err = s.SerializeIterable(buf, element.(*concurrency.ConcurrentList).Iterator())
-		} else if t.AssignableTo(listType) {
-			err = s.SerializeIterable(buf, s.collectList(element.(*list.List)))
-		} else {
-			return UnknownType
-		}
+	start := buf.Len()
+
+	switch v := element.(type) {
+	case nil:
+		buf.WriteString(RespNull)
+	case []interface{}:
+		err = s.SerializeArray(buf, v)
+	case int:
+		err = s.SerializeInteger(buf, int64(v))
+	case int64:
+		err = s.SerializeInteger(buf, v)
+	case string:
+		err = s.SerializeBulkString(buf, v)
+	case *values.String:
+		err = s.SerializeStringValue(buf, v)
+	case *values.List:
+		err = s.SerializeIterable(buf, v.Iterator())
+	case *concurrency.ConcurrentList:
+		err = s.SerializeIterable(buf, v.Iterator())
+	case *list.List:
+		err = s.SerializeIterable(buf, s.collectList(v))
+	case error:
+		err = s.SerializeError(buf, v)
 	default:
-		return UnknownType
+		err = UnknownType
 	}
 
 	if err != nil {
-		bufferPool.Put(buf)
+		buf.Truncate(start)
 		return err
 	}
 
@@ -129,39 +132,44 @@ func (RespSerializer) SerializeBulkString(buf *bytes.Buffer, data string) error
 	return nil
 }
 
+func (RespSerializer) SerializeStringValue(buf *bytes.Buffer, data *values.String) error {
+	buf.WriteByte('$')
+	buf.WriteString(strconv.Itoa(data.Len()))
+	buf.WriteString("\r\n")
+	buf.Write(data.AppendTo(buf.AvailableBuffer()))
+	buf.WriteString("\r\n")
+	return nil
+}
+
 func (s RespSerializer) SerializeArray(buf *bytes.Buffer, data []interface{}) error {
 	buf.WriteByte('*')
 	buf.WriteString(strconv.Itoa(len(data)))
 	buf.WriteString("\r\n")
-	var err error
 
-	tempBuf := bytes.Buffer{}
 	for _, element := range data {
-		tempBuf.Reset()
-		err = s.SerializeWithBuffer(&tempBuf, element)
-
+		err := s.SerializeWithBuffer(buf, element)
 		if err != nil {
 			return errors.Join(err, ArrayError)
 		}
-
-		buf.Write(tempBuf.Bytes())
 	}
 
 	return nil
 }
 
+// SerializeIterable buffers the elements first because the length of the
+// array is only known once the iteration ends
 func (s RespSerializer) SerializeIterable(buf *bytes.Buffer, data iter.Seq[interface{}]) error {
-	var err error
-	tempBuf := bytes.Buffer{}
+	tempBuf := bufferPool.Get().(*bytes.Buffer)
+	tempBuf.Reset()
+	defer bufferPool.Put(tempBuf)
 
 	var count = 0
 	for element := range data {
-		err = s.SerializeWithBuffer(&tempBuf, element)
-		count++
-
+		err := s.SerializeWithBuffer(tempBuf, element)
 		if err != nil {
 			return errors.Join(err, ArrayError)
 		}
+		count++
 	}
 
 	buf.WriteByte('*')
@@ -3,6 +3,7 @@ package resp
 import (
 	"bytes"
 	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
 	"testing"
 )
 
@@ -70,6 +71,30 @@ func TestRespSerializer_Serialize(t *testing.T) {
 			message:  "Array with error",
 			err:      nil,
 		},
+		{
+			data:     values.NewString("hello"),
+			expected: []byte("$5\r\nhello\r\n"),
+			message:  "String value",
+			err:      nil,
+		},
+		{
+			data:     values.NewInt(-127),
+			expected: []byte("$4\r\n-127\r\n"),
+			message:  "Int encoded string value",
+			err:      nil,
+		},
+		{
+			data:     values.NewListFromSlice([]interface{}{"hello", int64(1)}),
+			expected: []byte("*2\r\n$5\r\nhello\r\n:1\r\n"),
+			message:  "List value",
+			err:      nil,
+		},
+		{
+			data:     []interface{}{"hello", struct{}{}},
+			expected: []byte{},
+			message:  "Array with unknown type",
+			err:      UnknownType,
+		},
 	}
 
 	serializer := RespSerializer{}
@@ -82,3 +107,32 @@ func TestRespSerializer_Serialize(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkRespSerializer_Serialize(b *testing.B) {
+	serializer := RespSerializer{}
+	data := []interface{}{"SET", "key", "value", int64(10)}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		buf, err := serializer.Serialize(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		serializer.Release(buf)
+	}
+}
+
+func BenchmarkRespSerializer_SerializeList(b *testing.B) {
+	serializer := RespSerializer{}
+	data := values.NewList()
+	for i := 0; i < 100; i++ {
+		data.PushRight("value")
+	}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		buf, err := serializer.Serialize(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		serializer.Release(buf)
+	}
+}
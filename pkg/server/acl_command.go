@@ -0,0 +1,174 @@
+package server
+
+import (
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/acl"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Server) aclCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, engine.WrongNumberOfArguments
+	}
+
+	args := make([]string, 0, len(payloadArray)-1)
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, engine.UnsupportedTypeForCommand
+		}
+		args = append(args, str)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SETUSER":
+		if len(args) < 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		if err := s.acl.SetUser(args[1], args[2:]...); err != nil {
+			return nil, err
+		}
+		return engine.OK, nil
+	case "GETUSER":
+		if len(args) != 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		user, ok := s.acl.User(args[1])
+		if !ok {
+			return nil, nil
+		}
+		return []interface{}{
+			"flags", toArray(user.Flags()),
+			"passwords", toArray(user.Passwords()),
+			"commands", user.CommandRules(),
+			"keys", user.KeyRules(),
+			"channels", user.ChannelRules(),
+			"selectors", []interface{}{},
+		}, nil
+	case "DELUSER":
+		if len(args) < 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		deleted, err := s.acl.DeleteUsers(args[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		s.killUsers(client, args[1:])
+		return int64(deleted), nil
+	case "LIST":
+		users := s.acl.Users()
+		list := make([]interface{}, 0, len(users))
+		for _, user := range users {
+			list = append(list, "user "+user.Name()+" "+user.Rules())
+		}
+		return list, nil
+	case "USERS":
+		users := s.acl.Users()
+		names := make([]interface{}, 0, len(users))
+		for _, user := range users {
+			names = append(names, user.Name())
+		}
+		return names, nil
+	case "WHOAMI":
+		return client.User(), nil
+	case "CAT":
+		switch len(args) {
+		case 1:
+			return toArray(acl.Categories), nil
+		case 2:
+			category := strings.ToLower(args[1])
+			for _, c := range acl.Categories {
+				if c == category {
+					return toArray(engine.CommandsInCategory(category)), nil
+				}
+			}
+			return nil, acl.UnknownCategory
+		default:
+			return nil, engine.WrongNumberOfArguments
+		}
+	case "LOG":
+		return s.aclLog(args[1:])
+	case "LOAD":
+		if err := s.acl.Load(); err != nil {
+			return nil, err
+		}
+		// Clients of users that no longer exist are disconnected
+		var removed []string
+		for _, c := range s.clients.list() {
+			if _, ok := s.acl.User(c.User()); !ok {
+				removed = append(removed, c.User())
+			}
+		}
+		s.killUsers(client, removed)
+		return engine.OK, nil
+	case "SAVE":
+		if err := s.acl.Save(); err != nil {
+			return nil, err
+		}
+		return engine.OK, nil
+	default:
+		return nil, engine.UnsupportedCommandError
+	}
+}
+
+// aclLog implements ACL LOG [count | RESET]
+func (s *Server) aclLog(args []string) (interface{}, error) {
+	count := 10
+	if len(args) == 1 {
+		if strings.ToUpper(args[0]) == "RESET" {
+			s.acl.Log().Reset()
+			return engine.OK, nil
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return nil, engine.NotAnInteger
+		}
+		count = n
+	} else if len(args) > 1 {
+		return nil, engine.WrongNumberOfArguments
+	}
+
+	now := time.Now()
+	entries := s.acl.Log().Entries(count)
+	reply := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		reply = append(reply, []interface{}{
+			"count", entry.Count,
+			"reason", entry.Reason,
+			"context", entry.Context,
+			"object", entry.Object,
+			"username", entry.Username,
+			"age-seconds", strconv.FormatFloat(now.Sub(entry.Created).Seconds(), 'f', 3, 64),
+			"client-info", entry.ClientInfo,
+			"entry-id", entry.EntryID,
+			"timestamp-created", entry.Created.UnixMilli(),
+			"timestamp-last-updated", entry.Updated.UnixMilli(),
+		})
+	}
+	return reply, nil
+}
+
+// killUsers disconnects the clients authenticated as the users
+func (s *Server) killUsers(self *Client, users []string) {
+	if len(users) == 0 {
+		return
+	}
+	for _, client := range s.clients.list() {
+		for _, user := range users {
+			if client.User() == user && client.authenticated.Load() {
+				client.kill(client == self)
+				break
+			}
+		}
+	}
+}
+
+func toArray(strs []string) []interface{} {
+	array := make([]interface{}, len(strs))
+	for i, str := range strs {
+		array[i] = str
+	}
+	return array
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/acl"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"strings"
+	"time"
+)
+
+var NoAuth = errors.New("NOAUTH Authentication required.")
+
+// NoPermission prefixes the errors of the commands denied by the ACLs
+var NoPermission = errors.New("NOPERM")
+
+var NoDefaultPassword = errors.New("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+
+// logContext is the context of the ACL LOG entries of commands sent by clients
+const logContext = "toplevel"
+
+// scriptLogContext is the context of the ACL LOG entries of commands called by scripts
+const scriptLogContext = "lua"
+
+// authCommand implements AUTH [username] password
+func (s *Server) authCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	args := make([]string, 0, 2)
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, engine.UnsupportedTypeForCommand
+		}
+		args = append(args, str)
+	}
+
+	var username, password string
+	switch len(args) {
+	case 1:
+		username, password = acl.DefaultUser, args[0]
+		if user, ok := s.acl.User(acl.DefaultUser); ok && user.NoPass() {
+			return nil, NoDefaultPassword
+		}
+	case 2:
+		username, password = args[0], args[1]
+	default:
+		return nil, engine.WrongNumberOfArguments
+	}
+
+	if _, err := s.acl.Authenticate(username, password); err != nil {
+		s.acl.Log().Add(acl.ReasonAuth, logContext, "AUTH", username, client.info(time.Now()))
+		return nil, err
+	}
+
+	client.authenticate(username)
+	return engine.OK, nil
+}
+
+// authorize checks that the user of the client can run the command on its keys,
+// denials are recorded in ACL LOG
+func (s *Server) authorize(client *Client, name string, payloadArray []interface{}, context string) error {
+	subcommand := engine.Subcommand(payloadArray)
+	command := strings.ToLower(name)
+	if subcommand != "" {
+		command += "|" + strings.ToLower(subcommand)
+	}
+
+	// Unknown commands are reported by the engine
+	if _, ok := engine.CommandCategories(command); !ok {
+		return nil
+	}
+
+	username := client.User()
+	user, ok := s.acl.User(username)
+	if !ok || !user.CanRun(name, subcommand) {
+		s.acl.Log().Add(acl.ReasonCommand, context, command, username, client.info(time.Now()))
+		return fmt.Errorf("%w User %s has no permissions to run the '%s' command", NoPermission, username, command)
+	}
+
+	write := engine.IsWriteCommand(payloadArray)
+	for _, key := range engine.CommandKeys(payloadArray) {
+		if !user.CanAccessKey(key, write) {
+			s.acl.Log().Add(acl.ReasonKey, context, key, username, client.info(time.Now()))
+			return fmt.Errorf("%w No permissions to access a key", NoPermission)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package server
+
+// backlog keeps the latest bytes of the replication stream, so replicas
+// that reconnect after a short disconnection continue from their offset
+// instead of doing a full synchronization
+type backlog struct {
+	buf []byte
+	// next is where the next byte is written, histLen the bytes kept
+	next    int
+	histLen int
+}
+
+func newBacklog(size int64) *backlog {
+	return &backlog{buf: make([]byte, max(size, 1))}
+}
+
+func (b *backlog) size() int64 {
+	return int64(len(b.buf))
+}
+
+// write appends the data, discarding the oldest bytes when it is full
+func (b *backlog) write(data []byte) {
+	if len(data) >= len(b.buf) {
+		copy(b.buf, data[len(data)-len(b.buf):])
+		b.next = 0
+		b.histLen = len(b.buf)
+		return
+	}
+
+	n := copy(b.buf[b.next:], data)
+	copy(b.buf, data[n:])
+	b.next = (b.next + len(data)) % len(b.buf)
+	b.histLen = min(b.histLen+len(data), len(b.buf))
+}
+
+// last returns the latest n bytes, n must not exceed histLen
+func (b *backlog) last(n int) []byte {
+	data := make([]byte, 0, n)
+	start := (b.next - n + len(b.buf)) % len(b.buf)
+	if start+n <= len(b.buf) {
+		return append(data, b.buf[start:start+n]...)
+	}
+	data = append(data, b.buf[start:]...)
+	return append(data, b.buf[:b.next]...)
+}
+
+// resize changes the size keeping the latest bytes
+func (b *backlog) resize(size int64) {
+	resized := newBacklog(size)
+	resized.write(b.last(b.histLen))
+	*b = *resized
+}
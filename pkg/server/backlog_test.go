@@ -0,0 +1,48 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestBacklog(t *testing.T) {
+	b := newBacklog(8)
+
+	b.write([]byte("abc"))
+	if got := string(b.last(b.histLen)); got != "abc" {
+		t.Errorf("expected abc, got %q", got)
+	}
+
+	// Wraps around discarding the oldest bytes
+	b.write([]byte("defghij"))
+	if b.histLen != 8 {
+		t.Errorf("expected histLen 8, got %d", b.histLen)
+	}
+	if got := string(b.last(8)); got != "cdefghij" {
+		t.Errorf("expected cdefghij, got %q", got)
+	}
+	if got := string(b.last(3)); got != "hij" {
+		t.Errorf("expected hij, got %q", got)
+	}
+
+	// Data larger than the backlog keeps its tail
+	b.write([]byte("0123456789"))
+	if got := string(b.last(8)); got != "23456789" {
+		t.Errorf("expected 23456789, got %q", got)
+	}
+}
+
+func TestBacklog_resize(t *testing.T) {
+	b := newBacklog(8)
+	b.write([]byte("abcdefghij"))
+
+	b.resize(4)
+	if b.size() != 4 || string(b.last(b.histLen)) != "ghij" {
+		t.Errorf("expected ghij in 4 bytes, got %q in %d", b.last(b.histLen), b.size())
+	}
+
+	b.resize(16)
+	b.write([]byte("klm"))
+	if got := string(b.last(b.histLen)); got != "ghijklm" {
+		t.Errorf("expected ghijklm, got %q", got)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var SyntaxError = errors.New("syntax error")
+
+var NoSuchClient = errors.New("no such client")
+
+var InvalidClientName = errors.New("client names cannot contain spaces, newlines or special characters")
+
+var InvalidTimeout = errors.New("timeout is not an integer or out of range")
+
+func (s *Server) clientCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, engine.WrongNumberOfArguments
+	}
+
+	args := make([]string, 0, len(payloadArray)-1)
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, engine.UnsupportedTypeForCommand
+		}
+		args = append(args, str)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		return client.id, nil
+	case "INFO":
+		return client.info(time.Now()) + "\n", nil
+	case "LIST":
+		return s.clientList(args[1:])
+	case "KILL":
+		return s.clientKill(client, args[1:])
+	case "SETNAME":
+		if len(args) != 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		name := args[1]
+		for _, c := range name {
+			if c <= ' ' || c > '~' {
+				return nil, InvalidClientName
+			}
+		}
+		client.name.Store(&name)
+		return engine.OK, nil
+	case "GETNAME":
+		if name := client.Name(); name != "" {
+			return name, nil
+		}
+		return nil, nil
+	case "PAUSE":
+		if len(args) != 2 && len(args) != 3 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		timeout, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || timeout < 0 {
+			return nil, InvalidTimeout
+		}
+		all := true
+		if len(args) == 3 {
+			switch strings.ToUpper(args[2]) {
+			case "ALL":
+			case "WRITE":
+				all = false
+			default:
+				return nil, SyntaxError
+			}
+		}
+		s.pause.pause(time.Duration(timeout)*time.Millisecond, all)
+		return engine.OK, nil
+	case "UNPAUSE":
+		s.pause.unpause()
+		return engine.OK, nil
+	default:
+		return nil, engine.UnsupportedCommandError
+	}
+}
+
+// clientClass parses the TYPE of CLIENT LIST and CLIENT KILL, slave is an
+// alias of replica
+func clientClass(value string) (string, bool) {
+	switch class := strings.ToLower(value); class {
+	case config.ClassNormal, config.ClassReplica, config.ClassPubSub:
+		return class, true
+	case "slave":
+		return config.ClassReplica, true
+	default:
+		return "", false
+	}
+}
+
+// clientList implements CLIENT LIST [TYPE normal|replica|pubsub] [ID id [id ...]]
+func (s *Server) clientList(args []string) (interface{}, error) {
+	var ids map[int64]bool
+	class := ""
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "TYPE":
+			if i+1 >= len(args) {
+				return nil, SyntaxError
+			}
+			var ok bool
+			if class, ok = clientClass(args[i+1]); !ok {
+				return nil, SyntaxError
+			}
+			i++
+		case "ID":
+			if i+1 >= len(args) {
+				return nil, SyntaxError
+			}
+			ids = make(map[int64]bool)
+			for _, arg := range args[i+1:] {
+				id, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || id < 1 {
+					return nil, SyntaxError
+				}
+				ids[id] = true
+			}
+			i = len(args)
+		default:
+			return nil, SyntaxError
+		}
+	}
+
+	now := time.Now()
+	b := strings.Builder{}
+	for _, client := range s.clients.list() {
+		if (ids != nil && !ids[client.id]) || (class != "" && client.Class() != class) {
+			continue
+		}
+		b.WriteString(client.info(now))
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// clientFilter holds the filters of CLIENT KILL, empty fields match every client
+type clientFilter struct {
+	id     int64
+	addr   string
+	laddr  string
+	user   string
+	class  string
+	maxAge int64
+	skipMe bool
+}
+
+func (f clientFilter) matches(client *Client, self *Client, now time.Time) bool {
+	switch {
+	case f.id != 0 && client.id != f.id:
+		return false
+	case f.addr != "" && client.conn.RemoteAddr().String() != f.addr:
+		return false
+	case f.laddr != "" && client.conn.LocalAddr().String() != f.laddr:
+		return false
+	case f.user != "" && client.User() != f.user:
+		return false
+	case f.class != "" && client.Class() != f.class:
+		return false
+	case f.maxAge != 0 && int64(now.Sub(client.created).Seconds()) < f.maxAge:
+		return false
+	case f.skipMe && client == self:
+		return false
+	}
+	return true
+}
+
+// clientKill implements both forms of CLIENT KILL, the old one with an
+// address replies OK, the one with filters the number of killed clients
+func (s *Server) clientKill(self *Client, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, engine.WrongNumberOfArguments
+	}
+
+	if len(args) == 1 {
+		for _, client := range s.clients.list() {
+			if client.conn.RemoteAddr().String() == args[0] {
+				client.kill(client == self)
+				return engine.OK, nil
+			}
+		}
+		return nil, NoSuchClient
+	}
+
+	if len(args)%2 != 0 {
+		return nil, SyntaxError
+	}
+
+	filter := clientFilter{skipMe: true}
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "ID":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id < 1 {
+				return nil, SyntaxError
+			}
+			filter.id = id
+		case "ADDR":
+			filter.addr = value
+		case "LADDR":
+			filter.laddr = value
+		case "USER":
+			filter.user = value
+		case "MAXAGE":
+			maxAge, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || maxAge < 1 {
+				return nil, SyntaxError
+			}
+			filter.maxAge = maxAge
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				return nil, SyntaxError
+			}
+		case "TYPE":
+			class, ok := clientClass(value)
+			if !ok {
+				return nil, SyntaxError
+			}
+			filter.class = class
+		default:
+			return nil, SyntaxError
+		}
+	}
+
+	var killed int64
+	now := time.Now()
+	for _, client := range s.clients.list() {
+		if filter.matches(client, self, now) {
+			client.kill(client == self)
+			killed++
+		}
+	}
+	return killed, nil
+}
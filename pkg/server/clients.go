@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/acl"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client holds the metadata of a connection reported by CLIENT LIST
+type Client struct {
+	id      int64
+	conn    net.Conn
+	created time.Time
+
+	name atomic.Pointer[string]
+	user atomic.Pointer[string]
+	// class selects the output buffer limits, like normal or pubsub
+	class       atomic.Pointer[string]
+	lastCommand atomic.Pointer[string]
+	// lastInteraction is the unix nanoseconds of the last command
+	lastInteraction atomic.Int64
+
+	// readBytes are the bytes read from the connection, parsedBytes the ones
+	// consumed by the parser, the difference is the pending query buffer
+	readBytes   atomic.Int64
+	parsedBytes atomic.Int64
+	// argvMem is the size of the arguments of the command being executed
+	argvMem atomic.Int64
+	// outputBytes is the size of the reply being written
+	outputBytes atomic.Int64
+
+	// listeningPort is the port announced by replicas with REPLCONF
+	listeningPort atomic.Int64
+	// asking is set by ASKING for the next command
+	asking atomic.Bool
+	// monitor is set by MONITOR, the replies go through its stream
+	monitor atomic.Pointer[monitor]
+
+	// authenticated clients can run the commands allowed to their user
+	authenticated atomic.Bool
+	// killed clients are disconnected after their current reply
+	killed atomic.Bool
+}
+
+func newClient(id int64, conn net.Conn) *Client {
+	c := &Client{
+		id:      id,
+		conn:    conn,
+		created: time.Now(),
+	}
+	name, user, class, command := "", acl.DefaultUser, config.ClassNormal, "NULL"
+	c.name.Store(&name)
+	c.user.Store(&user)
+	c.class.Store(&class)
+	c.lastCommand.Store(&command)
+	c.lastInteraction.Store(c.created.UnixNano())
+	return c
+}
+
+func (c *Client) ID() int64 {
+	return c.id
+}
+
+func (c *Client) Name() string {
+	return *c.name.Load()
+}
+
+func (c *Client) User() string {
+	return *c.user.Load()
+}
+
+// Class is the class of the client for client-output-buffer-limit
+func (c *Client) Class() string {
+	return *c.class.Load()
+}
+
+func (c *Client) setClass(class string) {
+	c.class.Store(&class)
+}
+
+// authenticate switches the client to the user
+func (c *Client) authenticate(user string) {
+	c.user.Store(&user)
+	c.authenticated.Store(true)
+}
+
+// Read counts the bytes read from the connection for the query buffer size
+func (c *Client) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	c.readBytes.Add(int64(n))
+	return n, err
+}
+
+// split wraps the split function of the parser to count the bytes it consumes
+func (c *Client) split(scan bufio.SplitFunc) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := scan(data, atEOF)
+		c.parsedBytes.Add(int64(advance))
+		return advance, token, err
+	}
+}
+
+// beginCommand records the command about to be executed
+func (c *Client) beginCommand(name string, payloadArray []interface{}) {
+	command := strings.ToLower(name)
+	c.lastCommand.Store(&command)
+	c.lastInteraction.Store(time.Now().UnixNano())
+
+	var size int64
+	for _, arg := range payloadArray {
+		if str, ok := arg.(string); ok {
+			size += int64(len(str))
+		}
+	}
+	c.argvMem.Store(size)
+}
+
+// kill disconnects the client, the current reply of the client is still written
+func (c *Client) kill(self bool) {
+	c.killed.Store(true)
+	if !self {
+		_ = c.conn.Close()
+	}
+}
+
+// Addr is the address of the client, like addr in CLIENT LIST
+func (c *Client) Addr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// info formats the client like a line of CLIENT LIST
+func (c *Client) info(now time.Time) string {
+	qbuf := c.readBytes.Load() - c.parsedBytes.Load()
+	argvMem := c.argvMem.Load()
+	omem := c.outputBytes.Load()
+	obl := int64(0)
+	if omem > 0 {
+		obl = 1
+	}
+	flags := "N"
+	if c.Class() == config.ClassReplica {
+		flags = "S"
+	}
+	if c.monitor.Load() != nil {
+		flags = "O"
+	}
+
+	return fmt.Sprintf(
+		"id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=0 psub=0 multi=-1 "+
+			"qbuf=%d argv-mem=%d obl=%d oll=0 omem=%d tot-mem=%d events=r cmd=%s user=%s resp=2",
+		c.id,
+		c.conn.RemoteAddr(),
+		c.conn.LocalAddr(),
+		c.Name(),
+		int64(now.Sub(c.created).Seconds()),
+		int64(now.Sub(time.Unix(0, c.lastInteraction.Load())).Seconds()),
+		flags,
+		qbuf,
+		argvMem,
+		obl,
+		omem,
+		qbuf+argvMem+omem,
+		*c.lastCommand.Load(),
+		c.User(),
+	)
+}
+
+// clientRegistry tracks the connected clients
+type clientRegistry struct {
+	lock    sync.RWMutex
+	clients map[int64]*Client
+	lastID  atomic.Int64
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[int64]*Client)}
+}
+
+// register adds a client for the connection, unless there are already
+// maxClients clients
+func (r *clientRegistry) register(conn net.Conn, maxClients int64) (*Client, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if int64(len(r.clients)) >= maxClients {
+		return nil, false
+	}
+	client := newClient(r.lastID.Add(1), conn)
+	r.clients[client.id] = client
+	return client, true
+}
+
+func (r *clientRegistry) unregister(client *Client) {
+	r.lock.Lock()
+	delete(r.clients, client.id)
+	r.lock.Unlock()
+}
+
+// list returns the clients sorted by id
+func (r *clientRegistry) list() []*Client {
+	r.lock.RLock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
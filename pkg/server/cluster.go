@@ -0,0 +1,573 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/cluster"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterCronPeriod is how often the nodes exchange their state
+const clusterCronPeriod = 100 * time.Millisecond
+
+// clusterLinkTimeout bounds the exchanges with the other nodes
+const clusterLinkTimeout = time.Second
+
+var ClusterDisabled = errors.New("this instance has cluster support disabled")
+
+var CrossSlot = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+
+var TryAgain = errors.New("TRYAGAIN Multiple keys request during rehashing of slot")
+
+var SlotNotServed = errors.New("CLUSTERDOWN Hash slot not served")
+
+var ReplicaOfInCluster = errors.New("REPLICAOF not allowed in cluster mode.")
+
+var InvalidNodeAddress = errors.New("invalid node address specified")
+
+var InvalidKeysCount = errors.New("invalid number of keys")
+
+// bindCluster loads the cluster when cluster-enabled is set
+func (s *Server) bindCluster(cfg *config.Config) error {
+	if !cfg.GetBool(config.ClusterEnabled) {
+		return nil
+	}
+	if cfg.GetString(config.ReplicaOf) != "" {
+		return ReplicaOfInCluster
+	}
+
+	c, err := cluster.LoadFile(cfg.GetString(config.ClusterConfigFile), int(cfg.GetInt(config.Port)))
+	if err != nil {
+		return err
+	}
+	if host := cfg.GetString(config.ClusterAnnounceIP); host != "" {
+		c.SetHost(host)
+	}
+	cfg.OnChange(config.ClusterAnnounceIP, func(value string) error {
+		c.SetHost(value)
+		return nil
+	})
+	c.SetTimeout(time.Duration(cfg.GetInt(config.ClusterNodeTimeout)) * time.Millisecond)
+	cfg.OnChange(config.ClusterNodeTimeout, func(value string) error {
+		timeout, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		c.SetTimeout(time.Duration(timeout) * time.Millisecond)
+		return nil
+	})
+
+	s.cluster = c
+	return nil
+}
+
+// clusterRedirect checks that this node serves the keys of the command.
+// Keys of other nodes get MOVED, missing keys of a slot being migrated get
+// ASK, and the node importing a slot serves the clients that sent ASKING.
+func (s *Server) clusterRedirect(client *Client, name string, payloadArray []interface{}) error {
+	asking := client.asking.Swap(false)
+	// MIGRATE only moves the keys of this node
+	if s.cluster == nil || name == engine.MIGRATE {
+		return nil
+	}
+
+	keys := engine.CommandKeys(payloadArray)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return CrossSlot
+		}
+	}
+
+	missing := 0
+	for _, key := range keys {
+		if !s.eng.Exists(key) {
+			missing++
+		}
+	}
+
+	state := s.cluster.Slot(slot)
+	switch {
+	case state.Owner == nil:
+		return SlotNotServed
+	case state.Owner.Myself && state.MigratingTo != nil && missing > 0:
+		if missing < len(keys) {
+			return TryAgain
+		}
+		return fmt.Errorf("ASK %d %s", slot, state.MigratingTo.Address())
+	case state.Owner.Myself:
+		return nil
+	case state.ImportingFrom != nil && asking:
+		if len(keys) > 1 && missing > 0 {
+			return TryAgain
+		}
+		return nil
+	default:
+		return fmt.Errorf("MOVED %d %s", slot, state.Owner.Address())
+	}
+}
+
+// askingCommand implements ASKING, the next command may use a slot being imported
+func (s *Server) askingCommand(client *Client, _ []interface{}) (interface{}, error) {
+	if s.cluster == nil {
+		return nil, ClusterDisabled
+	}
+	client.asking.Store(true)
+	return engine.OK, nil
+}
+
+func (s *Server) clusterCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) < 2 {
+		return nil, engine.WrongNumberOfArguments
+	}
+	if s.cluster == nil {
+		return nil, ClusterDisabled
+	}
+
+	args := make([]string, 0, len(payloadArray)-1)
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, engine.UnsupportedTypeForCommand
+		}
+		args = append(args, str)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "INFO":
+		return s.clusterInfo(), nil
+	case "MYID":
+		return s.cluster.Myself().ID, nil
+	case "NODES":
+		return s.cluster.FormatNodes(), nil
+	case "SLOTS":
+		return s.clusterSlots(client), nil
+	case "SHARDS":
+		return s.clusterShards(client), nil
+	case "KEYSLOT":
+		if len(args) != 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		return int64(cluster.KeySlot(args[1])), nil
+	case "COUNTKEYSINSLOT":
+		if len(args) != 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		slot, err := cluster.ParseSlot(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return s.eng.CountKeysInSlot(slot), nil
+	case "GETKEYSINSLOT":
+		if len(args) != 3 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		slot, err := cluster.ParseSlot(args[1])
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil || count < 0 {
+			return nil, InvalidKeysCount
+		}
+		keys := s.eng.KeysInSlot(slot, count)
+		res := make([]interface{}, len(keys))
+		for i, key := range keys {
+			res[i] = key
+		}
+		return res, nil
+	case "MEET":
+		if len(args) != 3 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		port, err := strconv.Atoi(args[2])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%w: %s:%s", InvalidNodeAddress, args[1], args[2])
+		}
+		s.cluster.Meet(args[1], port)
+		return engine.OK, nil
+	case "FORGET":
+		if len(args) != 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		return okOrError(s.cluster.Forget(args[1]))
+	case "ADDSLOTS", "DELSLOTS":
+		if len(args) < 2 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		ranges := make([]cluster.SlotRange, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			slot, err := cluster.ParseSlot(arg)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, cluster.SlotRange{Start: slot, End: slot})
+		}
+		return s.changeSlots(strings.ToUpper(args[0]) == "ADDSLOTS", ranges)
+	case "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return nil, engine.WrongNumberOfArguments
+		}
+		ranges := make([]cluster.SlotRange, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			start, err := cluster.ParseSlot(args[i])
+			if err != nil {
+				return nil, err
+			}
+			end, err := cluster.ParseSlot(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, cluster.InvalidSlot
+			}
+			ranges = append(ranges, cluster.SlotRange{Start: start, End: end})
+		}
+		return s.changeSlots(strings.ToUpper(args[0]) == "ADDSLOTSRANGE", ranges)
+	case "SETSLOT":
+		return s.clusterSetSlot(args[1:])
+	case "SAVECONFIG":
+		return okOrError(s.cluster.Save())
+	case "GOSSIP":
+		return s.clusterGossipCommand(client, args[1:])
+	default:
+		return nil, engine.UnsupportedCommandError
+	}
+}
+
+func okOrError(err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	return engine.OK, nil
+}
+
+func (s *Server) changeSlots(add bool, ranges []cluster.SlotRange) (interface{}, error) {
+	if add {
+		return okOrError(s.cluster.AddSlots(ranges))
+	}
+	return okOrError(s.cluster.DelSlots(ranges))
+}
+
+// clusterSetSlot implements CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE id and STABLE
+func (s *Server) clusterSetSlot(args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, engine.WrongNumberOfArguments
+	}
+	slot, err := cluster.ParseSlot(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	action := strings.ToUpper(args[1])
+	if action == "STABLE" {
+		if len(args) != 2 {
+			return nil, SyntaxError
+		}
+		return okOrError(s.cluster.Stable(slot))
+	}
+	if len(args) != 3 {
+		return nil, SyntaxError
+	}
+
+	switch action {
+	case "IMPORTING":
+		return okOrError(s.cluster.Importing(slot, args[2]))
+	case "MIGRATING":
+		return okOrError(s.cluster.Migrating(slot, args[2]))
+	case "NODE":
+		return okOrError(s.cluster.Assign(slot, args[2]))
+	default:
+		return nil, SyntaxError
+	}
+}
+
+func (s *Server) clusterInfo() string {
+	info := s.cluster.Info()
+	b := strings.Builder{}
+	for _, field := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"cluster_state", info.State},
+		{"cluster_slots_assigned", info.SlotsAssigned},
+		{"cluster_slots_ok", info.SlotsOK},
+		{"cluster_slots_pfail", info.SlotsFailing},
+		{"cluster_slots_fail", 0},
+		{"cluster_known_nodes", info.KnownNodes},
+		{"cluster_size", info.Size},
+		{"cluster_current_epoch", info.CurrentEpoch},
+		{"cluster_my_epoch", info.MyEpoch},
+	} {
+		_, _ = fmt.Fprintf(&b, "%s:%v\r\n", field.name, field.value)
+	}
+	return b.String()
+}
+
+// nodeHost is the host of a node for the client, this node may not know its
+// own host yet, then the address the client connected to is used
+func nodeHost(client *Client, n cluster.Node) string {
+	if n.Host != "" || !n.Myself {
+		return n.Host
+	}
+	if addr, ok := client.conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// clusterSlots implements CLUSTER SLOTS, the ranges of slots with their node
+func (s *Server) clusterSlots(client *Client) []interface{} {
+	type entry struct {
+		r    cluster.SlotRange
+		node cluster.Node
+	}
+	var entries []entry
+	for _, n := range s.cluster.Nodes() {
+		for _, r := range s.cluster.SlotRanges(n.ID) {
+			entries = append(entries, entry{r, n})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].r.Start < entries[j].r.Start
+	})
+
+	res := make([]interface{}, len(entries))
+	for i, e := range entries {
+		res[i] = []interface{}{
+			int64(e.r.Start), int64(e.r.End),
+			[]interface{}{nodeHost(client, e.node), int64(e.node.Port), e.node.ID},
+		}
+	}
+	return res
+}
+
+// clusterShards implements CLUSTER SHARDS, each node is a shard without replicas
+func (s *Server) clusterShards(client *Client) []interface{} {
+	nodes := s.cluster.Nodes()
+	res := make([]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		slots := make([]interface{}, 0)
+		for _, r := range s.cluster.SlotRanges(n.ID) {
+			slots = append(slots, int64(r.Start), int64(r.End))
+		}
+		health := "online"
+		if n.Failing {
+			health = "fail"
+		}
+		host := nodeHost(client, n)
+		res = append(res, []interface{}{
+			"slots", slots,
+			"nodes", []interface{}{[]interface{}{
+				"id", n.ID, "port", int64(n.Port), "ip", host, "endpoint", host,
+				"role", "master", "replication-offset", int64(0), "health", health,
+			}},
+		})
+	}
+	return res
+}
+
+// clusterGossipCommand implements CLUSTER GOSSIP, the exchange of the state
+// between nodes. The reply is the state of this node.
+func (s *Server) clusterGossipCommand(client *Client, args []string) (interface{}, error) {
+	msg, err := cluster.ParseMessage(args)
+	if err != nil {
+		return nil, err
+	}
+
+	host := remoteHost(client.conn)
+	if err = s.cluster.Receive(msg, host); err != nil {
+		s.logger.Printf("Error saving the cluster config: %s", err)
+	}
+	if err = s.cluster.LearnHost(msg.Observed); err != nil {
+		s.logger.Printf("Error saving the cluster config: %s", err)
+	}
+
+	reply := s.cluster.Message()
+	reply.Observed = host
+	res := make([]interface{}, 0)
+	for _, arg := range reply.Args() {
+		res = append(res, arg)
+	}
+	return res, nil
+}
+
+func remoteHost(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// clusterLink is a connection to another node
+type clusterLink struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	timeout time.Duration
+}
+
+// clusterCron exchanges the state with the other nodes and the addresses
+// of CLUSTER MEET until the context is done
+func (s *Server) clusterCron(ctx context.Context) {
+	links := make(map[string]*clusterLink)
+	defer func() {
+		for _, link := range links {
+			_ = link.conn.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(clusterCronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.clusterGossip(links)
+		}
+	}
+}
+
+// clusterGossip exchanges the state with each node concurrently
+func (s *Server) clusterGossip(links map[string]*clusterLink) {
+	meets := make(map[string]bool)
+	for _, address := range s.cluster.Meets() {
+		meets[address] = true
+	}
+	for _, n := range s.cluster.Nodes() {
+		if _, ok := meets[n.Address()]; !ok && !n.Myself && n.Host != "" {
+			meets[n.Address()] = false
+		}
+	}
+
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for address, meet := range meets {
+		link := links[address]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link, err := s.exchangeGossip(link, address)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				delete(links, address)
+				return
+			}
+			links[address] = link
+			if meet {
+				s.cluster.Met(address)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Forgotten nodes
+	for address, link := range links {
+		if _, ok := meets[address]; !ok {
+			_ = link.conn.Close()
+			delete(links, address)
+		}
+	}
+}
+
+// exchangeGossip sends the state of this node through the link, which is
+// connected when nil, and merges the state in the reply
+func (s *Server) exchangeGossip(link *clusterLink, address string) (*clusterLink, error) {
+	if link == nil {
+		conn, err := net.DialTimeout("tcp", address, clusterLinkTimeout)
+		if err != nil {
+			return nil, err
+		}
+		link = &clusterLink{conn: conn, scanner: resp.RespParser{}.CreateScanner(conn), timeout: clusterLinkTimeout}
+		if err = s.authenticateLink(link); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	msg := s.cluster.Message()
+	msg.Observed = host
+	args := []interface{}{engine.CLUSTER, "GOSSIP"}
+	for _, arg := range msg.Args() {
+		args = append(args, arg)
+	}
+
+	res, err := link.do(args...)
+	if err != nil {
+		_ = link.conn.Close()
+		return nil, err
+	}
+	fields, _ := res.([]interface{})
+	replyArgs := make([]string, len(fields))
+	for i, field := range fields {
+		replyArgs[i], _ = field.(string)
+	}
+	reply, err := cluster.ParseMessage(replyArgs)
+	if err != nil {
+		_ = link.conn.Close()
+		return nil, err
+	}
+
+	if err = s.cluster.Receive(reply, host); err != nil {
+		s.logger.Printf("Error saving the cluster config: %s", err)
+	}
+	if err = s.cluster.LearnHost(reply.Observed); err != nil {
+		s.logger.Printf("Error saving the cluster config: %s", err)
+	}
+	return link, nil
+}
+
+// authenticateLink authenticates with masteruser and masterauth, like replicas
+func (s *Server) authenticateLink(link *clusterLink) error {
+	cfg := s.eng.Config()
+	password := cfg.GetString(config.MasterAuth)
+	if password == "" {
+		return nil
+	}
+	args := []interface{}{engine.AUTH}
+	if user := cfg.GetString(config.MasterUser); user != "" {
+		args = append(args, user)
+	}
+	_, err := link.do(append(args, password)...)
+	return err
+}
+
+// do sends a command and reads its reply, error replies are returned as errors
+func (l *clusterLink) do(args ...interface{}) (interface{}, error) {
+	serialized, err := resp.RespSerializer{}.Serialize(args)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.RespSerializer{}.Release(serialized)
+
+	_ = l.conn.SetDeadline(time.Now().Add(l.timeout))
+	if _, err = l.conn.Write(serialized.Bytes()); err != nil {
+		return nil, err
+	}
+	res, err := resp.RespParser{}.ParseScanner(l.scanner)
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := res.(error); ok {
+		return nil, replyErr
+	}
+	return res, nil
+}
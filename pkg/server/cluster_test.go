@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startClusterNode serves a server in cluster mode on a random port and
+// returns its node id and port, the port is configured before the node
+// loads so it announces it
+func startClusterNode(t *testing.T) (*testConn, string, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	cfg := config.New()
+	for name, value := range map[string]string{
+		config.Port:              port,
+		config.ClusterEnabled:    "yes",
+		config.ClusterConfigFile: filepath.Join(t.TempDir(), "nodes.conf"),
+	} {
+		if err := cfg.Override(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eng, _ := engine.NewEngine(engine.EngineOptions{Config: cfg})
+	serv, err := NewServerWithOptions(eng, log.New(io.Discard, "", log.LstdFlags), ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ready := make(chan struct{})
+	go serv.Serve(ctx, listener, ready)
+	<-ready
+
+	conn := dialTest(t, "tcp", listener.Addr().String())
+	id, err := conn.do("CLUSTER", "MYID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, id.(string), port
+}
+
+func contains(substring string) func(res interface{}) bool {
+	return func(res interface{}) bool {
+		str, ok := res.(string)
+		return ok && strings.Contains(str, substring)
+	}
+}
+
+// isError checks the message of an error reply
+func isError(message string) func(res interface{}) bool {
+	return func(res interface{}) bool {
+		err, ok := res.(error)
+		return ok && err.Error() == message
+	}
+}
+
+func TestServer_Cluster(t *testing.T) {
+	a, idA, portA := startClusterNode(t)
+	b, _, portB := startClusterNode(t)
+	c, idC, portC := startClusterNode(t)
+
+	a.do("CLUSTER", "MEET", "127.0.0.1", portB)
+	a.do("CLUSTER", "MEET", "127.0.0.1", portC)
+	a.do("CLUSTER", "ADDSLOTSRANGE", "0", "5460")
+	b.do("CLUSTER", "ADDSLOTSRANGE", "5461", "10922")
+	c.do("CLUSTER", "ADDSLOTSRANGE", "10923", "16383")
+	for _, conn := range []*testConn{a, b, c} {
+		eventually(t, conn, contains("cluster_state:ok\r\n"), "CLUSTER", "INFO")
+		eventually(t, conn, contains("cluster_known_nodes:3\r\n"), "CLUSTER", "INFO")
+	}
+
+	if res, _ := a.do("CLUSTER", "KEYSLOT", "foo"); res != int64(12182) {
+		t.Errorf("expected slot 12182, got %v", res)
+	}
+	if res, _ := a.do("SET", "foo", "bar"); !isError("MOVED 12182 127.0.0.1:" + portC)(res) {
+		t.Errorf("expected MOVED, got %v", res)
+	}
+	if res, _ := c.do("SET", "foo", "bar"); res != engine.OK {
+		t.Errorf("expected OK, got %v", res)
+	}
+	if res, _ := c.do("DEL", "foo", "bar"); !isError(CrossSlot.Error())(res) {
+		t.Errorf("expected CROSSSLOT, got %v", res)
+	}
+	if res, _ := c.do("EXISTS", "{foo}a", "foo"); res != int64(1) {
+		t.Errorf("expected 1 for keys with the same hash tag, got %v", res)
+	}
+	if res, _ := c.do("CLUSTER", "COUNTKEYSINSLOT", "12182"); res != int64(1) {
+		t.Errorf("expected 1 key, got %v", res)
+	}
+	if res, _ := c.do("CLUSTER", "GETKEYSINSLOT", "12182", "10"); !reflect.DeepEqual(res, []interface{}{"foo"}) {
+		t.Errorf("expected foo, got %v", res)
+	}
+
+	slots, _ := a.do("CLUSTER", "SLOTS")
+	port, _ := strconv.ParseInt(portA, 10, 64)
+	expected := []interface{}{int64(0), int64(5460), []interface{}{"127.0.0.1", port, idA}}
+	if entries, ok := slots.([]interface{}); !ok || len(entries) != 3 || !reflect.DeepEqual(entries[0], expected) {
+		t.Errorf("unexpected CLUSTER SLOTS %v", slots)
+	}
+	if shards, ok := a.do("CLUSTER", "SHARDS"); ok != nil || len(shards.([]interface{})) != 3 {
+		t.Errorf("unexpected CLUSTER SHARDS %v", shards)
+	}
+
+	// Migrate the slot of foo from c to a
+	if res, _ := a.do("CLUSTER", "SETSLOT", "12182", "IMPORTING", idC); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+	if res, _ := c.do("CLUSTER", "SETSLOT", "12182", "MIGRATING", idA); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+	if res, _ := c.do("GET", "{foo}missing"); !isError("ASK 12182 127.0.0.1:" + portA)(res) {
+		t.Errorf("expected ASK, got %v", res)
+	}
+	if res, _ := c.do("MIGRATE", "127.0.0.1", portA, "", "0", "5000", "KEYS", "foo"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+	if res, _ := c.do("CLUSTER", "COUNTKEYSINSLOT", "12182"); res != int64(0) {
+		t.Errorf("expected the migrated key to be deleted, got %v", res)
+	}
+	if res, _ := c.do("MIGRATE", "127.0.0.1", portA, "foo", "0", "5000"); res != NoKey {
+		t.Errorf("expected NOKEY, got %v", res)
+	}
+	if res, _ := a.do("GET", "foo"); !isError("MOVED 12182 127.0.0.1:" + portC)(res) {
+		t.Errorf("expected MOVED without ASKING, got %v", res)
+	}
+	a.do("ASKING")
+	if res, _ := a.do("GET", "foo"); res != "bar" {
+		t.Errorf("expected bar after ASKING, got %v", res)
+	}
+
+	a.do("CLUSTER", "SETSLOT", "12182", "NODE", idA)
+	c.do("CLUSTER", "SETSLOT", "12182", "NODE", idA)
+	eventually(t, b, isError("MOVED 12182 127.0.0.1:"+portA), "GET", "foo")
+	if res, _ := a.do("GET", "foo"); res != "bar" {
+		t.Errorf("expected bar, got %v", res)
+	}
+	eventually(t, c, contains("cluster_my_epoch:0\r\n"), "CLUSTER", "INFO")
+	eventually(t, c, contains("cluster_current_epoch:1\r\n"), "CLUSTER", "INFO")
+}
+
+func TestServer_ClusterDisabled(t *testing.T) {
+	conn := dialTest(t, "tcp", startLimitsServer(t))
+
+	if res, _ := conn.do("CLUSTER", "INFO"); !isError(ClusterDisabled.Error())(res) {
+		t.Errorf("expected cluster support disabled, got %v", res)
+	}
+	info, _ := conn.do("INFO", "cluster")
+	if info != "# Cluster\r\ncluster_enabled:0\r\n" {
+		t.Errorf("unexpected INFO cluster %q", info)
+	}
+}
+
+func TestServer_ClusterConfigFile(t *testing.T) {
+	conn, id, port := startClusterNode(t)
+	conn.do("CLUSTER", "ADDSLOTS", "1", "2", "3")
+
+	cfg, _ := conn.do("CONFIG", "GET", "cluster-config-file")
+	file := cfg.([]interface{})[1].(string)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), id+" :"+port+"@"+port+" myself,master - 0 0 0 connected 1-3\n") {
+		t.Errorf("unexpected cluster config file %q", data)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// outputChunkSize is how much of a reply is written at a time, the rest of
+// the reply is the pending output checked against the limits
+const outputChunkSize = 16 * 1024
+
+var MaxClientsReached = errors.New("max number of clients reached")
+
+var OutputBufferLimitReached = errors.New("client output buffer limit reached")
+
+// limits are the connection limits of the configuration, the OnChange
+// functions keep them updated for the connected clients
+type limits struct {
+	maxClients atomic.Int64
+	// timeout and keepAlive are in seconds, zero disables them
+	timeout      atomic.Int64
+	keepAlive    atomic.Int64
+	outputBuffer atomic.Pointer[map[string]config.ClientOutputBufferLimit]
+}
+
+// bind loads the limits and follows their changes
+func (l *limits) bind(cfg *config.Config) error {
+	for name, value := range map[string]*atomic.Int64{
+		config.MaxClients:   &l.maxClients,
+		config.Timeout:      &l.timeout,
+		config.TCPKeepAlive: &l.keepAlive,
+	} {
+		value.Store(cfg.GetInt(name))
+		cfg.OnChange(name, func(v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return err
+			}
+			value.Store(n)
+			return nil
+		})
+	}
+
+	if err := l.setOutputBuffer(cfg.GetString(config.ClientOutputBufferLimits)); err != nil {
+		return err
+	}
+	cfg.OnChange(config.ClientOutputBufferLimits, l.setOutputBuffer)
+	return nil
+}
+
+func (l *limits) setOutputBuffer(value string) error {
+	limits, err := config.ParseClientOutputBufferLimits(value)
+	if err != nil {
+		return err
+	}
+	l.outputBuffer.Store(&limits)
+	return nil
+}
+
+// output returns the output buffer limit of the class of clients
+func (l *limits) output(class string) config.ClientOutputBufferLimit {
+	return (*l.outputBuffer.Load())[class]
+}
+
+// setKeepAlive applies tcp-keepalive to the connection, TLS connections
+// apply it to the TCP connection underneath
+func (s *Server) setKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	seconds := s.limits.keepAlive.Load()
+	if seconds <= 0 {
+		_ = tcpConn.SetKeepAlive(false)
+		return
+	}
+	_ = tcpConn.SetKeepAlive(true)
+	_ = tcpConn.SetKeepAlivePeriod(time.Duration(seconds) * time.Second)
+}
+
+// setIdleDeadline closes normal clients that don't send a command within
+// the timeout, the other classes are never idle
+func (s *Server) setIdleDeadline(client *Client) {
+	seconds := s.limits.timeout.Load()
+	if seconds <= 0 || client.Class() != config.ClassNormal {
+		_ = client.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	_ = client.conn.SetReadDeadline(time.Now().Add(time.Duration(seconds) * time.Second))
+}
+
+// isTimeout reports whether the error is an expired deadline
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// denyMaxClients writes the maxclients error to the connection
+func (s *Server) denyMaxClients(conn net.Conn) {
+	serialized, _ := resp.RespSerializer{}.Serialize(MaxClientsReached)
+	_, _ = conn.Write(serialized.Bytes())
+}
+
+// writeReply writes the reply in chunks, the unwritten part is the output
+// buffer of the client. Replies over the hard limit of the class are not
+// written, and the write fails once the pending output stays over the soft
+// limit for the soft seconds. The replies of monitors are queued behind
+// their stream.
+func (s *Server) writeReply(client *Client, reply []byte) error {
+	limit := s.limits.output(client.Class())
+	if m := client.monitor.Load(); m != nil {
+		if !m.send(reply, limit) {
+			return OutputBufferLimitReached
+		}
+		return nil
+	}
+
+	defer client.outputBytes.Store(0)
+	if limit.Hard > 0 && int64(len(reply)) > limit.Hard {
+		return OutputBufferLimitReached
+	}
+
+	overSoft := false
+	for written := 0; written < len(reply); {
+		pending := int64(len(reply) - written)
+		client.outputBytes.Store(pending)
+
+		switch {
+		case limit.Soft > 0 && pending > limit.Soft && !overSoft:
+			overSoft = true
+			_ = client.conn.SetWriteDeadline(time.Now().Add(time.Duration(limit.SoftSeconds) * time.Second))
+		case overSoft && pending <= limit.Soft:
+			overSoft = false
+			_ = client.conn.SetWriteDeadline(time.Time{})
+		}
+
+		n, err := client.conn.Write(reply[written:min(written+outputChunkSize, len(reply))])
+		written += n
+		if err != nil && overSoft && isTimeout(err) {
+			return OutputBufferLimitReached
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if overSoft {
+		_ = client.conn.SetWriteDeadline(time.Time{})
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startLimitsServer serves a server with the default options and returns
+// its address
+func startLimitsServer(t *testing.T) string {
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	return serveTest(t, NewServer(eng, log.New(io.Discard, "", log.LstdFlags)))
+}
+
+// infoStat returns the line of the field in INFO stats
+func infoStat(t *testing.T, conn *testConn, field string) string {
+	res, err := conn.do("INFO", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(res.(string), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return line
+		}
+	}
+	t.Fatalf("missing %s in INFO stats", field)
+	return ""
+}
+
+func TestServer_MaxClients(t *testing.T) {
+	addr := startLimitsServer(t)
+
+	conn := dialTest(t, "tcp", addr)
+	if res, _ := conn.do("CONFIG", "SET", "maxclients", "1"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+
+	rejected := dialTest(t, "tcp", addr)
+	res, _ := rejected.receive(5 * time.Second)
+	if err, ok := res.(error); !ok || !strings.Contains(err.Error(), "max number of clients reached") {
+		t.Errorf("expected max number of clients reached, got %v", res)
+	}
+
+	if line := infoStat(t, conn, "rejected_connections"); line != "rejected_connections:1" {
+		t.Errorf("unexpected %s", line)
+	}
+}
+
+func TestServer_Timeout(t *testing.T) {
+	addr := startLimitsServer(t)
+
+	conn := dialTest(t, "tcp", addr)
+	if res, _ := conn.do("CONFIG", "SET", "timeout", "1"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+
+	idle := dialTest(t, "tcp", addr)
+	_ = idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the idle client to be closed, got %v", err)
+	}
+
+	other := dialTest(t, "tcp", addr)
+	if line := infoStat(t, other, "client_timeout_disconnections"); line == "client_timeout_disconnections:0" {
+		t.Errorf("unexpected %s", line)
+	}
+}
+
+func TestServer_OutputBufferHardLimit(t *testing.T) {
+	addr := startLimitsServer(t)
+
+	conn := dialTest(t, "tcp", addr)
+	conn.do("CONFIG", "SET", "client-output-buffer-limit", "normal 1kb 0 0")
+	conn.do("SET", "key", strings.Repeat("a", 2048))
+
+	if res, err := conn.do("GET", "key"); err == nil {
+		t.Fatalf("expected the client to be closed, got %v", res)
+	}
+
+	other := dialTest(t, "tcp", addr)
+	if line := infoStat(t, other, "client_output_buffer_limit_disconnections"); line != "client_output_buffer_limit_disconnections:1" {
+		t.Errorf("unexpected %s", line)
+	}
+}
+
+func TestServer_writeReply(t *testing.T) {
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	serv := NewServer(eng, log.New(io.Discard, "", log.LstdFlags))
+	if err := eng.Config().Set("client-output-buffer-limit", "normal 0 1kb 1"); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4*outputChunkSize)
+
+	t.Run("Reader keeps up", func(t *testing.T) {
+		server, conn := net.Pipe()
+		defer conn.Close()
+		go io.Copy(io.Discard, conn)
+
+		if err := serv.writeReply(newClient(1, server), reply); err != nil {
+			t.Errorf("writeReply() error = %v", err)
+		}
+	})
+
+	t.Run("Over the soft limit for too long", func(t *testing.T) {
+		server, conn := net.Pipe()
+		defer conn.Close()
+
+		client := newClient(2, server)
+		if err := serv.writeReply(client, reply); !errors.Is(err, OutputBufferLimitReached) {
+			t.Errorf("expected OutputBufferLimitReached, got %v", err)
+		}
+		if client.outputBytes.Load() != 0 {
+			t.Error("expected the output buffer to be released")
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/acl"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ProtectedModeDenied = errors.New("DENIED Running in protected mode because protected mode is enabled, " +
+	"no bind address was specified and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface and unix sockets. " +
+	"Set a password with requirepass, bind to specific addresses, or disable protected mode with " +
+	"CONFIG SET protected-mode no from the loopback interface.")
+
+// bindAddress is a TCP address to listen on
+type bindAddress struct {
+	network string
+	address string
+	// optional addresses, prefixed with - in the bind directive, are
+	// skipped when they are not available, like IPv6 on hosts without it
+	optional bool
+}
+
+// bindAddresses returns the addresses of the bind directive for the port,
+// * binds every IPv4 address and ::* every IPv6 address. Without binds the
+// server listens on every interface.
+func bindAddresses(binds []string, port string) []bindAddress {
+	if len(binds) == 0 {
+		return []bindAddress{{network: "tcp", address: net.JoinHostPort("", port)}}
+	}
+
+	addresses := make([]bindAddress, 0, len(binds))
+	for _, bind := range binds {
+		optional := strings.HasPrefix(bind, "-")
+		host := strings.TrimPrefix(bind, "-")
+
+		network := "tcp"
+		switch host {
+		case "*":
+			network, host = "tcp4", "0.0.0.0"
+		case "::*":
+			network, host = "tcp6", "::"
+		}
+
+		addresses = append(addresses, bindAddress{
+			network:  network,
+			address:  net.JoinHostPort(host, port),
+			optional: optional,
+		})
+	}
+	return addresses
+}
+
+// listen opens a listener for each bind address
+func (s *Server) listen(port string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(s.binds))
+	for _, bind := range bindAddresses(s.binds, port) {
+		listener, err := net.Listen(bind.network, bind.address)
+		if err != nil && bind.optional {
+			s.logger.Printf("Skipping optional bind address %s: %s", bind.address, err)
+			continue
+		}
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// StartUnixServer listens on the unix socket, its permissions are changed
+// when UnixSocketPerm is set
+func (s *Server) StartUnixServer(ctx context.Context, ready chan struct{}) {
+	if s.unixSocket == "" {
+		s.logger.Fatal("unix socket is not configured")
+	}
+
+	// A socket file left by a previous run would fail the listen
+	if err := os.Remove(s.unixSocket); err != nil && !os.IsNotExist(err) {
+		s.logger.Fatal(err)
+	}
+
+	listener, err := net.Listen("unix", s.unixSocket)
+	if err != nil {
+		s.logger.Fatal(err)
+	}
+
+	if s.unixSocketPerm != 0 {
+		if err = os.Chmod(s.unixSocket, s.unixSocketPerm); err != nil {
+			s.logger.Fatal(err)
+		}
+	}
+
+	s.serveAll(ctx, []net.Listener{listener}, ready)
+}
+
+// Serve serves a listener opened by the caller, like one on a random port
+// of an integration test, until the context is done. Ready is signaled
+// once it is listening.
+func (s *Server) Serve(ctx context.Context, listener net.Listener, ready chan struct{}) {
+	s.serveAll(ctx, []net.Listener{listener}, ready)
+}
+
+// serveAll serves the listeners, ready is signaled once all of them are listening
+func (s *Server) serveAll(ctx context.Context, listeners []net.Listener, ready chan struct{}) {
+	for _, listener := range listeners {
+		s.logger.Printf("Listening on %s", listener.Addr())
+	}
+	ready <- struct{}{}
+	defer close(ready)
+
+	s.cronOnce.Do(func() {
+		go s.replicationCron(ctx)
+		if s.cluster != nil {
+			go s.clusterCron(ctx)
+		}
+	})
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			defer wg.Done()
+			s.serve(ctx, listener)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+// protected reports whether protected mode rejects a client. It is active
+// when it is enabled, there are no bind addresses and the default user has
+// no password. Loopback and unix socket clients are always accepted.
+func (s *Server) protected(addr net.Addr) bool {
+	if !s.protectedMode.Load() || len(s.binds) > 0 {
+		return false
+	}
+
+	if user, ok := s.acl.User(acl.DefaultUser); !ok || !user.NoPass() {
+		return false
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && !tcpAddr.IP.IsLoopback()
+}
+
+// denyProtected writes the protected mode error to the connection
+func (s *Server) denyProtected(conn net.Conn) {
+	serialized, _ := resp.RespSerializer{}.Serialize(ProtectedModeDenied)
+	_, _ = conn.Write(serialized.Bytes())
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBindAddresses(t *testing.T) {
+	tests := []struct {
+		name  string
+		binds []string
+		want  []bindAddress
+	}{
+		{
+			name: "every interface",
+			want: []bindAddress{{network: "tcp", address: ":6379"}},
+		},
+		{
+			name:  "IPv4 and IPv6",
+			binds: []string{"127.0.0.1", "::1"},
+			want: []bindAddress{
+				{network: "tcp", address: "127.0.0.1:6379"},
+				{network: "tcp", address: "[::1]:6379"},
+			},
+		},
+		{
+			name:  "wildcards and optional addresses",
+			binds: []string{"*", "-::*"},
+			want: []bindAddress{
+				{network: "tcp4", address: "0.0.0.0:6379"},
+				{network: "tcp6", address: "[::]:6379", optional: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bindAddresses(tt.binds, "6379"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bindAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func startTestServer(t *testing.T, opts ServerOptions, start func(s *Server, ctx context.Context, ready chan struct{})) *Server {
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	serv, err := NewServerWithOptions(eng, log.New(io.Discard, "", log.LstdFlags), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ready := make(chan struct{})
+	go start(serv, ctx, ready)
+	<-ready
+	return serv
+}
+
+// serveTest serves the server on a random port of the loopback interface
+// until the test ends and returns its address, like servertest.Start
+func serveTest(t *testing.T, s *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ready := make(chan struct{})
+	go s.Serve(ctx, listener, ready)
+	<-ready
+	return listener.Addr().String()
+}
+
+func dialTest(t *testing.T, network, address string) *testConn {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newTestConn(conn)
+}
+
+func TestServer_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "server.sock")
+	startTestServer(t, ServerOptions{UnixSocket: socket, UnixSocketPerm: 0700}, func(s *Server, ctx context.Context, ready chan struct{}) {
+		s.StartUnixServer(ctx, ready)
+	})
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("expected permissions 0700, got %o", perm)
+	}
+
+	conn := dialTest(t, "unix", socket)
+	if res, err := conn.do("PING"); err != nil || res != "PONG" {
+		t.Errorf("expected PONG, got %v %v", res, err)
+	}
+}
+
+func TestServer_Bind(t *testing.T) {
+	binds := []string{"127.0.0.1", "-::1"}
+	// Port 0 listens on a random port of each address
+	serv := startTestServer(t, ServerOptions{Bind: binds}, func(s *Server, ctx context.Context, ready chan struct{}) {
+		s.StartServer(ctx, "0", ready)
+	})
+
+	expected := 1
+	if listener, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		listener.Close()
+		expected++
+	}
+
+	// The listeners are registered once they are served, after ready
+	var addresses []string
+	for deadline := time.Now().Add(5 * time.Second); len(addresses) < expected; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d listeners, got %v", expected, addresses)
+		}
+		serv.listenersLock.Lock()
+		addresses = addresses[:0]
+		for _, listener := range serv.listeners {
+			addresses = append(addresses, listener.Addr().String())
+		}
+		serv.listenersLock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, address := range addresses {
+		conn := dialTest(t, "tcp", address)
+		if res, err := conn.do("PING"); err != nil || res != "PONG" {
+			t.Errorf("expected PONG from %s, got %v %v", address, res, err)
+		}
+	}
+}
+
+func TestServer_protected(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	loopback := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	loopback6 := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5000}
+	unix := &net.UnixAddr{Name: "/tmp/server.sock", Net: "unix"}
+
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	serv := NewServer(eng, log.New(io.Discard, "", log.LstdFlags))
+
+	if !serv.protected(remote) {
+		t.Error("expected remote clients to be denied without a password")
+	}
+	if serv.protected(loopback) || serv.protected(loopback6) || serv.protected(unix) {
+		t.Error("expected loopback and unix socket clients to be accepted")
+	}
+
+	_ = eng.Config().Set("requirepass", "secret")
+	if serv.protected(remote) {
+		t.Error("expected remote clients to be accepted with a password")
+	}
+
+	_ = eng.Config().Set("requirepass", "")
+	_ = eng.Config().Set("protected-mode", "no")
+	if serv.protected(remote) {
+		t.Error("expected remote clients to be accepted without protected mode")
+	}
+
+	_ = eng.Config().Set("protected-mode", "yes")
+	serv.binds = []string{"0.0.0.0"}
+	if serv.protected(remote) {
+		t.Error("expected remote clients to be accepted with bind addresses")
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/values"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrateDefaultTimeout is used by MIGRATE when the timeout is zero
+const migrateDefaultTimeout = time.Second
+
+const NoKey = "NOKEY"
+
+var BusyKey = errors.New("BUSYKEY Target key name already exists.")
+
+var InvalidDB = errors.New("DB index is out of range")
+
+// migrateOptions are the arguments of MIGRATE
+type migrateOptions struct {
+	address string
+	keys    []string
+	timeout time.Duration
+	copy    bool
+	replace bool
+	auth    []interface{}
+}
+
+// migrateCommand implements MIGRATE host port key|"" destination-db timeout
+// [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key...].
+// The keys are written to the target with the commands of the snapshots,
+// after ASKING in cluster mode, then deleted unless COPY is given. The
+// keys can't change or be written by others until they are deleted.
+func (s *Server) migrateCommand(_ *Client, payloadArray []interface{}) (interface{}, error) {
+	opts, err := parseMigrate(payloadArray)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := s.eng.Migrate(opts.keys, opts.copy, func(keys []string, vals []values.Value) error {
+		return s.migrateKeys(opts, keys, vals)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return NoKey, nil
+	}
+	return engine.OK, nil
+}
+
+// migrateKeys writes the keys to the target of MIGRATE. The writes of the
+// engine are held meanwhile, so the connection is bounded by the timeout.
+func (s *Server) migrateKeys(opts migrateOptions, keys []string, vals []values.Value) error {
+	conn, err := net.DialTimeout("tcp", opts.address, opts.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	link := &clusterLink{conn: conn, scanner: resp.RespParser{}.CreateScanner(conn), timeout: opts.timeout}
+
+	if opts.auth != nil {
+		if _, err = link.do(opts.auth...); err != nil {
+			return err
+		}
+	}
+	if !opts.replace {
+		for _, key := range keys {
+			if err = s.migrateAsking(link); err != nil {
+				return err
+			}
+			exists, err := link.do(engine.EXISTS, key)
+			if err != nil {
+				return err
+			}
+			if exists != int64(0) {
+				return BusyKey
+			}
+		}
+	}
+	for i, key := range keys {
+		if err = s.migrateAsking(link); err != nil {
+			return err
+		}
+		command, err := engine.RestoreCommand(key, vals[i])
+		if err != nil {
+			return err
+		}
+		if _, err = link.do(command...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAsking allows the next command on the node importing the slot
+func (s *Server) migrateAsking(link *clusterLink) error {
+	if s.cluster == nil {
+		return nil
+	}
+	_, err := link.do(engine.ASKING)
+	return err
+}
+
+func parseMigrate(payloadArray []interface{}) (migrateOptions, error) {
+	if len(payloadArray) < 6 {
+		return migrateOptions{}, engine.WrongNumberOfArguments
+	}
+	args := make([]string, 0, len(payloadArray)-1)
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return migrateOptions{}, engine.UnsupportedTypeForCommand
+		}
+		args = append(args, str)
+	}
+
+	opts := migrateOptions{address: net.JoinHostPort(args[0], args[1])}
+	if args[3] != "0" {
+		return migrateOptions{}, InvalidDB
+	}
+	timeout, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || timeout < 0 {
+		return migrateOptions{}, InvalidTimeout
+	}
+	opts.timeout = time.Duration(timeout) * time.Millisecond
+	if opts.timeout == 0 {
+		opts.timeout = migrateDefaultTimeout
+	}
+
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			opts.copy = true
+		case "REPLACE":
+			opts.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return migrateOptions{}, SyntaxError
+			}
+			opts.auth = []interface{}{engine.AUTH, args[i+1]}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return migrateOptions{}, SyntaxError
+			}
+			opts.auth = []interface{}{engine.AUTH, args[i+1], args[i+2]}
+			i += 2
+		case "KEYS":
+			if args[2] != "" {
+				return migrateOptions{}, SyntaxError
+			}
+			opts.keys = args[i+1:]
+			i = len(args)
+		default:
+			return migrateOptions{}, SyntaxError
+		}
+	}
+	if args[2] != "" {
+		opts.keys = []string{args[2]}
+	}
+	return opts, nil
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitor streams the commands run by the server to a client that sent
+// MONITOR. The commands are buffered and written by streamToMonitor, so a
+// slow monitor never blocks the clients, it is disconnected once its
+// pending output exceeds the limits of its class.
+type monitor struct {
+	client *Client
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	pending  []byte
+	overSoft time.Time
+	closed   bool
+}
+
+func newMonitor(client *Client) *monitor {
+	m := &monitor{client: client}
+	m.cond = sync.NewCond(&m.lock)
+	return m
+}
+
+// send buffers the data, it reports false when the pending output exceeds
+// the limits
+func (m *monitor) send(data []byte, limit config.ClientOutputBufferLimit) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return true
+	}
+
+	m.pending = append(m.pending, data...)
+	m.cond.Signal()
+
+	pending := int64(len(m.pending))
+	m.client.outputBytes.Store(pending)
+	if limit.Hard > 0 && pending > limit.Hard {
+		return false
+	}
+	if limit.Soft > 0 && pending > limit.Soft {
+		now := time.Now()
+		if m.overSoft.IsZero() {
+			m.overSoft = now
+		}
+		return now.Sub(m.overSoft) <= time.Duration(limit.SoftSeconds)*time.Second
+	}
+	m.overSoft = time.Time{}
+	return true
+}
+
+// close stops streamToMonitor and the connection
+func (m *monitor) close() {
+	m.lock.Lock()
+	m.closed = true
+	m.cond.Broadcast()
+	m.lock.Unlock()
+	_ = m.client.conn.Close()
+}
+
+// monitors holds the clients that sent MONITOR. The list is copied when
+// it changes, so feeding the commands costs an atomic load when nobody
+// is monitoring.
+type monitors struct {
+	lock sync.Mutex
+	list atomic.Pointer[[]*monitor]
+}
+
+func (ms *monitors) load() []*monitor {
+	if list := ms.list.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+func (ms *monitors) add(m *monitor) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	list := append(append([]*monitor(nil), ms.load()...), m)
+	ms.list.Store(&list)
+}
+
+// remove reports whether the monitor was in the list
+func (ms *monitors) remove(m *monitor) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	list := make([]*monitor, 0, len(ms.load()))
+	for _, other := range ms.load() {
+		if other != m {
+			list = append(list, other)
+		}
+	}
+	if len(list) == len(ms.load()) {
+		return false
+	}
+	ms.list.Store(&list)
+	return true
+}
+
+// monitorCommand implements MONITOR, the client gets OK and then a line
+// for each command run by the server
+func (s *Server) monitorCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) != 1 {
+		return nil, engine.WrongNumberOfArguments
+	}
+	if client.Class() == config.ClassReplica || client.monitor.Load() != nil {
+		return noReply, nil
+	}
+
+	// OK goes first in the stream, before the commands of other clients
+	m := newMonitor(client)
+	serialized, _ := resp.RespSerializer{}.Serialize(engine.OK)
+	m.pending = append(m.pending, serialized.Bytes()...)
+	resp.RespSerializer{}.Release(serialized)
+
+	client.monitor.Store(m)
+	s.monitors.add(m)
+	go s.streamToMonitor(m)
+	return noReply, nil
+}
+
+// feedMonitors sends a command to the monitors, like Redis the admin
+// commands are not shown since their arguments may hold secrets, and the
+// passwords of the others are redacted
+func (s *Server) feedMonitors(addr string, payloadArray []interface{}) {
+	list := s.monitors.load()
+	if len(list) == 0 || engine.IsAdminCommand(payloadArray) {
+		return
+	}
+
+	line := monitorLine(time.Now(), addr, payloadArray)
+	for _, m := range list {
+		if !m.send(line, s.limits.output(m.client.Class())) {
+			s.logger.Printf("Monitor %s closed for overcoming of output buffer limits", m.client.conn.RemoteAddr())
+			s.eng.Stats().OutputBufferLimitDisconnection()
+			if s.monitors.remove(m) {
+				m.close()
+			}
+		}
+	}
+}
+
+// dropMonitor forgets the client when it is a monitor
+func (s *Server) dropMonitor(client *Client) {
+	if m := client.monitor.Load(); m != nil && s.monitors.remove(m) {
+		m.close()
+	}
+}
+
+// streamToMonitor writes the pending output of the monitor
+func (s *Server) streamToMonitor(m *monitor) {
+	conn := m.client.conn
+	var err error
+	for err == nil {
+		m.lock.Lock()
+		for len(m.pending) == 0 && !m.closed {
+			m.cond.Wait()
+		}
+		if m.closed {
+			m.lock.Unlock()
+			return
+		}
+		data := m.pending
+		m.pending = nil
+		m.overSoft = time.Time{}
+		m.lock.Unlock()
+
+		_, err = conn.Write(data)
+		m.client.outputBytes.Store(0)
+	}
+
+	s.logger.Printf("Lost connection with monitor %s: %s", conn.RemoteAddr(), err)
+	_ = conn.Close()
+}
+
+// monitorLine formats a command like Redis, e.g.
+// +1339518083.107412 [0 127.0.0.1:60866] "SET" "key" "value"
+func monitorLine(now time.Time, addr string, payloadArray []interface{}) []byte {
+	line := make([]byte, 0, 64)
+	line = append(line, '+')
+	line = strconv.AppendInt(line, now.Unix(), 10)
+	line = fmt.Appendf(line, ".%06d [0 %s]", now.Nanosecond()/int(time.Microsecond), addr)
+	for _, arg := range engine.RedactArgs(payloadArray) {
+		line = append(line, ' ')
+		line = appendQuoted(line, fmt.Sprint(arg))
+	}
+	return append(line, '\r', '\n')
+}
+
+// appendQuoted appends the argument quoted and escaped like sdscatrepr,
+// so the line never holds a CRLF
+func appendQuoted(line []byte, arg string) []byte {
+	line = append(line, '"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; c {
+		case '\\', '"':
+			line = append(line, '\\', c)
+		case '\n':
+			line = append(line, '\\', 'n')
+		case '\r':
+			line = append(line, '\\', 'r')
+		case '\t':
+			line = append(line, '\\', 't')
+		case '\a':
+			line = append(line, '\\', 'a')
+		case '\b':
+			line = append(line, '\\', 'b')
+		default:
+			if c < ' ' || c > '~' {
+				line = fmt.Appendf(line, "\\x%02x", c)
+			} else {
+				line = append(line, c)
+			}
+		}
+	}
+	return append(line, '"')
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startMonitorServer(t *testing.T) string {
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	return serveTest(t, NewServer(eng, log.New(io.Discard, "", log.LstdFlags)))
+}
+
+func TestServer_MONITOR(t *testing.T) {
+	addr := startMonitorServer(t)
+	monitor := dialTest(t, "tcp", addr)
+	conn := dialTest(t, "tcp", addr)
+
+	if res, err := monitor.do("MONITOR"); err != nil || res != engine.OK {
+		t.Fatalf("expected OK, got %v %v", res, err)
+	}
+
+	expectLine := func(pattern string) {
+		t.Helper()
+		res, err := monitor.receive(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line, _ := res.(string); !regexp.MustCompile(`^\d+\.\d{6} ` + pattern + `$`).MatchString(line) {
+			t.Errorf("expected a line matching %s, got %q", pattern, res)
+		}
+	}
+
+	conn.do("SET", "key", "a \"b\"\r\n\x01")
+	expectLine(`\[0 127\.0\.0\.1:\d+\] "SET" "key" "a \\"b\\"\\r\\n\\x01"`)
+
+	// Admin commands are not shown
+	conn.do("CONFIG", "SET", "maxclients", "100")
+	conn.do("PING")
+	expectLine(`\[0 127\.0\.0\.1:\d+\] "PING"`)
+
+	conn.do("EVAL", "return redis.call('GET', KEYS[1])", "1", "key")
+	expectLine(`\[0 127\.0\.0\.1:\d+\] "EVAL" "return redis.call\('GET', KEYS\[1\]\)" "1" "key"`)
+	expectLine(`\[0 lua\] "GET" "key"`)
+
+	res, _ := conn.do("CLIENT", "LIST")
+	if !strings.Contains(res.(string), "flags=O") {
+		t.Errorf("expected the monitor in CLIENT LIST, got %q", res)
+	}
+}
+
+func TestServer_MONITOR_Slow(t *testing.T) {
+	addr := startMonitorServer(t)
+	conn := dialTest(t, "tcp", addr)
+	if res, _ := conn.do("CONFIG", "SET", "client-output-buffer-limit", "normal 65536 0 0"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+
+	// The monitor never reads its stream
+	monitor := dialTest(t, "tcp", addr)
+	if res, _ := monitor.do("MONITOR"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+
+	value := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	for range 500 {
+		if res, err := conn.do("SET", "key", value); err != nil || res != engine.OK {
+			t.Fatalf("expected OK, got %v %v", res, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the commands not to wait for the monitor, took %s", elapsed)
+	}
+
+	if line := infoStat(t, conn, "client_output_buffer_limit_disconnections"); line != "client_output_buffer_limit_disconnections:1" {
+		t.Errorf("expected the monitor to be disconnected, got %s", line)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// pauser implements CLIENT PAUSE, commands wait until the pause ends
+// or CLIENT UNPAUSE is called
+type pauser struct {
+	lock  sync.Mutex
+	until time.Time
+	// all pauses every command, otherwise only the write commands
+	all bool
+	// resume is closed by unpause to release the waiting commands
+	resume chan struct{}
+}
+
+func newPauser() *pauser {
+	return &pauser{resume: make(chan struct{})}
+}
+
+// pause extends the current pause, like Redis the longest pause and the
+// most restrictive mode win
+func (p *pauser) pause(timeout time.Duration, all bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	if now.After(p.until) {
+		p.all = all
+	} else {
+		p.all = p.all || all
+	}
+
+	if until := now.Add(timeout); until.After(p.until) {
+		p.until = until
+	}
+}
+
+func (p *pauser) unpause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.until = time.Time{}
+	p.all = false
+	close(p.resume)
+	p.resume = make(chan struct{})
+}
+
+// wait blocks while commands of the kind are paused
+func (p *pauser) wait(write bool) {
+	for {
+		p.lock.Lock()
+		remaining := time.Until(p.until)
+		if remaining <= 0 || !(p.all || write) {
+			p.lock.Unlock()
+			return
+		}
+		resume := p.resume
+		p.lock.Unlock()
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-resume:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
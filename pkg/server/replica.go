@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaRetryDelay is the time between the attempts to connect to the primary
+const replicaRetryDelay = time.Second
+
+// replicaAckPeriod is how often replicas acknowledge their offset
+const replicaAckPeriod = time.Second
+
+// States of the link to the primary reported by ROLE
+const (
+	linkConnect    = "connect"
+	linkConnecting = "connecting"
+	linkSync       = "sync"
+	linkConnected  = "connected"
+)
+
+var UnexpectedPrimaryReply = errors.New("unexpected reply from the primary")
+
+// primaryLink is the connection of a replica to its primary, it reconnects
+// until it is stopped
+type primaryLink struct {
+	host string
+	port string
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	linkState atomic.Pointer[string]
+	// lastIO is the unix nanoseconds of the last data from the primary
+	lastIO atomic.Int64
+}
+
+func newPrimaryLink(host, port string) *primaryLink {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &primaryLink{host: host, port: port, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	l.setState(linkConnect)
+	l.lastIO.Store(time.Now().UnixNano())
+	return l
+}
+
+func (l *primaryLink) state() string {
+	return *l.linkState.Load()
+}
+
+func (l *primaryLink) setState(state string) {
+	l.linkState.Store(&state)
+}
+
+// stop closes the connection and waits for the replication to end
+func (l *primaryLink) stop() {
+	l.cancel()
+	<-l.done
+}
+
+// primaryConn sends commands to the primary, the acknowledgements are
+// sent concurrently with the replies to GETACK
+type primaryConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	timeout   time.Duration
+	writeLock sync.Mutex
+}
+
+func (c *primaryConn) send(args ...interface{}) error {
+	serialized, err := resp.RespSerializer{}.Serialize(args)
+	if err != nil {
+		return err
+	}
+	defer resp.RespSerializer{}.Release(serialized)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err = c.conn.Write(serialized.Bytes())
+	return err
+}
+
+// readLine reads a status or bulk string reply, error replies are returned as errors
+func (c *primaryConn) readLine() (string, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "+"):
+		return line[1:], nil
+	case strings.HasPrefix(line, "-"):
+		return "", errors.New(line[1:])
+	case strings.HasPrefix(line, "$"):
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return "", fmt.Errorf("%w: %q", UnexpectedPrimaryReply, line)
+		}
+		body := make([]byte, length+2)
+		if _, err = io.ReadFull(c.reader, body); err != nil {
+			return "", err
+		}
+		return string(body[:length]), nil
+	default:
+		return "", fmt.Errorf("%w: %q", UnexpectedPrimaryReply, line)
+	}
+}
+
+// command sends a command of the handshake and reads its status reply
+func (c *primaryConn) command(args ...interface{}) (string, error) {
+	if err := c.send(args...); err != nil {
+		return "", err
+	}
+	return c.readLine()
+}
+
+// readSnapshot reads the snapshot of a full synchronization, a bulk
+// string without the final CRLF
+func (c *primaryConn) readSnapshot() ([]byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("%w: %q", UnexpectedPrimaryReply, line)
+	}
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: %q", UnexpectedPrimaryReply, line)
+	}
+
+	snapshot := make([]byte, length)
+	_, err = io.ReadFull(c.reader, snapshot)
+	return snapshot, err
+}
+
+// replicate keeps the replica synchronized with its primary until the link is stopped
+func (s *Server) replicate(link *primaryLink) {
+	defer close(link.done)
+	address := net.JoinHostPort(link.host, link.port)
+
+	for {
+		err := s.syncWithPrimary(link)
+		link.setState(linkConnect)
+		if link.ctx.Err() != nil {
+			return
+		}
+		s.logger.Printf("Lost connection with primary %s: %s", address, err)
+
+		select {
+		case <-link.ctx.Done():
+			return
+		case <-time.After(replicaRetryDelay):
+		}
+	}
+}
+
+// syncWithPrimary connects to the primary, synchronizes the dataset, then
+// applies the stream of the primary until the connection fails
+func (s *Server) syncWithPrimary(link *primaryLink) error {
+	cfg := s.eng.Config()
+	timeout := time.Duration(cfg.GetInt(config.ReplTimeout)) * time.Second
+
+	link.setState(linkConnecting)
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(link.ctx, "tcp", net.JoinHostPort(link.host, link.port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(link.ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	primary := &primaryConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	if err = s.handshake(primary); err != nil {
+		return err
+	}
+	if err = s.psync(link, primary); err != nil {
+		return err
+	}
+
+	link.setState(linkConnected)
+	link.lastIO.Store(time.Now().UnixNano())
+	s.logger.Printf("Synchronized with primary %s", conn.RemoteAddr())
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.acknowledge(primary, done)
+
+	return s.applyStream(link, primary)
+}
+
+// handshake authenticates with masteruser and masterauth, then announces the replica
+func (s *Server) handshake(primary *primaryConn) error {
+	cfg := s.eng.Config()
+	if password := cfg.GetString(config.MasterAuth); password != "" {
+		args := []interface{}{engine.AUTH}
+		if user := cfg.GetString(config.MasterUser); user != "" {
+			args = append(args, user)
+		}
+		if _, err := primary.command(append(args, password)...); err != nil {
+			return fmt.Errorf("AUTH failed: %w", err)
+		}
+	}
+
+	if _, err := primary.command(engine.PING); err != nil {
+		return fmt.Errorf("PING failed: %w", err)
+	}
+	port := strconv.FormatInt(cfg.GetInt(config.Port), 10)
+	if _, err := primary.command(engine.REPLCONF, "listening-port", port); err != nil {
+		return fmt.Errorf("REPLCONF listening-port failed: %w", err)
+	}
+	if _, err := primary.command(engine.REPLCONF, "capa", "psync2"); err != nil {
+		return fmt.Errorf("REPLCONF capa failed: %w", err)
+	}
+	return nil
+}
+
+// psync continues the stream of the replica when the primary has its
+// offset, otherwise the dataset is replaced with a snapshot of the primary
+func (s *Server) psync(link *primaryLink, primary *primaryConn) error {
+	// The backlog created below keeps the writes made once promoted
+	s.hookWrites()
+	s.repl.lock.Lock()
+	id, offset := s.repl.id, s.repl.offset
+	s.repl.lock.Unlock()
+
+	reply, err := primary.command(engine.PSYNC, id, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return fmt.Errorf("PSYNC failed: %w", err)
+	}
+
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		primaryOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %q", UnexpectedPrimaryReply, reply)
+		}
+
+		link.setState(linkSync)
+		snapshot, err := primary.readSnapshot()
+		if err != nil {
+			return err
+		}
+
+		s.repl.applyLock.Lock()
+		defer s.repl.applyLock.Unlock()
+		if err = s.eng.Replace(bytes.NewReader(snapshot)); err != nil {
+			return err
+		}
+
+		s.repl.lock.Lock()
+		s.repl.id, s.repl.id2 = fields[1], ""
+		s.repl.offset, s.repl.secondOffset = primaryOffset, -1
+		s.repl.backlog = newBacklog(s.eng.Config().GetMemory(config.ReplBacklogSize))
+		// The replicas of this server have a different dataset now
+		s.dropReplicas()
+		s.repl.lock.Unlock()
+		return nil
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		s.repl.lock.Lock()
+		defer s.repl.lock.Unlock()
+		if len(fields) == 2 && fields[1] != s.repl.id {
+			// The primary was promoted, the replicas of this server reconnect to learn its id
+			s.repl.shiftID(fields[1])
+			s.dropReplicas()
+		}
+		if s.repl.backlog == nil {
+			s.repl.backlog = newBacklog(s.eng.Config().GetMemory(config.ReplBacklogSize))
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", UnexpectedPrimaryReply, reply)
+	}
+}
+
+// acknowledge sends the offset of the replica to the primary until done
+func (s *Server) acknowledge(primary *primaryConn, done chan struct{}) {
+	ticker := time.NewTicker(replicaAckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.repl.lock.Lock()
+			offset := s.repl.offset
+			s.repl.lock.Unlock()
+			if err := primary.send(engine.REPLCONF, "ACK", strconv.FormatInt(offset, 10)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// applyStream applies the commands of the primary and forwards them, as
+// they were received, to the replicas of this server
+func (s *Server) applyStream(link *primaryLink, primary *primaryConn) error {
+	// raw collects the bytes of the command being parsed
+	var raw []byte
+	parser := resp.RespParser{}
+	scanner := parser.CreateScanner(primary.reader)
+	scan := resp.ScanPayload()
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := scan(data, atEOF)
+		raw = append(raw, data[:advance]...)
+		return advance, token, err
+	})
+
+	for {
+		raw = raw[:0]
+		_ = primary.conn.SetReadDeadline(time.Now().Add(primary.timeout))
+		payload, err := parser.ParseScanner(scanner)
+		if err != nil {
+			return err
+		}
+		link.lastIO.Store(time.Now().UnixNano())
+
+		if err = s.applyFromPrimary(primary, payload, raw); err != nil {
+			return err
+		}
+	}
+}
+
+// applyFromPrimary applies a command of the stream, PING keeps the link
+// alive and REPLCONF GETACK asks for the offset
+func (s *Server) applyFromPrimary(primary *primaryConn, payload interface{}, raw []byte) error {
+	s.exec.RLock()
+	defer s.exec.RUnlock()
+	if s.closing.Load() {
+		return net.ErrClosed
+	}
+
+	s.repl.applyLock.Lock()
+	defer s.repl.applyLock.Unlock()
+
+	payloadArray, _ := payload.([]interface{})
+	name := ""
+	if len(payloadArray) > 0 {
+		name, _ = payloadArray[0].(string)
+	}
+	subcommand := ""
+	if len(payloadArray) > 1 {
+		subcommand, _ = payloadArray[1].(string)
+	}
+
+	switch {
+	case strings.EqualFold(name, engine.PING):
+	case strings.EqualFold(name, engine.REPLCONF) && strings.EqualFold(subcommand, "GETACK"):
+		// The acknowledged offset doesn't include the GETACK itself
+		s.repl.lock.Lock()
+		offset := s.repl.offset
+		s.repl.lock.Unlock()
+		if err := primary.send(engine.REPLCONF, "ACK", strconv.FormatInt(offset, 10)); err != nil {
+			return err
+		}
+	default:
+		s.feedMonitors(primary.conn.RemoteAddr().String(), payloadArray)
+		if err := s.eng.ApplyReplicated(payload); err != nil {
+			s.logger.Printf("Error applying a command of the primary: %s", err)
+		}
+	}
+
+	s.repl.lock.Lock()
+	s.feed(raw)
+	s.repl.lock.Unlock()
+	return nil
+}
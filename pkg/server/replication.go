@@ -0,0 +1,738 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicationCronPeriod is how often the primary pings its replicas and
+// checks their timeouts
+const replicationCronPeriod = time.Second
+
+// States of the replicas reported by INFO replication
+const (
+	replicaSendBulk = "send_bulk"
+	replicaOnline   = "online"
+)
+
+var ReadOnlyReplica = errors.New("READONLY You can't write against a read only replica.")
+
+var NoMasterLink = errors.New("NOMASTERLINK Can't SYNC while not connected with my master")
+
+var WaitOnReplica = errors.New("WAIT cannot be used with replica instances. " +
+	"Please also note that writes to replicas are just local and are not propagated.")
+
+var InvalidMasterPort = errors.New("Invalid master port")
+
+var NegativeTimeout = errors.New("timeout is negative")
+
+// noReply is returned by the commands that don't reply, like REPLCONF ACK
+type noReplyType struct{}
+
+var noReply = noReplyType{}
+
+// replication is the replication state. Primaries stream their writes to
+// the replicas, replicas forward the stream of their primary to their own
+// replicas, so the offsets of a replica match the ones of its primary.
+type replication struct {
+	lock sync.Mutex
+	// id and offset identify the stream, id2 and secondOffset are the
+	// stream of the previous primary, replicas of it continue after a failover
+	id           string
+	id2          string
+	offset       int64
+	secondOffset int64
+	// backlog is created when the first replica connects
+	backlog  *backlog
+	replicas map[int64]*replica
+	// acked is closed and replaced when a replica acknowledges an offset
+	acked    chan struct{}
+	lastPing time.Time
+	// primary is the link of replicas to their primary, nil on primaries
+	primary *primaryLink
+
+	// roleLock serializes the role changes of REPLICAOF
+	roleLock sync.Mutex
+	// applyLock is held while a replica applies and forwards a command of
+	// its primary, so snapshots don't fall between them
+	applyLock sync.Mutex
+	// hookOnce registers the write hook of the engine with the first
+	// backlog, writes run one at a time from then on
+	hookOnce sync.Once
+}
+
+func newReplication() *replication {
+	return &replication{
+		id:           newReplID(),
+		secondOffset: -1,
+		replicas:     make(map[int64]*replica),
+		acked:        make(chan struct{}),
+	}
+}
+
+// newReplID returns a random replication id of 40 characters
+func newReplID() string {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// continueFrom returns the stream from the offset when the backlog still
+// has it, the lock must be held
+func (r *replication) continueFrom(id string, offset int64) ([]byte, bool) {
+	if r.backlog == nil {
+		return nil, false
+	}
+	if id != r.id && (id != r.id2 || offset > r.secondOffset) {
+		return nil, false
+	}
+	first := r.offset - int64(r.backlog.histLen) + 1
+	if offset < first || offset > r.offset+1 {
+		return nil, false
+	}
+	return r.backlog.last(int(r.offset + 1 - offset)), true
+}
+
+// shiftID starts a new stream, the replicas of the previous one can
+// continue up to the current offset, the lock must be held
+func (r *replication) shiftID(id string) {
+	r.id2 = r.id
+	r.secondOffset = r.offset + 1
+	r.id = id
+}
+
+// ackedCount returns the replicas that acknowledged the offset, the lock must be held
+func (r *replication) ackedCount(offset int64) int64 {
+	var count int64
+	for _, rep := range r.replicas {
+		if rep.ackOffset.Load() >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// replica is a replica connected to this server. The replication stream
+// is buffered in pending and written by streamToReplica.
+type replica struct {
+	client    *Client
+	state     atomic.Pointer[string]
+	ackOffset atomic.Int64
+	// ackTime is the unix nanoseconds of the last acknowledgement
+	ackTime atomic.Int64
+
+	lock sync.Mutex
+	cond *sync.Cond
+	// initial is the reply to PSYNC, it is not subject to the output limits
+	initial  []byte
+	pending  []byte
+	overSoft time.Time
+	closed   bool
+}
+
+func newReplica(client *Client) *replica {
+	r := &replica{client: client}
+	r.cond = sync.NewCond(&r.lock)
+	state := replicaSendBulk
+	r.state.Store(&state)
+	r.ackTime.Store(time.Now().UnixNano())
+	return r
+}
+
+// send buffers the data, it reports false when the pending output exceeds
+// the limits of the replica class
+func (r *replica) send(data []byte, limit config.ClientOutputBufferLimit) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return true
+	}
+
+	r.pending = append(r.pending, data...)
+	r.cond.Signal()
+
+	pending := int64(len(r.pending))
+	if limit.Hard > 0 && pending > limit.Hard {
+		return false
+	}
+	if limit.Soft > 0 && pending > limit.Soft {
+		now := time.Now()
+		if r.overSoft.IsZero() {
+			r.overSoft = now
+		}
+		return now.Sub(r.overSoft) <= time.Duration(limit.SoftSeconds)*time.Second
+	}
+	r.overSoft = time.Time{}
+	return true
+}
+
+// close stops streamToReplica and the connection
+func (r *replica) close() {
+	r.lock.Lock()
+	r.closed = true
+	r.cond.Broadcast()
+	r.lock.Unlock()
+	_ = r.client.conn.Close()
+}
+
+// bindReplication registers the replication settings, then connects to
+// the primary of replicaof
+func (s *Server) bindReplication(cfg *config.Config) error {
+	s.eng.SetReplicationInfo(s.replicationInfo)
+
+	cfg.OnChange(config.ReplBacklogSize, func(value string) error {
+		size, err := config.ParseMemory(value)
+		if err != nil {
+			return err
+		}
+		s.repl.lock.Lock()
+		defer s.repl.lock.Unlock()
+		if s.repl.backlog != nil {
+			s.repl.backlog.resize(size)
+		}
+		return nil
+	})
+
+	if replicaOf := strings.Fields(cfg.GetString(config.ReplicaOf)); len(replicaOf) > 0 {
+		if len(replicaOf) != 2 {
+			return fmt.Errorf("%w '%s'", config.InvalidArgument, config.ReplicaOf)
+		}
+		s.replicaOf(replicaOf[0], replicaOf[1])
+	}
+	return nil
+}
+
+// hookWrites registers propagateWrite with the engine before the first
+// backlog is created. Until then there is nothing to feed, so the writes
+// don't pay for keeping their order. The repl lock must not be held,
+// since propagateWrite takes it with the write lock of the engine held.
+func (s *Server) hookWrites() {
+	s.repl.hookOnce.Do(func() {
+		s.eng.OnWrite(s.propagateWrite)
+	})
+}
+
+// propagateWrite feeds the writes of the engine to the replicas. The
+// writes of replicas are local, they forward the stream of their primary.
+func (s *Server) propagateWrite(command []interface{}) {
+	s.repl.lock.Lock()
+	defer s.repl.lock.Unlock()
+	if s.repl.primary != nil || s.repl.backlog == nil {
+		return
+	}
+
+	serialized, err := resp.RespSerializer{}.Serialize(command)
+	if err != nil {
+		s.logger.Println(err)
+		return
+	}
+	s.feed(serialized.Bytes())
+	resp.RespSerializer{}.Release(serialized)
+}
+
+// feedCommand adds a command of the server, like PING, to the stream, the
+// lock must be held
+func (s *Server) feedCommand(args ...interface{}) {
+	if s.repl.backlog == nil {
+		return
+	}
+	serialized, _ := resp.RespSerializer{}.Serialize(args)
+	s.feed(serialized.Bytes())
+	resp.RespSerializer{}.Release(serialized)
+}
+
+// feed appends the data to the backlog and the replicas, the lock must be held
+func (s *Server) feed(data []byte) {
+	if s.repl.backlog == nil {
+		return
+	}
+	s.repl.backlog.write(data)
+	s.repl.offset += int64(len(data))
+
+	limit := s.limits.output(config.ClassReplica)
+	for id, rep := range s.repl.replicas {
+		if !rep.send(data, limit) {
+			s.logger.Printf("Replica %s closed for overcoming of output buffer limits", rep.client.conn.RemoteAddr())
+			s.eng.Stats().OutputBufferLimitDisconnection()
+			delete(s.repl.replicas, id)
+			rep.close()
+		}
+	}
+}
+
+// dropReplicas disconnects every replica, the lock must be held
+func (s *Server) dropReplicas() {
+	for id, rep := range s.repl.replicas {
+		delete(s.repl.replicas, id)
+		rep.close()
+	}
+}
+
+// dropReplica forgets the client when it is a replica
+func (s *Server) dropReplica(client *Client) {
+	s.repl.lock.Lock()
+	rep, ok := s.repl.replicas[client.id]
+	delete(s.repl.replicas, client.id)
+	s.repl.lock.Unlock()
+	if ok {
+		rep.close()
+	}
+}
+
+// streamToReplica writes the reply to PSYNC, then the stream, to the replica
+func (s *Server) streamToReplica(rep *replica) {
+	conn := rep.client.conn
+	rep.client.outputBytes.Store(int64(len(rep.initial)))
+	_, err := conn.Write(rep.initial)
+	rep.initial = nil
+	online := replicaOnline
+	rep.state.Store(&online)
+
+	for err == nil {
+		rep.lock.Lock()
+		for len(rep.pending) == 0 && !rep.closed {
+			rep.cond.Wait()
+		}
+		if rep.closed {
+			rep.lock.Unlock()
+			return
+		}
+		data := rep.pending
+		rep.pending = nil
+		rep.overSoft = time.Time{}
+		rep.lock.Unlock()
+
+		rep.client.outputBytes.Store(int64(len(data)))
+		_, err = conn.Write(data)
+	}
+
+	rep.client.outputBytes.Store(0)
+	s.logger.Printf("Lost connection with replica %s: %s", conn.RemoteAddr(), err)
+	_ = conn.Close()
+}
+
+// psyncCommand implements PSYNC replicationid offset. The replica continues
+// from the backlog when it has the offset, otherwise it gets a snapshot.
+func (s *Server) psyncCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) != 3 {
+		return nil, engine.WrongNumberOfArguments
+	}
+	id, ok := payloadArray[1].(string)
+	if !ok {
+		return nil, engine.UnsupportedTypeForCommand
+	}
+	offset, err := toInt64(payloadArray[2])
+	if err != nil {
+		return nil, err
+	}
+
+	s.repl.lock.Lock()
+	linked := s.repl.primary == nil || s.repl.primary.state() == linkConnected
+	s.repl.lock.Unlock()
+	if !linked {
+		return nil, NoMasterLink
+	}
+
+	client.setClass(config.ClassReplica)
+	rep := newReplica(client)
+
+	s.hookWrites()
+	s.repl.applyLock.Lock()
+	defer s.repl.applyLock.Unlock()
+
+	s.repl.lock.Lock()
+	if data, ok := s.repl.continueFrom(id, offset); ok {
+		rep.initial = append([]byte("+CONTINUE "+s.repl.id+"\r\n"), data...)
+		s.repl.replicas[client.id] = rep
+		s.repl.lock.Unlock()
+		s.logger.Printf("Partial resynchronization request from %s accepted", client.conn.RemoteAddr())
+		s.eng.Stats().SyncPartial(true)
+		go s.streamToReplica(rep)
+		return noReply, nil
+	}
+	s.repl.lock.Unlock()
+
+	// Replicas without a dataset ask for a full synchronization with ?
+	if id != "?" {
+		s.eng.Stats().SyncPartial(false)
+	}
+	s.eng.Stats().SyncFull()
+	s.logger.Printf("Starting full synchronization with replica %s", client.conn.RemoteAddr())
+	snapshot := bytes.Buffer{}
+	err = s.eng.Snapshot(&snapshot, func() {
+		s.repl.lock.Lock()
+		defer s.repl.lock.Unlock()
+		if s.repl.backlog == nil {
+			s.repl.backlog = newBacklog(s.eng.Config().GetMemory(config.ReplBacklogSize))
+		}
+		header := fmt.Sprintf("+FULLRESYNC %s %d\r\n$%d\r\n", s.repl.id, s.repl.offset, snapshot.Len())
+		rep.initial = append([]byte(header), snapshot.Bytes()...)
+		s.repl.replicas[client.id] = rep
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go s.streamToReplica(rep)
+	return noReply, nil
+}
+
+// replconfCommand implements the REPLCONF options replicas send to their primary
+func (s *Server) replconfCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	args := make([]string, 0, len(payloadArray)-1)
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, engine.UnsupportedTypeForCommand
+		}
+		args = append(args, str)
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, SyntaxError
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "ACK":
+		offset, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return noReply, nil
+		}
+		s.repl.lock.Lock()
+		if rep, ok := s.repl.replicas[client.id]; ok {
+			rep.ackOffset.Store(offset)
+			rep.ackTime.Store(time.Now().UnixNano())
+			close(s.repl.acked)
+			s.repl.acked = make(chan struct{})
+		}
+		s.repl.lock.Unlock()
+		return noReply, nil
+	case "GETACK":
+		// Only replicas acknowledge their offset, to the primary link
+		return noReply, nil
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "listening-port":
+			port, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || port < 0 || port > 65535 {
+				return nil, engine.NotAnInteger
+			}
+			client.listeningPort.Store(port)
+		case "capa", "ip-address":
+		default:
+			return nil, fmt.Errorf("Unrecognized REPLCONF option: %s", args[i])
+		}
+	}
+	return engine.OK, nil
+}
+
+// waitCommand implements WAIT numreplicas timeout, the timeout is in
+// milliseconds and zero blocks until enough replicas acknowledge
+func (s *Server) waitCommand(_ *Client, payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) != 3 {
+		return nil, engine.WrongNumberOfArguments
+	}
+	numReplicas, err := toInt64(payloadArray[1])
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := toInt64(payloadArray[2])
+	if err != nil {
+		return nil, err
+	}
+	if timeout < 0 {
+		return nil, NegativeTimeout
+	}
+
+	s.repl.lock.Lock()
+	replica := s.repl.primary != nil
+	offset := s.repl.offset
+	s.repl.lock.Unlock()
+	if replica {
+		return nil, WaitOnReplica
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+	return s.waitReplicas(ctx, offset, numReplicas), nil
+}
+
+// waitReplicas asks the replicas for their offset and waits until
+// numReplicas acknowledge the offset, or ctx is done. It returns the
+// replicas that acknowledged it.
+func (s *Server) waitReplicas(ctx context.Context, offset int64, numReplicas int64) int64 {
+	requested := false
+	for {
+		s.repl.lock.Lock()
+		acked := s.repl.ackedCount(offset)
+		notify := s.repl.acked
+		if acked < numReplicas && !requested {
+			s.feedCommand(engine.REPLCONF, "GETACK", "*")
+			requested = true
+		}
+		s.repl.lock.Unlock()
+
+		if acked >= numReplicas {
+			return acked
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return acked
+		case <-s.done:
+			return acked
+		}
+	}
+}
+
+// roleCommand implements ROLE
+func (s *Server) roleCommand(_ *Client, _ []interface{}) (interface{}, error) {
+	s.repl.lock.Lock()
+	defer s.repl.lock.Unlock()
+
+	if link := s.repl.primary; link != nil {
+		offset := int64(-1)
+		if link.state() == linkConnected {
+			offset = s.repl.offset
+		}
+		port, _ := strconv.ParseInt(link.port, 10, 64)
+		return []interface{}{"slave", link.host, port, link.state(), offset}, nil
+	}
+
+	replicas := make([]interface{}, 0, len(s.repl.replicas))
+	for _, rep := range s.sortedReplicas() {
+		replicas = append(replicas, []interface{}{
+			replicaIP(rep),
+			strconv.FormatInt(rep.client.listeningPort.Load(), 10),
+			strconv.FormatInt(rep.ackOffset.Load(), 10),
+		})
+	}
+	return []interface{}{"master", s.repl.offset, replicas}, nil
+}
+
+// replicaofCommand implements REPLICAOF host port and REPLICAOF NO ONE
+func (s *Server) replicaofCommand(_ *Client, payloadArray []interface{}) (interface{}, error) {
+	if len(payloadArray) != 3 {
+		return nil, engine.WrongNumberOfArguments
+	}
+	if s.cluster != nil {
+		return nil, ReplicaOfInCluster
+	}
+	host, ok := payloadArray[1].(string)
+	if !ok {
+		return nil, engine.UnsupportedTypeForCommand
+	}
+	port, ok := payloadArray[2].(string)
+	if !ok {
+		return nil, engine.UnsupportedTypeForCommand
+	}
+
+	if strings.EqualFold(host, "NO") && strings.EqualFold(port, "ONE") {
+		s.replicaOfNoOne()
+		return engine.OK, nil
+	}
+
+	if n, err := strconv.ParseInt(port, 10, 64); err != nil || n < 1 || n > 65535 {
+		return nil, InvalidMasterPort
+	}
+	if !s.replicaOf(host, port) {
+		return "OK Already connected to specified master", nil
+	}
+	return engine.OK, nil
+}
+
+// replicaOf makes the server a replica of the primary, it reports false
+// when it already is
+func (s *Server) replicaOf(host, port string) bool {
+	s.repl.roleLock.Lock()
+	defer s.repl.roleLock.Unlock()
+
+	s.repl.lock.Lock()
+	previous := s.repl.primary
+	s.repl.lock.Unlock()
+	if previous != nil && previous.host == host && previous.port == port {
+		return false
+	}
+	if previous != nil {
+		previous.stop()
+	}
+
+	link := newPrimaryLink(host, port)
+	s.repl.lock.Lock()
+	s.repl.primary = link
+	// The replicas of this server reconnect, they continue with the stream
+	// of the new primary when it has their offset
+	s.dropReplicas()
+	s.repl.lock.Unlock()
+
+	s.eng.SetReplica(true)
+	s.logger.Printf("Connecting to primary %s", net.JoinHostPort(host, port))
+	go s.replicate(link)
+	return true
+}
+
+// replicaOfNoOne turns a replica into a primary. Its stream gets a new id,
+// the replicas of the previous primary can continue with it.
+func (s *Server) replicaOfNoOne() {
+	s.repl.roleLock.Lock()
+	defer s.repl.roleLock.Unlock()
+
+	s.repl.lock.Lock()
+	link := s.repl.primary
+	s.repl.lock.Unlock()
+	if link == nil {
+		return
+	}
+	link.stop()
+
+	s.repl.lock.Lock()
+	s.repl.primary = nil
+	s.repl.shiftID(newReplID())
+	// The replicas reconnect to learn the new id
+	s.dropReplicas()
+	s.repl.lock.Unlock()
+
+	s.eng.SetReplica(false)
+	s.logger.Println("Stopped replication, the server is now a primary")
+}
+
+// readOnlyReplica reports whether writes are rejected, like on replicas
+// with replica-read-only
+func (s *Server) readOnlyReplica() bool {
+	s.repl.lock.Lock()
+	replica := s.repl.primary != nil
+	s.repl.lock.Unlock()
+	return replica && s.eng.Config().GetBool(config.ReplicaReadOnly)
+}
+
+// sortedReplicas returns the replicas sorted by client id, the lock must be held
+func (s *Server) sortedReplicas() []*replica {
+	replicas := make([]*replica, 0, len(s.repl.replicas))
+	for _, client := range s.clients.list() {
+		if rep, ok := s.repl.replicas[client.id]; ok {
+			replicas = append(replicas, rep)
+		}
+	}
+	return replicas
+}
+
+func replicaIP(rep *replica) string {
+	if addr, ok := rep.client.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return rep.client.conn.RemoteAddr().String()
+}
+
+// replicationInfo reports the fields of INFO replication
+func (s *Server) replicationInfo() engine.ReplicationInfo {
+	s.repl.lock.Lock()
+	defer s.repl.lock.Unlock()
+
+	now := time.Now()
+	info := engine.ReplicationInfo{
+		Role:         "master",
+		ReplID:       s.repl.id,
+		ReplID2:      "0000000000000000000000000000000000000000",
+		Offset:       s.repl.offset,
+		SecondOffset: s.repl.secondOffset,
+		Replicas:     make([]engine.ReplicaInfo, 0, len(s.repl.replicas)),
+	}
+	if s.repl.id2 != "" {
+		info.ReplID2 = s.repl.id2
+	}
+	if s.repl.backlog != nil {
+		info.BacklogSize = s.repl.backlog.size()
+		info.BacklogHistLen = int64(s.repl.backlog.histLen)
+		info.BacklogFirstByteOffset = s.repl.offset - info.BacklogHistLen + 1
+	}
+
+	if link := s.repl.primary; link != nil {
+		info.Role = "slave"
+		info.MasterHost = link.host
+		info.MasterPort = link.port
+		info.MasterLinkUp = link.state() == linkConnected
+		info.MasterLastIO = int64(now.Sub(time.Unix(0, link.lastIO.Load())).Seconds())
+		info.SyncInProgress = link.state() == linkSync
+		info.ReadOnly = s.eng.Config().GetBool(config.ReplicaReadOnly)
+	}
+
+	for _, rep := range s.sortedReplicas() {
+		info.Replicas = append(info.Replicas, engine.ReplicaInfo{
+			IP:     replicaIP(rep),
+			Port:   strconv.FormatInt(rep.client.listeningPort.Load(), 10),
+			State:  *rep.state.Load(),
+			Offset: rep.ackOffset.Load(),
+			Lag:    int64(now.Sub(time.Unix(0, rep.ackTime.Load())).Seconds()),
+		})
+	}
+	return info
+}
+
+// replicationCron pings the replicas every repl-ping-replica-period, so
+// they detect a lost primary, and disconnects the replicas that didn't
+// acknowledge their offset within repl-timeout
+func (s *Server) replicationCron(ctx context.Context) {
+	ticker := time.NewTicker(replicationCronPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			cfg := s.eng.Config()
+			period := time.Duration(cfg.GetInt(config.ReplPingReplicaPeriod)) * time.Second
+			timeout := time.Duration(cfg.GetInt(config.ReplTimeout)) * time.Second
+
+			s.repl.lock.Lock()
+			if s.repl.primary == nil && len(s.repl.replicas) > 0 && now.Sub(s.repl.lastPing) >= period {
+				s.feedCommand(engine.PING)
+				s.repl.lastPing = now
+			}
+			for id, rep := range s.repl.replicas {
+				if *rep.state.Load() == replicaOnline && now.Sub(time.Unix(0, rep.ackTime.Load())) > timeout {
+					s.logger.Printf("Disconnecting timed out replica %s", rep.client.conn.RemoteAddr())
+					delete(s.repl.replicas, id)
+					rep.close()
+				}
+			}
+			s.repl.lock.Unlock()
+		}
+	}
+}
+
+// toInt64 parses an integer argument
+func toInt64(arg interface{}) (int64, error) {
+	switch v := arg.(type) {
+	case int64:
+		return v, nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, engine.NotAnInteger
+		}
+		return n, nil
+	default:
+		return 0, engine.NotAnInteger
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startReplicationServer serves a server and returns its host and port,
+// the arguments of REPLICAOF
+func startReplicationServer(t *testing.T) (string, string) {
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	s := NewServer(eng, log.New(io.Discard, "", log.LstdFlags))
+	host, port, err := net.SplitHostPort(serveTest(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.stopReplication)
+	return host, port
+}
+
+// eventually retries the command until check accepts its reply
+func eventually(t *testing.T, conn *testConn, check func(res interface{}) bool, args ...interface{}) {
+	var res interface{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		res, _ = conn.do(args...)
+		if check(res) {
+			return
+		}
+	}
+	t.Fatalf("unexpected reply to %v: %v", args, res)
+}
+
+func equals(expected interface{}) func(res interface{}) bool {
+	return func(res interface{}) bool {
+		return res == expected
+	}
+}
+
+func TestServer_Replication(t *testing.T) {
+	primaryHost, primaryPort := startReplicationServer(t)
+	replicaHost, replicaPort := startReplicationServer(t)
+
+	primary := dialTest(t, "tcp", net.JoinHostPort(primaryHost, primaryPort))
+	replica := dialTest(t, "tcp", net.JoinHostPort(replicaHost, replicaPort))
+
+	// Keys written before the replica connects come in the snapshot
+	primary.do("SET", "before", "1")
+	if res, _ := replica.do("REPLICAOF", primaryHost, primaryPort); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+	eventually(t, replica, equals("1"), "GET", "before")
+
+	// Then the writes are streamed
+	primary.do("SET", "after", "2")
+	primary.do("DEL", "before")
+	eventually(t, replica, equals("2"), "GET", "after")
+	eventually(t, replica, equals(nil), "GET", "before")
+
+	res, _ := replica.do("SET", "key", "value")
+	if err, ok := res.(error); !ok || !strings.HasPrefix(err.Error(), "READONLY") {
+		t.Errorf("expected READONLY, got %v", res)
+	}
+
+	role, _ := replica.do("ROLE")
+	if fields, ok := role.([]interface{}); !ok || fields[0] != "slave" || fields[3] != "connected" {
+		t.Errorf("unexpected ROLE of the replica %v", role)
+	}
+	role, _ = primary.do("ROLE")
+	if fields, ok := role.([]interface{}); !ok || fields[0] != "master" || len(fields[2].([]interface{})) != 1 {
+		t.Errorf("unexpected ROLE of the primary %v", role)
+	}
+
+	info, _ := primary.do("INFO", "replication")
+	if !strings.Contains(info.(string), "role:master\r\nconnected_slaves:1\r\n") {
+		t.Errorf("unexpected INFO replication %q", info)
+	}
+
+	primary.do("SET", "waited", "3")
+	if res, _ := primary.do("WAIT", "1", "5000"); res != int64(1) {
+		t.Errorf("expected 1 replica, got %v", res)
+	}
+
+	// Promoted replicas accept writes
+	if res, _ := replica.do("REPLICAOF", "NO", "ONE"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+	if res, _ := replica.do("SET", "key", "value"); res != engine.OK {
+		t.Errorf("expected OK, got %v", res)
+	}
+	if res, _ := replica.do("GET", "waited"); res != "3" {
+		t.Errorf("expected 3, got %v", res)
+	}
+}
+
+func TestServer_Replication_PartialResync(t *testing.T) {
+	primaryHost, primaryPort := startReplicationServer(t)
+	replicaHost, replicaPort := startReplicationServer(t)
+
+	primary := dialTest(t, "tcp", net.JoinHostPort(primaryHost, primaryPort))
+	replica := dialTest(t, "tcp", net.JoinHostPort(replicaHost, replicaPort))
+
+	replica.do("REPLICAOF", primaryHost, primaryPort)
+	primary.do("SET", "key", "1")
+	eventually(t, replica, equals("1"), "GET", "key")
+
+	// The replica continues from its offset with the backlog
+	if res, _ := primary.do("CLIENT", "KILL", "TYPE", "replica"); res != int64(1) {
+		t.Fatalf("expected 1 killed replica, got %v", res)
+	}
+	primary.do("SET", "key", "2")
+	eventually(t, replica, equals("2"), "GET", "key")
+
+	if line := infoStat(t, primary, "sync_partial_ok"); line != "sync_partial_ok:1" {
+		t.Errorf("unexpected %s", line)
+	}
+}
+
+func TestServer_Replication_Functions(t *testing.T) {
+	primaryHost, primaryPort := startReplicationServer(t)
+	replicaHost, replicaPort := startReplicationServer(t)
+
+	primary := dialTest(t, "tcp", net.JoinHostPort(primaryHost, primaryPort))
+	replica := dialTest(t, "tcp", net.JoinHostPort(replicaHost, replicaPort))
+
+	// Libraries loaded before the replica connects come in the snapshot
+	library := "#!lua name=lib\r\n" +
+		"redis.register_function{function_name='get', callback=function(keys) return redis.call('GET', keys[1]) end, flags={'no-writes'}}\n"
+	if res, err := primary.do("FUNCTION", "LOAD", library); res != "lib" {
+		t.Fatalf("expected lib, got %v, error %v", res, err)
+	}
+	replica.do("REPLICAOF", primaryHost, primaryPort)
+	primary.do("SET", "key", "value")
+	eventually(t, replica, equals("value"), "FCALL_RO", "get", "1", "key")
+
+	// Then the changes to the libraries are streamed
+	writer := "#!lua name=writer\nredis.register_function('set', function(keys, args) return redis.call('SET', keys[1], args[1]) end)"
+	primary.do("FUNCTION", "LOAD", writer)
+	if res, _ := primary.do("FCALL", "set", "1", "key", "changed"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+	eventually(t, replica, equals("changed"), "FCALL_RO", "get", "1", "key")
+
+	// Replicas only run the functions that don't write
+	eventually(t, replica, isError(ReadOnlyReplica.Error()), "FCALL", "set", "1", "key", "value")
+	if res, _ := replica.do("FUNCTION", "DELETE", "writer"); !isError(ReadOnlyReplica.Error())(res) {
+		t.Errorf("expected READONLY, got %v", res)
+	}
+
+	primary.do("FUNCTION", "DELETE", "writer")
+	eventually(t, replica, isError(engine.FunctionNotFound.Error()), "FCALL", "set", "1", "key", "value")
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/cluster"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+)
+
+var NonLocalKey = errors.New("Script attempted to access a non local key in a cluster node")
+
+// evalCommand implements EVAL, EVALSHA, FCALL and FCALL_RO, the commands
+// called by the script are checked like the ones sent by the client
+func (s *Server) evalCommand(client *Client, payloadArray []interface{}) (interface{}, error) {
+	opts := engine.ScriptOptions{
+		Check: func(command []interface{}) error {
+			return s.checkScriptCommand(client, command)
+		},
+		Caller: client,
+	}
+	// Read only replicas only run the functions with the no-writes flag
+	if s.readOnlyReplica() {
+		opts.DenyWrite = ReadOnlyReplica
+	}
+	s.pause.wait(payloadArray[0] != engine.FCALL_RO)
+	return s.eng.Eval(payloadArray, opts)
+}
+
+// checkScriptCommand checks the ACLs, the read only replicas and, in
+// cluster mode, that the keys belong to this node
+func (s *Server) checkScriptCommand(client *Client, command []interface{}) error {
+	name, _ := command[0].(string)
+	if err := s.authorize(client, name, command, scriptLogContext); err != nil {
+		return err
+	}
+
+	if engine.IsWriteCommand(command) && s.readOnlyReplica() {
+		return ReadOnlyReplica
+	}
+	s.feedMonitors("lua", command)
+
+	if s.cluster == nil {
+		return nil
+	}
+	for _, key := range engine.CommandKeys(command) {
+		if owner := s.cluster.Slot(cluster.KeySlot(key)).Owner; owner == nil || !owner.Myself {
+			return NonLocalKey
+		}
+	}
+	return nil
+}
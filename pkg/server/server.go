@@ -3,107 +3,392 @@ package server
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/acl"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/cluster"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/config"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
 	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	eng    *engine.Engine
-	logger *log.Logger
+	eng     *engine.Engine
+	logger  *log.Logger
+	clients *clientRegistry
+	pause   *pauser
+	acl     *acl.ACL
+	tls     *tlsLoader
+
+	binds          []string
+	unixSocket     string
+	unixSocketPerm os.FileMode
+	protectedMode  atomic.Bool
+	limits         limits
+	repl           *replication
+	monitors       monitors
+	// cluster is nil unless cluster-enabled is set
+	cluster *cluster.Cluster
+
+	// exec is read locked by each command until its reply is written,
+	// Shutdown write locks it to drain them
+	exec          sync.RWMutex
+	closing       atomic.Bool
+	listenersLock sync.Mutex
+	listeners     []net.Listener
+	done          chan struct{}
+	doneOnce      sync.Once
+	// cronOnce starts the background tasks with the first listener
+	cronOnce sync.Once
+}
+
+type ServerOptions struct {
+	// ACL holds the users, an ACL with only the default user is created when nil.
+	// The requirepass parameter of the engine configuration sets the password
+	// of the default user.
+	ACL *acl.ACL
+	// TLS enables StartTLSServer
+	TLS *TLSOptions
+	// Bind are the addresses of the TCP and TLS listeners, like the bind
+	// directive. Every interface is used when empty.
+	Bind []string
+	// UnixSocket enables StartUnixServer, UnixSocketPerm are the
+	// permissions of the socket file, zero keeps the default ones
+	UnixSocket     string
+	UnixSocketPerm os.FileMode
 }
 
 func NewServer(eng *engine.Engine, logger *log.Logger) *Server {
-	return &Server{
-		eng:    eng,
-		logger: logger,
+	serv, _ := NewServerWithOptions(eng, logger, ServerOptions{})
+	return serv
+}
+
+func NewServerWithOptions(eng *engine.Engine, logger *log.Logger, opts ServerOptions) (*Server, error) {
+	s := &Server{
+		eng:     eng,
+		logger:  logger,
+		clients: newClientRegistry(),
+		pause:   newPauser(),
+		acl:     opts.ACL,
+		repl:    newReplication(),
+
+		binds:          opts.Bind,
+		unixSocket:     opts.UnixSocket,
+		unixSocketPerm: opts.UnixSocketPerm,
+		done:           make(chan struct{}),
+	}
+
+	if s.acl == nil {
+		s.acl = acl.New(engine.CommandCategories)
+	}
+
+	if opts.TLS != nil {
+		loader, err := newTLSLoader(*opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.tls = loader
 	}
+
+	cfg := eng.Config()
+	if password := cfg.GetString(config.RequirePass); password != "" {
+		if err := s.acl.SetDefaultPassword(password); err != nil {
+			return nil, err
+		}
+	}
+	cfg.OnChange(config.RequirePass, s.acl.SetDefaultPassword)
+
+	s.protectedMode.Store(cfg.GetBool(config.ProtectedMode))
+	cfg.OnChange(config.ProtectedMode, func(value string) error {
+		s.protectedMode.Store(value == "yes")
+		return nil
+	})
+
+	if err := s.limits.bind(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := s.bindCluster(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := s.bindReplication(cfg); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ACL returns the users checked before running each command
+func (s *Server) ACL() *acl.ACL {
+	return s.acl
 }
 
 func (s *Server) handleClient(conn net.Conn) {
 	defer conn.Close()
-	var parser = resp.RespParser{}
+	// A panic only closes the connection of the client that caused it
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Printf("Closing client %s after a panic: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+	if s.protected(conn.RemoteAddr()) {
+		s.logger.Printf("Denied connection from %s in protected mode", conn.RemoteAddr())
+		s.denyProtected(conn)
+		return
+	}
+	client, ok := s.clients.register(conn, s.limits.maxClients.Load())
+	if !ok {
+		s.logger.Printf("Rejected connection from %s, max number of clients reached", conn.RemoteAddr())
+		s.eng.Stats().RejectedConnection()
+		s.denyMaxClients(conn)
+		return
+	}
+	defer s.clients.unregister(client)
+	defer s.dropReplica(client)
+	defer s.dropMonitor(client)
+	s.eng.Stats().ClientConnected()
+	defer s.eng.Stats().ClientDisconnected()
+	s.setKeepAlive(conn)
+	if user, ok := s.acl.User(acl.DefaultUser); ok && user.Enabled() && user.NoPass() {
+		client.authenticate(acl.DefaultUser)
+	}
+	if err := s.authenticateCertificate(client); err != nil {
+		s.logger.Printf("TLS handshake failed from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Clients that are not authenticated get the small limits of Redis
+	var parser = resp.RespParser{Limits: func() resp.Limits {
+		if client.authenticated.Load() {
+			return resp.DefaultLimits
+		}
+		return resp.UnauthenticatedLimits
+	}}
 	var serializer = resp.RespSerializer{}
-	var serialized *bytes.Buffer
-	var scanner = parser.CreateScanner(conn)
+	var scanner = parser.CreateScanner(client)
+	scanner.Split(client.split(parser.SplitFunc()))
 
 	for {
+		s.setIdleDeadline(client)
 		payload, err := parser.ParseScanner(scanner)
 
-		if err != nil {
-			s.logger.Printf("client closed connection from %s", conn.RemoteAddr())
+		if isTimeout(err) {
+			s.logger.Printf("Closing idle client %s", conn.RemoteAddr())
+			s.eng.Stats().TimeoutDisconnection()
 			return
 		}
 
-		// Process payload
-		res, err := s.eng.Process(payload)
-
-		// Report engine errors
-		if err != nil {
-			s.logger.Println(err)
-			serialized, _ = serializer.Serialize(err)
-			_, err = conn.Write(serialized.Bytes())
-			if err != nil {
-				s.logger.Println(err)
-				return
-			}
+		if errors.Is(err, resp.ProtocolError) {
+			s.logger.Printf("Closing client %s: %s", conn.RemoteAddr(), err)
+			serialized, _ := serializer.Serialize(err)
+			_ = s.writeReply(client, serialized.Bytes())
+			serializer.Release(serialized)
+			return
 		}
 
-		// Serialize response
-		serialized, err = serializer.Serialize(res)
-
-		// Report serialization errors
 		if err != nil {
-			s.logger.Println(err)
-			serialized, _ = serializer.Serialize(err)
-			_, err = conn.Write(serialized.Bytes())
-			if err != nil {
-				s.logger.Println(err)
-				return
-			}
+			s.logger.Printf("client closed connection from %s", conn.RemoteAddr())
+			return
 		}
 
-		// Write response
-		_, err = conn.Write(serialized.Bytes())
-		if err != nil {
-			s.logger.Println(err)
+		if !s.handleCommand(client, serializer, payload) {
 			return
 		}
 	}
 }
 
+// handleCommand runs a command and writes its reply, it returns false when
+// the connection has to be closed
+func (s *Server) handleCommand(client *Client, serializer resp.RespSerializer, payload interface{}) bool {
+	if !isShutdownCommand(payload) {
+		s.exec.RLock()
+		defer s.exec.RUnlock()
+	}
+	if s.closing.Load() {
+		return false
+	}
+
+	// Process payload
+	res, err := s.dispatch(client, payload)
+
+	// The client that shut down the server gets no reply
+	if s.closing.Load() {
+		return false
+	}
+
+	// Replicas and monitors get the stream instead of replies
+	if _, ok := res.(noReplyType); ok && err == nil {
+		return !client.killed.Load()
+	}
+
+	// Report engine errors
+	if err != nil {
+		s.logger.Println(err)
+		res = err
+	}
+
+	// Serialize response
+	var serialized *bytes.Buffer
+	serialized, err = serializer.Serialize(res)
+
+	// Report serialization errors
+	if err != nil {
+		s.logger.Println(err)
+		serialized, _ = serializer.Serialize(err)
+	}
+
+	// Write response
+	err = s.writeReply(client, serialized.Bytes())
+	serializer.Release(serialized)
+	if errors.Is(err, OutputBufferLimitReached) {
+		s.logger.Printf("Client %s closed for overcoming of output buffer limits", client.conn.RemoteAddr())
+		s.eng.Stats().OutputBufferLimitDisconnection()
+		return false
+	}
+	if err != nil {
+		s.logger.Println(err)
+		return false
+	}
+
+	return !client.killed.Load()
+}
+
+// dispatch authenticates the client, checks the ACLs, runs the commands
+// that need the connection, like CLIENT, and sends the others to the
+// engine once they are not paused
+func (s *Server) dispatch(client *Client, payload interface{}) (interface{}, error) {
+	payloadArray, _ := payload.([]interface{})
+	if len(payloadArray) == 0 {
+		return s.eng.Process(payload)
+	}
+	name, _ := payloadArray[0].(string)
+	client.beginCommand(name, payloadArray)
+	defer client.argvMem.Store(0)
+
+	if name == engine.AUTH {
+		return s.runCommand(client, name, payloadArray, s.authCommand)
+	}
+
+	if !client.authenticated.Load() {
+		s.eng.Stats().RecordRejected(name)
+		return nil, NoAuth
+	}
+
+	if err := s.authorize(client, name, payloadArray, logContext); err != nil {
+		s.eng.Stats().RecordRejected(name)
+		return nil, err
+	}
+
+	if engine.IsWriteCommand(payloadArray) && s.readOnlyReplica() {
+		s.eng.Stats().RecordRejected(name)
+		return nil, ReadOnlyReplica
+	}
+
+	if err := s.clusterRedirect(client, name, payloadArray); err != nil {
+		s.eng.Stats().RecordRejected(name)
+		return nil, err
+	}
+
+	s.feedMonitors(client.Addr(), payloadArray)
+
+	switch name {
+	case engine.CLIENT:
+		return s.runCommand(client, name, payloadArray, s.clientCommand)
+	case engine.ACL:
+		return s.runCommand(client, name, payloadArray, s.aclCommand)
+	case engine.SHUTDOWN:
+		return s.runCommand(client, name, payloadArray, s.shutdownCommand)
+	case engine.REPLICAOF, engine.SLAVEOF:
+		return s.runCommand(client, name, payloadArray, s.replicaofCommand)
+	case engine.PSYNC:
+		return s.runCommand(client, name, payloadArray, s.psyncCommand)
+	case engine.REPLCONF:
+		return s.runCommand(client, name, payloadArray, s.replconfCommand)
+	case engine.ROLE:
+		return s.runCommand(client, name, payloadArray, s.roleCommand)
+	case engine.WAIT:
+		return s.runCommand(client, name, payloadArray, s.waitCommand)
+	case engine.CLUSTER:
+		return s.runCommand(client, name, payloadArray, s.clusterCommand)
+	case engine.ASKING:
+		return s.runCommand(client, name, payloadArray, s.askingCommand)
+	case engine.MIGRATE:
+		return s.runCommand(client, name, payloadArray, s.migrateCommand)
+	case engine.MONITOR:
+		return s.runCommand(client, name, payloadArray, s.monitorCommand)
+	case engine.EVAL, engine.EVALSHA, engine.FCALL, engine.FCALL_RO:
+		return s.evalCommand(client, payloadArray)
+	default:
+		s.pause.wait(engine.IsWriteCommand(payloadArray))
+		return s.eng.ProcessFrom(payload, client)
+	}
+}
+
+type serverCommand func(client *Client, payloadArray []interface{}) (interface{}, error)
+
+// runCommand runs a command handled by the server and records its stats
+func (s *Server) runCommand(client *Client, name string, payloadArray []interface{}, command serverCommand) (interface{}, error) {
+	start := time.Now()
+	res, err := command(client, payloadArray)
+	s.eng.Stats().RecordCommand(name, start, err)
+	// WAIT blocks for the replicas, like in Redis that is not a latency
+	// spike, and AUTH is never logged, like in Redis
+	if name != engine.WAIT {
+		s.eng.RecordCommandLatency(payloadArray, start)
+		if name != engine.AUTH {
+			s.eng.RecordSlowlog(start, payloadArray, client)
+		}
+	}
+	return res, err
+}
+
+// StartServer listens for TCP connections on the port of each bind address
 func (s *Server) StartServer(ctx context.Context, port string, ready chan struct{}) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	listeners, err := s.listen(port)
 	if err != nil {
 		s.logger.Fatal(err)
 	}
 
-	defer listener.Close()
+	s.serveAll(ctx, listeners, ready)
+}
+
+// serve accepts the connections of the listener until the context is done
+// or the server shuts down
+func (s *Server) serve(ctx context.Context, listener net.Listener) {
+	s.listenersLock.Lock()
+	if s.closing.Load() {
+		s.listenersLock.Unlock()
+		_ = listener.Close()
+		return
+	}
+	s.listeners = append(s.listeners, listener)
+	s.listenersLock.Unlock()
 
-	s.logger.Printf("Listening on %s", listener.Addr())
-	ready <- struct{}{}
-	defer close(ready)
+	// Closing the listener unblocks Accept
+	stop := context.AfterFunc(ctx, func() {
+		_ = listener.Close()
+	})
+	defer stop()
+	defer listener.Close()
 
 	for {
-		select {
-		case <-ctx.Done():
-			err = listener.Close()
-			if err != nil {
-				s.logger.Printf("Error closing listener: %s", err)
-				return
-			}
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
 			return
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				s.logger.Println(err)
-				continue
-			}
-
-			s.logger.Printf("Accepted connection from %s", conn.RemoteAddr())
-			go s.handleClient(conn)
 		}
+		if err != nil {
+			s.logger.Println(err)
+			continue
+		}
+
+		s.logger.Printf("Accepted connection from %s", conn.RemoteAddr())
+		go s.handleClient(conn)
 	}
 }
@@ -3,7 +3,9 @@ package server
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/client"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
 	"github.com/cdgn-coding/redis-compatible-challenge/pkg/resp"
 	"github.com/stretchr/testify/suite"
@@ -11,6 +13,7 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -20,21 +23,26 @@ type TestSuite struct {
 	suite.Suite
 	serv   *Server
 	cancel context.CancelFunc
+	// addr is the address of the random port the server listens on
+	addr string
 }
 
 func (suite *TestSuite) SetupSuite() {
 	eng, _ := engine.NewEngine(engine.EngineOptions{})
-	serv := &Server{
-		eng:    eng,
-		logger: log.New(io.Discard, "", log.LstdFlags),
-	}
+	serv := NewServer(eng, log.New(io.Discard, "", log.LstdFlags))
 	ctx, cancel := context.WithCancel(context.Background())
 
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+
 	suite.serv = serv
 	suite.cancel = cancel
+	suite.addr = listener.Addr().String()
 
 	ready := make(chan struct{})
-	go serv.StartServer(ctx, "3000", ready)
+	go serv.Serve(ctx, listener, ready)
 	<-ready
 }
 
@@ -43,7 +51,7 @@ func (suite *TestSuite) TearDownSuite() {
 }
 
 func (suite *TestSuite) TestServer_SET_GET() {
-	conn, err := net.Dial("tcp", ":3000")
+	conn, err := net.Dial("tcp", suite.addr)
 	if err != nil {
 		suite.T().Fatal(err)
 	}
@@ -89,7 +97,7 @@ func (suite *TestSuite) TestConcurrencyServer() {
 		go func(i int) {
 			defer wg.Done()
 
-			conn, err := net.Dial("tcp", ":3000")
+			conn, err := net.Dial("tcp", suite.addr)
 			if err != nil {
 				errs[i] = fmt.Errorf("connection error: %v", err)
 				return
@@ -97,35 +105,22 @@ func (suite *TestSuite) TestConcurrencyServer() {
 			defer conn.Close()
 
 			parser := resp.RespParser{}
-			ticker := time.NewTicker(1 * time.Millisecond)
-			defer ticker.Stop()
-
 			scanner := bufio.NewScanner(conn)
 			scanner.Split(bufio.ScanLines)
 
-			timeout := time.After(10 * time.Minute)
+			// The scanner stops at the first error, so the replies are read
+			// with a single deadline for the whole goroutine
+			_ = conn.SetReadDeadline(time.Now().Add(1 * time.Minute))
 
-			for j := 0; j < numRequests; {
-				// Write request
+			for j := 0; j < numRequests; j++ {
 				_, err = conn.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
 				if err != nil {
 					errs[i] = fmt.Errorf("write error: %v", err)
 					return
 				}
-				select {
-				case <-timeout:
-					errs[i] = fmt.Errorf("global timeout reached")
+				if _, err = parser.ParseScanner(scanner); err != nil {
+					errs[i] = fmt.Errorf("read error: %v", err)
 					return
-
-				case <-ticker.C:
-					_ = conn.SetReadDeadline(time.Now().Add(1 * time.Millisecond))
-					_, err = parser.ParseScanner(scanner)
-
-					if err != nil {
-						continue
-					}
-
-					j++
 				}
 			}
 		}(i)
@@ -141,6 +136,359 @@ func (suite *TestSuite) TestConcurrencyServer() {
 	}
 }
 
+// testConn drives the tests with a connection of the client package, error
+// replies are returned as replies, the way the parser returns them
+type testConn struct {
+	net.Conn
+	client *client.Conn
+}
+
+func newTestConn(conn net.Conn) *testConn {
+	return &testConn{Conn: conn, client: client.NewConn(conn)}
+}
+
+func (suite *TestSuite) dial() *testConn {
+	conn, err := net.Dial("tcp", suite.addr)
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+	suite.T().Cleanup(func() { conn.Close() })
+	return newTestConn(conn)
+}
+
+// send writes a command without waiting for its reply
+func (c *testConn) send(args ...interface{}) {
+	_ = c.client.Send(args...)
+	_ = c.client.Flush(context.Background())
+}
+
+func (c *testConn) do(args ...interface{}) (interface{}, error) {
+	_ = c.client.Send(args...)
+	return c.receive(5 * time.Second)
+}
+
+// receive reads the next reply
+func (c *testConn) receive(timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := c.client.Receive(ctx)
+	var reply client.Error
+	if errors.As(err, &reply) {
+		return errors.New(string(reply)), nil
+	}
+	return res, err
+}
+
+func (suite *TestSuite) TestServer_INFO_Clients() {
+	conn := suite.dial()
+
+	body, err := conn.do("INFO", "clients")
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+
+	suite.Contains(body, "# Clients\r\nconnected_clients:")
+	suite.NotContains(body, "connected_clients:0")
+}
+
+func (suite *TestSuite) TestServer_ErrorReply() {
+	conn := suite.dial()
+
+	res, _ := conn.do("UNKNOWN")
+	suite.IsType(errors.New(""), res)
+
+	// A single reply is written for each command
+	res, _ = conn.do("PING")
+	suite.Equal("PONG", res)
+}
+
+func (suite *TestSuite) TestServer_CLIENT() {
+	conn := suite.dial()
+	other := suite.dial()
+
+	id, _ := conn.do("CLIENT", "ID")
+	otherID, _ := other.do("CLIENT", "ID")
+	suite.IsType(int64(0), id)
+	suite.NotEqual(id, otherID)
+
+	res, _ := conn.do("CLIENT", "GETNAME")
+	suite.Nil(res)
+	res, _ = conn.do("CLIENT", "SETNAME", "worker")
+	suite.Equal("OK", res)
+	res, _ = conn.do("CLIENT", "GETNAME")
+	suite.Equal("worker", res)
+	res, _ = conn.do("CLIENT", "SETNAME", "bad name")
+	suite.IsType(errors.New(""), res)
+
+	res, _ = conn.do("CLIENT", "INFO")
+	suite.Contains(res, fmt.Sprintf("id=%d addr=%s ", id, conn.LocalAddr()))
+	suite.Contains(res, "name=worker ")
+	suite.Contains(res, "cmd=client user=default")
+
+	other.do("SET", "key", "value")
+	res, _ = conn.do("CLIENT", "LIST")
+	suite.Contains(res, fmt.Sprintf("id=%d ", id))
+	suite.Contains(res, fmt.Sprintf("id=%d ", otherID))
+	suite.Contains(res, "cmd=set ")
+
+	res, _ = conn.do("CLIENT", "LIST", "ID", fmt.Sprint(otherID))
+	suite.NotContains(res, fmt.Sprintf("id=%d ", id))
+	suite.Equal(1, strings.Count(res.(string), "\n"))
+}
+
+func (suite *TestSuite) TestServer_CLIENT_KILL() {
+	conn := suite.dial()
+	other := suite.dial()
+	otherID, _ := other.do("CLIENT", "ID")
+
+	res, _ := conn.do("CLIENT", "KILL", "ID", fmt.Sprint(otherID))
+	suite.Equal(int64(1), res)
+	_, err := other.do("PING")
+	suite.Error(err, "expected the killed client to be disconnected")
+
+	res, _ = conn.do("CLIENT", "KILL", "ID", fmt.Sprint(otherID))
+	suite.Equal(int64(0), res)
+
+	// SKIPME defaults to yes
+	self, _ := conn.do("CLIENT", "ID")
+	res, _ = conn.do("CLIENT", "KILL", "ID", fmt.Sprint(self))
+	suite.Equal(int64(0), res)
+
+	third := suite.dial()
+	third.do("PING")
+	res, _ = conn.do("CLIENT", "KILL", third.LocalAddr().String())
+	suite.Equal("OK", res)
+	_, err = third.do("PING")
+	suite.Error(err)
+
+	res, _ = conn.do("CLIENT", "KILL", "127.0.0.1:1")
+	suite.IsType(errors.New(""), res)
+}
+
+func (suite *TestSuite) TestServer_CLIENT_PAUSE() {
+	conn := suite.dial()
+	writer := suite.dial()
+
+	res, _ := conn.do("CLIENT", "PAUSE", "10000", "WRITE")
+	suite.Equal("OK", res)
+
+	// Reads are served while writes wait
+	res, _ = writer.do("GET", "paused")
+	suite.Nil(res)
+
+	writer.send("SET", "paused", "value")
+	_ = writer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := writer.Read(make([]byte, 1))
+	suite.Error(err, "expected the write to be paused")
+
+	res, _ = conn.do("CLIENT", "UNPAUSE")
+	suite.Equal("OK", res)
+	res, _ = writer.receive(5 * time.Second)
+	suite.Equal("OK", res)
+
+	// Pauses end after the timeout
+	start := time.Now()
+	conn.do("CLIENT", "PAUSE", "100")
+	res, _ = writer.do("GET", "paused")
+	suite.Equal("value", res)
+	suite.GreaterOrEqual(time.Since(start), 100*time.Millisecond)
+}
+
+func (suite *TestSuite) TestServer_ACL() {
+	admin := suite.dial()
+	res, _ := admin.do("ACL", "SETUSER", "alice", "on", ">secret", "~cache:*", "+get", "+set", "+acl|whoami")
+	suite.Equal("OK", res)
+
+	alice := suite.dial()
+	res, _ = alice.do("AUTH", "alice", "wrong")
+	suite.ErrorContains(res.(error), "WRONGPASS")
+	res, _ = alice.do("AUTH", "alice", "secret")
+	suite.Equal("OK", res)
+	res, _ = alice.do("ACL", "WHOAMI")
+	suite.Equal("alice", res)
+
+	res, _ = alice.do("SET", "cache:1", "value")
+	suite.Equal("OK", res)
+	res, _ = alice.do("GET", "other")
+	suite.ErrorContains(res.(error), "NOPERM No permissions to access a key")
+	res, _ = alice.do("CONFIG", "GET", "port")
+	suite.ErrorContains(res.(error), "NOPERM User alice has no permissions to run the 'config|get' command")
+
+	res, _ = admin.do("ACL", "LOG", "2")
+	entries := res.([]interface{})
+	suite.Len(entries, 2)
+	suite.Equal("command", entries[0].([]interface{})[3])
+	suite.Equal("config|get", entries[0].([]interface{})[7])
+	suite.Equal("alice", entries[0].([]interface{})[9])
+	suite.Equal("key", entries[1].([]interface{})[3])
+	suite.Equal("other", entries[1].([]interface{})[7])
+
+	// LOADVALUE replaces keys like RESTORE, only the admins can send it
+	res, _ = alice.do("LOADVALUE", "cache:1", "counter", "1")
+	suite.ErrorContains(res.(error), "NOPERM User alice has no permissions to run the 'loadvalue' command")
+
+	res, _ = admin.do("ACL", "GETUSER", "alice")
+	user := res.([]interface{})
+	suite.Equal([]interface{}{"on"}, user[1])
+	suite.Equal("-@all +get +set +acl|whoami", user[5])
+	suite.Equal("~cache:*", user[7])
+
+	res, _ = admin.do("ACL", "LIST")
+	suite.Contains(res, "user default on nopass ~* &* +@all")
+
+	res, _ = admin.do("CLIENT", "KILL", "USER", "alice")
+	suite.Equal(int64(1), res)
+	_, err := alice.do("PING")
+	suite.Error(err)
+
+	res, _ = admin.do("ACL", "DELUSER", "alice")
+	suite.Equal(int64(1), res)
+	res, _ = admin.do("ACL", "LOG", "RESET")
+	suite.Equal("OK", res)
+}
+
+func (suite *TestSuite) TestServer_EVAL() {
+	admin := suite.dial()
+	res, _ := admin.do("EVAL", "redis.call('SET', KEYS[1], ARGV[1]) return redis.call('GET', KEYS[1])", "1", "script:key", "value")
+	suite.Equal("value", res)
+
+	res, _ = admin.do("ACL", "SETUSER", "bob", "on", "nopass", "~cache:*", "+@scripting", "+get")
+	suite.Equal("OK", res)
+	bob := suite.dial()
+	res, _ = bob.do("AUTH", "bob", "any")
+	suite.Equal("OK", res)
+
+	res, _ = bob.do("EVAL", "return redis.call('GET', KEYS[1])", "1", "other")
+	suite.ErrorContains(res.(error), "NOPERM No permissions to access a key")
+	res, _ = bob.do("EVAL", "return redis.call('GET', 'other')", "0")
+	suite.ErrorContains(res.(error), "NOPERM No permissions to access a key")
+	res, _ = bob.do("EVAL", "return redis.pcall('SET', 'cache:1', 'value')['err']", "0")
+	suite.Equal("NOPERM User bob has no permissions to run the 'set' command", res)
+
+	res, _ = admin.do("ACL", "LOG", "1")
+	entries := res.([]interface{})
+	suite.Equal("lua", entries[0].([]interface{})[5])
+	suite.Equal("set", entries[0].([]interface{})[7])
+
+	res, _ = admin.do("ACL", "DELUSER", "bob")
+	suite.Equal(int64(1), res)
+	res, _ = admin.do("ACL", "LOG", "RESET")
+	suite.Equal("OK", res)
+}
+
+func (suite *TestSuite) TestServer_SLOWLOG() {
+	conn := suite.dial()
+	conn.do("CLIENT", "SETNAME", "slow-client")
+	conn.do("CONFIG", "SET", "slowlog-log-slower-than", "0")
+	defer conn.do("CONFIG", "SET", "slowlog-log-slower-than", "10000")
+	conn.do("SET", "slow:key", "value")
+
+	res, _ := conn.do("SLOWLOG", "GET", "1")
+	entry := res.([]interface{})[0].([]interface{})
+	suite.Equal([]interface{}{"SET", "slow:key", "value"}, entry[3])
+	suite.Equal(conn.LocalAddr().String(), entry[4])
+	suite.Equal("slow-client", entry[5])
+}
+
+func (suite *TestSuite) TestServer_SLOWLOG_ServerCommands() {
+	conn := suite.dial()
+	conn.do("CONFIG", "SET", "slowlog-log-slower-than", "0")
+	defer conn.do("CONFIG", "SET", "slowlog-log-slower-than", "10000")
+	conn.do("SLOWLOG", "RESET")
+
+	// Commands of the server, not only the ones of the engine, are logged
+	// with their secrets redacted, and AUTH is never logged
+	conn.do("CLIENT", "SETNAME", "slow-client")
+	res, _ := conn.do("MIGRATE", "127.0.0.1", "1", "slow:missing", "0", "5000", "AUTH2", "user", "secret")
+	suite.Equal(NoKey, res)
+	conn.do("AUTH", "secret")
+
+	res, _ = conn.do("SLOWLOG", "GET", "-1")
+	entries := res.([]interface{})
+	suite.Len(entries, 3)
+	suite.Equal([]interface{}{"MIGRATE", "127.0.0.1", "1", "slow:missing", "0", "5000", "AUTH2", engine.Redacted, engine.Redacted}, entries[0].([]interface{})[3])
+	suite.Equal("slow-client", entries[0].([]interface{})[5])
+	suite.Equal([]interface{}{"CLIENT", "SETNAME", "slow-client"}, entries[1].([]interface{})[3])
+	suite.Equal([]interface{}{"SLOWLOG", "RESET"}, entries[2].([]interface{})[3])
+}
+
+func (suite *TestSuite) TestServer_RequirePass() {
+	admin := suite.dial()
+	res, _ := admin.do("AUTH", "secret")
+	suite.ErrorContains(res.(error), "without any password configured")
+
+	res, _ = admin.do("CONFIG", "SET", "requirepass", "secret")
+	suite.Equal("OK", res)
+	defer admin.do("CONFIG", "SET", "requirepass", "")
+
+	// Connected clients stay authenticated
+	res, _ = admin.do("PING")
+	suite.Equal("PONG", res)
+
+	conn := suite.dial()
+	res, _ = conn.do("PING")
+	suite.ErrorContains(res.(error), "NOAUTH")
+	res, _ = conn.do("AUTH", "wrong")
+	suite.ErrorContains(res.(error), "WRONGPASS")
+	res, _ = conn.do("AUTH", "secret")
+	suite.Equal("OK", res)
+	res, _ = conn.do("PING")
+	suite.Equal("PONG", res)
+}
+
+func (suite *TestSuite) TestServer_ProtocolLimits() {
+	admin := suite.dial()
+	res, _ := admin.do("CONFIG", "SET", "requirepass", "secret")
+	suite.Equal("OK", res)
+	defer admin.do("CONFIG", "SET", "requirepass", "")
+
+	payloads := map[string]string{
+		"*9223372036854775807\r\n":      "invalid multibulk length",
+		"*-5\r\n":                       "invalid multibulk length",
+		"*11\r\n":                       "invalid multibulk length",
+		"*3\r\n$3\r\nSET\r\n$20000\r\n": "invalid bulk length",
+	}
+	for payload, expected := range payloads {
+		conn := suite.dial()
+		_, _ = conn.Write([]byte(payload))
+		res, err := conn.receive(5 * time.Second)
+		suite.NoError(err)
+		suite.ErrorContains(res.(error), expected, payload)
+
+		// The connection is closed after the error
+		_, err = conn.receive(5 * time.Second)
+		suite.Error(err)
+	}
+
+	// Authenticated clients get the default limits
+	conn := suite.dial()
+	res, _ = conn.do("AUTH", "secret")
+	suite.Equal("OK", res)
+	res, _ = conn.do("SET", "big", strings.Repeat("a", 20000))
+	suite.Equal("OK", res)
+	res, _ = admin.do("PING")
+	suite.Equal("PONG", res)
+}
+
+func (suite *TestSuite) TestServer_Panic() {
+	// The command exists already when the tests run again with -count
+	_ = engine.RegisterCommand(engine.Command{
+		Name: "TEST.PANIC",
+		Handler: func(ks engine.Keyspace, args []string) (interface{}, error) {
+			panic("test panic")
+		},
+	})
+
+	conn := suite.dial()
+	_, err := conn.do("TEST.PANIC")
+	suite.Error(err)
+
+	// Only the connection of the client is closed
+	other := suite.dial()
+	res, _ := other.do("PING")
+	suite.Equal("PONG", res)
+}
+
 func TestServerSuite(t *testing.T) {
 	suite.Run(t, new(TestSuite))
 }
@@ -0,0 +1,28 @@
+// Package servertest serves a server in integration tests. It is apart
+// from the server package, so the server doesn't link the testing package.
+package servertest
+
+import (
+	"context"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/server"
+	"net"
+	"testing"
+)
+
+// Start serves the server on a random port of the loopback interface for
+// integration tests and returns its address. The server stops accepting
+// connections when the test ends.
+func Start(tb testing.TB, s *server.Server) string {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	ready := make(chan struct{})
+	go s.Serve(ctx, listener, ready)
+	<-ready
+	return listener.Addr().String()
+}
@@ -0,0 +1,26 @@
+package servertest
+
+import (
+	"context"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/client"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/server"
+	"io"
+	"log"
+	"testing"
+)
+
+func TestStart(t *testing.T) {
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	addr := Start(t, server.NewServer(eng, log.New(io.Discard, "", log.LstdFlags)))
+
+	c := client.New(client.Options{Addr: addr})
+	defer c.Close()
+	ctx := context.Background()
+	if res, err := c.Do(ctx, "SET", "key", "value"); err != nil || res != "OK" {
+		t.Fatalf("expected OK, got %v %v", res, err)
+	}
+	if val, ok, _ := eng.Get(ctx, "key"); !ok || val != "value" {
+		t.Errorf("expected the engine to hold value, got %q", val)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"strings"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long shutdowns wait for the commands in flight
+const DefaultShutdownTimeout = 10 * time.Second
+
+var ShutdownFailed = errors.New("Errors trying to SHUTDOWN. Check logs.")
+
+var NoShutdownInProgress = errors.New("no shutdown in progress")
+
+// ShutdownMode decides whether the dataset is saved before shutting down
+type ShutdownMode uint8
+
+const (
+	// ShutdownDefault saves when there are save rules
+	ShutdownDefault ShutdownMode = iota
+	ShutdownSave
+	ShutdownNoSave
+)
+
+// Shutdown stops the server: commands not started yet are held, the
+// commands in flight write their replies and the replicas catch up until
+// ctx is done, the dataset is saved according to the mode, then the
+// listeners and the connections are closed. When the save fails the server
+// keeps running, unless force is set.
+func (s *Server) Shutdown(ctx context.Context, mode ShutdownMode, force bool) error {
+	return s.shutdown(ctx, mode, force, false)
+}
+
+// shutdown implements Shutdown, now skips waiting for the replicas
+func (s *Server) shutdown(ctx context.Context, mode ShutdownMode, force bool, now bool) error {
+	// The script in progress would hold the commands in flight
+	if mode == ShutdownNoSave {
+		_ = s.eng.KillScript(true)
+	}
+
+	// The write lock waits for the commands in flight, and holds new ones
+	locked := make(chan struct{})
+	go func() {
+		s.exec.Lock()
+		close(locked)
+	}()
+
+	drained := true
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		drained = false
+		s.logger.Println("Timed out waiting for the commands in flight, closing their connections")
+	}
+
+	if !now {
+		s.waitReplicasCatchUp(ctx)
+	}
+
+	if mode == ShutdownSave || (mode == ShutdownDefault && s.eng.SaveOnShutdown()) {
+		s.logger.Println("Saving the dataset before shutting down")
+		if err := s.eng.Save(); err != nil {
+			s.logger.Printf("Error saving the dataset on shutdown: %s", err)
+			if !force {
+				s.releaseExec(drained, locked)
+				return ShutdownFailed
+			}
+		}
+	}
+
+	s.closing.Store(true)
+	s.stopReplication()
+
+	s.listenersLock.Lock()
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.listeners = nil
+	s.listenersLock.Unlock()
+
+	for _, client := range s.clients.list() {
+		_ = client.conn.Close()
+	}
+
+	// Held commands see the closing flag and return
+	s.releaseExec(drained, locked)
+	s.doneOnce.Do(func() { close(s.done) })
+	s.logger.Println("Server is now ready to exit")
+	return nil
+}
+
+// releaseExec releases the write lock, when the shutdown didn't wait for it
+// the lock is released once it is acquired
+func (s *Server) releaseExec(drained bool, locked chan struct{}) {
+	if drained {
+		s.exec.Unlock()
+		return
+	}
+	go func() {
+		<-locked
+		s.exec.Unlock()
+	}()
+}
+
+// waitReplicasCatchUp waits until the replicas acknowledge the last write, or ctx is done
+func (s *Server) waitReplicasCatchUp(ctx context.Context) {
+	s.repl.lock.Lock()
+	offset := s.repl.offset
+	replicas := int64(len(s.repl.replicas))
+	primary := s.repl.primary == nil
+	s.repl.lock.Unlock()
+	if replicas == 0 || !primary {
+		return
+	}
+
+	s.logger.Printf("Waiting for %d replicas to catch up before shutting down", replicas)
+	if acked := s.waitReplicas(ctx, offset, replicas); acked < replicas {
+		s.logger.Printf("Only %d of %d replicas caught up", acked, replicas)
+	}
+}
+
+// stopReplication disconnects from the primary, the replication ends once
+// the commands held by the shutdown return
+func (s *Server) stopReplication() {
+	s.repl.lock.Lock()
+	defer s.repl.lock.Unlock()
+	if s.repl.primary != nil {
+		s.repl.primary.cancel()
+	}
+}
+
+// Done is closed once the server shuts down
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// isShutdownCommand reports whether the payload is SHUTDOWN, which runs
+// without the read lock because it waits for the other commands
+func isShutdownCommand(payload interface{}) bool {
+	payloadArray, ok := payload.([]interface{})
+	return ok && len(payloadArray) > 0 && payloadArray[0] == engine.SHUTDOWN
+}
+
+// shutdownCommand implements SHUTDOWN [NOSAVE | SAVE] [NOW] [FORCE] [ABORT].
+// NOW skips waiting for the replicas. Shutdowns complete before replying,
+// so there is never one to ABORT.
+func (s *Server) shutdownCommand(_ *Client, payloadArray []interface{}) (interface{}, error) {
+	mode := ShutdownDefault
+	force, now := false, false
+	for _, arg := range payloadArray[1:] {
+		str, ok := arg.(string)
+		if !ok {
+			return nil, engine.UnsupportedTypeForCommand
+		}
+		switch strings.ToUpper(str) {
+		case "NOSAVE":
+			mode = ShutdownNoSave
+		case "SAVE":
+			mode = ShutdownSave
+		case "NOW":
+			now = true
+		case "FORCE":
+			force = true
+		case "ABORT":
+			return nil, NoShutdownInProgress
+		default:
+			return nil, SyntaxError
+		}
+	}
+
+	// Only SHUTDOWN NOSAVE stops busy scripts, saving would wait for them
+	if mode != ShutdownNoSave && s.eng.ScriptBusy() {
+		return nil, engine.Busy
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	if err := s.shutdown(ctx, mode, force, now); err != nil {
+		return nil, err
+	}
+	return engine.OK, nil
+}
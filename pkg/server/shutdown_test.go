@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startShutdownServer serves a server persisting to the file and returns
+// its address
+func startShutdownServer(t *testing.T, file string) (*Server, string) {
+	global := true
+	eng, _ := engine.NewEngine(engine.EngineOptions{File: &file, GlobalPath: &global})
+	serv := NewServer(eng, log.New(io.Discard, "", log.LstdFlags))
+	return serv, serveTest(t, serv)
+}
+
+func TestServer_SHUTDOWN(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.resp")
+	serv, addr := startShutdownServer(t, file)
+
+	conn := dialTest(t, "tcp", addr)
+	other := dialTest(t, "tcp", addr)
+	conn.do("SET", "key", "value")
+
+	if res, _ := conn.do("SHUTDOWN", "ABORT"); res == nil {
+		t.Error("expected no shutdown in progress")
+	}
+
+	// The client gets no reply and every connection is closed
+	if _, err := conn.do("SHUTDOWN", "SAVE"); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	if _, err := other.do("PING"); err == nil {
+		t.Error("expected the other connections to be closed")
+	}
+
+	select {
+	case <-serv.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the server to be done")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("expected the dataset to be saved, got %v", err)
+	}
+}
+
+func TestServer_SHUTDOWN_SaveError(t *testing.T) {
+	// The parent of the file is a regular file, so saves fail
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(parent, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	serv, addr := startShutdownServer(t, filepath.Join(parent, "data.resp"))
+
+	conn := dialTest(t, "tcp", addr)
+	res, err := conn.do("SHUTDOWN", "SAVE")
+	if err != nil || res == nil || res.(error).Error() != ShutdownFailed.Error() {
+		t.Fatalf("expected the shutdown to fail, got %v %v", res, err)
+	}
+
+	// The server keeps running
+	if res, err = conn.do("PING"); err != nil || res != "PONG" {
+		t.Fatalf("expected PONG, got %v %v", res, err)
+	}
+
+	// NOSAVE doesn't save
+	if _, err = conn.do("SHUTDOWN", "NOSAVE"); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	<-serv.Done()
+}
+
+func TestServer_Shutdown_Timeout(t *testing.T) {
+	serv, addr := startShutdownServer(t, filepath.Join(t.TempDir(), "data.resp"))
+
+	admin := dialTest(t, "tcp", addr)
+	writer := dialTest(t, "tcp", addr)
+	admin.do("CLIENT", "PAUSE", "10000", "WRITE")
+
+	// The paused write is a command in flight
+	writer.send("SET", "key", "value")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := serv.Shutdown(ctx, ShutdownNoSave, false); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected the shutdown to wait for the deadline, took %s", elapsed)
+	}
+
+	if _, err := writer.receive(time.Second); err == nil {
+		t.Error("expected the connection in flight to be closed")
+	}
+}
+
+func TestServer_Shutdown_Drain(t *testing.T) {
+	serv, addr := startShutdownServer(t, filepath.Join(t.TempDir(), "data.resp"))
+
+	admin := dialTest(t, "tcp", addr)
+	writer := dialTest(t, "tcp", addr)
+	admin.do("CLIENT", "PAUSE", "200", "WRITE")
+	writer.send("SET", "key", "value")
+	time.Sleep(50 * time.Millisecond)
+
+	// The paused write completes before the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- serv.Shutdown(ctx, ShutdownNoSave, false) }()
+
+	if res, err := writer.receive(5 * time.Second); err != nil || res != "OK" {
+		t.Errorf("expected the reply in flight, got %v %v", res, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_SHUTDOWN_BusyScript(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.resp")
+	serv, addr := startShutdownServer(t, file)
+
+	conn := dialTest(t, "tcp", addr)
+	other := dialTest(t, "tcp", addr)
+	if res, _ := conn.do("CONFIG", "SET", "busy-reply-threshold", "50"); res != engine.OK {
+		t.Fatalf("expected OK, got %v", res)
+	}
+	conn.send("EVAL", "redis.call('SET', 'key', 'value') while true do end", "0")
+
+	// The script wrote, so only SHUTDOWN NOSAVE stops it
+	eventually(t, other, isError(engine.Busy.Error()), "GET", "key")
+	if res, _ := other.do("SCRIPT", "KILL"); !isError(engine.Unkillable.Error())(res) {
+		t.Errorf("expected UNKILLABLE, got %v", res)
+	}
+	if res, _ := other.do("SHUTDOWN"); !isError(engine.Busy.Error())(res) {
+		t.Errorf("expected BUSY, got %v", res)
+	}
+	if _, err := other.do("SHUTDOWN", "NOSAVE"); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+
+	select {
+	case <-serv.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to be done")
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tlsHandshakeTimeout limits how long a client can take to complete the handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+var NoTLSConfig = errors.New("TLS is not configured")
+
+var InvalidCACertificate = errors.New("no certificates found in the CA file")
+
+var MissingCACertificate = errors.New("tls-ca-cert-file is required to verify client certificates")
+
+var InvalidAuthClients = errors.New("tls-auth-clients must be yes, no or optional")
+
+// TLSOptions are the certificates of the TLS listener, like the tls-*
+// directives of Redis
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// CACertFile verifies the client certificates
+	CACertFile string
+	// AuthClients is "yes" to require client certificates, "optional" to
+	// verify them when they are sent, or "no"
+	AuthClients string
+	// ClientsUser is "CN" to authenticate clients as the ACL user named like
+	// the common name of their certificate, or "off"
+	ClientsUser string
+}
+
+// tlsLoader keeps the current TLS configuration, reloads replace it for new
+// connections while existing connections keep theirs
+type tlsLoader struct {
+	opts   TLSOptions
+	config atomic.Pointer[tls.Config]
+}
+
+func newTLSLoader(opts TLSOptions) (*tlsLoader, error) {
+	l := &tlsLoader{opts: opts}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *tlsLoader) reload() error {
+	cert, err := tls.LoadX509KeyPair(l.opts.CertFile, l.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch strings.ToLower(l.opts.AuthClients) {
+	case "", "yes":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		config.ClientAuth = tls.NoClientCert
+	default:
+		return InvalidAuthClients
+	}
+
+	if l.opts.CACertFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(l.opts.CACertFile))
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return InvalidCACertificate
+		}
+		config.ClientCAs = pool
+	} else if config.ClientAuth != tls.NoClientCert {
+		return MissingCACertificate
+	}
+
+	l.config.Store(config)
+	return nil
+}
+
+// tlsConfig returns a configuration that uses the latest certificates on each handshake
+func (l *tlsLoader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.config.Load(), nil
+		},
+	}
+}
+
+// ReloadTLS reads the certificates again, like Redis on SIGHUP. Existing
+// connections are not affected.
+func (s *Server) ReloadTLS() error {
+	if s.tls == nil {
+		return NoTLSConfig
+	}
+	return s.tls.reload()
+}
+
+// StartTLSServer listens for TLS connections on the port
+func (s *Server) StartTLSServer(ctx context.Context, port string, ready chan struct{}) {
+	if s.tls == nil {
+		s.logger.Fatal(NoTLSConfig)
+	}
+
+	listeners, err := s.listen(port)
+	if err != nil {
+		s.logger.Fatal(err)
+	}
+
+	config := s.tls.tlsConfig()
+	for i, listener := range listeners {
+		listeners[i] = tls.NewListener(listener, config)
+	}
+	s.serveAll(ctx, listeners, ready)
+}
+
+// authenticateCertificate completes the handshake of TLS connections, and
+// authenticates the client as the user named like the common name of its
+// certificate when ClientsUser is CN
+func (s *Server) authenticateCertificate(client *Client) error {
+	conn, ok := client.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if !strings.EqualFold(s.tls.opts.ClientsUser, "CN") {
+		return nil
+	}
+
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil
+	}
+
+	name := certificates[0].Subject.CommonName
+	if user, ok := s.acl.User(name); ok && user.Enabled() {
+		client.authenticate(name)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/acl"
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/engine"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self signed CA when parent is nil
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCertificate{
+		cert: cert,
+		key:  key,
+		pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+// write saves the certificate and its key as PEM files
+func (c *testCertificate) write(t *testing.T, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir := t.TempDir()
+	opts := TLSOptions{
+		CertFile:    filepath.Join(dir, "server.crt"),
+		KeyFile:     filepath.Join(dir, "server.key"),
+		CACertFile:  filepath.Join(dir, "ca.crt"),
+		AuthClients: "yes",
+		ClientsUser: "CN",
+	}
+
+	ca := newTestCertificate(t, "ca", nil)
+	ca.write(t, opts.CACertFile, "")
+	newTestCertificate(t, "server", ca).write(t, opts.CertFile, opts.KeyFile)
+	alice := newTestCertificate(t, "alice", ca)
+	bob := newTestCertificate(t, "bob", ca)
+
+	users := acl.New(engine.CommandCategories)
+	_ = users.SetUser("alice", "on", "allkeys", "+@all")
+	_ = users.SetDefaultPassword("secret")
+
+	eng, _ := engine.NewEngine(engine.EngineOptions{})
+	serv, err := NewServerWithOptions(eng, log.New(io.Discard, "", log.LstdFlags), ServerOptions{ACL: users, TLS: &opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan struct{})
+	go serv.Serve(ctx, tls.NewListener(listener, serv.tls.tlsConfig()), ready)
+	<-ready
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(cert *testCertificate) (*testConn, error) {
+		config := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{cert.pair}
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { conn.Close() })
+		return newTestConn(conn), nil
+	}
+
+	// The common name authenticates the client as the ACL user
+	conn, err := dial(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := conn.do("ACL", "WHOAMI"); err != nil || res != "alice" {
+		t.Fatalf("expected alice, got %v %v", res, err)
+	}
+
+	// Certificates of unknown users need to AUTH
+	other, err := dial(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := other.do("PING"); !reflect.DeepEqual(res, errors.New(NoAuth.Error())) {
+		t.Errorf("expected NOAUTH, got %v", res)
+	}
+
+	// Clients without certificates are rejected
+	if anonymous, err := dial(nil); err == nil {
+		if _, err = anonymous.do("PING"); err == nil {
+			t.Error("expected clients without certificates to be rejected")
+		}
+	}
+
+	// Reloads apply to new connections and keep the existing ones
+	newTestCertificate(t, "reloaded", ca).write(t, opts.CertFile, opts.KeyFile)
+	if err = serv.ReloadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := conn.do("PING"); err != nil || res != "PONG" {
+		t.Errorf("expected the existing connection to work, got %v %v", res, err)
+	}
+	reloaded, err := dial(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := reloaded.do("PING"); err != nil || res != "PONG" {
+		t.Fatalf("expected PONG, got %v %v", res, err)
+	}
+	state := reloaded.Conn.(*tls.Conn).ConnectionState()
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != "reloaded" {
+		t.Errorf("expected the reloaded certificate, got %s", cn)
+	}
+
+	// Invalid certificates keep the current ones
+	if err = os.WriteFile(opts.CertFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = serv.ReloadTLS(); err == nil {
+		t.Error("expected the reload to fail")
+	}
+	if _, err = dial(alice); err != nil {
+		t.Errorf("expected the previous certificate to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package values
+
+// customOverhead is the size of the Custom struct
+const customOverhead = 32
+
+// CustomData is the data of a value of a custom type, the types are
+// registered by extensions with engine.RegisterType. The data must not
+// change once it is stored: the snapshots marshal it, and the commands that
+// are not writes read it, without the write lock. Write commands store a
+// modified copy instead.
+type CustomData interface {
+	// Size estimates the memory used by the data in bytes
+	Size() int64
+	// MarshalBinary serializes the data for the dump file and the replicas
+	MarshalBinary() ([]byte, error)
+}
+
+// Custom is a value of a custom type
+type Custom struct {
+	typeName string
+	data     CustomData
+}
+
+func NewCustom(typeName string, data CustomData) *Custom {
+	return &Custom{typeName: typeName, data: data}
+}
+
+func (c *Custom) Type() Type {
+	return TypeCustom
+}
+
+func (c *Custom) Encoding() Encoding {
+	return EncodingRaw
+}
+
+func (c *Custom) Size() int64 {
+	return customOverhead + c.data.Size()
+}
+
+// TypeName is the name the type is registered with, TYPE reports it
+func (c *Custom) TypeName() string {
+	return c.typeName
+}
+
+func (c *Custom) Data() CustomData {
+	return c.data
+}
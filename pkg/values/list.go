@@ -0,0 +1,62 @@
+package values
+
+import (
+	"github.com/cdgn-coding/redis-compatible-challenge/pkg/concurrency"
+	"sync/atomic"
+)
+
+// listOverhead is the size of the List struct
+const listOverhead = 80
+
+// listNodeOverhead is the size of a list node without the element
+const listNodeOverhead = 32
+
+// List is a Redis list backed by a concurrency.ConcurrentList
+type List struct {
+	concurrency.ConcurrentList
+	// elementsSize tracks the size of the elements, so Size doesn't walk the list
+	elementsSize atomic.Int64
+}
+
+func NewList() *List {
+	return &List{}
+}
+
+func NewListFromSlice(slice []interface{}) *List {
+	ls := NewList()
+	for _, val := range slice {
+		ls.PushRight(val)
+	}
+	return ls
+}
+
+func (l *List) Type() Type {
+	return TypeList
+}
+
+func (l *List) Encoding() Encoding {
+	return EncodingLinkedList
+}
+
+func (l *List) PushLeft(value interface{}) {
+	l.ConcurrentList.PushLeft(value)
+	l.elementsSize.Add(elementSize(value))
+}
+
+func (l *List) PushRight(value interface{}) {
+	l.ConcurrentList.PushRight(value)
+	l.elementsSize.Add(elementSize(value))
+}
+
+func (l *List) Size() int64 {
+	return listOverhead + l.elementsSize.Load()
+}
+
+func elementSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return listNodeOverhead + int64(len(v))
+	default:
+		return listNodeOverhead
+	}
+}
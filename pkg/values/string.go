@@ -0,0 +1,113 @@
+package values
+
+import (
+	"strconv"
+)
+
+// EmbStrSizeLimit is the longest string reported with the embstr encoding
+const EmbStrSizeLimit = 44
+
+// stringOverhead is the size of the String struct
+const stringOverhead = 40
+
+// maxIntLength is the length of the longest int64 in base 10, "-9223372036854775808"
+const maxIntLength = 20
+
+// String is an immutable Redis string. Strings that represent a base 10
+// int64 are stored as integers, so INCR and DECR don't parse them again.
+type String struct {
+	raw   string
+	num   int64
+	isInt bool
+}
+
+func NewString(s string) *String {
+	if n, ok := parseInt(s); ok {
+		return &String{num: n, isInt: true}
+	}
+	return &String{raw: s}
+}
+
+func NewInt(n int64) *String {
+	return &String{num: n, isInt: true}
+}
+
+// parseInt only accepts the canonical representation of an integer, so
+// values like "007" or "+1" keep their original bytes
+func parseInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > maxIntLength {
+		return 0, false
+	}
+
+	if s[0] != '-' && (s[0] < '0' || s[0] > '9') {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func (s *String) Type() Type {
+	return TypeString
+}
+
+func (s *String) Encoding() Encoding {
+	if s.isInt {
+		return EncodingInt
+	}
+	if len(s.raw) <= EmbStrSizeLimit {
+		return EncodingEmbStr
+	}
+	return EncodingRaw
+}
+
+func (s *String) Size() int64 {
+	return stringOverhead + int64(len(s.raw))
+}
+
+// Int returns the integer held by the string, ok is false when it is not int encoded
+func (s *String) Int() (int64, bool) {
+	return s.num, s.isInt
+}
+
+func (s *String) String() string {
+	if s.isInt {
+		return strconv.FormatInt(s.num, 10)
+	}
+	return s.raw
+}
+
+// AppendTo appends the string bytes to dst without allocating an intermediate string
+func (s *String) AppendTo(dst []byte) []byte {
+	if s.isInt {
+		return strconv.AppendInt(dst, s.num, 10)
+	}
+	return append(dst, s.raw...)
+}
+
+// Len returns the number of bytes of the string
+func (s *String) Len() int {
+	if !s.isInt {
+		return len(s.raw)
+	}
+
+	n := s.num
+	length := 1
+	if n < 0 {
+		length++
+		if n == -n {
+			// math.MinInt64 cannot be negated
+			return maxIntLength
+		}
+		n = -n
+	}
+	for n >= 10 {
+		n /= 10
+		length++
+	}
+	return length
+}
@@ -0,0 +1,58 @@
+package values
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewString(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		encoding Encoding
+		isInt    bool
+	}{
+		{name: "Short string", data: "hello", encoding: EncodingEmbStr},
+		{name: "Long string", data: strings.Repeat("a", EmbStrSizeLimit+1), encoding: EncodingRaw},
+		{name: "Empty string", data: "", encoding: EncodingEmbStr},
+		{name: "Positive integer", data: "127", encoding: EncodingInt, isInt: true},
+		{name: "Negative integer", data: "-127", encoding: EncodingInt, isInt: true},
+		{name: "Min integer", data: "-9223372036854775808", encoding: EncodingInt, isInt: true},
+		{name: "Integer overflow", data: "9223372036854775808", encoding: EncodingEmbStr},
+		{name: "Leading zeros", data: "007", encoding: EncodingEmbStr},
+		{name: "Plus sign", data: "+1", encoding: EncodingEmbStr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			str := NewString(tt.data)
+			if str.Encoding() != tt.encoding {
+				t.Errorf("got encoding %s, want %s", str.Encoding(), tt.encoding)
+			}
+			if _, ok := str.Int(); ok != tt.isInt {
+				t.Errorf("got int %v, want %v", ok, tt.isInt)
+			}
+			if str.String() != tt.data {
+				t.Errorf("got %q, want %q", str.String(), tt.data)
+			}
+			if str.Len() != len(tt.data) {
+				t.Errorf("got length %d, want %d", str.Len(), len(tt.data))
+			}
+			if string(str.AppendTo(nil)) != tt.data {
+				t.Errorf("got appended %q, want %q", str.AppendTo(nil), tt.data)
+			}
+		})
+	}
+}
+
+func TestType_String(t *testing.T) {
+	if NewString("a").Type().String() != "string" {
+		t.Errorf("expected string type")
+	}
+	if NewList().Type().String() != "list" {
+		t.Errorf("expected list type")
+	}
+	if Type(255).String() != "none" {
+		t.Errorf("expected unknown types to be reported as none")
+	}
+}
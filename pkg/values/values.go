@@ -0,0 +1,69 @@
+// Package values defines the typed values stored in the engine keyspace.
+//
+// Commands and the serializer dispatch on these types with type switches, so
+// no reflection is needed to find out what a key holds.
+package values
+
+// Type is the Redis data type of a value, as reported by the TYPE command
+type Type uint8
+
+const (
+	TypeNone Type = iota
+	TypeString
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeHash
+	// TypeCustom values are of the types registered by extensions
+	TypeCustom
+)
+
+var typeNames = [...]string{
+	TypeNone:   "none",
+	TypeString: "string",
+	TypeList:   "list",
+	TypeSet:    "set",
+	TypeZSet:   "zset",
+	TypeHash:   "hash",
+	TypeCustom: "custom",
+}
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return typeNames[TypeNone]
+}
+
+// Encoding is the internal representation of a value, as reported by the
+// OBJECT ENCODING command
+type Encoding uint8
+
+const (
+	EncodingRaw Encoding = iota
+	EncodingInt
+	EncodingEmbStr
+	EncodingLinkedList
+)
+
+var encodingNames = [...]string{
+	EncodingRaw:        "raw",
+	EncodingInt:        "int",
+	EncodingEmbStr:     "embstr",
+	EncodingLinkedList: "linkedlist",
+}
+
+func (e Encoding) String() string {
+	if int(e) < len(encodingNames) {
+		return encodingNames[e]
+	}
+	return encodingNames[EncodingRaw]
+}
+
+// Value is implemented by every type that can be stored under a key
+type Value interface {
+	Type() Type
+	Encoding() Encoding
+	// Size estimates the memory used by the value in bytes
+	Size() int64
+}